@@ -0,0 +1,782 @@
+package prefix_tree
+
+// Arena layout. A binary trie with one node per bit of a key, like the default layout,
+// whose nodes live in slabs instead of being allocated one by one.
+//
+// Nodes are stored in chunks of arenaChunkSize nodes and refer to their children by
+// index rather than by pointer. Chunks are never moved once allocated, so an index
+// stays valid for the lifetime of the layout. Index 0 is reserved and means no child.
+// Nodes released by a delete go to a free list and are reused by later inserts.
+//
+// Loading a large table allocates a few chunks instead of a heap object per node. For
+// value types without pointers the chunks hold no pointers at all, so the garbage
+// collector never scans them.
+//
+// The nodes of an arena are never shared. A snapshot is a copy of the arena, so every
+// node released by a delete can be reused. Persistent and RCU trees share nodes between
+// versions, so they never use an arena, see WithArena().
+
+import (
+	"math"
+	"unsafe"
+)
+
+// Number of nodes per chunk, as a power of 2
+const arenaChunkBits = 10
+
+const (
+	arenaChunkSize = 1 << arenaChunkBits
+	arenaChunkMask = arenaChunkSize - 1
+)
+
+// Largest number of node indexes of an arena, including the reserved index 0
+const maxArenaNodes = math.MaxUint32
+
+type arenaNode[T any] struct {
+	// Indexes of the left (bit 0) and right (bit 1) children. 0 if there is none.
+	children [2]uint32
+
+	terminal bool
+	value    T
+}
+
+// Position of a walk in an arena layout
+type arenaFrame struct {
+	idx   uint32 // index of the node
+	depth int    // depth of the node, i.e. its prefix length in bits
+	bit   byte   // bit that leads from the parent to the node
+}
+
+type arenaLayout[T any] struct {
+	// Slabs of nodes. The node at index i is at chunks[i>>arenaChunkBits][i&arenaChunkMask].
+	chunks [][]arenaNode[T]
+
+	used uint32   // number of indexes handed out, including the reserved index 0
+	free []uint32 // indexes of released nodes, reused before new ones
+	root uint32
+}
+
+// Returns a new arena layout
+// Returns:
+//
+//	*arenaLayout - pointer to the new layout
+func newArenaLayout[T any]() *arenaLayout[T] {
+	l := &arenaLayout[T]{
+		chunks: [][]arenaNode[T]{make([]arenaNode[T], arenaChunkSize)},
+		used:   1,
+	}
+
+	l.root = l.newNode()
+	return l
+}
+
+// Returns the node at an index. The pointer stays valid as the arena grows.
+func (l *arenaLayout[T]) node(idx uint32) *arenaNode[T] {
+	return &l.chunks[idx>>arenaChunkBits][idx&arenaChunkMask]
+}
+
+// Returns the index of a new node. Released nodes are reused
+// first, otherwise the node is taken from the last chunk, which is allocated if full.
+// Callers must check there is room with reserve().
+func (l *arenaLayout[T]) newNode() uint32 {
+	var idx uint32
+
+	if n := len(l.free); n > 0 {
+		idx = l.free[n-1]
+		l.free = l.free[:n-1]
+	} else {
+		if uint64(l.used) == uint64(len(l.chunks))<<arenaChunkBits {
+			l.chunks = append(l.chunks, make([]arenaNode[T], arenaChunkSize))
+		}
+
+		idx = l.used
+		l.used++
+	}
+
+	*l.node(idx) = arenaNode[T]{}
+	return idx
+}
+
+// Whether the arena has room for the given number of new nodes
+func (l *arenaLayout[T]) reserve(count int) bool {
+	return uint64(len(l.free))+uint64(maxArenaNodes-l.used) >= uint64(count)
+}
+
+// Puts a node on the free list. The node is cleared, so the value it held can be
+// collected.
+func (l *arenaLayout[T]) freeNode(idx uint32) {
+	*l.node(idx) = arenaNode[T]{}
+	l.free = append(l.free, idx)
+}
+
+// Puts a node and every node under it on the free list
+func (l *arenaLayout[T]) freeNodes(idx uint32) {
+	stack := []uint32{idx}
+	for len(stack) > 0 {
+		idx := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for _, child := range l.node(idx).children {
+			if 0 != child {
+				stack = append(stack, child)
+			}
+		}
+
+		l.freeNode(idx)
+	}
+}
+
+// Arena trees are never persistent, see WithArena(), so their nodes are never shared
+func (l *arenaLayout[T]) freeze() {}
+
+// See freeze(). Returns a copy of the arena.
+func (l *arenaLayout[T]) snapshot() treeLayout[T] {
+	return l.clone(nil)
+}
+
+func (l *arenaLayout[T]) empty() treeLayout[T] {
+	return newArenaLayout[T]()
+}
+
+func (l *arenaLayout[T]) clone(cloneFn CloneFn[T]) treeLayout[T] {
+	// The copy only holds the nodes in use, so it has no free list
+	cloned := newArenaLayout[T]()
+
+	for bit, child := range l.node(l.root).children {
+		if 0 != child {
+			cloned.node(cloned.root).children[bit], _ = cloned.copyNodes(l, child, cloneFn)
+		}
+	}
+
+	return cloned
+}
+
+// Copies a node of another arena and every node under it into the arena. Values
+// are passed through cloneFn, if set.
+// Arguments:
+//
+//	src     - arena to copy from
+//	idx     - index of the node in src
+//	cloneFn - returns the copy of a value. Optional argument.
+//
+// Returns:
+//
+//	uint32 - index of the copy
+//	int    - number of terminal nodes copied
+func (l *arenaLayout[T]) copyNodes(src *arenaLayout[T], idx uint32, cloneFn CloneFn[T]) (uint32, int) {
+	copied := l.copyNode(src, idx, cloneFn)
+	count := 0
+
+	// Copies start out pointing to the children of the original and replace them
+	stack := []uint32{copied}
+	for len(stack) > 0 {
+		node := l.node(stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+
+		if node.terminal {
+			count++
+		}
+
+		for bit, child := range node.children {
+			if 0 != child {
+				node.children[bit] = l.copyNode(src, child, cloneFn)
+				stack = append(stack, node.children[bit])
+			}
+		}
+	}
+
+	return copied, count
+}
+
+// Copies a node of another arena into the arena. The value of a terminal node is
+// passed through cloneFn, if set.
+func (l *arenaLayout[T]) copyNode(src *arenaLayout[T], idx uint32, cloneFn CloneFn[T]) uint32 {
+	copied := l.newNode()
+
+	node := l.node(copied)
+	*node = *src.node(idx)
+
+	if node.terminal && nil != cloneFn {
+		node.value = cloneFn(node.value)
+	}
+
+	return copied
+}
+
+// Insert a key into the layout.
+// Arguments:
+//
+//	key   - key to insert expressed as byte slice.
+//	plen  - prefix length of the key in bits.
+//	value - value associated with the key.
+//
+// Returns:
+//
+//	OpResult - result of the operation
+//	error    - error if any. ErrInsertFailed if the arena is out of indexes.
+func (l *arenaLayout[T]) insert(key []byte, plen int, value T) (OpResult, error) {
+	// Start from root
+	idx := l.root
+	depth := 0
+
+	// Traverse down the tree as far as possible
+	for depth < plen {
+		bit := getBit(key, depth)
+
+		next := l.node(idx).children[bit]
+		if 0 == next {
+			break
+		}
+
+		idx = next
+		depth++
+	}
+
+	// Create nodes for the remaining bits in the key/mask. The last node created
+	// corresponds to the key/mask.
+	if depth < plen {
+		if !l.reserve(plen - depth) {
+			return Error, ErrInsertFailed
+		}
+
+		for ; depth < plen; depth++ {
+			child := l.newNode()
+			l.node(idx).children[getBit(key, depth)] = child
+			idx = child
+		}
+	}
+
+	// If the node is already terminal, it's a duplicate insert. It is left to the
+	// caller to determine if this is an error.
+	node := l.node(idx)
+	if node.terminal {
+		return Dup, nil
+	}
+
+	node.terminal = true
+	node.value = value
+
+	return Ok, nil
+}
+
+// Looks up the node for a key.
+// Arguments:
+//
+//	key   - key to find expressed as byte slice.
+//	plen  - prefix length of the key in bits.
+//	mType - type of match to perform (Exact/Partial/Longest)
+//	path  - indexes of the nodes traversed, the root first. Optional argument.
+//
+// Returns:
+//
+//	uint32 - index of the terminal node found, 0 if there is none
+//	int    - depth of the node found
+func (l *arenaLayout[T]) lookup(key []byte, plen int, mType MatchType, path *[]uint32) (uint32, int) {
+	idx := l.root
+	depth := 0
+
+	// Deepest terminal node seen so far. Only tracked for Longest match.
+	var longest uint32
+	longestDepth := 0
+
+	for depth < plen {
+		node := l.node(idx)
+		if node.terminal {
+			// A partial match finds the earliest matching prefix in the tree
+			if Partial == mType {
+				return idx, depth
+			}
+
+			// A longest match keeps going and remembers the most specific
+			// prefix seen so far, in case the full key is not in the tree
+			if Longest == mType {
+				longest, longestDepth = idx, depth
+			}
+		}
+
+		if nil != path {
+			*path = append(*path, idx)
+		}
+
+		idx = node.children[getBit(key, depth)]
+		if 0 == idx {
+			break
+		}
+
+		depth++
+	}
+
+	if 0 != idx && l.node(idx).terminal {
+		return idx, depth
+	}
+
+	// Fall back to the most specific prefix seen during the traversal
+	return longest, longestDepth
+}
+
+func (l *arenaLayout[T]) update(key []byte, plen int, value T) bool {
+	idx, _ := l.lookup(key, plen, Exact, nil)
+	if 0 == idx {
+		return false
+	}
+
+	l.node(idx).value = value
+	return true
+}
+
+func (l *arenaLayout[T]) find(key []byte, plen int, mType MatchType) (T, int, bool) {
+	idx, depth := l.lookup(key, plen, mType, nil)
+	if 0 == idx {
+		var zero T
+		return zero, 0, false
+	}
+
+	return l.node(idx).value, depth, true
+}
+
+func (l *arenaLayout[T]) trace(key []byte, plen int, visitFn func(int, T)) {
+	idx := l.root
+	depth := 0
+
+	for 0 != idx {
+		node := l.node(idx)
+		if node.terminal {
+			visitFn(depth, node.value)
+		}
+
+		if depth >= plen {
+			break
+		}
+
+		idx = node.children[getBit(key, depth)]
+		depth++
+	}
+}
+
+// Removes a key from the layout. Nodes left without a purpose are released.
+// Arguments:
+//
+//	key  - key to delete expressed as byte slice.
+//	plen - prefix length of the key in bits.
+//
+// Returns:
+//
+//	T    - value associated with the deleted key
+//	bool - whether the key was found
+func (l *arenaLayout[T]) remove(key []byte, plen int) (T, bool) {
+	var zero T
+	var path []uint32
+
+	// Find the node to delete. It must be an exact match for deletion.
+	idx, depth := l.lookup(key, plen, Exact, &path)
+	if 0 == idx || depth != plen {
+		return zero, false
+	}
+
+	node := l.node(idx)
+	value := node.value
+
+	node.terminal = false
+	node.value = zero
+
+	if 0 == node.children[0] && 0 == node.children[1] {
+		l.release(idx, path, key)
+	}
+
+	return value, true
+}
+
+// Detaches a node from its parent, releases it along with its subtree, and releases
+// the nodes up the tree that are left without a purpose.
+// Arguments:
+//
+//	idx  - index of the node to detach.
+//	path - indexes of the ancestors of the node, the root first.
+//	key  - key of the path
+func (l *arenaLayout[T]) release(idx uint32, path []uint32, key []byte) {
+	l.freeNodes(idx)
+
+	for len(path) > 0 {
+		parent := path[len(path)-1]
+		path = path[:len(path)-1]
+
+		// The parent is at the depth of the number of its ancestors
+		node := l.node(parent)
+		node.children[getBit(key, len(path))] = 0
+
+		// Stop at a node that is still in use or at the root
+		if node.terminal || 0 != node.children[0] || 0 != node.children[1] || 0 == len(path) {
+			break
+		}
+
+		l.freeNode(parent)
+	}
+}
+
+// Removes every entry equal to or more specific than a key by releasing the
+// subtree for the key.
+// Arguments:
+//
+//	key     - key of the subtree expressed as byte slice.
+//	plen    - prefix length of the key in bits.
+//	visitFn - function to call for each removed entry. Optional argument.
+//
+// Returns:
+//
+//	int - number of entries removed
+func (l *arenaLayout[T]) prune(key []byte, plen int, visitFn func([]byte, int, T)) int {
+	var path []uint32
+
+	start, keyBuf := l.subtree(key, plen, &path)
+	if 0 == start.idx {
+		return 0
+	}
+
+	count := 0
+	l.visit(start, keyBuf, func(key []byte, plen int, value T) error {
+		if nil != visitFn {
+			visitFn(key, plen, value)
+		}
+
+		count++
+		return nil
+	})
+
+	l.release(start.idx, path, key)
+
+	return count
+}
+
+func (l *arenaLayout[T]) walk(key []byte, plen int, visitFn func([]byte, int, T) error) error {
+	start, keyBuf := l.subtree(key, plen, nil)
+	if 0 == start.idx {
+		return nil
+	}
+
+	return l.visit(start, keyBuf, visitFn)
+}
+
+// Performs a pre-order depth-first traversal of a subtree, left (bit 0) before
+// right (bit 1). The key of every node is rebuilt from the traversed bits.
+// Arguments:
+//
+//	start   - root of the subtree
+//	key     - key bits of the path to the parent of the root
+//	visitFn - function to call for each terminal node. Receives the key bytes,
+//	          the prefix length in bits and the value.
+//
+// Returns:
+//
+//	error    - error returned by visitFn, if any
+func (l *arenaLayout[T]) visit(start arenaFrame, key []byte, visitFn func([]byte, int, T) error) error {
+	stack := []arenaFrame{start}
+
+	for len(stack) > 0 {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		// Record the bit that led to this node. Root has no bits.
+		if frame.depth > 0 {
+			key = setBit(key, frame.depth-1, frame.bit)
+		}
+
+		node := l.node(frame.idx)
+		if node.terminal {
+			if err := visitFn(key, frame.depth, node.value); nil != err {
+				return err
+			}
+		}
+
+		// Push the right child first so that the left child is visited first
+		if 0 != node.children[1] {
+			stack = append(stack, arenaFrame{idx: node.children[1], depth: frame.depth + 1, bit: 1})
+		}
+
+		if 0 != node.children[0] {
+			stack = append(stack, arenaFrame{idx: node.children[0], depth: frame.depth + 1, bit: 0})
+		}
+	}
+
+	return nil
+}
+
+// Returns the node for a key, which is the root of the subtree that holds every entry
+// equal to or more specific than the key.
+// Arguments:
+//
+//	key  - key expressed as byte slice.
+//	plen - prefix length of the key in bits.
+//	path - indexes of the nodes traversed, the root first. Optional argument.
+//
+// Returns:
+//
+//	arenaFrame - root of the subtree. The index is 0 if there is no such subtree.
+//	[]byte     - key bits of the path to the parent of the root
+func (l *arenaLayout[T]) subtree(key []byte, plen int, path *[]uint32) (arenaFrame, []byte) {
+	// Key bits of the path. Copied since the bits are modified by the walk.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	frame := arenaFrame{idx: l.root}
+
+	for frame.depth < plen {
+		if nil != path {
+			*path = append(*path, frame.idx)
+		}
+
+		bit := getBit(keyBuf, frame.depth)
+
+		child := l.node(frame.idx).children[bit]
+		if 0 == child {
+			return arenaFrame{}, nil
+		}
+
+		frame = arenaFrame{idx: child, depth: frame.depth + 1, bit: bit}
+	}
+
+	return frame, keyBuf
+}
+
+func (l *arenaLayout[T]) seek(key []byte, plen int, inclusive bool) ([]byte, int, T, bool) {
+	idx, keyBuf, depth := l.seekNode(key, plen, inclusive)
+	if 0 == idx {
+		var zero T
+		return nil, 0, zero, false
+	}
+
+	return keyBuf, depth, l.node(idx).value, true
+}
+
+// Returns the first terminal node at or after the given key in walk order.
+// Arguments:
+//
+//	key       - key to start from expressed as byte slice.
+//	plen      - prefix length of the key in bits.
+//	inclusive - whether the key itself can be returned.
+//
+// Returns:
+//
+//	uint32 - index of the terminal node found, 0 if there are no more entries
+//	[]byte - key bits of the node
+//	int    - prefix length of the node in bits
+func (l *arenaLayout[T]) seekNode(key []byte, plen int, inclusive bool) (uint32, []byte, int) {
+	// Key bits of the path. Copied since the bits are modified below.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	idx := l.root
+	depth := 0
+
+	// Closest subtree to the right of the path and the depth of its parent.
+	// Everything in this subtree comes after the key in walk order.
+	var next uint32
+	nextDepth := 0
+
+	// Traverse the path of the key as far as possible
+	for depth < plen {
+		node := l.node(idx)
+
+		bit := getBit(keyBuf, depth)
+		if 0 == bit && 0 != node.children[1] {
+			next = node.children[1]
+			nextDepth = depth
+		}
+
+		idx = node.children[bit]
+		if 0 == idx {
+			break
+		}
+
+		depth++
+	}
+
+	if 0 != idx {
+		node := l.node(idx)
+
+		// The key itself is in the tree
+		if inclusive && node.terminal {
+			return idx, keyBuf, depth
+		}
+
+		// Longer prefixes of the key come next
+		for bit, child := range node.children {
+			if 0 != child {
+				return l.first(child, keyBuf, depth, byte(bit))
+			}
+		}
+	}
+
+	if 0 == next {
+		return 0, nil, 0
+	}
+
+	return l.first(next, keyBuf, nextDepth, 1)
+}
+
+// Returns the first terminal node of a subtree in walk order.
+// Arguments:
+//
+//	idx   - index of the root of the subtree
+//	key   - key bits of the path to the parent of the root
+//	depth - depth of the parent of the root
+//	bit   - bit that leads from the parent to the root
+//
+// Returns:
+//
+//	uint32 - index of the terminal node found, 0 if the subtree has no entries
+//	[]byte - key bits of the node
+//	int    - prefix length of the node in bits
+func (l *arenaLayout[T]) first(idx uint32, key []byte, depth int, bit byte) (uint32, []byte, int) {
+	for {
+		key = setBit(key, depth, bit)
+		depth++
+
+		node := l.node(idx)
+		if node.terminal {
+			return idx, key, depth
+		}
+
+		switch {
+		case 0 != node.children[0]:
+			idx, bit = node.children[0], 0
+		case 0 != node.children[1]:
+			idx, bit = node.children[1], 1
+		default:
+			return 0, nil, 0
+		}
+	}
+}
+
+// State of a set operation between two arena layouts
+type arenaMerge[T any] struct {
+	a, b      *arenaLayout[T]
+	merged    *arenaLayout[T]
+	op        setOp
+	resolveFn ResolveFn[T]
+	count     int // number of entries in the result
+}
+
+func (l *arenaLayout[T]) merge(other treeLayout[T], op setOp, resolveFn ResolveFn[T]) (treeLayout[T], int, bool) {
+	o, ok := other.(*arenaLayout[T])
+	if !ok {
+		return nil, 0, false
+	}
+
+	m := &arenaMerge[T]{a: l, b: o, merged: newArenaLayout[T](), op: op, resolveFn: resolveFn}
+
+	aRoot, bRoot := l.node(l.root), o.node(o.root)
+	root := m.merged.node(m.merged.root)
+
+	for bit := range root.children {
+		root.children[bit] = m.merge(aRoot.children[bit], bRoot.children[bit])
+	}
+
+	return m.merged, m.count, true
+}
+
+// Returns the result of the set operation for the subtrees at two nodes with the same
+// key bits, one in each layout. A node index is 0 if the layout has no such node.
+// Returns the index of the result in the merged layout, 0 if the result is empty.
+func (m *arenaMerge[T]) merge(a uint32, b uint32) uint32 {
+	switch {
+	case 0 == a && 0 == b:
+		return 0
+	case 0 == b:
+		if opIntersect == m.op {
+			return 0
+		}
+		return m.copy(m.a, a)
+	case 0 == a:
+		if opUnion != m.op {
+			return 0
+		}
+		return m.copy(m.b, b)
+	}
+
+	aNode, bNode := m.a.node(a), m.b.node(b)
+
+	var value T
+	terminal := false
+
+	switch {
+	case aNode.terminal && bNode.terminal:
+		if opDifference != m.op {
+			value, terminal = m.resolveFn(aNode.value, bNode.value), true
+		}
+	case aNode.terminal:
+		if opIntersect != m.op {
+			value, terminal = aNode.value, true
+		}
+	case bNode.terminal:
+		if opUnion == m.op {
+			value, terminal = bNode.value, true
+		}
+	}
+
+	left := m.merge(aNode.children[0], bNode.children[0])
+	right := m.merge(aNode.children[1], bNode.children[1])
+
+	if !terminal && 0 == left && 0 == right {
+		return 0
+	}
+
+	if terminal {
+		m.count++
+	}
+
+	idx := m.merged.newNode()
+
+	node := m.merged.node(idx)
+	node.children = [2]uint32{left, right}
+	node.terminal = terminal
+	node.value = value
+
+	return idx
+}
+
+// Returns a copy of the subtree at a node in the merged layout
+func (m *arenaMerge[T]) copy(src *arenaLayout[T], idx uint32) uint32 {
+	copied, count := m.merged.copyNodes(src, idx, nil)
+	m.count += count
+
+	return copied
+}
+
+func (l *arenaLayout[T]) stats(stats *treeStats) {
+	type statsFrame struct {
+		idx     uint32
+		depth   int  // depth of the node, i.e. its prefix length in bits
+		inChain bool // whether the parent is part of a single child chain
+	}
+
+	stack := []statsFrame{{idx: l.root}}
+	for len(stack) > 0 {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node := l.node(frame.idx)
+
+		// The memory of the nodes is that of the chunks, added below
+		stats.addNode(frame.depth, 0)
+
+		if node.terminal {
+			stats.addEntry(frame.depth, frame.depth)
+		}
+
+		// A chain starts at the first node without an entry and with a single child
+		inChain := l.root != frame.idx && !node.terminal && (0 == node.children[0]) != (0 == node.children[1])
+		if inChain && !frame.inChain {
+			stats.SingleChildChains++
+		}
+
+		for bit := 1; bit >= 0; bit-- {
+			if child := node.children[bit]; 0 != child {
+				stack = append(stack, statsFrame{idx: child, depth: frame.depth + 1, inChain: inChain})
+			}
+		}
+	}
+
+	// Chunks are allocated whole, free and unused nodes included
+	size := uint64(unsafe.Sizeof(arenaNode[T]{}))
+	stats.Bytes += uint64(len(l.chunks))*arenaChunkSize*size + uint64(cap(l.free))*uint64(unsafe.Sizeof(uint32(0)))
+}
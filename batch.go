@@ -0,0 +1,174 @@
+package prefix_tree
+
+// Batch lookups for high volume classification, e.g. of the addresses of a batch of
+// packets. A batch takes the read lock once and reports a result per key, so a miss
+// or an invalid key does not fail the batch. The results slice of the caller is
+// reused, so a batch allocates nothing once the slice is large enough.
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// Result of a key of a batch lookup, see SearchBatch()
+type BatchResult[T any] struct {
+	// Match if the whole key was found, PartialMatch if a prefix of the key was found,
+	// NoMatch if nothing was found, Error if the key is invalid or was not looked up.
+	Result OpResult
+
+	Value T // value of the prefix found, if any
+}
+
+// Batch lookups of IP addresses. The IPv4 and IPv6 prefix trees implement it, i.e. the
+// trees returned by NewV4Tree() and NewV6Tree() and their snapshots, clones and
+// compiled copies. Like io.WriterTo, it is reached with a type assertion. For e.g.
+//
+//	tree := NewV4Tree[string](WithRWMutex())
+//	...
+//	searcher := tree.(AddrBatchSearcher[string])
+//	results, err = searcher.SearchBatch(ctx, addrs, Longest, results)
+type AddrBatchSearcher[T any] interface {
+	SearchBatch(ctx context.Context, addrs []netip.Addr, mType MatchType, results []BatchResult[T]) ([]BatchResult[T], error)
+}
+
+var (
+	_ AddrBatchSearcher[any] = (*V4Tree[any])(nil)
+	_ AddrBatchSearcher[any] = (*V6Tree[any])(nil)
+)
+
+// Looks up a batch of keys under a single read lock. Every key is looked up with all
+// of its bits, i.e. as if its mask was all ones. The batch stops early if ctx is done.
+// Arguments:
+//
+//	ctx     - context for the lock functions.
+//	keys    - keys to find expressed as byte slices.
+//	mType   - type of match to perform (Exact/Partial/Longest)
+//	results - slice to store the results in. Reused if large enough. Can be nil.
+//
+// Returns:
+//
+//	[]BatchResult - result of the lookup for each key, in the same order as keys
+//	error         - error from the lock functions, if any. If ctx is done, the error
+//	                of ctx. The remaining keys are left as Error.
+func (t *Tree[T]) SearchBatch(ctx context.Context, keys [][]byte, mType MatchType, results []BatchResult[T]) ([]BatchResult[T], error) {
+	return t.searchBatch(ctx, len(keys), func(i int) []byte {
+		return keys[i]
+	}, mType, results)
+}
+
+// Looks up a batch of keys under a single read lock. See SearchBatch().
+// Arguments:
+//
+//	ctx     - context for the lock functions.
+//	count   - number of keys
+//	keyFn   - returns the i-th key. nil if the key is invalid. The key is only used
+//	          until the next call.
+//	mType   - type of match to perform (Exact/Partial/Longest)
+//	results - slice to store the results in. Reused if large enough. Can be nil.
+//
+// Returns:
+//
+//	[]BatchResult - result of the lookup for each key
+//	error         - error if any
+func (t *Tree[T]) searchBatch(ctx context.Context, count int, keyFn func(int) []byte, mType MatchType, results []BatchResult[T]) ([]BatchResult[T], error) {
+	results = slices.Grow(results[:0], count)[:count]
+
+	// Results start out as Error
+	clear(results)
+
+	if err := t.rlock(ctx); nil != err {
+		return results, err
+	}
+	defer func() {
+		t.runlock(ctx)
+	}()
+
+	r := t.reader()
+	checker := ctxChecker{ctx: ctx}
+
+	for i := range results {
+		if err := checker.check(); nil != err {
+			return results, err
+		}
+
+		key := keyFn(i)
+		if 0 == len(key) {
+			continue
+		}
+
+		plen := len(key) * 8
+
+		value, depth, ok := r.layout.find(key, plen, mType)
+		switch {
+		case !ok:
+			results[i].Result = NoMatch
+		case depth < plen:
+			results[i] = BatchResult[T]{Result: PartialMatch, Value: value}
+		default:
+			results[i] = BatchResult[T]{Result: Match, Value: value}
+		}
+	}
+
+	return results, nil
+}
+
+// Looks up a batch of IPv4 addresses under a single read lock. See Tree.SearchBatch()
+// and AddrBatchSearcher.
+// IPv4-mapped IPv6 addresses are looked up as IPv4 addresses. Other addresses are
+// reported as Error.
+// Arguments:
+//
+//	ctx     - context for the operation
+//	addrs   - addresses to find
+//	mType   - type of match to perform. Longest for classification.
+//	results - slice to store the results in. Reused if large enough. Can be nil.
+//
+// Returns:
+//
+//	[]BatchResult - result of the lookup for each address, in the same order as addrs
+//	error         - error from the lock functions, if any
+func (v4t *V4Tree[T]) SearchBatch(ctx context.Context, addrs []netip.Addr, mType MatchType, results []BatchResult[T]) ([]BatchResult[T], error) {
+	key := make([]byte, net.IPv4len)
+
+	return v4t.tree.searchBatch(ctx, len(addrs), func(i int) []byte {
+		addr := addrs[i].Unmap()
+		if !addr.Is4() {
+			return nil
+		}
+
+		a4 := addr.As4()
+		copy(key, a4[:])
+		return key
+	}, mType, results)
+}
+
+// Looks up a batch of IPv6 addresses under a single read lock. See Tree.SearchBatch()
+// and AddrBatchSearcher.
+// IPv4 and IPv4-mapped IPv6 addresses are reported as Error.
+// Arguments:
+//
+//	ctx     - context for the operation
+//	addrs   - addresses to find
+//	mType   - type of match to perform. Longest for classification.
+//	results - slice to store the results in. Reused if large enough. Can be nil.
+//
+// Returns:
+//
+//	[]BatchResult - result of the lookup for each address, in the same order as addrs
+//	error         - error from the lock functions, if any
+func (v6t *V6Tree[T]) SearchBatch(ctx context.Context, addrs []netip.Addr, mType MatchType, results []BatchResult[T]) ([]BatchResult[T], error) {
+	key := make([]byte, net.IPv6len)
+
+	return v6t.tree.searchBatch(ctx, len(addrs), func(i int) []byte {
+		addr := addrs[i]
+		if !addr.Is6() || addr.Is4In6() {
+			return nil
+		}
+
+		a16 := addr.As16()
+		copy(key, a16[:])
+		return key
+	}, mType, results)
+}
@@ -0,0 +1,189 @@
+package prefix_tree
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestTree_SearchBatch(t *testing.T) {
+	ctx := context.Background()
+	strided := NewTree[string](WithStride(4))
+	compiled, _ := NewTree[string]().Compile(ctx)
+
+	keys := [][]byte{
+		{10, 1, 2, 3},
+		{10, 2, 0, 1},
+		{11, 0, 0, 1},
+		{},
+		{10, 1, 2, 0},
+	}
+
+	tests := []struct {
+		mType    MatchType
+		expected string
+	}{
+		{Exact, "[{3 net-24} {5 } {5 } {0 } {5 }]"},
+		{Partial, "[{4 net-8} {4 net-8} {5 } {0 } {4 net-8}]"},
+		{Longest, "[{3 net-24} {4 net-8} {5 } {0 } {4 net-24}]"},
+	}
+
+	for _, tr := range []*Tree[string]{NewTree[string](WithRWMutex()), NewCompressedTree[string](), strided, NewArenaTree[string](), NewRCUTree[string]()} {
+		tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-8")
+		tr.Insert(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00}, "net-24")
+		tr.Insert(ctx, []byte{10, 1, 2, 3}, []byte{0xFF, 0xFF, 0xFF, 0xFF}, "net-24")
+
+		compiled, _ = tr.Compile(ctx)
+
+		for _, tr := range []*Tree[string]{tr, compiled} {
+			var results []BatchResult[string]
+			for _, tt := range tests {
+				var err error
+				results, err = tr.SearchBatch(ctx, keys, tt.mType, results)
+				if err != nil || fmt.Sprint(results) != tt.expected {
+					t.Fatalf("SearchBatch (%v) failed: %v %v", tt.mType, results, err)
+				}
+			}
+		}
+	}
+
+	// Results are reused, and grown if needed
+	results := make([]BatchResult[string], 1, 10)
+	results, _ = compiled.SearchBatch(ctx, keys, Exact, results)
+	if len(results) != len(keys) || cap(results) != 10 {
+		t.Fatalf("expected results to be reused, got %d/%d", len(results), cap(results))
+	}
+
+	results, _ = compiled.SearchBatch(ctx, keys[:1], Exact, make([]BatchResult[string], 0, 0))
+	if len(results) != 1 || results[0].Result != Match {
+		t.Fatalf("expected results to grow, got %v", results)
+	}
+}
+
+func TestTree_SearchBatchContext(t *testing.T) {
+	tr := NewTree[int](WithContextLock())
+	tr.Insert(context.Background(), []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := tr.SearchBatch(ctx, [][]byte{{10, 0, 0, 1}}, Longest, nil)
+	if err != context.Canceled || len(results) != 1 || results[0].Result != Error {
+		t.Fatalf("expected context.Canceled, got %v %v", results, err)
+	}
+}
+
+func TestV4Tree_SearchBatch(t *testing.T) {
+	ctx := context.Background()
+
+	v4t := NewV4Tree[int]()
+	v4t.Insert(ctx, "10.0.0.0/8", 8)
+	v4t.Insert(ctx, "10.1.0.0/16", 16)
+
+	addrs := []netip.Addr{
+		netip.MustParseAddr("10.1.2.3"),
+		netip.MustParseAddr("10.2.0.1"),
+		netip.MustParseAddr("192.168.0.1"),
+		netip.MustParseAddr("::ffff:10.1.0.1"),
+		netip.MustParseAddr("2001:db8::1"),
+		{},
+	}
+
+	results, err := v4t.(AddrBatchSearcher[int]).SearchBatch(ctx, addrs, Longest, nil)
+	if err != nil || fmt.Sprint(results) != "[{4 16} {4 8} {5 0} {4 16} {0 0} {0 0}]" {
+		t.Fatalf("SearchBatch failed: %v %v", results, err)
+	}
+
+	// So do snapshots and compiled copies
+	snapshot, _ := v4t.Snapshot(ctx)
+	compiled, _ := v4t.Compile(ctx)
+	for _, tree := range []PrefixTree[int]{snapshot, compiled} {
+		searcher, ok := tree.(AddrBatchSearcher[int])
+		if !ok {
+			t.Fatalf("%T is not an AddrBatchSearcher", tree)
+		}
+
+		if batch, err := searcher.SearchBatch(ctx, addrs, Longest, nil); err != nil || fmt.Sprint(batch) != fmt.Sprint(results) {
+			t.Fatalf("SearchBatch failed: %v %v", batch, err)
+		}
+	}
+
+	// Same results as one search per address
+	for i, addr := range addrs[:4] {
+		res, v, _ := v4t.SearchLongest(ctx, addr.Unmap().String())
+		if res == Error {
+			res = NoMatch
+		}
+
+		if res != results[i].Result || v != results[i].Value {
+			t.Fatalf("SearchLongest %s mismatch: %v/%v != %v", addr, res, v, results[i])
+		}
+	}
+}
+
+func TestV6Tree_SearchBatch(t *testing.T) {
+	ctx := context.Background()
+
+	v6t := NewV6Tree[int]()
+	v6t.Insert(ctx, "2001:db8::/32", 32)
+	v6t.Insert(ctx, "2001:db8::1/128", 128)
+
+	searcher := v6t.(AddrBatchSearcher[int])
+
+	addrs := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"),
+		netip.MustParseAddr("fe80::1"),
+		netip.MustParseAddr("::ffff:10.1.0.1"),
+		netip.MustParseAddr("10.1.0.1"),
+	}
+
+	results, err := searcher.SearchBatch(ctx, addrs, Longest, nil)
+	if err != nil || fmt.Sprint(results) != "[{3 128} {4 32} {5 0} {0 0} {0 0}]" {
+		t.Fatalf("SearchBatch failed: %v %v", results, err)
+	}
+
+	results, err = searcher.SearchBatch(ctx, addrs, Partial, results)
+	if err != nil || fmt.Sprint(results) != "[{4 32} {4 32} {5 0} {0 0} {0 0}]" {
+		t.Fatalf("SearchBatch failed: %v %v", results, err)
+	}
+}
+
+// BenchmarkV4TreeSearchBatch compares a batch lookup against one lookup per address
+func BenchmarkV4TreeSearchBatch(b *testing.B) {
+	ctx := context.Background()
+
+	v4t := NewV4Tree[int](WithRWMutex())
+	searcher := v4t.(AddrBatchSearcher[int])
+	for i := 0; i < 1000; i++ {
+		v4t.Insert(ctx, fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), i)
+	}
+
+	const batchSize = 1024
+
+	addrs := make([]netip.Addr, batchSize)
+	saddrs := make([]string, batchSize)
+	for i := range addrs {
+		addrs[i] = netip.AddrFrom4([4]byte{10, byte(i / 256 % 4), byte(i % 256), byte(i)})
+		saddrs[i] = addrs[i].String()
+	}
+
+	b.Run("Search", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, saddr := range saddrs {
+				v4t.SearchLongest(ctx, saddr)
+			}
+		}
+	})
+
+	b.Run("SearchBatch", func(b *testing.B) {
+		b.ReportAllocs()
+
+		var results []BatchResult[int]
+		for i := 0; i < b.N; i++ {
+			results, _ = searcher.SearchBatch(ctx, addrs, Longest, results)
+		}
+	})
+}
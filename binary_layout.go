@@ -0,0 +1,1098 @@
+package prefix_tree
+
+// Binary trie layout. Every node has a left (bit 0) and a right (bit 1) child.
+//
+// By default the layout allocates one node per bit of a key. A path compressed layout
+// folds runs of bits without a branch or a terminal node into a single node, which
+// stores the skipped bits. Both behave the same.
+//
+// Only path compressed and persistent layouts allocate nodes with the fields they need
+// for it, see node.go. The default layout allocates plain Node values.
+
+import (
+	"unsafe"
+)
+
+type binaryLayout[T any] struct {
+	root *RootNode[T]
+
+	// Whether runs of bits are folded into a single node
+	compressed bool
+
+	// Whether the nodes keep track of the version that created them, so the nodes
+	// of a frozen version can be shared, see freeze()
+	persistent bool
+
+	// Current version. Nodes of older versions are never modified.
+	gen uint64
+}
+
+// Returns a new binary layout
+// Arguments:
+//
+//	compressed - whether runs of bits are folded into a single node
+//	persistent - whether the nodes of a frozen version can be shared
+//
+// Returns:
+//
+//	*binaryLayout - pointer to the new layout
+func newBinaryLayout[T any](compressed bool, persistent bool) *binaryLayout[T] {
+	l := &binaryLayout[T]{
+		compressed: compressed,
+		persistent: persistent,
+	}
+
+	l.root = &RootNode[T]{Node: l.newNode()}
+	return l
+}
+
+func (l *binaryLayout[T]) isRoot(node *Node[T]) bool {
+	return l.root.Node == node
+}
+
+// Returns a new node of the current version, of the node type of the layout
+func (l *binaryLayout[T]) newNode() *Node[T] {
+	switch {
+	case l.compressed && l.persistent:
+		node := &persistentCompressedNode[T]{gen: l.gen}
+		return &node.Node
+	case l.compressed:
+		node := &compressedNode[T]{}
+		return &node.Node
+	case l.persistent:
+		node := &persistentNode[T]{gen: l.gen}
+		return &node.Node
+	}
+
+	return NewNode[T]()
+}
+
+// Returns the size of a node of the layout in bytes
+func (l *binaryLayout[T]) nodeSize() uintptr {
+	switch {
+	case l.compressed && l.persistent:
+		return unsafe.Sizeof(persistentCompressedNode[T]{})
+	case l.compressed:
+		return unsafe.Sizeof(compressedNode[T]{})
+	case l.persistent:
+		return unsafe.Sizeof(persistentNode[T]{})
+	}
+
+	return unsafe.Sizeof(Node[T]{})
+}
+
+// Returns the version of a node of a persistent layout
+func (l *binaryLayout[T]) nodeGen(node *Node[T]) uint64 {
+	if l.compressed {
+		return (*persistentCompressedNode[T])(unsafe.Pointer(node)).gen
+	}
+
+	return (*persistentNode[T])(unsafe.Pointer(node)).gen
+}
+
+// Returns the number of bits skipped on the way to a node. Always 0 unless the
+// layout is path compressed.
+func (l *binaryLayout[T]) skipLen(node *Node[T]) int {
+	if !l.compressed {
+		return 0
+	}
+
+	return int(asCompressed(node).skipLen)
+}
+
+// Returns the number of leading bits skipped on the way to a node that match the
+// key bits [bitIdx, plen). Always 0 unless the layout is path compressed.
+func (l *binaryLayout[T]) matchSkip(node *Node[T], key []byte, bitIdx int, plen int) int {
+	if !l.compressed {
+		return 0
+	}
+
+	return asCompressed(node).matchSkip(key, bitIdx, plen)
+}
+
+// Returns the node itself if it belongs to the current version. Otherwise returns
+// a copy of the node, which replaces the node in its parent. Nodes of a layout
+// that is not persistent always belong to the current version.
+// Arguments:
+//
+//	parent - owned parent of the node. nil if the node is the root.
+//	node   - node to own
+//
+// Returns:
+//
+//	*Node - node of the current version
+func (l *binaryLayout[T]) own(parent *Node[T], node *Node[T]) *Node[T] {
+	if !l.persistent || l.gen == l.nodeGen(node) {
+		return node
+	}
+
+	owned := l.copyNode(node, nil)
+
+	switch {
+	case nil == parent:
+		l.root.Node = owned
+	case node == parent.right:
+		parent.right = owned
+	default:
+		parent.left = owned
+	}
+
+	return owned
+}
+
+// Owns every node on a path, starting from the root. The owned nodes replace the
+// nodes on the stack.
+// Arguments:
+//
+//	nodeAncestors - stack of nodes on the path. The root is at the bottom.
+func (l *binaryLayout[T]) ownPath(nodeAncestors *NodeStack[T]) {
+	var parent *Node[T]
+	for i, node := range nodeAncestors.nodes {
+		parent = l.own(parent, node)
+		nodeAncestors.nodes[i] = parent
+	}
+}
+
+// Only persistent layouts keep track of versions. The nodes of other layouts are
+// never shared.
+func (l *binaryLayout[T]) freeze() {
+	l.gen++
+}
+
+// The layout must be persistent, otherwise later writes modify the shared nodes
+func (l *binaryLayout[T]) snapshot() treeLayout[T] {
+	return &binaryLayout[T]{
+		root:       &RootNode[T]{Node: l.root.Node},
+		compressed: l.compressed,
+		persistent: l.persistent,
+		gen:        l.gen,
+	}
+}
+
+func (l *binaryLayout[T]) empty() treeLayout[T] {
+	return newBinaryLayout[T](l.compressed, l.persistent)
+}
+
+func (l *binaryLayout[T]) clone(cloneFn CloneFn[T]) treeLayout[T] {
+	cloned := newBinaryLayout[T](l.compressed, l.persistent)
+	cloned.root.Node, _ = cloned.copyNodes(l.root.Node, cloneFn)
+	return cloned
+}
+
+// Copies a node of a layout with the same path compression and every node under it
+// into the layout. Values are passed through cloneFn, if set.
+// Arguments:
+//
+//	node    - root of the nodes to copy
+//	cloneFn - returns the copy of a value. Optional argument.
+//
+// Returns:
+//
+//	*Node - copy of the node
+//	int   - number of terminal nodes copied
+func (l *binaryLayout[T]) copyNodes(node *Node[T], cloneFn CloneFn[T]) (*Node[T], int) {
+	copied := l.copyNode(node, cloneFn)
+	count := 0
+
+	// Copies start out pointing to the children of the original and replace them
+	nodeStack := NewNodeStack[T]()
+	nodeStack.Push(copied)
+
+	for !nodeStack.IsEmpty() {
+		node := nodeStack.Pop()
+		if node.IsTerminal() {
+			count++
+		}
+
+		if nil != node.left {
+			node.left = l.copyNode(node.left, cloneFn)
+			nodeStack.Push(node.left)
+		}
+
+		if nil != node.right {
+			node.right = l.copyNode(node.right, cloneFn)
+			nodeStack.Push(node.right)
+		}
+	}
+
+	return copied, count
+}
+
+// Copies a node of a layout with the same path compression into a new node of the
+// current version. The value of a terminal node is passed through cloneFn, if set.
+func (l *binaryLayout[T]) copyNode(node *Node[T], cloneFn CloneFn[T]) *Node[T] {
+	copied := l.newNode()
+	*copied = *node
+
+	if l.compressed {
+		from, to := asCompressed(node), asCompressed(copied)
+		to.skip, to.skipLen = from.skip, from.skipLen
+	}
+
+	if copied.terminal && nil != cloneFn {
+		copied.value = cloneFn(copied.value)
+	}
+
+	return copied
+}
+
+// Insert a key into the layout.
+// Arguments:
+//
+//	key   - key to insert expressed as byte slice.
+//	plen  - prefix length of the key in bits.
+//	value - value associated with the key.
+//
+// Returns:
+//
+//	OpResult - result of the operation
+//	error    - error if any
+func (l *binaryLayout[T]) insert(key []byte, plen int, value T) (OpResult, error) {
+	// Start from root. Every node on the path is owned, since it is modified
+	// or leads to a node that is.
+	node := l.own(nil, l.root.Node)
+	depth := 0
+
+	// Traverse down the tree as far as possible.
+	for depth < plen {
+		// We don't store the bit value in the node.
+		// Bit 1 goes to right child, bit 0 goes to left child.
+		bit := getBit(key, depth)
+		next := node.getChild(bit)
+
+		// If we can't go further, create new nodes for the remaining bits
+		// in the key/mask. The last node created corresponds to the key/mask.
+		if nil == next {
+			head, tail := l.newPath(key, depth+1, plen)
+			node.setChild(bit, head)
+
+			node = tail
+			break
+		}
+
+		// In a path compressed tree the key must also match the bits skipped on
+		// the way to the next node. If the key diverges from the skipped bits or
+		// ends within them, split the path at that point.
+		next = l.own(node, next)
+
+		matchLen := l.matchSkip(next, key, depth+1, plen)
+		if matchLen < l.skipLen(next) {
+			next = l.splitPath(node, bit, next, matchLen)
+		}
+
+		node = next
+		depth += 1 + matchLen
+	}
+
+	// Cannot be hit but check just in case.
+	// This cannot be the root node
+	if l.isRoot(node) {
+		return Error, ErrInsertFailed
+	}
+
+	// If the node is already terminal, it's a duplicate insert
+	// It is left to the caller to determine if this is an error.
+	// We will not return an error here.
+	if node.IsTerminal() {
+		return Dup, nil
+	}
+
+	// Mark the node as terminal and set the value
+	node.SaveAndMarkTerminal(value)
+
+	// Successful insert
+	return Ok, nil
+}
+
+// Creates the nodes for the key bits [bitIdx, plen). The bit at bitIdx-1 is the
+// branch bit that leads from the parent to the first node created. Attaching the
+// first node to the parent is left to the caller.
+// Arguments:
+//
+//	key    - key expressed as byte slice.
+//	bitIdx - index of the first bit after the branch bit.
+//	plen   - prefix length of the key in bits.
+//
+// Returns:
+//
+//	*Node - first node created
+//	*Node - last node created. This node corresponds to the key.
+func (l *binaryLayout[T]) newPath(key []byte, bitIdx int, plen int) (*Node[T], *Node[T]) {
+	head := l.newNode()
+	tail := head
+
+	for {
+		// Path compressed trees fold as many bits as possible into a single node
+		if l.compressed {
+			skipLen := min(plen-bitIdx, maxSkipLen)
+			asCompressed(tail).skip = getBits(key, bitIdx, skipLen)
+			asCompressed(tail).skipLen = uint8(skipLen)
+			bitIdx += skipLen
+		}
+
+		if bitIdx >= plen {
+			break
+		}
+
+		// One node per remaining bit.
+		// Bit 1 goes to right child, bit 0 goes to left child.
+		next := l.newNode()
+		tail.setChild(getBit(key, bitIdx), next)
+
+		tail = next
+		bitIdx++
+	}
+
+	return head, tail
+}
+
+// Splits the bits skipped on the way to a node by inserting a new node after
+// the first splitLen skipped bits. Only used by path compressed trees.
+// Arguments:
+//
+//	parent   - parent of the node.
+//	bit      - branch bit that leads from the parent to the node.
+//	node     - node whose skipped bits are split.
+//	splitLen - number of skipped bits moved to the new node.
+//
+// Returns:
+//
+//	*Node - new node. The node is its only child.
+func (l *binaryLayout[T]) splitPath(parent *Node[T], bit byte, node *Node[T], splitLen int) *Node[T] {
+	split := asCompressed(node)
+
+	// Bits left in the node after the split. The skipped bit at
+	// splitLen becomes the branch bit from the new node.
+	restLen := int(split.skipLen) - splitLen - 1
+
+	mid := l.newNode()
+	asCompressed(mid).skip = split.skip >> (restLen + 1)
+	asCompressed(mid).skipLen = uint8(splitLen)
+	mid.setChild(split.getSkipBit(splitLen), node)
+
+	split.skip &= uint64(1)<<restLen - 1
+	split.skipLen = uint8(restLen)
+
+	parent.setChild(bit, mid)
+	return mid
+}
+
+// Merges a non-terminal node with a single child into that child. Only used by
+// path compressed trees. The merge is skipped if the node has two children or if
+// the merged bits do not fit in a single node.
+// Arguments:
+//
+//	parent - parent of the node.
+//	node   - node to merge.
+func (l *binaryLayout[T]) mergePath(parent *Node[T], node *Node[T]) {
+	var child *Node[T]
+	var bit uint64
+
+	switch {
+	case nil != node.left && nil == node.right:
+		child = node.left
+	case nil == node.left && nil != node.right:
+		child = node.right
+		bit = 1
+	default:
+		return
+	}
+
+	skipLen := l.skipLen(node) + 1 + l.skipLen(child)
+	if skipLen > maxSkipLen {
+		return
+	}
+
+	child = l.own(node, child)
+	merged := asCompressed(child)
+
+	// The node's skipped bits, the branch bit to the child
+	// and the child's skipped bits are all skipped now.
+	merged.skip = asCompressed(node).skip<<(1+merged.skipLen) | bit<<merged.skipLen | merged.skip
+	merged.skipLen = uint8(skipLen)
+
+	if node == parent.right {
+		parent.right = child
+	} else {
+		parent.left = child
+	}
+}
+
+// Looks up the node for a key.
+// Arguments:
+//
+//	key   - key to find expressed as byte slice.
+//	plen  - prefix length of the key in bits.
+//	mType - type of match to perform (Exact/Partial/Longest)
+//	nodeAncestors - stack of ancestor nodes. Optional argument.
+//
+// Returns:
+//
+//	*Node - the terminal node found, nil if there is none
+//	int   - depth of the node found
+func (l *binaryLayout[T]) lookup(key []byte, plen int, mType MatchType, nodeAncestors *NodeStack[T]) (*Node[T], int) {
+	// Start from root
+	node := l.root.Node
+	depth := 0
+
+	// Deepest terminal node seen so far. Only tracked for Longest match.
+	var longest *Node[T]
+	longestDepth := 0
+
+	// Traverse down the tree as far as possible.
+	for depth < plen {
+		if node.IsTerminal() {
+			// Check for partial match condition. If we see a terminal node
+			// during traversal and the match type is Partial, we are done.
+			// A partial match will find the earliest matching prefix in the tree.
+			if Partial == mType {
+				return node, depth
+			}
+
+			// A longest match keeps going and remembers the most specific
+			// prefix seen so far, in case the full key is not in the tree.
+			if Longest == mType {
+				longest, longestDepth = node, depth
+			}
+		}
+
+		// Save the traversed node if asked for
+		if nodeAncestors != nil {
+			nodeAncestors.Push(node)
+		}
+
+		// Bit 1 goes to right child, bit 0 goes to left child.
+		next := node.getChild(getBit(key, depth))
+
+		// The key must also match all the bits skipped on the way to
+		// the next node. Otherwise the key is not in the tree.
+		if nil != next && l.matchSkip(next, key, depth+1, plen) < l.skipLen(next) {
+			next = nil
+		}
+
+		node = next
+		if nil == node {
+			break
+		}
+
+		depth += 1 + l.skipLen(node)
+	}
+
+	// For Exact match, we must end up on a terminal node
+	if nil != node && node.IsTerminal() {
+		return node, depth
+	}
+
+	// Fall back to the most specific prefix seen during the traversal
+	return longest, longestDepth
+}
+
+func (l *binaryLayout[T]) update(key []byte, plen int, value T) bool {
+	nodeAncestors := NewNodeStack[T]()
+
+	node, _ := l.lookup(key, plen, Exact, nodeAncestors)
+	if nil == node {
+		return false
+	}
+
+	l.ownPath(nodeAncestors)
+	node = l.own(nodeAncestors.Peek(), node)
+
+	node.value = value
+	return true
+}
+
+func (l *binaryLayout[T]) find(key []byte, plen int, mType MatchType) (T, int, bool) {
+	node, depth := l.lookup(key, plen, mType, nil)
+	if nil == node {
+		var zero T
+		return zero, 0, false
+	}
+
+	return node.value, depth, true
+}
+
+func (l *binaryLayout[T]) trace(key []byte, plen int, visitFn func(int, T)) {
+	node := l.root.Node
+	depth := 0
+
+	for nil != node {
+		if node.IsTerminal() {
+			visitFn(depth, node.value)
+		}
+
+		if depth >= plen {
+			break
+		}
+
+		next := node.getChild(getBit(key, depth))
+		if nil == next || l.matchSkip(next, key, depth+1, plen) < l.skipLen(next) {
+			break
+		}
+
+		node = next
+		depth += 1 + l.skipLen(node)
+	}
+}
+
+// Removes a key from the layout. Nodes left without a purpose are released.
+// Arguments:
+//
+//	key  - key to delete expressed as byte slice.
+//	plen - prefix length of the key in bits.
+//
+// Returns:
+//
+//	T    - value associated with the deleted key
+//	bool - whether the key was found
+func (l *binaryLayout[T]) remove(key []byte, plen int) (T, bool) {
+	var zero T
+
+	// Stack of ancestors to the node we are searching for
+	nodeAncestors := NewNodeStack[T]()
+
+	// Find the node to delete. It must be an exact match for deletion.
+	node, depth := l.lookup(key, plen, Exact, nodeAncestors)
+	if nil == node || depth != plen || l.isRoot(node) {
+		return zero, false
+	}
+
+	l.ownPath(nodeAncestors)
+	node = l.own(nodeAncestors.Peek(), node)
+
+	value := node.value
+
+	// Unmark terminal to indicate deletion
+	node.UnmarkTerminal()
+	node.value = zero
+
+	// Is the match node not a leaf?
+	if !node.IsLeaf() {
+		// A path compressed tree folds the node into its child, if it has only one
+		if l.compressed {
+			l.mergePath(nodeAncestors.Peek(), node)
+		}
+
+		return value, true
+	}
+
+	l.release(node, nodeAncestors)
+
+	return value, true
+}
+
+// Detaches a node from its parent, along with its subtree, and removes the nodes
+// up the tree that are left without a purpose.
+// Arguments:
+//
+//	node          - node to detach.
+//	nodeAncestors - stack of ancestors of the node. The parent is on top.
+func (l *binaryLayout[T]) release(node *Node[T], nodeAncestors *NodeStack[T]) {
+	// Remove nodes up the tree
+	for !nodeAncestors.IsEmpty() {
+		// Pop the parent node
+		parent := nodeAncestors.Pop()
+
+		// Remove the reference to the current node from the parent
+		if node == parent.right {
+			parent.right = nil
+		} else {
+			parent.left = nil
+		}
+
+		node = parent
+
+		// If the new node is not a leaf, is a terminal or root, break
+		if !node.IsLeaf() || node.IsTerminal() || l.isRoot(node) {
+			// A path compressed tree folds a non-terminal node left
+			// with a single child into that child
+			if l.compressed && !node.IsTerminal() && !l.isRoot(node) {
+				l.mergePath(nodeAncestors.Peek(), node)
+			}
+
+			break
+		}
+	}
+}
+
+// Removes every entry equal to or more specific than a key by detaching the
+// subtree for the key.
+// Arguments:
+//
+//	key     - key of the subtree expressed as byte slice.
+//	plen    - prefix length of the key in bits.
+//	visitFn - function to call for each removed entry. Optional argument.
+//
+// Returns:
+//
+//	int - number of entries removed
+func (l *binaryLayout[T]) prune(key []byte, plen int, visitFn func([]byte, int, T)) int {
+	// Stack of ancestors to the root of the subtree
+	nodeAncestors := NewNodeStack[T]()
+
+	start, keyBuf := l.subtree(key, plen, nodeAncestors)
+	if nil == start.node {
+		return 0
+	}
+
+	count := 0
+	l.visit(start, keyBuf, func(key []byte, plen int, value T) error {
+		if nil != visitFn {
+			visitFn(key, plen, value)
+		}
+
+		count++
+		return nil
+	})
+
+	// The subtree is only detached, so it is not owned
+	l.ownPath(nodeAncestors)
+	l.release(start.node, nodeAncestors)
+
+	return count
+}
+
+// Performs a pre-order depth-first traversal of the subtree for a key, left (bit 0)
+// before right (bit 1). The key of every node is rebuilt from the traversed bits.
+// Arguments:
+//
+//	key     - key of the subtree expressed as byte slice.
+//	plen    - prefix length of the key in bits. 0 for the entire tree.
+//	visitFn - function to call for each terminal node. Receives the key bytes,
+//	          the prefix length in bits and the value.
+//
+// Returns:
+//
+//	error    - error returned by visitFn, if any
+func (l *binaryLayout[T]) walk(key []byte, plen int, visitFn func([]byte, int, T) error) error {
+	start, keyBuf := l.subtree(key, plen, nil)
+	if nil == start.node {
+		return nil
+	}
+
+	return l.visit(start, keyBuf, visitFn)
+}
+
+// Performs a pre-order depth-first traversal of a subtree.
+// Arguments:
+//
+//	start   - root of the subtree
+//	key     - key bits of the path to the parent of the root
+//	visitFn - function to call for each terminal node. Receives the key bytes,
+//	          the prefix length in bits and the value.
+//
+// Returns:
+//
+//	error    - error returned by visitFn, if any
+func (l *binaryLayout[T]) visit(start nodeFrame[T], key []byte, visitFn func([]byte, int, T) error) error {
+	stack := []nodeFrame[T]{start}
+
+	// Start looping
+	for len(stack) > 0 {
+		// Pop the top frame from the stack
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node := frame.node
+
+		// Record the bits that led to this node. Root has no bits.
+		if frame.depth > 0 {
+			key = l.setPath(key, frame.depth-l.skipLen(node)-1, frame.bit, node)
+		}
+
+		if node.IsTerminal() && !l.isRoot(node) {
+			err := visitFn(key, frame.depth, node.value)
+			if nil != err {
+				return err
+			}
+		}
+
+		// Push the right child first so that the left child is visited first
+		if nil != node.right {
+			stack = append(stack, nodeFrame[T]{node: node.right, depth: frame.depth + 1 + l.skipLen(node.right), bit: 1})
+		}
+
+		if nil != node.left {
+			stack = append(stack, nodeFrame[T]{node: node.left, depth: frame.depth + 1 + l.skipLen(node.left), bit: 0})
+		}
+	}
+
+	return nil
+}
+
+// Returns the root of the subtree that holds every entry equal to or more specific
+// than a key. The root is the node for the key or, in a path compressed tree, the
+// first node whose path extends the key.
+// Arguments:
+//
+//	key  - key expressed as byte slice.
+//	plen - prefix length of the key in bits.
+//	nodeAncestors - stack of ancestor nodes. Optional argument.
+//
+// Returns:
+//
+//	nodeFrame - root of the subtree. The node is nil if there is no such subtree.
+//	[]byte    - key bits of the path to the parent of the root
+func (l *binaryLayout[T]) subtree(key []byte, plen int, nodeAncestors *NodeStack[T]) (nodeFrame[T], []byte) {
+	// Key bits of the path. Copied since the bits are modified by the walk.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	// Start from root
+	frame := nodeFrame[T]{node: l.root.Node}
+
+	for frame.depth < plen {
+		// Save the traversed node if asked for
+		if nodeAncestors != nil {
+			nodeAncestors.Push(frame.node)
+		}
+
+		bit := getBit(keyBuf, frame.depth)
+
+		child := frame.node.getChild(bit)
+		if nil == child {
+			return nodeFrame[T]{}, nil
+		}
+
+		// The key must be a prefix of the bits skipped on the way to the child
+		matchLen := l.matchSkip(child, keyBuf, frame.depth+1, plen)
+		if matchLen < l.skipLen(child) && frame.depth+1+matchLen < plen {
+			return nodeFrame[T]{}, nil
+		}
+
+		frame = nodeFrame[T]{node: child, depth: frame.depth + 1 + l.skipLen(child), bit: bit}
+	}
+
+	return frame, keyBuf
+}
+
+func (l *binaryLayout[T]) seek(key []byte, plen int, inclusive bool) ([]byte, int, T, bool) {
+	node, keyBuf, depth := l.seekNode(key, plen, inclusive)
+	if nil == node {
+		var zero T
+		return nil, 0, zero, false
+	}
+
+	return keyBuf, depth, node.value, true
+}
+
+// Returns the first terminal node at or after the given key in walk order.
+// Arguments:
+//
+//	key       - key to start from expressed as byte slice.
+//	plen      - prefix length of the key in bits.
+//	inclusive - whether the key itself can be returned.
+//
+// Returns:
+//
+//	*Node - the terminal node found, nil if there are no more entries
+//	[]byte - key bits of the node
+//	int    - prefix length of the node in bits
+func (l *binaryLayout[T]) seekNode(key []byte, plen int, inclusive bool) (*Node[T], []byte, int) {
+	// Key bits of the path. Copied since the bits are modified below.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	// Start from root
+	node := l.root.Node
+	depth := 0
+
+	// Closest subtree to the right of the path and the depth of its
+	// parent. Everything in this subtree comes after the key in walk order.
+	var next *Node[T]
+	nextDepth := 0
+
+	// Traverse the path of the key as far as possible
+	for depth < plen {
+		bit := getBit(keyBuf, depth)
+		if 0 == bit && nil != node.right {
+			next = node.right
+			nextDepth = depth
+		}
+
+		child := node.getChild(bit)
+		if nil == child {
+			node = nil
+			break
+		}
+
+		// The key ends within the bits skipped on the way to the child or diverges
+		// from them. The child's subtree comes right after the key if the key is a
+		// prefix of the child's path or the key has a 0 bit where the path has a 1.
+		matchLen := l.matchSkip(child, keyBuf, depth+1, plen)
+		if matchLen < l.skipLen(child) {
+			if depth+1+matchLen == plen || 1 == asCompressed(child).getSkipBit(matchLen) {
+				return l.first(child, keyBuf, depth, bit)
+			}
+
+			node = nil
+			break
+		}
+
+		node = child
+		depth += 1 + matchLen
+	}
+
+	if nil != node {
+		// The key itself is in the tree
+		if inclusive && node.IsTerminal() && !l.isRoot(node) {
+			return node, keyBuf, depth
+		}
+
+		// Longer prefixes of the key come next
+		if nil != node.left {
+			return l.first(node.left, keyBuf, depth, 0)
+		}
+
+		if nil != node.right {
+			return l.first(node.right, keyBuf, depth, 1)
+		}
+	}
+
+	if nil == next {
+		return nil, nil, 0
+	}
+
+	return l.first(next, keyBuf, nextDepth, 1)
+}
+
+// Returns the first terminal node of a subtree in walk order.
+// Arguments:
+//
+//	node  - root of the subtree
+//	key   - key bits of the path to the parent of node
+//	depth - depth of the parent of node
+//	bit   - bit that leads from the parent to node
+//
+// Returns:
+//
+//	*Node  - the terminal node found, nil if the subtree has no entries
+//	[]byte - key bits of the node
+//	int    - prefix length of the node in bits
+func (l *binaryLayout[T]) first(node *Node[T], key []byte, depth int, bit byte) (*Node[T], []byte, int) {
+	for {
+		key = l.setPath(key, depth, bit, node)
+		depth += 1 + l.skipLen(node)
+
+		if node.IsTerminal() {
+			return node, key, depth
+		}
+
+		if nil != node.left {
+			node, bit = node.left, 0
+		} else if nil != node.right {
+			node, bit = node.right, 1
+		} else {
+			return nil, nil, 0
+		}
+	}
+}
+
+// Writes the bits of the path from a parent to a node into the key, i.e. the
+// branch bit followed by the bits skipped on the way to the node.
+// Arguments:
+//
+//	key   - key expressed as byte slice
+//	depth - depth of the parent
+//	bit   - bit that leads from the parent to the node
+//	node  - the node
+//
+// Returns:
+//
+//	[]byte - updated key
+func (l *binaryLayout[T]) setPath(key []byte, depth int, bit byte, node *Node[T]) []byte {
+	key = setBit(key, depth, bit)
+	if !l.compressed {
+		return key
+	}
+
+	return setBits(key, depth+1, int(asCompressed(node).skipLen), asCompressed(node).skip)
+}
+
+// Position in a binary layout. The bits skipped on the way to the node from the
+// off-th bit on are still ahead, followed by the node itself.
+type binaryPos[T any] struct {
+	node *Node[T]
+	off  int
+}
+
+// State of a set operation between two binary layouts with the same path compression
+type binaryMerge[T any] struct {
+	merged    *binaryLayout[T] // layout of the result
+	op        setOp
+	resolveFn ResolveFn[T]
+	count     int // number of entries in the result
+}
+
+// Whether a position is at the node itself
+func (m *binaryMerge[T]) atNode(p binaryPos[T]) bool {
+	return p.off == m.merged.skipLen(p.node)
+}
+
+// Returns the position one bit further down, along the given bit. The node is nil
+// if there is nothing along the bit.
+func (m *binaryMerge[T]) next(p binaryPos[T], bit byte) binaryPos[T] {
+	switch {
+	case nil == p.node:
+		return p
+	case m.atNode(p):
+		return binaryPos[T]{node: p.node.getChild(bit)}
+	case bit == asCompressed(p.node).getSkipBit(p.off):
+		return binaryPos[T]{node: p.node, off: p.off + 1}
+	}
+
+	return binaryPos[T]{}
+}
+
+func (l *binaryLayout[T]) merge(other treeLayout[T], op setOp, resolveFn ResolveFn[T]) (treeLayout[T], int, bool) {
+	o, ok := other.(*binaryLayout[T])
+	if !ok || o.compressed != l.compressed {
+		return nil, 0, false
+	}
+
+	merged := newBinaryLayout[T](l.compressed, l.persistent)
+
+	m := &binaryMerge[T]{merged: merged, op: op, resolveFn: resolveFn}
+	merged.root.Node = m.mergeNode(binaryPos[T]{node: l.root.Node}, binaryPos[T]{node: o.root.Node})
+
+	return merged, m.count, true
+}
+
+// Returns the result of the set operation for the subtrees at two positions, one in
+// each layout, for the same key bits. The bits skipped on the way to the returned
+// node start at the positions. Returns nil if the result is empty.
+func (m *binaryMerge[T]) merge(a binaryPos[T], b binaryPos[T]) *Node[T] {
+	switch {
+	case nil == a.node && nil == b.node:
+		return nil
+	case nil == b.node:
+		if opIntersect == m.op {
+			return nil
+		}
+		return m.copy(a)
+	case nil == a.node:
+		if opUnion != m.op {
+			return nil
+		}
+		return m.copy(b)
+	}
+
+	node := m.mergeNode(a, b)
+
+	var child *Node[T]
+	var bit byte
+
+	switch {
+	case node.IsTerminal():
+		return node
+	case nil == node.left && nil == node.right:
+		return nil
+	case nil != node.left && nil == node.right:
+		child = node.left
+	case nil == node.left && nil != node.right:
+		child = node.right
+		bit = 1
+	default:
+		return node
+	}
+
+	// A path compressed layout folds the node into its only child, as long as the
+	// bits fit. The child is a new node, so it can be modified.
+	if !m.merged.compressed || m.merged.skipLen(child) >= maxSkipLen {
+		return node
+	}
+
+	folded := asCompressed(child)
+	folded.skip |= uint64(bit) << folded.skipLen
+	folded.skipLen++
+
+	return child
+}
+
+// Returns a new node for two positions that are both present, with the entry for
+// the key bits of the positions, if any, and the result for the subtrees under them
+func (m *binaryMerge[T]) mergeNode(a binaryPos[T], b binaryPos[T]) *Node[T] {
+	node := m.merged.newNode()
+
+	aTerminal := m.atNode(a) && a.node.IsTerminal()
+	bTerminal := m.atNode(b) && b.node.IsTerminal()
+
+	switch {
+	case aTerminal && bTerminal:
+		if opDifference != m.op {
+			node.SaveAndMarkTerminal(m.resolveFn(a.node.value, b.node.value))
+		}
+	case aTerminal:
+		if opIntersect != m.op {
+			node.SaveAndMarkTerminal(a.node.value)
+		}
+	case bTerminal:
+		if opUnion == m.op {
+			node.SaveAndMarkTerminal(b.node.value)
+		}
+	}
+
+	if node.IsTerminal() {
+		m.count++
+	}
+
+	node.left = m.merge(m.next(a, 0), m.next(b, 0))
+	node.right = m.merge(m.next(a, 1), m.next(b, 1))
+
+	return node
+}
+
+// Returns a copy of the subtree at a position. The bits skipped on the way to the
+// copy start at the position.
+func (m *binaryMerge[T]) copy(p binaryPos[T]) *Node[T] {
+	node, count := m.merged.copyNodes(p.node, nil)
+	m.count += count
+
+	if m.merged.compressed {
+		copied := asCompressed(node)
+
+		restLen := int(copied.skipLen) - p.off
+		copied.skip &= uint64(1)<<restLen - 1
+		copied.skipLen = uint8(restLen)
+	}
+
+	return node
+}
+
+func (l *binaryLayout[T]) stats(stats *treeStats) {
+	type statsFrame struct {
+		node    *Node[T]
+		depth   int  // depth of the node
+		plen    int  // prefix length of the node in bits
+		inChain bool // whether the parent is part of a single child chain
+	}
+
+	size := l.nodeSize()
+
+	stack := []statsFrame{{node: l.root.Node}}
+	for len(stack) > 0 {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node := frame.node
+		stats.addNode(frame.depth, size)
+
+		if node.IsTerminal() && !l.isRoot(node) {
+			stats.addEntry(frame.depth, frame.plen)
+		}
+
+		// A chain starts at the first node without an entry and with a single child
+		inChain := !l.isRoot(node) && !node.IsTerminal() && (nil == node.left) != (nil == node.right)
+		if inChain && !frame.inChain {
+			stats.SingleChildChains++
+		}
+
+		if nil != node.right {
+			stack = append(stack, statsFrame{node: node.right, depth: frame.depth + 1, plen: frame.plen + 1 + l.skipLen(node.right), inChain: inChain})
+		}
+
+		if nil != node.left {
+			stack = append(stack, statsFrame{node: node.left, depth: frame.depth + 1, plen: frame.plen + 1 + l.skipLen(node.left), inChain: inChain})
+		}
+	}
+}
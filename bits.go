@@ -0,0 +1,132 @@
+package prefix_tree
+
+// Helpers to read and write the bits of keys. Bit 0 of a key is the MSB of its first byte.
+
+import (
+	"math/bits"
+)
+
+// Returns the bit at the given index of the key. Bit 0 is the MSB of the first byte.
+// Arguments:
+//
+//	key    - key expressed as byte slice
+//	bitIdx - index of the bit
+//
+// Returns:
+//
+//	byte - 0 or 1
+func getBit(key []byte, bitIdx int) byte {
+	return (key[bitIdx/8] >> (7 - bitIdx%8)) & 1
+}
+
+// Sets the bit at the given index of the key. The key is grown if needed.
+// Arguments:
+//
+//	key    - key expressed as byte slice
+//	bitIdx - index of the bit
+//	bit    - 0 or 1
+//
+// Returns:
+//
+//	[]byte - updated key
+func setBit(key []byte, bitIdx int, bit byte) []byte {
+	for len(key) <= bitIdx/8 {
+		key = append(key, 0)
+	}
+
+	if 1 == bit {
+		key[bitIdx/8] |= msbByteVal >> (bitIdx % 8)
+	} else {
+		key[bitIdx/8] &^= msbByteVal >> (bitIdx % 8)
+	}
+
+	return key
+}
+
+// Returns the prefix length of the mask, i.e. the number of leading 1 bits.
+// Arguments:
+//
+//	mask - mask expressed as byte slice
+//
+// Returns:
+//
+//	int - prefix length in bits
+func getPrefixLen(mask []byte) int {
+	plen := 0
+	for _, m := range mask {
+		if 0xFF != m {
+			return plen + bits.LeadingZeros8(^m)
+		}
+
+		plen += 8
+	}
+
+	return plen
+}
+
+// Returns n bits of the key starting at the given bit index, right aligned.
+// Arguments:
+//
+//	key    - key expressed as byte slice
+//	bitIdx - index of the first bit
+//	n      - number of bits to return. Cannot be more than 64.
+//
+// Returns:
+//
+//	uint64 - the bits
+func getBits(key []byte, bitIdx int, n int) uint64 {
+	var val uint64
+
+	for n > 0 {
+		// Bits available in the current byte
+		avail := 8 - bitIdx%8
+		take := min(avail, n)
+
+		b := (key[bitIdx/8] >> (avail - take)) & byte(0xFF>>(8-take))
+		val = val<<take | uint64(b)
+
+		bitIdx += take
+		n -= take
+	}
+
+	return val
+}
+
+// Sets n bits of the key starting at the given bit index. The key is grown if needed.
+// Arguments:
+//
+//	key    - key expressed as byte slice
+//	bitIdx - index of the first bit
+//	n      - number of bits to set. Cannot be more than 64.
+//	val    - the bits, right aligned
+//
+// Returns:
+//
+//	[]byte - updated key
+func setBits(key []byte, bitIdx int, n int, val uint64) []byte {
+	for i := 0; i < n; i++ {
+		key = setBit(key, bitIdx+i, byte(val>>(n-1-i))&1)
+	}
+
+	return key
+}
+
+// Sets the leading plen bits of the mask and clears the rest.
+// Arguments:
+//
+//	mask - mask expressed as byte slice
+//	plen - prefix length in bits
+func setMask(mask []byte, plen int) {
+	for i := range mask {
+		switch {
+		case plen >= 8:
+			mask[i] = 0xFF
+		case plen > 0:
+			mask[i] = ^byte(0xFF >> plen)
+		default:
+			mask[i] = 0
+		}
+
+		plen -= 8
+	}
+}
@@ -0,0 +1,137 @@
+package prefix_tree
+
+// Compiled trees. Most tables are built once and then only read. Compile() turns the
+// current contents of a tree into an immutable tree in a flat layout, see
+// flat_layout.go, whose nodes are stored in a single array. Lookups are faster, the
+// nodes take less memory and the garbage collector has no pointers to chase.
+
+import (
+	"context"
+)
+
+// Returns a compiled, read-only copy of the current contents of the tree. Reads
+// give the same results as those of the tree, and lookups allocate nothing. Later
+// writes to the tree never affect the copy. Writes to the copy fail with ErrReadOnly.
+//
+// Compiling takes O(n). The copy shares no nodes with the tree, so the tree can be
+// dropped once compiled. A clone of a compiled tree is a path compressed tree that
+// can be written to.
+// Arguments:
+//
+//	ctx - context for the lock functions
+//
+// Returns:
+//
+//	*Tree - compiled tree
+//	error - error from the lock functions, if any
+func (t *Tree[T]) Compile(ctx context.Context) (*Tree[T], error) {
+	if err := t.rlock(ctx); nil != err {
+		return nil, err
+	}
+	defer func() {
+		t.runlock(ctx)
+	}()
+
+	r := t.reader()
+
+	return &Tree[T]{
+		layout:   compileFlatLayout(r.layout, t.persistent),
+		numNodes: r.numNodes,
+		readOnly: true,
+		codec:    t.codec,
+		opts:     t.opts,
+	}, nil
+}
+
+// Returns a compiled, read-only copy of the IPv4 prefix tree. See Tree.Compile().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	PrefixTree - compiled tree
+//	error      - error from the lock functions, if any
+func (v4t *V4Tree[T]) Compile(ctx context.Context) (PrefixTree[T], error) {
+	compiled, err := v4t.tree.Compile(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapV4Tree(compiled), nil
+}
+
+// Returns a compiled, read-only copy of the IPv6 prefix tree. See Tree.Compile().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	PrefixTree - compiled tree
+//	error      - error from the lock functions, if any
+func (v6t *V6Tree[T]) Compile(ctx context.Context) (PrefixTree[T], error) {
+	compiled, err := v6t.tree.Compile(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapV6Tree(compiled), nil
+}
+
+// Returns a compiled, read-only copy of the strings tree. See Tree.Compile().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	PrefixTree - compiled tree
+//	error      - error from the lock functions, if any
+func (st *StringsTree[T]) Compile(ctx context.Context) (PrefixTree[T], error) {
+	compiled, err := st.tree.Compile(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapStringsTree(compiled), nil
+}
+
+// Returns a compiled, read-only copy of the reversed strings tree. See Tree.Compile().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	PrefixTree - compiled tree
+//	error      - error from the lock functions, if any
+func (rst *ReversedStringsTree[T]) Compile(ctx context.Context) (PrefixTree[T], error) {
+	compiled, err := rst.tree.Compile(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapReversedStringsTree(compiled), nil
+}
+
+// Returns a compiled, read-only copy of the keyed tree. See Tree.Compile().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	*KeyedTree - compiled tree
+//	error      - error from the lock functions, if any
+func (kt *KeyedTree[K, T]) Compile(ctx context.Context) (*KeyedTree[K, T], error) {
+	compiled, err := kt.tree.Compile(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	return &KeyedTree[K, T]{
+		tree:  compiled,
+		codec: kt.codec,
+	}, nil
+}
@@ -0,0 +1,286 @@
+package prefix_tree
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestTree_Compile(t *testing.T) {
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	newTrees := map[string]func() *Tree[int]{
+		"Binary":     func() *Tree[int] { return NewTree[int]() },
+		"Compressed": func() *Tree[int] { return NewCompressedTree[int]() },
+		"RCU":        func() *Tree[int] { return NewRCUTree[int]() },
+		"Stride4":    func() *Tree[int] { return NewTree[int](WithStride(4)) },
+		"Arena":      func() *Tree[int] { return NewArenaTree[int]() },
+	}
+
+	// Short keys with few distinct bits to get plenty of shared prefixes, plus long
+	// keys to get skipped runs of more than 64 bits
+	randomKey := func() ([]byte, []byte) {
+		keyLen := 2
+		if random.Intn(4) == 0 {
+			keyLen = 12
+		}
+
+		key := make([]byte, keyLen)
+		for i := range key {
+			key[i] = byte(random.Intn(4)) << 6
+		}
+
+		mask := make([]byte, keyLen)
+		copy(mask, newTreeEntry(make([]byte, keyLen), 1+random.Intn(keyLen*8), 0).Mask)
+		return key, mask
+	}
+
+	for name, newTree := range newTrees {
+		t.Run(name, func(t *testing.T) {
+			tr := newTree()
+			for i := 0; i < 1000; i++ {
+				key, mask := randomKey()
+				tr.Insert(ctx, key, mask, i)
+			}
+
+			compiled, err := tr.Compile(ctx)
+			if err != nil || !compiled.IsReadOnly() || compiled.numNodes != tr.numNodes {
+				t.Fatalf("Compile failed: %v", err)
+			}
+
+			expected := treeEntries(tr)
+			if fmt.Sprint(treeEntries(compiled)) != fmt.Sprint(expected) {
+				t.Fatalf("walk mismatch:\ntree     %v\ncompiled %v", expected, treeEntries(compiled))
+			}
+
+			for i := 0; i < 1000; i++ {
+				key, mask := randomKey()
+
+				for _, mType := range []MatchType{Exact, Partial, Longest} {
+					res1, v1, err1 := tr.Search(ctx, key, mask, mType)
+					res2, v2, err2 := compiled.Search(ctx, key, mask, mType)
+					if res1 != res2 || v1 != v2 || err1 != err2 {
+						t.Fatalf("Search %v/%v (%v) mismatch: %v/%v/%v != %v/%v/%v", key, mask, mType, res1, v1, err1, res2, v2, err2)
+					}
+				}
+
+				res1, entries1, err1 := tr.SearchAll(ctx, key, mask)
+				res2, entries2, err2 := compiled.SearchAll(ctx, key, mask)
+				if res1 != res2 || err1 != err2 || fmt.Sprint(entries1) != fmt.Sprint(entries2) {
+					t.Fatalf("SearchAll %v/%v mismatch: %v/%v != %v/%v", key, mask, entries1, err1, entries2, err2)
+				}
+
+				res1, entries1, err1 = tr.SearchCovered(ctx, key, mask)
+				res2, entries2, err2 = compiled.SearchCovered(ctx, key, mask)
+				if res1 != res2 || err1 != err2 || fmt.Sprint(entries1) != fmt.Sprint(entries2) {
+					t.Fatalf("SearchCovered %v/%v mismatch: %v/%v != %v/%v", key, mask, entries1, err1, entries2, err2)
+				}
+
+				c1 := tr.NewCursor(ctx)
+				c2 := compiled.NewCursor(ctx)
+				c1.Seek(key, mask)
+				c2.Seek(key, mask)
+				for j := 0; j < 3; j++ {
+					ok1, ok2 := c1.Next(), c2.Next()
+					k1, m1 := c1.Key()
+					k2, m2 := c2.Key()
+					if ok1 != ok2 || fmt.Sprint(k1, m1, c1.Value()) != fmt.Sprint(k2, m2, c2.Value()) {
+						t.Fatalf("Seek %v/%v mismatch: %v/%v/%v != %v/%v/%v", key, mask, k1, m1, c1.Value(), k2, m2, c2.Value())
+					}
+				}
+			}
+
+			stats, err := compiled.Stats(ctx)
+			if err != nil || stats.Entries != tr.numNodes || stats.Nodes != uint64(len(compiled.layout.(*flatLayout[int]).nodes)) {
+				t.Fatalf("unexpected stats %+v %v", stats, err)
+			}
+
+			// Writes fail and writes to the tree do not affect the compiled tree
+			key, mask := randomKey()
+			if _, err := compiled.Insert(ctx, key, mask, 1); err != ErrReadOnly {
+				t.Fatalf("expected ErrReadOnly, got %v", err)
+			}
+
+			tr.DeletePrefix(ctx, []byte{0}, []byte{0x80})
+			tr.DeletePrefix(ctx, []byte{0x80}, []byte{0x80})
+			if !tr.IsEmpty() || fmt.Sprint(treeEntries(compiled)) != fmt.Sprint(expected) {
+				t.Fatalf("compiled tree changed with the tree")
+			}
+		})
+	}
+}
+
+func TestTree_CompileEmpty(t *testing.T) {
+	ctx := context.Background()
+
+	compiled, err := NewTree[int]().Compile(ctx)
+	if err != nil || !compiled.IsEmpty() || 0 != len(treeEntries(compiled)) {
+		t.Fatalf("Compile of an empty tree failed: %v", err)
+	}
+
+	if res, _, err := compiled.SearchLongest(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0xFF, 0xFF, 0xFF}); res != Error || err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v %v", res, err)
+	}
+}
+
+func TestTree_CompileWritableCopies(t *testing.T) {
+	ctx := context.Background()
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+
+	tr := NewTree[int](WithRWMutex())
+	tr.Insert(ctx, []byte{10, 1, 0, 0}, mask, 1)
+	tr.Insert(ctx, []byte{10, 2, 0, 0}, mask, 2)
+
+	compiled, _ := tr.Compile(ctx)
+
+	// A clone can be written to
+	clone, err := compiled.Clone(ctx)
+	if err != nil || clone.IsReadOnly() {
+		t.Fatalf("Clone failed: %v", err)
+	}
+
+	if res, err := clone.Insert(ctx, []byte{10, 3, 0, 0}, mask, 3); res != Ok || err != nil || clone.numNodes != 3 {
+		t.Fatalf("Insert into the clone failed: %v %v", res, err)
+	}
+
+	// So can the result of a set operation, with the compiled tree on either side
+	union, err := Union(ctx, compiled, clone, func(a, b int) int { return a + b })
+	if err != nil || union.IsReadOnly() || fmt.Sprint(treeValues(union)) != "[2 4 3]" {
+		t.Fatalf("Union failed: %v %v", treeValues(union), err)
+	}
+
+	difference, err := Difference(ctx, clone, compiled)
+	if err != nil || fmt.Sprint(treeValues(difference)) != "[3]" {
+		t.Fatalf("Difference failed: %v %v", treeValues(difference), err)
+	}
+
+	intersection, err := Intersect(ctx, compiled, compiled, func(a, b int) int { return a * b })
+	if err != nil || fmt.Sprint(treeValues(intersection)) != "[1 4]" {
+		t.Fatalf("Intersect failed: %v %v", treeValues(intersection), err)
+	}
+
+	if res, _, err := intersection.Delete(ctx, []byte{10, 1, 0, 0}, mask); res != Match || err != nil {
+		t.Fatalf("Delete from the result failed: %v %v", res, err)
+	}
+
+	// The clone of a compiled persistent tree is persistent, so a snapshot of the
+	// clone shares its nodes and is not affected by later writes
+	persistent := NewPersistentTree[int]()
+	persistent.Insert(ctx, []byte{10, 1, 0, 0}, mask, 1)
+
+	compiled, _ = persistent.Compile(ctx)
+	clone, _ = compiled.Clone(ctx)
+	snapshot, _ := clone.Snapshot(ctx)
+
+	clone.Delete(ctx, []byte{10, 1, 0, 0}, mask)
+	clone.Insert(ctx, []byte{10, 2, 0, 0}, mask, 2)
+
+	if fmt.Sprint(treeValues(snapshot)) != "[1]" || fmt.Sprint(treeValues(clone)) != "[2]" {
+		t.Fatalf("expected [1] and [2], got %v and %v", treeValues(snapshot), treeValues(clone))
+	}
+}
+
+// Returns the values of a tree in walk order
+func treeValues(tr *Tree[int]) []int {
+	values := []int{}
+	for _, entry := range treeEntries(tr) {
+		values = append(values, entry.Value)
+	}
+
+	return values
+}
+
+func TestTree_CompileAllocs(t *testing.T) {
+	ctx := context.Background()
+
+	tr := NewTree[int]()
+	keys := generateTestKeys(1000)
+	for i := range keys {
+		tr.Insert(ctx, keys[i].key, keys[i].mask, i)
+	}
+
+	compiled, _ := tr.Compile(ctx)
+
+	i := 0
+	allocs := testing.AllocsPerRun(1000, func() {
+		compiled.SearchExact(ctx, keys[i%len(keys)].key, keys[i%len(keys)].mask)
+		compiled.SearchLongest(ctx, keys[i%len(keys)].key, keys[i%len(keys)].mask)
+		i++
+	})
+
+	if 0 != allocs {
+		t.Fatalf("expected no allocations per lookup, got %v", allocs)
+	}
+}
+
+func TestPrefixTree_Compile(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range testPrefixTrees() {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := tt.newTree()
+			for i, key := range tt.keys {
+				tree.Insert(ctx, key, testRoute{ASN: 64512 + i, Name: "route " + key})
+			}
+
+			compiled, err := tree.Compile(ctx)
+			if err != nil || fmt.Sprint(walkOutput(compiled)) != fmt.Sprint(walkOutput(tree)) {
+				t.Fatalf("Compile failed: %v %v", walkOutput(compiled), err)
+			}
+
+			for _, key := range tt.keys {
+				res1, v1, err1 := tree.SearchExact(ctx, key)
+				res2, v2, err2 := compiled.SearchExact(ctx, key)
+				if res1 != res2 || v1 != v2 || err1 != err2 {
+					t.Fatalf("SearchExact %s mismatch: %v/%v/%v != %v/%v/%v", key, res1, v1, err1, res2, v2, err2)
+				}
+
+				res1, v1, err1 = tree.Search(ctx, key)
+				res2, v2, err2 = compiled.Search(ctx, key)
+				if res1 != res2 || v1 != v2 || err1 != err2 {
+					t.Fatalf("Search %s mismatch: %v/%v/%v != %v/%v/%v", key, res1, v1, err1, res2, v2, err2)
+				}
+			}
+
+			if _, err := compiled.Insert(ctx, tt.keys[0], testRoute{}); err != ErrReadOnly {
+				t.Fatalf("expected ErrReadOnly, got %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkCompiledTree compares lookups in a tree before and after Compile()
+func BenchmarkCompiledTree(b *testing.B) {
+	ctx := context.Background()
+
+	const numKeys = 100000
+	keys := generateTestKeys(numKeys)
+
+	tree := NewTree[int]()
+	for i := range keys {
+		tree.Insert(ctx, keys[i].key, keys[i].mask, i)
+	}
+
+	compiled, _ := tree.Compile(ctx)
+
+	for _, tt := range []struct {
+		name string
+		tree *Tree[int]
+	}{{"Binary", tree}, {"Compiled", compiled}} {
+		b.Run(tt.name+"/SearchExact", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tt.tree.SearchExact(ctx, keys[i%numKeys].key, keys[i%numKeys].mask)
+			}
+		})
+
+		b.Run(tt.name+"/SearchLongest", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tt.tree.SearchLongest(ctx, keys[i%numKeys].key, keys[i%numKeys].mask)
+			}
+		})
+	}
+}
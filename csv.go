@@ -0,0 +1,337 @@
+package prefix_tree
+
+// Streaming CSV import and export of the contents of a PrefixTree. Every record holds
+// the key of an entry, in the same format accepted by Insert(), and its value in one or
+// more columns. How a value maps to its columns is set by a CSVMapping. For e.g.
+//
+//	prefix,asn,name
+//	10.0.0.0/8,64512,private
+//	10.1.0.0/16,64513,lab
+//
+// Records are written and read one at a time, so large tables never have to be held
+// in memory.
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Name of the key column in the header of a CSV table
+const csvKeyColumn = "prefix"
+
+// Number of records inserted into a tree at a time by CSVReader.ReadTree()
+const csvBatchSize = 1024
+
+// Maps the value of an entry to the columns of a CSV record and back. The zero
+// mapping stores the JSON encoding of the value in a single column named "value".
+type CSVMapping[T any] struct {
+	// Names of the value columns. The first record of a table is a header with the key
+	// column, "prefix", followed by the value columns. The reader finds the columns by
+	// name, so they can be in any order and other columns are ignored. Without names,
+	// tables have no header, the key is the first column and the value the rest.
+	Columns []string
+
+	// Returns the value columns for a value, in the order of Columns
+	Format func(T) ([]string, error)
+
+	// Returns the value for the value columns, in the order of Columns
+	Parse func([]string) (T, error)
+}
+
+// Fills in the defaults of the zero mapping
+func (m CSVMapping[T]) withDefaults() CSVMapping[T] {
+	if nil != m.Format || nil != m.Parse {
+		return m
+	}
+
+	return CSVMapping[T]{
+		Columns: []string{"value"},
+		Format: func(value T) ([]string, error) {
+			data, err := json.Marshal(value)
+			return []string{string(data)}, err
+		},
+		Parse: func(columns []string) (T, error) {
+			var value T
+			err := json.Unmarshal([]byte(columns[0]), &value)
+			return value, err
+		},
+	}
+}
+
+// Writes the entries of a tree as CSV records
+type CSVWriter[T any] struct {
+	w       *csv.Writer
+	mapping CSVMapping[T]
+
+	headerDone bool // whether the header was written
+}
+
+// Returns a new CSV writer
+// Arguments:
+//
+//	w       - writer to write the records to
+//	mapping - maps values to columns
+//
+// Returns:
+//
+//	*CSVWriter - pointer to the new writer
+func NewCSVWriter[T any](w io.Writer, mapping CSVMapping[T]) *CSVWriter[T] {
+	return &CSVWriter[T]{
+		w:       csv.NewWriter(w),
+		mapping: mapping.withDefaults(),
+	}
+}
+
+// Writes an entry as a record. Writes the header first, if the mapping names the
+// value columns. Records are buffered until Flush().
+// Arguments:
+//
+//	entry - entry to write
+//
+// Returns:
+//
+//	error - error if any
+func (cw *CSVWriter[T]) Write(entry Entry[T]) error {
+	if !cw.headerDone && len(cw.mapping.Columns) > 0 {
+		if err := cw.w.Write(append([]string{csvKeyColumn}, cw.mapping.Columns...)); nil != err {
+			return err
+		}
+	}
+	cw.headerDone = true
+
+	if nil == cw.mapping.Format {
+		return ErrNoCSVFunction
+	}
+
+	columns, err := cw.mapping.Format(entry.Value)
+	if nil != err {
+		return err
+	}
+
+	return cw.w.Write(append([]string{entry.Key}, columns...))
+}
+
+// Writes every entry of a tree in walk order and flushes the records
+// Arguments:
+//
+//	ctx  - context for the walk
+//	tree - tree to write
+//
+// Returns:
+//
+//	error - error if any
+func (cw *CSVWriter[T]) WriteTree(ctx context.Context, tree PrefixTree[T]) error {
+	err := tree.WalkKeys(ctx, func(ctx context.Context, key string, value T) error {
+		return cw.Write(Entry[T]{Key: key, Value: value})
+	})
+	if nil != err {
+		return err
+	}
+
+	return cw.Flush()
+}
+
+// Writes the buffered records to the underlying writer
+// Returns:
+//
+//	error - error if any
+func (cw *CSVWriter[T]) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// Reads entries from CSV records
+type CSVReader[T any] struct {
+	r       *csv.Reader
+	mapping CSVMapping[T]
+
+	headerDone bool  // whether the header was read
+	keyIdx     int   // index of the key column
+	valueIdxs  []int // indexes of the value columns, in the order of the mapping
+	minColumns int   // number of columns a record needs to hold the key and the value
+
+	columns []string // value columns of the current record
+}
+
+// Returns a new CSV reader
+// Arguments:
+//
+//	r       - reader to read the records from
+//	mapping - maps columns to values
+//
+// Returns:
+//
+//	*CSVReader - pointer to the new reader
+func NewCSVReader[T any](r io.Reader, mapping CSVMapping[T]) *CSVReader[T] {
+	cr := &CSVReader[T]{
+		r:       csv.NewReader(r),
+		mapping: mapping.withDefaults(),
+	}
+
+	// Records have a varying number of columns if there are columns to ignore
+	cr.r.FieldsPerRecord = -1
+	cr.r.ReuseRecord = true
+
+	return cr
+}
+
+// Reads the header and finds the key and value columns by name
+func (cr *CSVReader[T]) readHeader() error {
+	cr.headerDone = true
+
+	if 0 == len(cr.mapping.Columns) {
+		return nil
+	}
+
+	header, err := cr.r.Read()
+	if nil != err {
+		if io.EOF == err {
+			err = ErrInvalidCSVHeader
+		}
+		return err
+	}
+
+	cr.keyIdx = slices.Index(header, csvKeyColumn)
+	if cr.keyIdx < 0 {
+		return fmt.Errorf("%w: no %s column", ErrInvalidCSVHeader, csvKeyColumn)
+	}
+
+	cr.minColumns = cr.keyIdx + 1
+	cr.valueIdxs = make([]int, len(cr.mapping.Columns))
+	for i, name := range cr.mapping.Columns {
+		cr.valueIdxs[i] = slices.Index(header, name)
+		if cr.valueIdxs[i] < 0 {
+			return fmt.Errorf("%w: no %s column", ErrInvalidCSVHeader, name)
+		}
+
+		cr.minColumns = max(cr.minColumns, cr.valueIdxs[i]+1)
+	}
+
+	return nil
+}
+
+// Reads the next entry
+// Returns:
+//
+//	Entry - next entry
+//	error - io.EOF if there are no more entries, other error if any
+func (cr *CSVReader[T]) Read() (Entry[T], error) {
+	var entry Entry[T]
+
+	if !cr.headerDone {
+		if err := cr.readHeader(); nil != err {
+			return entry, err
+		}
+	}
+
+	if nil == cr.mapping.Parse {
+		return entry, ErrNoCSVFunction
+	}
+
+	record, err := cr.r.Read()
+	if nil != err {
+		return entry, err
+	}
+
+	line, _ := cr.r.FieldPos(0)
+
+	// Without a header, the key is the first column and the value the rest
+	if 0 == len(cr.mapping.Columns) {
+		if len(record) < 2 {
+			return entry, fmt.Errorf("line %d: expected a key and a value", line)
+		}
+
+		cr.columns = append(cr.columns[:0], record[1:]...)
+	} else {
+		if len(record) < cr.minColumns {
+			return entry, fmt.Errorf("line %d: expected at least %d columns", line, cr.minColumns)
+		}
+
+		cr.columns = cr.columns[:0]
+		for _, idx := range cr.valueIdxs {
+			cr.columns = append(cr.columns, record[idx])
+		}
+	}
+
+	entry.Value, err = cr.mapping.Parse(cr.columns)
+	if nil != err {
+		return entry, fmt.Errorf("line %d: %w", line, err)
+	}
+
+	entry.Key = record[cr.keyIdx]
+	return entry, nil
+}
+
+// Reads every remaining entry and inserts it into a tree. Entries are inserted in
+// batches with InsertBatch(), so a tree with locks is locked once per batch rather
+// than once per entry. Stops at the first error. The entries before the one that
+// failed are in the tree, the entries after it are not.
+// Arguments:
+//
+//	ctx  - context for the inserts
+//	tree - tree to insert into
+//
+// Returns:
+//
+//	int   - number of entries inserted, i.e. those before the first error
+//	error - error if any. ErrDuplicateKey if a key is already in the tree.
+func (cr *CSVReader[T]) ReadTree(ctx context.Context, tree PrefixTree[T]) (int, error) {
+	count := 0
+	batch := make([]Entry[T], 0, csvBatchSize)
+
+	insert := func() error {
+		results, err := tree.InsertBatch(ctx, batch)
+
+		// InsertBatch() goes on after a failed entry, so the entries inserted
+		// after it are deleted again
+		failed := len(results)
+		for i := range results {
+			if Ok != results[i] {
+				failed = i
+				break
+			}
+		}
+
+		for i := failed + 1; i < len(results); i++ {
+			if Ok == results[i] {
+				tree.Delete(ctx, batch[i].Key)
+			}
+		}
+
+		if failed < len(results) && Dup == results[failed] {
+			err = fmt.Errorf("%w %s", ErrDuplicateKey, batch[failed].Key)
+		}
+
+		count += failed
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		entry, err := cr.Read()
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			// The entries read before the error are still inserted
+			if err := insert(); nil != err {
+				return count, err
+			}
+
+			return count, err
+		}
+
+		batch = append(batch, entry)
+		if len(batch) == csvBatchSize {
+			if err := insert(); nil != err {
+				return count, err
+			}
+		}
+	}
+
+	return count, insert()
+}
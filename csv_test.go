@@ -0,0 +1,200 @@
+package prefix_tree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Maps a route to an asn and a name column
+var testRouteMapping = CSVMapping[testRoute]{
+	Columns: []string{"asn", "name"},
+	Format: func(route testRoute) ([]string, error) {
+		return []string{strconv.Itoa(route.ASN), route.Name}, nil
+	},
+	Parse: func(columns []string) (testRoute, error) {
+		asn, err := strconv.Atoi(columns[0])
+		return testRoute{ASN: asn, Name: columns[1]}, err
+	},
+}
+
+func TestPrefixTree_CSV(t *testing.T) {
+	ctx := context.Background()
+
+	mappings := map[string]CSVMapping[testRoute]{
+		"Default": {},
+		"Columns": testRouteMapping,
+		"NoHeader": {
+			Format: testRouteMapping.Format,
+			Parse:  testRouteMapping.Parse,
+		},
+	}
+
+	for _, tt := range testPrefixTrees() {
+		for name, mapping := range mappings {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				tree := tt.newTree()
+				for i, key := range tt.keys {
+					tree.Insert(ctx, key, testRoute{ASN: 64512 + i, Name: "route, " + key})
+				}
+
+				var buf bytes.Buffer
+				if err := NewCSVWriter(&buf, mapping).WriteTree(ctx, tree); err != nil {
+					t.Fatalf("WriteTree failed: %v", err)
+				}
+
+				decoded := tt.newTree()
+				count, err := NewCSVReader(&buf, mapping).ReadTree(ctx, decoded)
+				if err != nil || count != len(tt.keys) {
+					t.Fatalf("ReadTree failed: %d %v", count, err)
+				}
+
+				if expected, actual := walkOutput(tree), walkOutput(decoded); fmt.Sprint(expected) != fmt.Sprint(actual) {
+					t.Fatalf("unexpected walk output after import:\n%v\n%v", expected, actual)
+				}
+			})
+		}
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[testRoute]()
+	v4t.Insert(ctx, "10.1.0.0/16", testRoute{ASN: 64513, Name: "lab"})
+	v4t.Insert(ctx, "10.0.0.0/8", testRoute{ASN: 64512, Name: "private"})
+
+	var buf bytes.Buffer
+	if err := NewCSVWriter(&buf, testRouteMapping).WriteTree(ctx, v4t); err != nil {
+		t.Fatalf("WriteTree failed: %v", err)
+	}
+
+	expected := "prefix,asn,name\n10.0.0.0/8,64512,private\n10.1.0.0/16,64513,lab\n"
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := NewCSVWriter(&buf, CSVMapping[testRoute]{}).WriteTree(ctx, v4t); err != nil {
+		t.Fatalf("WriteTree failed: %v", err)
+	}
+
+	expected = "prefix,value\n10.0.0.0/8,\"{\"\"asn\"\":64512,\"\"name\"\":\"\"private\"\"}\"\n10.1.0.0/16,\"{\"\"asn\"\":64513,\"\"name\"\":\"\"lab\"\"}\"\n"
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	// A mapping that only parses cannot write
+	err := NewCSVWriter(&buf, CSVMapping[testRoute]{Parse: testRouteMapping.Parse}).Write(Entry[testRoute]{Key: "10.0.0.0/8"})
+	if err != ErrNoCSVFunction {
+		t.Fatalf("expected %v, got %v", ErrNoCSVFunction, err)
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	ctx := context.Background()
+
+	// Columns are found by name and other columns are ignored
+	table := "name,comment,prefix,asn\nprivate,hand edited,10.0.0.0/8,64512\nlab,,10.1.0.0/16,64513\n"
+	reader := NewCSVReader(strings.NewReader(table), testRouteMapping)
+
+	entry, err := reader.Read()
+	if err != nil || entry.Key != "10.0.0.0/8" || entry.Value != (testRoute{ASN: 64512, Name: "private"}) {
+		t.Fatalf("unexpected entry %v %v", entry, err)
+	}
+	entry, err = reader.Read()
+	if err != nil || entry.Key != "10.1.0.0/16" || entry.Value != (testRoute{ASN: 64513, Name: "lab"}) {
+		t.Fatalf("unexpected entry %v %v", entry, err)
+	}
+	if _, err = reader.Read(); err != io.EOF {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+
+	tests := []struct {
+		name  string
+		table string
+		err   error
+	}{
+		{"Empty", "", ErrInvalidCSVHeader},
+		{"NoKeyColumn", "asn,name\n64512,private\n", ErrInvalidCSVHeader},
+		{"NoValueColumn", "prefix,asn\n10.0.0.0/8,64512\n", ErrInvalidCSVHeader},
+		{"ShortRecord", "prefix,asn,name\n10.0.0.0/8,64512\n", nil},
+		{"InvalidValue", "prefix,asn,name\n10.0.0.0/8,private,64512\n", strconv.ErrSyntax},
+		{"InvalidPrefix", "prefix,asn,name\n10.0.0.0/33,64512,private\n", nil},
+		{"Duplicate", "prefix,asn,name\n10.0.0.0/8,64512,private\n10.0.0.0/8,64513,lab\n", ErrDuplicateKey},
+	}
+
+	for _, tt := range tests {
+		_, err := NewCSVReader(strings.NewReader(tt.table), testRouteMapping).ReadTree(ctx, NewV4Tree[testRoute]())
+		if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestCSVReader_ReadTreeStops(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		table    string
+		count    int
+		expected string
+	}{
+		// The duplicate and the entries after it are in the same batch
+		{"Duplicate", "10.0.0.0/8,1\n10.1.0.0/16,2\n10.0.0.0/8,3\n10.2.0.0/16,4\n", 2, "[10.0.0.0/8=1 10.1.0.0/16=2]"},
+		{"Existing", "10.1.0.0/16,2\n192.168.0.0/16,5\n10.2.0.0/16,4\n", 1, "[10.1.0.0/16=2 192.168.0.0/16=0]"},
+		{"InvalidPrefix", "10.0.0.0/8,1\n10.0.0.0/33,2\n10.2.0.0/16,4\n", 1, "[10.0.0.0/8=1]"},
+		{"InvalidValue", "10.0.0.0/8,1\n10.1.0.0/16,x\n10.2.0.0/16,4\n", 1, "[10.0.0.0/8=1]"},
+	}
+
+	mapping := CSVMapping[int]{
+		Parse: func(columns []string) (int, error) {
+			return strconv.Atoi(columns[0])
+		},
+	}
+
+	for _, tt := range tests {
+		tree := NewV4Tree[int]()
+		if "Existing" == tt.name {
+			tree.Insert(ctx, "192.168.0.0/16", 0)
+		}
+
+		count, err := NewCSVReader(strings.NewReader(tt.table), mapping).ReadTree(ctx, tree)
+		if err == nil || count != tt.count {
+			t.Fatalf("%s: expected an error after %d entries, got %d %v", tt.name, tt.count, count, err)
+		}
+
+		if actual := fmt.Sprint(walkOutput(tree)); tt.expected != actual {
+			t.Fatalf("%s: expected %s, got %s", tt.name, tt.expected, actual)
+		}
+	}
+}
+
+func TestCSVReader_Batches(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int]()
+
+	for i, prefix := range generateIPv4Addresses(3*csvBatchSize + 1) {
+		v4t.Insert(ctx, prefix, i)
+	}
+
+	var buf bytes.Buffer
+	if err := NewCSVWriter(&buf, CSVMapping[int]{}).WriteTree(ctx, v4t); err != nil {
+		t.Fatalf("WriteTree failed: %v", err)
+	}
+
+	decoded := NewV4Tree[int](WithRWMutex())
+	count, err := NewCSVReader(&buf, CSVMapping[int]{}).ReadTree(ctx, decoded)
+	if err != nil || count != 3*csvBatchSize+1 {
+		t.Fatalf("ReadTree failed: %d %v", count, err)
+	}
+
+	if expected, actual := walkOutput(v4t), walkOutput(decoded); fmt.Sprint(expected) != fmt.Sprint(actual) {
+		t.Fatalf("unexpected walk output after import")
+	}
+}
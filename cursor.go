@@ -0,0 +1,236 @@
+package prefix_tree
+
+// Pull-style iteration over the entries of a tree. A cursor remembers the key of the
+// current entry and finds the next entry with a fresh lookup on every call to Next().
+// The read lock is only held during that lookup, so the tree can be modified while
+// iterating. Each step sees the tree as it is at the time of the step.
+//
+// Entries are returned in walk order, i.e. the order used by Walk().
+
+import (
+	"context"
+)
+
+// Cursor over the entries of a Tree
+type TreeCursor[T any] struct {
+	tree *Tree[T]
+	ctx  context.Context
+
+	key   []byte // key bits of the current entry
+	plen  int    // prefix length of the current entry in bits
+	value T      // value of the current entry
+
+	inclusive bool // whether the next call to Next() can return key/plen itself
+	valid     bool // whether the cursor is positioned on an entry
+
+	err error // error from the lock functions that stopped the cursor, if any
+}
+
+// Returns a new cursor positioned before the first entry of the tree
+// Arguments:
+//
+//	ctx - context for the lock functions.
+//
+// Returns:
+//
+//	*TreeCursor - pointer to the new cursor
+func (t *Tree[T]) NewCursor(ctx context.Context) *TreeCursor[T] {
+	return &TreeCursor[T]{
+		tree:      t,
+		ctx:       ctx,
+		key:       []byte{},
+		inclusive: true,
+	}
+}
+
+// Positions the cursor such that the next call to Next() moves to the first
+// entry at or after the given key/mask.
+// Arguments:
+//
+//	key  - key to seek to expressed as byte slice.
+//	mask - mask for the key expressed as byte slice.
+//
+// Returns:
+//
+//	error - error if any
+func (c *TreeCursor[T]) Seek(key []byte, mask []byte) error {
+	if len(key) != len(mask) {
+		return ErrInvalidKeyMask
+	}
+
+	c.key = append([]byte{}, key...)
+	c.plen = getPrefixLen(mask)
+	c.inclusive = true
+	c.valid = false
+	c.err = nil
+
+	return nil
+}
+
+// Moves the cursor to the next entry. Will read lock the tree during the lookup.
+// Check Err() once Next() returns false.
+// Returns:
+//
+//	bool - true if the cursor is positioned on an entry, false if there are no more entries
+func (c *TreeCursor[T]) Next() bool {
+	// Every step is a fresh lookup, so a done context is checked on every step
+	if err := c.ctx.Err(); nil != err {
+		c.err = err
+		c.valid = false
+		return false
+	}
+
+	if err := c.tree.rlock(c.ctx); nil != err {
+		c.err = err
+		c.valid = false
+		return false
+	}
+	defer func() {
+		c.tree.runlock(c.ctx)
+	}()
+
+	key, plen, value, ok := c.tree.reader().layout.seek(c.key, c.plen, c.inclusive)
+	if !ok {
+		c.valid = false
+		return false
+	}
+
+	c.key = key
+	c.plen = plen
+	c.value = value
+	c.inclusive = false
+	c.valid = true
+
+	return true
+}
+
+// Returns the key and mask of the current entry. Both are nil if the cursor is
+// not positioned on an entry.
+// Returns:
+//
+//	[]byte - key of the current entry
+//	[]byte - mask of the current entry
+func (c *TreeCursor[T]) Key() ([]byte, []byte) {
+	if !c.valid {
+		return nil, nil
+	}
+
+	entry := newTreeEntry(c.key, c.plen, c.value)
+	return entry.Key, entry.Mask
+}
+
+// Returns the value of the current entry. Returns the zero value if the cursor is
+// not positioned on an entry.
+// Returns:
+//
+//	T - value of the current entry
+func (c *TreeCursor[T]) Value() T {
+	if !c.valid {
+		var zero T
+		return zero
+	}
+
+	return c.value
+}
+
+// Returns the error that stopped the cursor, e.g. the context of the cursor is done. Nil if the cursor ran out of entries.
+// Returns:
+//
+//	error - error if any
+func (c *TreeCursor[T]) Err() error {
+	return c.err
+}
+
+// Cursor over the entries of a PrefixTree. Keys are in the same format accepted by Insert().
+type Cursor[T any] struct {
+	cursor *TreeCursor[T]
+
+	keyFn   func([]byte, []byte) string          // converts a key/mask to its string form
+	parseFn func(string) ([]byte, []byte, error) // converts a string to its key/mask
+}
+
+// Positions the cursor such that the next call to Next() moves to the first
+// entry at or after the given key.
+// Arguments:
+//
+//	s - key as a string
+//
+// Returns:
+//
+//	error - error if any
+func (c *Cursor[T]) Seek(s string) error {
+	key, mask, err := c.parseFn(s)
+	if nil != err {
+		return err
+	}
+
+	return c.cursor.Seek(key, mask)
+}
+
+// Moves the cursor to the next entry
+// Returns:
+//
+//	bool - true if the cursor is positioned on an entry, false if there are no more entries
+func (c *Cursor[T]) Next() bool {
+	return c.cursor.Next()
+}
+
+// Returns the error that stopped the cursor, if any. See TreeCursor.Err().
+// Returns:
+//
+//	error - error if any
+func (c *Cursor[T]) Err() error {
+	return c.cursor.Err()
+}
+
+// Returns the key of the current entry. Returns an empty string if the cursor is
+// not positioned on an entry.
+// Returns:
+//
+//	string - key of the current entry
+func (c *Cursor[T]) Key() string {
+	if !c.cursor.valid {
+		return ""
+	}
+
+	return c.keyFn(c.cursor.Key())
+}
+
+// Returns the value of the current entry. Returns the zero value if the cursor is
+// not positioned on an entry.
+// Returns:
+//
+//	T - value of the current entry
+func (c *Cursor[T]) Value() T {
+	return c.cursor.Value()
+}
+
+// Returns the prefix length of the current entry in bits. Returns 0 if the cursor
+// is not positioned on an entry.
+// Returns:
+//
+//	int - prefix length of the current entry
+func (c *Cursor[T]) PrefixLen() int {
+	if !c.cursor.valid {
+		return 0
+	}
+
+	return c.cursor.plen
+}
+
+// Returns a new cursor over the entries of a tree keyed by strings
+// Arguments:
+//
+//	ctx - context for the operation
+//	kt  - keyed tree
+//
+// Returns:
+//
+//	*Cursor - cursor positioned before the first entry
+func newCursor[T any](ctx context.Context, kt *KeyedTree[string, T]) *Cursor[T] {
+	return &Cursor[T]{
+		cursor:  kt.tree.NewCursor(ctx),
+		keyFn:   kt.keyOf,
+		parseFn: kt.keyParser(),
+	}
+}
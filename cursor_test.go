@@ -0,0 +1,230 @@
+package prefix_tree
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTreeCursor(t *testing.T) {
+	ctx := context.Background()
+	tr := NewTree[string]()
+
+	// empty tree
+	c := tr.NewCursor(ctx)
+	if c.Next() {
+		t.Fatalf("Next on empty tree returned an entry")
+	}
+
+	tr.Insert(ctx, []byte{192, 168, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00}, "net-192")
+	tr.Insert(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00}, "net-10-1-2")
+	tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-10")
+	tr.Insert(ctx, []byte{172, 16, 0, 0}, []byte{0xFF, 0xF0, 0x00, 0x00}, "net-172")
+
+	expected := []string{"net-10", "net-10-1-2", "net-172", "net-192"}
+
+	// full iteration
+	c = tr.NewCursor(ctx)
+	visited := []string{}
+	for c.Next() {
+		visited = append(visited, c.Value())
+	}
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, visited)
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, visited)
+		}
+	}
+
+	// cursor stays exhausted
+	if c.Next() {
+		t.Fatalf("Next after the last entry returned an entry")
+	}
+	if key, mask := c.Key(); key != nil || mask != nil || c.Value() != "" {
+		t.Fatalf("exhausted cursor returned key %v mask %v value %v", key, mask, c.Value())
+	}
+
+	tests := []struct {
+		key      []byte
+		mask     []byte
+		expected []string
+	}{
+		// seek to an existing key
+		{[]byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00}, expected[1:]},
+		// seek to a key that is not in the tree
+		{[]byte{11, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, expected[2:]},
+		// seek to a key covered by a prefix in the tree
+		{[]byte{10, 1, 2, 3}, []byte{0xFF, 0xFF, 0xFF, 0xFF}, expected[2:]},
+		// seek to a key covering prefixes in the tree
+		{[]byte{172, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, expected[2:]},
+		// seek past the last entry
+		{[]byte{200, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, []string{}},
+		// seek to the start
+		{[]byte{}, []byte{}, expected},
+	}
+
+	for _, tt := range tests {
+		if err := c.Seek(tt.key, tt.mask); err != nil {
+			t.Fatalf("Seek %v/%v failed: %v", tt.key, tt.mask, err)
+		}
+
+		visited = []string{}
+		for c.Next() {
+			visited = append(visited, c.Value())
+		}
+
+		if len(visited) != len(tt.expected) {
+			t.Fatalf("Seek %v/%v: expected %v, got %v", tt.key, tt.mask, tt.expected, visited)
+		}
+		for i := range tt.expected {
+			if visited[i] != tt.expected[i] {
+				t.Fatalf("Seek %v/%v: expected %v, got %v", tt.key, tt.mask, tt.expected, visited)
+			}
+		}
+	}
+
+	// keys are reported along with the values
+	c.Seek([]byte{172}, []byte{0xFF})
+	if !c.Next() {
+		t.Fatalf("Next after Seek failed")
+	}
+	key, mask := c.Key()
+	if string(key) != string([]byte{172, 16}) || string(mask) != string([]byte{0xFF, 0xF0}) {
+		t.Fatalf("unexpected key %v mask %v", key, mask)
+	}
+
+	if err := c.Seek([]byte{10}, []byte{}); err != ErrInvalidKeyMask {
+		t.Fatalf("expected ErrInvalidKeyMask, got %v", err)
+	}
+}
+
+func TestTreeCursor_ModifyWhileIterating(t *testing.T) {
+	ctx := context.Background()
+	tr := NewTree[int]()
+
+	for i := 0; i < 16; i++ {
+		tr.Insert(ctx, []byte{byte(i * 16)}, []byte{0xF0}, i)
+	}
+
+	// Delete every entry as it is visited. The cursor must still visit all of them.
+	c := tr.NewCursor(ctx)
+	visited := 0
+	for c.Next() {
+		if c.Value() != visited {
+			t.Fatalf("expected value %d, got %d", visited, c.Value())
+		}
+
+		key, mask := c.Key()
+		if res, _, err := tr.Delete(ctx, key, mask); err != nil || res != Match {
+			t.Fatalf("Delete %v/%v failed: %v %v", key, mask, res, err)
+		}
+
+		visited++
+	}
+
+	if visited != 16 || !tr.IsEmpty() {
+		t.Fatalf("expected to visit and delete 16 entries, visited %d", visited)
+	}
+}
+
+func TestPrefixTreeIterators(t *testing.T) {
+	ctx := context.Background()
+
+	v4t := NewV4Tree[int]()
+	cidrs := []string{"10.0.0.0/8", "10.1.2.0/24", "172.16.0.0/12", "192.168.1.1/32"}
+	for i, cidr := range cidrs {
+		v4t.Insert(ctx, cidr, i)
+	}
+
+	i := 0
+	for key, value := range v4t.All(ctx) {
+		if key != cidrs[i] || value != i {
+			t.Fatalf("unexpected entry %s/%d, expected %s/%d", key, value, cidrs[i], i)
+		}
+		i++
+	}
+	if i != len(cidrs) {
+		t.Fatalf("expected %d entries, got %d", len(cidrs), i)
+	}
+
+	plens := []int{8, 24, 12, 32}
+	i = 0
+	for key, plen := range v4t.Prefixes(ctx) {
+		if key != cidrs[i] || plen != plens[i] {
+			t.Fatalf("unexpected prefix %s/%d, expected %s/%d", key, plen, cidrs[i], plens[i])
+		}
+		i++
+	}
+
+	// stop early
+	i = 0
+	for range v4t.All(ctx) {
+		i++
+		if i == 2 {
+			break
+		}
+	}
+	if i != 2 {
+		t.Fatalf("expected iteration to stop after 2 entries, got %d", i)
+	}
+
+	// seek in an IPv4 tree
+	c := v4t.Cursor(ctx)
+	if err := c.Seek("10.1.0.0/16"); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if !c.Next() || c.Key() != "10.1.2.0/24" || c.Value() != 1 {
+		t.Fatalf("unexpected entry after Seek: %s/%d", c.Key(), c.Value())
+	}
+	if err := c.Seek("10.1.0.0/33"); err == nil {
+		t.Fatalf("Seek accepted an invalid address")
+	}
+
+	// reversed strings are iterated in the order of the reversed strings
+	rstree := NewReversedStringsTree[int]()
+	domains := []string{"example.org", "google.com", "mail.google.com"}
+	for i, domain := range domains {
+		rstree.Insert(ctx, domain, i)
+	}
+
+	i = 0
+	for key, value := range rstree.All(ctx) {
+		if key != domains[i] || value != i {
+			t.Fatalf("unexpected entry %s/%d, expected %s/%d", key, value, domains[i], i)
+		}
+		i++
+	}
+
+	rc := rstree.Cursor(ctx)
+	rc.Seek("a.google.com")
+	if !rc.Next() || rc.Key() != "mail.google.com" {
+		t.Fatalf("unexpected entry after Seek: %s", rc.Key())
+	}
+}
+
+func TestCursorContext(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int]()
+
+	for i, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"} {
+		v4t.Insert(ctx, cidr, i)
+	}
+
+	cursorCtx, cancel := context.WithCancel(ctx)
+	c := v4t.Cursor(cursorCtx)
+	if !c.Next() || c.Err() != nil {
+		t.Fatalf("Next failed: %v", c.Err())
+	}
+
+	// The cursor stops once its context is cancelled
+	cancel()
+	if c.Next() || c.Err() != context.Canceled {
+		t.Fatalf("expected the cursor to stop with %v, got %v", context.Canceled, c.Err())
+	}
+
+	// Seek clears the error
+	if err := c.Seek("10.0.0.0/8"); err != nil || c.Err() != nil {
+		t.Fatalf("Seek failed: %v %v", err, c.Err())
+	}
+}
@@ -0,0 +1,619 @@
+package prefix_tree
+
+// Differences between two versions of a tree. Diff() returns the entries added,
+// removed and changed from one version to the next, and ApplyDiff() replays them on
+// a tree. For e.g. to bring a live tree up to date with a new prefix list:
+//
+//	changes, err := live.Diff(ctx, latest, equalFn)
+//	...
+//	err = live.ApplyDiff(ctx, changes)
+//
+// The changes are ordered by key, in walk order.
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"unsafe"
+)
+
+// Value of a key that differs between two trees
+type TreeChange[T any] struct {
+	Key  []byte
+	Mask []byte
+	Old  T // value in the old tree
+	New  T // value in the new tree
+}
+
+// Differences between two trees, see Diff()
+type TreeChangeSet[T any] struct {
+	Added   []TreeEntry[T]  // entries of the new tree with keys that are not in the old tree
+	Removed []TreeEntry[T]  // entries of the old tree with keys that are not in the new tree
+	Changed []TreeChange[T] // keys in both trees with values that are not equal
+}
+
+// Whether the trees are the same
+func (cs *TreeChangeSet[T]) IsEmpty() bool {
+	return 0 == len(cs.Added) && 0 == len(cs.Removed) && 0 == len(cs.Changed)
+}
+
+// Value of a key that differs between two trees, with the key as a string
+type Change[T any] struct {
+	Key string
+	Old T // value in the old tree
+	New T // value in the new tree
+}
+
+// Differences between two trees with string keys, see Diff()
+type ChangeSet[T any] struct {
+	Added   []Entry[T]  // entries of the new tree with keys that are not in the old tree
+	Removed []Entry[T]  // entries of the old tree with keys that are not in the new tree
+	Changed []Change[T] // keys in both trees with values that are not equal
+}
+
+// Whether the trees are the same
+func (cs *ChangeSet[T]) IsEmpty() bool {
+	return 0 == len(cs.Added) && 0 == len(cs.Removed) && 0 == len(cs.Changed)
+}
+
+// Returns the differences between two trees, in walk order. Applying them to the old
+// tree with ApplyDiff() results in the entries of the new tree. The trees are read
+// locked for the duration of the operation, the old tree first.
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	before  - old tree
+//	after   - new tree
+//	equalFn - reports whether the values of a key in both trees are equal
+//
+// Returns:
+//
+//	*TreeChangeSet - differences between the trees
+//	error          - error from the lock functions, if any
+func Diff[T any](ctx context.Context, before *Tree[T], after *Tree[T], equalFn EqualFn[T]) (*TreeChangeSet[T], error) {
+	if nil == equalFn {
+		return nil, ErrNoEqualFunction
+	}
+
+	if nil == before || nil == after {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	unlock, err := rlockTrees(ctx, before, after)
+	if nil != err {
+		return nil, err
+	}
+	defer func() {
+		unlock()
+	}()
+
+	oldEntries, oldLens := layoutEntries(before.reader().layout)
+	newEntries, newLens := layoutEntries(after.reader().layout)
+
+	changes := &TreeChangeSet[T]{}
+
+	// Both lists are in walk order, so a single pass pairs up the keys in both
+	i, j := 0, 0
+	for i < len(oldEntries) || j < len(newEntries) {
+		order := 0
+		switch {
+		case i == len(oldEntries):
+			order = 1
+		case j == len(newEntries):
+			order = -1
+		default:
+			order = compareWalkOrder(oldEntries[i].Key, oldLens[i], newEntries[j].Key, newLens[j])
+		}
+
+		switch {
+		case order < 0:
+			changes.Removed = append(changes.Removed, oldEntries[i])
+			i++
+		case order > 0:
+			changes.Added = append(changes.Added, newEntries[j])
+			j++
+		default:
+			if !equalFn(oldEntries[i].Value, newEntries[j].Value) {
+				changes.Changed = append(changes.Changed, TreeChange[T]{
+					Key:  oldEntries[i].Key,
+					Mask: oldEntries[i].Mask,
+					Old:  oldEntries[i].Value,
+					New:  newEntries[j].Value,
+				})
+			}
+			i++
+			j++
+		}
+	}
+
+	return changes, nil
+}
+
+// Returns the entries of a layout in walk order, along with their prefix lengths
+func layoutEntries[T any](layout treeLayout[T]) ([]TreeEntry[T], []int) {
+	entries := []TreeEntry[T]{}
+	plens := []int{}
+
+	layout.walk(nil, 0, func(key []byte, plen int, value T) error {
+		entries = append(entries, newTreeEntry(key, plen, value))
+		plens = append(plens, plen)
+		return nil
+	})
+
+	return entries, plens
+}
+
+// Compares two keys in walk order. A key comes before the keys it is a prefix of and
+// a bit 0 before a bit 1.
+// Arguments:
+//
+//	a, b       - keys expressed as byte slices
+//	aLen, bLen - prefix lengths of the keys in bits
+//
+// Returns:
+//
+//	int - -1 if a comes first, 1 if b comes first, 0 if the keys are the same
+func compareWalkOrder(a []byte, aLen int, b []byte, bLen int) int {
+	plen := min(aLen, bLen)
+
+	// Whole bytes first, then the bits left in the last byte
+	if order := bytes.Compare(a[:plen/8], b[:plen/8]); 0 != order {
+		return order
+	}
+
+	if bits := plen % 8; 0 != bits {
+		if order := cmp.Compare(a[plen/8]>>(8-bits), b[plen/8]>>(8-bits)); 0 != order {
+			return order
+		}
+	}
+
+	return cmp.Compare(aLen, bLen)
+}
+
+// Read locks two trees. The trees are locked in the order of their addresses, so two
+// calls with the same trees in opposite orders cannot deadlock while writers wait on
+// both. A tree is only locked once, since a read lock may not be reentrant.
+// Arguments:
+//
+//	ctx  - context for the lock functions
+//	a, b - trees to lock
+//
+// Returns:
+//
+//	func  - unlocks the trees
+//	error - error from the lock functions, if any. No tree is locked on error.
+func rlockTrees[T any](ctx context.Context, a *Tree[T], b *Tree[T]) (func(), error) {
+	if uintptr(unsafe.Pointer(a)) > uintptr(unsafe.Pointer(b)) {
+		a, b = b, a
+	}
+
+	if err := a.rlock(ctx); nil != err {
+		return nil, err
+	}
+
+	if a == b {
+		return func() {
+			a.runlock(ctx)
+		}, nil
+	}
+
+	if err := b.rlock(ctx); nil != err {
+		a.runlock(ctx)
+		return nil, err
+	}
+
+	return func() {
+		b.runlock(ctx)
+		a.runlock(ctx)
+	}, nil
+}
+
+// Change to apply to a tree
+type treeOp[T any] struct {
+	key   []byte
+	plen  int
+	value T
+	name  string // key as a string, if any
+}
+
+// Returns the change to apply for a key/mask
+// Arguments:
+//
+//	key   - key expressed as byte slice. Copied.
+//	mask  - mask expressed as byte slice
+//	value - value to store, if any
+//	name  - key as a string, for error messages. Optional argument.
+//
+// Returns:
+//
+//	treeOp - change to apply
+//	error  - error if the key/mask is not valid
+func newTreeOp[T any](key []byte, mask []byte, value T, name string) (treeOp[T], error) {
+	op := treeOp[T]{key: slices.Clone(key), value: value, name: name}
+	if len(key) != len(mask) {
+		return op, fmt.Errorf("%w %s", ErrInvalidKeyMask, op)
+	}
+
+	plen, err := getKeyPrefixLen(key, mask)
+	if nil != err {
+		return op, fmt.Errorf("%w %s", err, op)
+	}
+
+	op.plen = plen
+	return op, nil
+}
+
+func (op treeOp[T]) String() string {
+	if "" != op.name {
+		return op.name
+	}
+
+	return fmt.Sprintf("%v/%d", op.key, op.plen)
+}
+
+// Applies changes returned by Diff() to the tree under a single write lock. Removed
+// entries are removed, changed entries set to their new value and added entries
+// inserted. Every key is checked first, so either every change is applied or none
+// is. Readers never see a part of the changes.
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	changes - changes to apply
+//
+// Returns:
+//
+//	error - ErrKeyNotFound if a removed or changed key is not in the tree,
+//	        ErrDuplicateKey if an added key is already in the tree or a key
+//	        appears more than once, other error if any
+func (t *Tree[T]) ApplyDiff(ctx context.Context, changes *TreeChangeSet[T]) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+
+	var err error
+
+	removed := make([]treeOp[T], len(changes.Removed))
+	for i, entry := range changes.Removed {
+		if removed[i], err = newTreeOp(entry.Key, entry.Mask, entry.Value, ""); nil != err {
+			return err
+		}
+	}
+
+	changed := make([]treeOp[T], len(changes.Changed))
+	for i, change := range changes.Changed {
+		if changed[i], err = newTreeOp(change.Key, change.Mask, change.New, ""); nil != err {
+			return err
+		}
+	}
+
+	added := make([]treeOp[T], len(changes.Added))
+	for i, entry := range changes.Added {
+		if added[i], err = newTreeOp(entry.Key, entry.Mask, entry.Value, ""); nil != err {
+			return err
+		}
+	}
+
+	return t.applyOps(ctx, removed, changed, added)
+}
+
+// Removes, updates and inserts keys under a single write lock. See ApplyDiff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	removed - keys to remove
+//	changed - keys to set to a new value
+//	added   - keys to insert
+//
+// Returns:
+//
+//	error - error if any. The tree is left alone on error.
+func (t *Tree[T]) applyOps(ctx context.Context, removed []treeOp[T], changed []treeOp[T], added []treeOp[T]) error {
+	// A key may appear only once, or the changes would depend on their order
+	type opKey struct {
+		key  string
+		plen int
+	}
+
+	seen := map[opKey]bool{}
+	for _, ops := range [][]treeOp[T]{removed, changed, added} {
+		for i := range ops {
+			var zero T
+			key := opKey{key: string(newTreeEntry(ops[i].key, ops[i].plen, zero).Key), plen: ops[i].plen}
+			if seen[key] {
+				return fmt.Errorf("%w %s", ErrDuplicateKey, ops[i])
+			}
+			seen[key] = true
+		}
+	}
+
+	if err := t.wlock(ctx); nil != err {
+		return err
+	}
+	defer func() {
+		t.unlock(ctx)
+	}()
+
+	for _, ops := range [][]treeOp[T]{removed, changed} {
+		for i := range ops {
+			if _, _, ok := t.layout.find(ops[i].key, ops[i].plen, Exact); !ok {
+				return fmt.Errorf("%w %s", ErrKeyNotFound, ops[i])
+			}
+		}
+	}
+
+	for i := range added {
+		if _, _, ok := t.layout.find(added[i].key, added[i].plen, Exact); ok {
+			return fmt.Errorf("%w %s", ErrDuplicateKey, added[i])
+		}
+	}
+
+	// Inserts are the only changes that can fail, e.g. if an arena is out of nodes,
+	// so they go first and are undone on error. The keys to remove and update were
+	// found above, so the rest cannot fail.
+	for i := range added {
+		if _, err := t.layout.insert(added[i].key, added[i].plen, added[i].value); nil != err {
+			for j := range added[:i] {
+				t.layout.remove(added[j].key, added[j].plen)
+				t.decrNumNodes()
+			}
+
+			return err
+		}
+		t.incrNumNodes()
+	}
+
+	for i := range removed {
+		t.layout.remove(removed[i].key, removed[i].plen)
+		t.decrNumNodes()
+	}
+
+	for i := range changed {
+		t.layout.update(changed[i].key, changed[i].plen, changed[i].value)
+	}
+
+	return nil
+}
+
+// Converts the differences between two trees to their string form
+// Arguments:
+//
+//	changes - differences returned by Diff()
+//	keyFn   - converts the key/mask of an entry to its string form
+//
+// Returns:
+//
+//	*ChangeSet - differences with string keys
+func toChangeSet[T any](changes *TreeChangeSet[T], keyFn func([]byte, []byte) string) *ChangeSet[T] {
+	changeSet := &ChangeSet[T]{
+		Added:   toEntries(changes.Added, keyFn),
+		Removed: toEntries(changes.Removed, keyFn),
+		Changed: make([]Change[T], len(changes.Changed)),
+	}
+
+	for i, change := range changes.Changed {
+		changeSet.Changed[i] = Change[T]{
+			Key: keyFn(change.Key, change.Mask),
+			Old: change.Old,
+			New: change.New,
+		}
+	}
+
+	return changeSet
+}
+
+// Applies differences with string keys to a tree. See Tree.ApplyDiff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	tree    - tree to apply the changes to
+//	changes - changes to apply
+//	parseFn - converts a key to its key/mask
+//
+// Returns:
+//
+//	error - error if any. The tree is left alone on error.
+func applyChangeSet[T any](ctx context.Context, tree *Tree[T], changes *ChangeSet[T], parseFn func(string) ([]byte, []byte, error)) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	newOp := func(name string, value T) (treeOp[T], error) {
+		key, mask, err := parseFn(name)
+		if nil != err {
+			return treeOp[T]{}, err
+		}
+
+		return newTreeOp(key, mask, value, name)
+	}
+
+	var err error
+
+	removed := make([]treeOp[T], len(changes.Removed))
+	for i, entry := range changes.Removed {
+		if removed[i], err = newOp(entry.Key, entry.Value); nil != err {
+			return err
+		}
+	}
+
+	changed := make([]treeOp[T], len(changes.Changed))
+	for i, change := range changes.Changed {
+		if changed[i], err = newOp(change.Key, change.New); nil != err {
+			return err
+		}
+	}
+
+	added := make([]treeOp[T], len(changes.Added))
+	for i, entry := range changes.Added {
+		if added[i], err = newOp(entry.Key, entry.Value); nil != err {
+			return err
+		}
+	}
+
+	return tree.applyOps(ctx, removed, changed, added)
+}
+
+// Returns the differences between the IPv4 prefix tree and a newer version of it.
+// See Diff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	other   - newer version of the tree
+//	equalFn - reports whether two values are equal
+//
+// Returns:
+//
+//	*ChangeSet - differences between the trees, in walk order
+//	error      - ErrInvalidPrefixTree if the other tree is not a IPv4 prefix tree,
+//	             error from the lock functions, if any
+func (v4t *V4Tree[T]) Diff(ctx context.Context, other PrefixTree[T], equalFn EqualFn[T]) (*ChangeSet[T], error) {
+	o, ok := other.(*V4Tree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	changes, err := Diff(ctx, v4t.tree, o.tree, equalFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return toChangeSet(changes, v4t.keyOf), nil
+}
+
+// Applies differences returned by Diff() to the IPv4 prefix tree atomically. See
+// Tree.ApplyDiff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	changes - changes to apply
+//
+// Returns:
+//
+//	error - error if any. The tree is left alone on error.
+func (v4t *V4Tree[T]) ApplyDiff(ctx context.Context, changes *ChangeSet[T]) error {
+	return applyChangeSet(ctx, v4t.tree, changes, v4t.keyParser())
+}
+
+// Returns the differences between the IPv6 prefix tree and a newer version of it.
+// See Diff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	other   - newer version of the tree
+//	equalFn - reports whether two values are equal
+//
+// Returns:
+//
+//	*ChangeSet - differences between the trees, in walk order
+//	error      - ErrInvalidPrefixTree if the other tree is not a IPv6 prefix tree,
+//	             error from the lock functions, if any
+func (v6t *V6Tree[T]) Diff(ctx context.Context, other PrefixTree[T], equalFn EqualFn[T]) (*ChangeSet[T], error) {
+	o, ok := other.(*V6Tree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	changes, err := Diff(ctx, v6t.tree, o.tree, equalFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return toChangeSet(changes, v6t.keyOf), nil
+}
+
+// Applies differences returned by Diff() to the IPv6 prefix tree atomically. See
+// Tree.ApplyDiff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	changes - changes to apply
+//
+// Returns:
+//
+//	error - error if any. The tree is left alone on error.
+func (v6t *V6Tree[T]) ApplyDiff(ctx context.Context, changes *ChangeSet[T]) error {
+	return applyChangeSet(ctx, v6t.tree, changes, v6t.keyParser())
+}
+
+// Returns the differences between the strings tree and a newer version of it.
+// See Diff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	other   - newer version of the tree
+//	equalFn - reports whether two values are equal
+//
+// Returns:
+//
+//	*ChangeSet - differences between the trees, in walk order
+//	error      - ErrInvalidPrefixTree if the other tree is not a strings tree,
+//	             error from the lock functions, if any
+func (st *StringsTree[T]) Diff(ctx context.Context, other PrefixTree[T], equalFn EqualFn[T]) (*ChangeSet[T], error) {
+	o, ok := other.(*StringsTree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	changes, err := Diff(ctx, st.tree, o.tree, equalFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return toChangeSet(changes, st.keyOf), nil
+}
+
+// Applies differences returned by Diff() to the strings tree atomically. See
+// Tree.ApplyDiff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	changes - changes to apply
+//
+// Returns:
+//
+//	error - error if any. The tree is left alone on error.
+func (st *StringsTree[T]) ApplyDiff(ctx context.Context, changes *ChangeSet[T]) error {
+	return applyChangeSet(ctx, st.tree, changes, st.keyParser())
+}
+
+// Returns the differences between the reversed strings tree and a newer version of
+// it. See Diff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	other   - newer version of the tree
+//	equalFn - reports whether two values are equal
+//
+// Returns:
+//
+//	*ChangeSet - differences between the trees, in walk order
+//	error      - ErrInvalidPrefixTree if the other tree is not a reversed strings
+//	             tree, error from the lock functions, if any
+func (rst *ReversedStringsTree[T]) Diff(ctx context.Context, other PrefixTree[T], equalFn EqualFn[T]) (*ChangeSet[T], error) {
+	o, ok := other.(*ReversedStringsTree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	changes, err := Diff(ctx, rst.tree, o.tree, equalFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return toChangeSet(changes, rst.keyOf), nil
+}
+
+// Applies differences returned by Diff() to the reversed strings tree atomically.
+// See Tree.ApplyDiff().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	changes - changes to apply
+//
+// Returns:
+//
+//	error - error if any. The tree is left alone on error.
+func (rst *ReversedStringsTree[T]) ApplyDiff(ctx context.Context, changes *ChangeSet[T]) error {
+	return applyChangeSet(ctx, rst.tree, changes, rst.keyParser())
+}
@@ -0,0 +1,296 @@
+package prefix_tree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	newTrees := map[string]func() *Tree[int]{
+		"Binary":     func() *Tree[int] { return NewTree[int]() },
+		"Compressed": func() *Tree[int] { return NewCompressedTree[int]() },
+		"RCU":        func() *Tree[int] { return NewRCUTree[int]() },
+		"Stride4":    func() *Tree[int] { return NewTree[int](WithStride(4)) },
+		"Arena":      func() *Tree[int] { return NewArenaTree[int]() },
+	}
+
+	randomKey := func() ([]byte, []byte) {
+		keyLen := 2
+		if random.Intn(4) == 0 {
+			keyLen = 12
+		}
+
+		key := make([]byte, keyLen)
+		for i := range key {
+			key[i] = byte(random.Intn(4)) << 6
+		}
+
+		return key, newTreeEntry(make([]byte, keyLen), 1+random.Intn(keyLen*8), 0).Mask
+	}
+
+	equalFn := func(a, b int) bool {
+		return a == b
+	}
+
+	for oldName, newOld := range newTrees {
+		for newName, newNew := range newTrees {
+			t.Run(oldName+"/"+newName, func(t *testing.T) {
+				old, updated := newOld(), newNew()
+				for i := 0; i < 300; i++ {
+					key, mask := randomKey()
+					value := random.Intn(3)
+
+					old.Insert(ctx, key, mask, value)
+					switch random.Intn(4) {
+					case 0:
+						// Removed
+					case 1:
+						updated.Insert(ctx, key, mask, value+1)
+					default:
+						updated.Insert(ctx, key, mask, value)
+					}
+
+					if 0 == random.Intn(4) {
+						key, mask := randomKey()
+						updated.Insert(ctx, key, mask, random.Intn(3))
+					}
+				}
+
+				oldEntries, newEntries := treeEntries(old), treeEntries(updated)
+
+				changes, err := Diff(ctx, old, updated, equalFn)
+				if err != nil {
+					t.Fatalf("Diff failed: %v", err)
+				}
+
+				// The changes are in walk order and account for every entry
+				inOld, inNew := map[string]int{}, map[string]int{}
+				for _, entry := range oldEntries {
+					inOld[fmt.Sprint(entry.Key, entry.Mask)] = entry.Value
+				}
+				for _, entry := range newEntries {
+					inNew[fmt.Sprint(entry.Key, entry.Mask)] = entry.Value
+				}
+
+				expected := &TreeChangeSet[int]{}
+				for _, entry := range oldEntries {
+					value, ok := inNew[fmt.Sprint(entry.Key, entry.Mask)]
+					if !ok {
+						expected.Removed = append(expected.Removed, entry)
+					} else if value != entry.Value {
+						expected.Changed = append(expected.Changed, TreeChange[int]{Key: entry.Key, Mask: entry.Mask, Old: entry.Value, New: value})
+					}
+				}
+				for _, entry := range newEntries {
+					if _, ok := inOld[fmt.Sprint(entry.Key, entry.Mask)]; !ok {
+						expected.Added = append(expected.Added, entry)
+					}
+				}
+
+				if fmt.Sprint(expected) != fmt.Sprint(changes) {
+					t.Fatalf("unexpected changes:\n%v\n%v", expected, changes)
+				}
+
+				if changes, _ := Diff(ctx, updated, updated, equalFn); !changes.IsEmpty() {
+					t.Fatalf("expected no changes between a tree and itself, got %v", changes)
+				}
+
+				// Applying the changes to the old tree results in the new tree
+				if err := old.ApplyDiff(ctx, changes); err != nil {
+					t.Fatalf("ApplyDiff failed: %v", err)
+				}
+
+				if actual := treeEntries(old); fmt.Sprint(newEntries) != fmt.Sprint(actual) || old.numNodes != updated.numNodes {
+					t.Fatalf("unexpected entries after ApplyDiff:\n%v\n%v", newEntries, actual)
+				}
+			})
+		}
+	}
+}
+
+func TestTree_ApplyDiff(t *testing.T) {
+	ctx := context.Background()
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+
+	tr := NewRCUTree[int]()
+	tr.Insert(ctx, []byte{10, 1, 0, 0}, mask, 1)
+	tr.Insert(ctx, []byte{10, 2, 0, 0}, mask, 2)
+
+	expected := fmt.Sprint(treeEntries(tr))
+	snapshot, _ := tr.Snapshot(ctx)
+
+	entry := func(b byte, value int) TreeEntry[int] {
+		return TreeEntry[int]{Key: []byte{10, b, 0, 0}, Mask: mask, Value: value}
+	}
+	change := func(b byte, value int) TreeChange[int] {
+		return TreeChange[int]{Key: []byte{10, b, 0, 0}, Mask: mask, New: value}
+	}
+
+	// Every change is checked before any is applied
+	tests := []struct {
+		name    string
+		changes TreeChangeSet[int]
+		err     error
+	}{
+		{"RemovedNotFound", TreeChangeSet[int]{Added: []TreeEntry[int]{entry(3, 3)}, Removed: []TreeEntry[int]{entry(1, 1), entry(4, 4)}}, ErrKeyNotFound},
+		{"ChangedNotFound", TreeChangeSet[int]{Removed: []TreeEntry[int]{entry(1, 1)}, Changed: []TreeChange[int]{change(4, 4)}}, ErrKeyNotFound},
+		{"AddedFound", TreeChangeSet[int]{Removed: []TreeEntry[int]{entry(1, 1)}, Added: []TreeEntry[int]{entry(3, 3), entry(2, 2)}}, ErrDuplicateKey},
+		{"RemovedAndChanged", TreeChangeSet[int]{Removed: []TreeEntry[int]{entry(1, 1)}, Changed: []TreeChange[int]{change(1, 2)}}, ErrDuplicateKey},
+		{"RemovedAndAdded", TreeChangeSet[int]{Removed: []TreeEntry[int]{entry(1, 1)}, Added: []TreeEntry[int]{entry(1, 2)}}, ErrDuplicateKey},
+		{"InvalidMask", TreeChangeSet[int]{Removed: []TreeEntry[int]{entry(1, 1)}, Added: []TreeEntry[int]{{Key: []byte{10}, Mask: mask}}}, ErrInvalidKeyMask},
+	}
+
+	for _, tt := range tests {
+		if err := tr.ApplyDiff(ctx, &tt.changes); !errors.Is(err, tt.err) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+
+		if actual := fmt.Sprint(treeEntries(tr)); expected != actual || tr.numNodes != 2 {
+			t.Fatalf("%s: tree changed by a failed ApplyDiff:\n%v\n%v", tt.name, expected, actual)
+		}
+	}
+
+	changes := &TreeChangeSet[int]{
+		Added:   []TreeEntry[int]{entry(3, 3)},
+		Removed: []TreeEntry[int]{entry(1, 1)},
+		Changed: []TreeChange[int]{change(2, 4)},
+	}
+	if err := tr.ApplyDiff(ctx, changes); err != nil {
+		t.Fatalf("ApplyDiff failed: %v", err)
+	}
+
+	if expected, actual := fmt.Sprint([]TreeEntry[int]{newTreeEntry([]byte{10, 2}, 16, 4), newTreeEntry([]byte{10, 3}, 16, 3)}), fmt.Sprint(treeEntries(tr)); expected != actual {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+
+	// Snapshots never see the changes
+	if actual := fmt.Sprint(treeEntries(snapshot)); expected != actual {
+		t.Fatalf("snapshot changed by ApplyDiff:\n%v\n%v", expected, actual)
+	}
+	if err := snapshot.ApplyDiff(ctx, changes); err != ErrReadOnly {
+		t.Fatalf("expected %v, got %v", ErrReadOnly, err)
+	}
+
+	if _, err := Diff(ctx, tr, snapshot, nil); err != ErrNoEqualFunction {
+		t.Fatalf("expected %v, got %v", ErrNoEqualFunction, err)
+	}
+}
+
+func TestTree_ApplyDiffInsertError(t *testing.T) {
+	ctx := context.Background()
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+
+	tr := NewArenaTree[int]()
+	for b := byte(1); b <= 4; b++ {
+		tr.Insert(ctx, []byte{10, b, 0, 0}, mask, int(b))
+	}
+
+	// Leaves the arena with only the nodes freed by the delete
+	tr.Delete(ctx, []byte{10, 4, 0, 0}, mask)
+	tr.layout.(*arenaLayout[int]).used = maxArenaNodes
+
+	expected := fmt.Sprint(treeEntries(tr))
+
+	// The first insert fits in the free nodes, the second does not
+	changes := &TreeChangeSet[int]{
+		Added: []TreeEntry[int]{
+			{Key: []byte{10, 3, 0, 0}, Mask: []byte{0xFF, 0xFF, 0x80, 0x00}, Value: 5},
+			{Key: []byte{192, 168, 0, 0}, Mask: mask, Value: 6},
+		},
+		Removed: []TreeEntry[int]{{Key: []byte{10, 1, 0, 0}, Mask: mask, Value: 1}},
+		Changed: []TreeChange[int]{{Key: []byte{10, 2, 0, 0}, Mask: mask, Old: 2, New: 7}},
+	}
+
+	if err := tr.ApplyDiff(ctx, changes); err != ErrInsertFailed {
+		t.Fatalf("expected %v, got %v", ErrInsertFailed, err)
+	}
+
+	if actual := fmt.Sprint(treeEntries(tr)); expected != actual || tr.numNodes != 3 {
+		t.Fatalf("tree changed by a failed ApplyDiff:\n%v\n%v", expected, actual)
+	}
+}
+
+func TestV4Tree_Diff(t *testing.T) {
+	ctx := context.Background()
+
+	live := NewV4Tree[string]()
+	live.Insert(ctx, "10.0.0.0/8", "private")
+	live.Insert(ctx, "10.1.0.0/16", "lab")
+	live.Insert(ctx, "192.168.0.0/16", "home")
+
+	latest := NewV4Tree[string]()
+	latest.Insert(ctx, "10.0.0.0/8", "private")
+	latest.Insert(ctx, "10.1.0.0/16", "staging")
+	latest.Insert(ctx, "10.1.2.0/24", "build")
+	latest.Insert(ctx, "172.16.0.0/12", "vpn")
+
+	equalFn := func(a, b string) bool {
+		return a == b
+	}
+
+	changes, err := live.Diff(ctx, latest, equalFn)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+
+	expected := "&{[{10.1.2.0/24 build} {172.16.0.0/12 vpn}] [{192.168.0.0/16 home}] [{10.1.0.0/16 lab staging}]}"
+	if actual := fmt.Sprint(changes); expected != actual {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+
+	if err := live.ApplyDiff(ctx, changes); err != nil {
+		t.Fatalf("ApplyDiff failed: %v", err)
+	}
+
+	if changes, _ := live.Diff(ctx, latest, equalFn); !changes.IsEmpty() {
+		t.Fatalf("expected no changes after ApplyDiff, got %v", changes)
+	}
+
+	// Keys are parsed before anything is applied
+	changes = &ChangeSet[string]{
+		Removed: []Entry[string]{{Key: "10.0.0.0/8"}},
+		Added:   []Entry[string]{{Key: "10.0.0.0/33"}},
+	}
+	if err := live.ApplyDiff(ctx, changes); err == nil || live.GetNodesCount() != 4 {
+		t.Fatalf("expected an error and no changes, got %v", err)
+	}
+
+	if _, err := live.Diff(ctx, NewV6Tree[string](), equalFn); err != ErrInvalidPrefixTree {
+		t.Fatalf("expected %v, got %v", ErrInvalidPrefixTree, err)
+	}
+}
+
+func TestReversedStringsTree_Diff(t *testing.T) {
+	ctx := context.Background()
+
+	live := NewReversedStringsTree[int]()
+	live.Insert(ctx, "google.com", 1)
+	live.Insert(ctx, "mail.google.com", 2)
+
+	latest := NewReversedStringsTree[int]()
+	latest.Insert(ctx, "google.com", 1)
+	latest.Insert(ctx, "drive.google.com", 3)
+
+	changes, err := live.Diff(ctx, latest, func(a, b int) bool { return a == b })
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+
+	if expected, actual := "&{[{drive.google.com 3}] [{mail.google.com 2}] []}", fmt.Sprint(changes); expected != actual {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+
+	if err := live.ApplyDiff(ctx, changes); err != nil {
+		t.Fatalf("ApplyDiff failed: %v", err)
+	}
+
+	if expected, actual := fmt.Sprint(walkOutput(latest)), fmt.Sprint(walkOutput(live)); expected != actual {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,530 @@
+package prefix_tree
+
+// Binary encoding of a tree. Used by MarshalBinary(), UnmarshalBinary(), WriteTo() and
+// ReadFrom(). The encoding is versioned and checksummed:
+//
+//	magic    4 bytes, "PFXT"
+//	version  1 byte, encodingVersion
+//	kind     1 byte, kind of tree that wrote the encoding, see treeKind
+//	entries  one per entry in walk order:
+//	           plen    uvarint, prefix length in bits
+//	           key     (plen+7)/8 bytes, bits past the prefix length are 0
+//	           length  uvarint, length of the value
+//	           value   length bytes, as encoded by the value codec of the tree
+//	count    8 bytes, number of entries, little endian
+//	checksum 4 bytes, CRC-32C of everything before, little endian
+//
+// Only the key bits covered by the prefix are stored, so the encoding does not depend
+// on the layout of the tree. An encoding written by a stride tree can be read by a
+// path compressed tree and so on. Decoding inserts the key bits directly, with no
+// string parsing, which is much faster than inserting the keys from text.
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Version of the binary encoding written. Decoding fails for other versions.
+const encodingVersion = 1
+
+// Magic bytes at the start of an encoding
+var encodingMagic = [4]byte{'P', 'F', 'X', 'T'}
+
+const (
+	encodingHeaderLen  = len(encodingMagic) + 2 // magic, version and kind
+	encodingTrailerLen = 8 + 4                  // count and checksum
+
+	// Longest key accepted when decoding a tree without a fixed key length
+	maxEncodedKeyLen = 1 << 16
+
+	// Size at which encoded entries are flushed to the writer
+	encodingBufSize = 64 << 10
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Kind of tree that wrote an encoding. A tree only decodes the encodings written by
+// the same kind of tree, e.g. a V4Tree does not decode the encoding of a StringsTree.
+type treeKind uint8
+
+const (
+	kindTree treeKind = iota
+	kindV4
+	kindV6
+	kindStrings
+	kindReversedStrings
+)
+
+// Encodes the values stored in a tree and decodes them back. Set with WithValueCodec().
+// Trees without a codec of their own use the default codec, which encodes strings,
+// byte slices, booleans and numbers directly, uses MarshalBinary()/UnmarshalBinary()
+// for types that implement encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+// and encoding/gob for anything else.
+type ValueCodec[T any] interface {
+	// Appends the encoding of the value to the buffer and returns the extended buffer
+	AppendValue(buf []byte, value T) ([]byte, error)
+
+	// Decodes a value. The data is only valid for the duration of the call.
+	DecodeValue(data []byte) (T, error)
+}
+
+// Default value codec
+type defaultValueCodec[T any] struct{}
+
+func (defaultValueCodec[T]) AppendValue(buf []byte, value T) ([]byte, error) {
+	// The value type of the tree decides the encoding rather than the dynamic type
+	// of the value. The zero value of an interface type is nil.
+	var zero T
+	if nil != any(zero) {
+		switch v := any(value).(type) {
+		case string:
+			return append(buf, v...), nil
+		case []byte:
+			return append(buf, v...), nil
+		case bool:
+			if v {
+				return append(buf, 1), nil
+			}
+			return append(buf, 0), nil
+		case int:
+			return binary.AppendVarint(buf, int64(v)), nil
+		case int8:
+			return binary.AppendVarint(buf, int64(v)), nil
+		case int16:
+			return binary.AppendVarint(buf, int64(v)), nil
+		case int32:
+			return binary.AppendVarint(buf, int64(v)), nil
+		case int64:
+			return binary.AppendVarint(buf, v), nil
+		case uint:
+			return binary.AppendUvarint(buf, uint64(v)), nil
+		case uint8:
+			return binary.AppendUvarint(buf, uint64(v)), nil
+		case uint16:
+			return binary.AppendUvarint(buf, uint64(v)), nil
+		case uint32:
+			return binary.AppendUvarint(buf, uint64(v)), nil
+		case uint64:
+			return binary.AppendUvarint(buf, v), nil
+		case float32:
+			return binary.LittleEndian.AppendUint32(buf, math.Float32bits(v)), nil
+		case float64:
+			return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v)), nil
+		}
+
+		// Only used if the value can be decoded the same way
+		if _, ok := any((*T)(nil)).(encoding.BinaryUnmarshaler); ok {
+			if m, ok := any(value).(encoding.BinaryMarshaler); ok {
+				data, err := m.MarshalBinary()
+				if nil != err {
+					return buf, err
+				}
+				return append(buf, data...), nil
+			}
+		}
+	}
+
+	var gobBuf bytes.Buffer
+	if err := gob.NewEncoder(&gobBuf).Encode(value); nil != err {
+		return buf, err
+	}
+
+	return append(buf, gobBuf.Bytes()...), nil
+}
+
+func (defaultValueCodec[T]) DecodeValue(data []byte) (T, error) {
+	var value T
+
+	// Same as AppendValue()
+	if nil != any(value) {
+		switch any(value).(type) {
+		case string:
+			return any(string(data)).(T), nil
+		case []byte:
+			return any(append([]byte{}, data...)).(T), nil
+		case bool:
+			if 1 != len(data) || data[0] > 1 {
+				return value, ErrInvalidEncoding
+			}
+			return any(1 == data[0]).(T), nil
+		case int:
+			n, err := decodeVarint(data, 64)
+			return any(int(n)).(T), err
+		case int8:
+			n, err := decodeVarint(data, 8)
+			return any(int8(n)).(T), err
+		case int16:
+			n, err := decodeVarint(data, 16)
+			return any(int16(n)).(T), err
+		case int32:
+			n, err := decodeVarint(data, 32)
+			return any(int32(n)).(T), err
+		case int64:
+			n, err := decodeVarint(data, 64)
+			return any(n).(T), err
+		case uint:
+			n, err := decodeUvarint(data, 64)
+			return any(uint(n)).(T), err
+		case uint8:
+			n, err := decodeUvarint(data, 8)
+			return any(uint8(n)).(T), err
+		case uint16:
+			n, err := decodeUvarint(data, 16)
+			return any(uint16(n)).(T), err
+		case uint32:
+			n, err := decodeUvarint(data, 32)
+			return any(uint32(n)).(T), err
+		case uint64:
+			n, err := decodeUvarint(data, 64)
+			return any(n).(T), err
+		case float32:
+			if 4 != len(data) {
+				return value, ErrInvalidEncoding
+			}
+			return any(math.Float32frombits(binary.LittleEndian.Uint32(data))).(T), nil
+		case float64:
+			if 8 != len(data) {
+				return value, ErrInvalidEncoding
+			}
+			return any(math.Float64frombits(binary.LittleEndian.Uint64(data))).(T), nil
+		}
+
+		if _, ok := any(value).(encoding.BinaryMarshaler); ok {
+			if _, ok := any((*T)(nil)).(encoding.BinaryUnmarshaler); ok {
+				return unmarshalValue[T](data)
+			}
+		}
+	}
+
+	return gobDecodeValue[T](data)
+}
+
+// Decodes a value with its UnmarshalBinary() method. Kept apart from DecodeValue()
+// since the value escapes to the heap.
+func unmarshalValue[T any](data []byte) (T, error) {
+	var value T
+	err := any(&value).(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	return value, err
+}
+
+// Decodes a value encoded by encoding/gob
+func gobDecodeValue[T any](data []byte) (T, error) {
+	var value T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// Decodes a signed varint that takes all of data and fits in the given number of bits
+func decodeVarint(data []byte, size int) (int64, error) {
+	n, l := binary.Varint(data)
+	if l != len(data) || (size < 64 && (n < -1<<(size-1) || n >= 1<<(size-1))) {
+		return 0, ErrInvalidEncoding
+	}
+
+	return n, nil
+}
+
+// Decodes an unsigned varint that takes all of data and fits in the given number of bits
+func decodeUvarint(data []byte, size int) (uint64, error) {
+	n, l := binary.Uvarint(data)
+	if l != len(data) || (size < 64 && n >= 1<<size) {
+		return 0, ErrInvalidEncoding
+	}
+
+	return n, nil
+}
+
+// Returns the value codec of the tree
+// Returns:
+//
+//	ValueCodec - codec set with WithValueCodec(), or the default codec
+//	error      - ErrInvalidValueCodec if the codec set is for another value type
+func (t *Tree[T]) valueCodec() (ValueCodec[T], error) {
+	if nil == t.codec {
+		return defaultValueCodec[T]{}, nil
+	}
+
+	codec, ok := t.codec.(ValueCodec[T])
+	if !ok {
+		return nil, ErrInvalidValueCodec
+	}
+
+	return codec, nil
+}
+
+// Writes the encoding of a tree, flushing it to the writer as it grows
+type treeEncoder struct {
+	w     io.Writer
+	buf   []byte // encoded entries not flushed yet
+	value []byte // encoding of the current value
+	crc   uint32
+	n     int64 // number of bytes written
+}
+
+func (e *treeEncoder) flush() error {
+	e.crc = crc32.Update(e.crc, crc32c, e.buf)
+
+	n, err := e.w.Write(e.buf)
+	e.n += int64(n)
+	e.buf = e.buf[:0]
+
+	return err
+}
+
+// Writes the binary encoding of the tree. Will read lock the tree while walking it.
+// Arguments:
+//
+//	ctx  - context for the lock functions and the walk
+//	w    - writer to write to
+//	kind - kind of tree written
+//
+// Returns:
+//
+//	int64 - number of bytes written
+//	error - error if any
+func (t *Tree[T]) writeTo(ctx context.Context, w io.Writer, kind treeKind) (int64, error) {
+	codec, err := t.valueCodec()
+	if nil != err {
+		return 0, err
+	}
+
+	e := &treeEncoder{
+		w:   w,
+		buf: make([]byte, 0, encodingBufSize),
+	}
+
+	e.buf = append(e.buf, encodingMagic[:]...)
+	e.buf = append(e.buf, encodingVersion, byte(kind))
+
+	var count uint64
+	err = t.walk(ctx, nil, 0, func(key []byte, plen int, value T) error {
+		e.buf = binary.AppendUvarint(e.buf, uint64(plen))
+		e.buf = append(e.buf, key[:(plen+7)/8]...)
+
+		// Clear the bits past the prefix length
+		if 0 != plen%8 {
+			e.buf[len(e.buf)-1] &= byte(0xFF << (8 - plen%8))
+		}
+
+		// The length of the value goes first, so the value is encoded on the side
+		var err error
+		e.value, err = codec.AppendValue(e.value[:0], value)
+		if nil != err {
+			return err
+		}
+
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(e.value)))
+		e.buf = append(e.buf, e.value...)
+
+		count++
+		if len(e.buf) >= encodingBufSize {
+			return e.flush()
+		}
+
+		return nil
+	})
+	if nil != err {
+		return e.n, err
+	}
+
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, count)
+	e.crc = crc32.Update(e.crc, crc32c, e.buf)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, e.crc)
+
+	n, err := e.w.Write(e.buf)
+	e.n += int64(n)
+
+	return e.n, err
+}
+
+// Returns the binary encoding of the tree
+// Arguments:
+//
+//	kind - kind of tree written
+//
+// Returns:
+//
+//	[]byte - encoding of the tree
+//	error  - error if any
+func (t *Tree[T]) marshal(kind treeKind) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := t.writeTo(context.Background(), &buf, kind); nil != err {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Replaces the contents of the tree with the entries of a binary encoding. The
+// encoding is verified and decoded into a new layout first, then swapped in under
+// the write lock, so the tree is left alone if the encoding is invalid.
+// Arguments:
+//
+//	data    - binary encoding
+//	kind    - kind of tree expected
+//	maxPlen - largest prefix length accepted in bits
+//
+// Returns:
+//
+//	error - ErrInvalidEncoding, ErrUnsupportedVersion, ErrChecksumMismatch or other
+//	        error if any
+func (t *Tree[T]) unmarshal(data []byte, kind treeKind, maxPlen int) error {
+	ctx := context.Background()
+
+	if t.readOnly {
+		return ErrReadOnly
+	}
+
+	codec, err := t.valueCodec()
+	if nil != err {
+		return err
+	}
+
+	if len(data) < encodingHeaderLen+encodingTrailerLen || !bytes.Equal(data[:len(encodingMagic)], encodingMagic[:]) {
+		return ErrInvalidEncoding
+	}
+
+	if encodingVersion != data[len(encodingMagic)] {
+		return fmt.Errorf("%w %d", ErrUnsupportedVersion, data[len(encodingMagic)])
+	}
+
+	if kind != treeKind(data[len(encodingMagic)+1]) {
+		return ErrInvalidEncoding
+	}
+
+	checksumAt := len(data) - 4
+	if crc32.Checksum(data[:checksumAt], crc32c) != binary.LittleEndian.Uint32(data[checksumAt:]) {
+		return ErrChecksumMismatch
+	}
+
+	count := binary.LittleEndian.Uint64(data[checksumAt-8:])
+	entries := data[encodingHeaderLen : checksumAt-8]
+
+	layout, err := t.emptyLayout(ctx)
+	if nil != err {
+		return err
+	}
+
+	var decoded uint64
+	for len(entries) > 0 {
+		plen, l := binary.Uvarint(entries)
+		if l <= 0 || 0 == plen || plen > uint64(maxPlen) {
+			return ErrInvalidEncoding
+		}
+		entries = entries[l:]
+
+		keyLen := int(plen+7) / 8
+		if len(entries) < keyLen {
+			return ErrInvalidEncoding
+		}
+		key := entries[:keyLen]
+		entries = entries[keyLen:]
+
+		valueLen, l := binary.Uvarint(entries)
+		if l <= 0 || valueLen > uint64(len(entries)-l) {
+			return ErrInvalidEncoding
+		}
+		entries = entries[l:]
+
+		value, err := codec.DecodeValue(entries[:valueLen])
+		if nil != err {
+			return err
+		}
+		entries = entries[valueLen:]
+
+		// Every key is stored once
+		if result, err := layout.insert(key, int(plen), value); Ok != result {
+			if nil == err {
+				err = ErrInvalidEncoding
+			}
+			return err
+		}
+
+		decoded++
+	}
+
+	if decoded != count {
+		return ErrInvalidEncoding
+	}
+
+	return t.swapLayout(ctx, layout, count)
+}
+
+// Replaces the contents of the tree with the binary encoding read from a reader.
+// Reads until EOF.
+// Arguments:
+//
+//	r       - reader to read from
+//	kind    - kind of tree expected
+//	maxPlen - largest prefix length accepted in bits
+//
+// Returns:
+//
+//	int64 - number of bytes read
+//	error - error if any
+func (t *Tree[T]) readFrom(r io.Reader, kind treeKind, maxPlen int) (int64, error) {
+	data, err := io.ReadAll(r)
+	if nil != err {
+		return int64(len(data)), err
+	}
+
+	return int64(len(data)), t.unmarshal(data, kind, maxPlen)
+}
+
+// Returns the binary encoding of the tree. Implements encoding.BinaryMarshaler. Values
+// are encoded by the value codec of the tree, see WithValueCodec().
+// Returns:
+//
+//	[]byte - encoding of the tree
+//	error  - error if any
+func (t *Tree[T]) MarshalBinary() ([]byte, error) {
+	return t.marshal(kindTree)
+}
+
+// Replaces the contents of the tree with the entries of an encoding returned by
+// MarshalBinary(). Implements encoding.BinaryUnmarshaler. The tree is left alone if
+// the encoding is invalid.
+// Arguments:
+//
+//	data - binary encoding
+//
+// Returns:
+//
+//	error - error if any
+func (t *Tree[T]) UnmarshalBinary(data []byte) error {
+	return t.unmarshal(data, kindTree, maxEncodedKeyLen*8)
+}
+
+// Writes the binary encoding of the tree. Implements io.WriterTo. See MarshalBinary().
+// Arguments:
+//
+//	w - writer to write to
+//
+// Returns:
+//
+//	int64 - number of bytes written
+//	error - error if any
+func (t *Tree[T]) WriteTo(w io.Writer) (int64, error) {
+	return t.writeTo(context.Background(), w, kindTree)
+}
+
+// Replaces the contents of the tree with the binary encoding read from a reader. Reads
+// until EOF. Implements io.ReaderFrom. See UnmarshalBinary().
+// Arguments:
+//
+//	r - reader to read from
+//
+// Returns:
+//
+//	int64 - number of bytes read
+//	error - error if any
+func (t *Tree[T]) ReadFrom(r io.Reader) (int64, error) {
+	return t.readFrom(r, kindTree, maxEncodedKeyLen*8)
+}
@@ -0,0 +1,341 @@
+package prefix_tree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTree_MarshalBinary(t *testing.T) {
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	newTrees := map[string]func() *Tree[int]{
+		"Binary":     func() *Tree[int] { return NewTree[int]() },
+		"Compressed": func() *Tree[int] { return NewCompressedTree[int]() },
+		"Persistent": func() *Tree[int] { return NewPersistentTree[int]() },
+		"RCU":        func() *Tree[int] { return NewRCUTree[int]() },
+		"Stride4":    func() *Tree[int] { return NewTree[int](WithStride(4)) },
+		"Stride8":    func() *Tree[int] { return NewTree[int](WithStride(8)) },
+	}
+
+	source := NewTree[int]()
+	for i := 0; i < 2048; i++ {
+		plen := 1 + random.Intn(32)
+		key := []byte{byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256))}
+		mask := make([]byte, 4)
+		setMask(mask, plen)
+		source.Insert(ctx, key, mask, random.Intn(1<<20)-1<<19)
+	}
+
+	data, err := source.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	expected := fmt.Sprint(treeEntries(source))
+
+	// The encoding does not depend on the layout
+	for name, newTree := range newTrees {
+		t.Run(name, func(t *testing.T) {
+			tr := newTree()
+			tr.Insert(ctx, []byte{1, 2, 3, 4}, []byte{0xFF, 0xFF, 0xFF, 0xFF}, 1)
+
+			if err := tr.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary failed: %v", err)
+			}
+			if tr.numNodes != source.numNodes || fmt.Sprint(treeEntries(tr)) != expected {
+				t.Fatalf("unexpected entries after UnmarshalBinary")
+			}
+
+			var buf bytes.Buffer
+			if n, err := tr.WriteTo(&buf); err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+				t.Fatalf("WriteTo: unexpected encoding %d %v", n, err)
+			}
+
+			decoded := newTree()
+			if n, err := decoded.ReadFrom(&buf); err != nil || n != int64(len(data)) {
+				t.Fatalf("ReadFrom failed: %d %v", n, err)
+			}
+			if fmt.Sprint(treeEntries(decoded)) != expected {
+				t.Fatalf("unexpected entries after ReadFrom")
+			}
+
+			// The decoded tree works as usual
+			if res, err := decoded.Insert(ctx, []byte{1, 2, 3, 4}, []byte{0xFF, 0xFF, 0xFF, 0xFF}, 1); err != nil || (res != Ok && res != Dup) {
+				t.Fatalf("Insert after decoding failed: %v %v", res, err)
+			}
+		})
+	}
+
+	// An empty tree
+	data, err = NewTree[int]().MarshalBinary()
+	if err != nil || len(data) != encodingHeaderLen+encodingTrailerLen {
+		t.Fatalf("MarshalBinary of an empty tree: %v %v", data, err)
+	}
+
+	tr := NewTree[int]()
+	tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}, 1)
+	if err := tr.UnmarshalBinary(data); err != nil || !tr.IsEmpty() {
+		t.Fatalf("UnmarshalBinary of an empty tree: %v %d", err, tr.numNodes)
+	}
+}
+
+// Returns the encoding with a valid checksum for the modified contents
+func rechecksum(data []byte) []byte {
+	at := len(data) - 4
+	binary.LittleEndian.PutUint32(data[at:], crc32.Checksum(data[:at], crc32.MakeTable(crc32.Castagnoli)))
+	return data
+}
+
+func TestTree_UnmarshalBinaryInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	source := NewTree[string]()
+	source.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}, "a")
+	source.Insert(ctx, []byte{10, 1, 0, 0}, []byte{0xFF, 0xFF, 0, 0}, "b")
+
+	data, err := source.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	modified := func(fn func([]byte) []byte) []byte {
+		return fn(append([]byte{}, data...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"Empty", []byte{}, ErrInvalidEncoding},
+		{"Truncated", data[:len(data)-1], ErrChecksumMismatch},
+		{"Magic", modified(func(d []byte) []byte { d[0] = 'X'; return rechecksum(d) }), ErrInvalidEncoding},
+		{"Version", modified(func(d []byte) []byte { d[4] = 2; return rechecksum(d) }), ErrUnsupportedVersion},
+		{"Kind", modified(func(d []byte) []byte { d[5] = byte(kindV4); return rechecksum(d) }), ErrInvalidEncoding},
+		{"Corrupted", modified(func(d []byte) []byte { d[encodingHeaderLen+1] ^= 0x01; return d }), ErrChecksumMismatch},
+		{"Count", modified(func(d []byte) []byte { d[len(d)-12] = 3; return rechecksum(d) }), ErrInvalidEncoding},
+		{"PrefixLen", modified(func(d []byte) []byte { d[encodingHeaderLen] = 0; return rechecksum(d) }), ErrInvalidEncoding},
+		{"Duplicate", rechecksum(append(append(append([]byte{}, data[:encodingHeaderLen]...),
+			bytes.Repeat(data[encodingHeaderLen:encodingHeaderLen+4], 2)...), 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)), ErrInvalidEncoding},
+	}
+
+	for _, tt := range tests {
+		tr := NewTree[string]()
+		tr.Insert(ctx, []byte{192, 168, 0, 0}, []byte{0xFF, 0xFF, 0, 0}, "c")
+
+		if err := tr.UnmarshalBinary(tt.data); !errors.Is(err, tt.err) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+
+		// The tree is left alone
+		if res, v, err := tr.Search(ctx, []byte{192, 168, 0, 0}, []byte{0xFF, 0xFF, 0, 0}, Exact); err != nil || res != Match || v != "c" || tr.numNodes != 1 {
+			t.Fatalf("%s: tree changed by a failed UnmarshalBinary", tt.name)
+		}
+	}
+
+	// Snapshots cannot be replaced
+	snapshot, _ := source.Snapshot(ctx)
+	if err := snapshot.UnmarshalBinary(data); err != ErrReadOnly {
+		t.Fatalf("expected %v, got %v", ErrReadOnly, err)
+	}
+}
+
+type testPoint struct {
+	X, Y int
+}
+
+// Encodes the values as JSON
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) AppendValue(buf []byte, value T) ([]byte, error) {
+	data, err := json.Marshal(value)
+	return append(buf, data...), err
+}
+
+func (jsonCodec[T]) DecodeValue(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+func TestValueCodec(t *testing.T) {
+	ctx := context.Background()
+	key := []byte{10, 0, 0, 0}
+	mask := []byte{0xFF, 0, 0, 0}
+
+	roundTrip := func(t *testing.T, src, dst interface {
+		MarshalBinary() ([]byte, error)
+		UnmarshalBinary([]byte) error
+	}) {
+		data, err := src.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %v", err)
+		}
+		if err := dst.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary failed: %v", err)
+		}
+	}
+
+	// Structs go through encoding/gob by default
+	points := NewTree[testPoint]()
+	points.Insert(ctx, key, mask, testPoint{X: 1, Y: -2})
+	decodedPoints := NewTree[testPoint]()
+	roundTrip(t, points, decodedPoints)
+	if _, v, _ := decodedPoints.Search(ctx, key, mask, Exact); v != (testPoint{X: 1, Y: -2}) {
+		t.Fatalf("unexpected point %v", v)
+	}
+
+	// Or through a codec of their own
+	jsonPoints := NewTree[testPoint](WithValueCodec[testPoint](jsonCodec[testPoint]{}))
+	jsonPoints.Insert(ctx, key, mask, testPoint{X: 3, Y: 4})
+	data, _ := jsonPoints.MarshalBinary()
+	if !bytes.Contains(data, []byte(`{"X":3,"Y":4}`)) {
+		t.Fatalf("expected the JSON codec to be used")
+	}
+	decodedPoints = NewTree[testPoint](WithValueCodec[testPoint](jsonCodec[testPoint]{}))
+	roundTrip(t, jsonPoints, decodedPoints)
+	if _, v, _ := decodedPoints.Search(ctx, key, mask, Exact); v != (testPoint{X: 3, Y: 4}) {
+		t.Fatalf("unexpected point %v", v)
+	}
+
+	// Types that implement encoding.BinaryMarshaler encode themselves
+	now := time.Now().UTC().Truncate(time.Second)
+	times := NewTree[time.Time]()
+	times.Insert(ctx, key, mask, now)
+	decodedTimes := NewTree[time.Time]()
+	roundTrip(t, times, decodedTimes)
+	if _, v, _ := decodedTimes.Search(ctx, key, mask, Exact); !v.Equal(now) {
+		t.Fatalf("unexpected time %v, expected %v", v, now)
+	}
+
+	// Numbers
+	floats := NewTree[float64]()
+	floats.Insert(ctx, key, mask, -1.5)
+	decodedFloats := NewTree[float64]()
+	roundTrip(t, floats, decodedFloats)
+	if _, v, _ := decodedFloats.Search(ctx, key, mask, Exact); v != -1.5 {
+		t.Fatalf("unexpected float %v", v)
+	}
+
+	var codec defaultValueCodec[int8]
+	if _, err := codec.DecodeValue(binary.AppendVarint(nil, 300)); err != ErrInvalidEncoding {
+		t.Fatalf("expected %v for an out of range int8, got %v", ErrInvalidEncoding, err)
+	}
+
+	// A codec for another type
+	mismatched := NewTree[int](WithValueCodec[string](jsonCodec[string]{}))
+	if _, err := mismatched.MarshalBinary(); err != ErrInvalidValueCodec {
+		t.Fatalf("expected %v, got %v", ErrInvalidValueCodec, err)
+	}
+}
+
+func TestPrefixTree_MarshalBinary(t *testing.T) {
+	ctx := context.Background()
+
+	trees := []struct {
+		name    string
+		newTree func() PrefixTree[string]
+		keys    []string
+	}{
+		{"V4", func() PrefixTree[string] { return NewV4Tree[string]() }, []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.1.1/32"}},
+		{"V4Stride", func() PrefixTree[string] { return NewV4Tree[string](WithStride(4)) }, []string{"10.0.0.0/8", "10.1.0.0/17"}},
+		{"V6", func() PrefixTree[string] { return NewV6Tree[string]() }, []string{"2001:db8::/32", "2001:db8:1::/48", "fe80::1/128"}},
+		{"Strings", func() PrefixTree[string] { return NewStringsTree[string]() }, []string{"example.com", "example.org", "test"}},
+		{"ReversedStrings", func() PrefixTree[string] { return NewReversedStringsTree[string]() }, []string{"example.com", "mail.example.com"}},
+	}
+
+	for i, tt := range trees {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := tt.newTree()
+			for _, key := range tt.keys {
+				tree.Insert(ctx, key, "value of "+key)
+			}
+
+			var buf bytes.Buffer
+			if _, err := tree.WriteTo(&buf); err != nil {
+				t.Fatalf("WriteTo failed: %v", err)
+			}
+			data, _ := tree.MarshalBinary()
+
+			decoded := tt.newTree()
+			if _, err := decoded.ReadFrom(&buf); err != nil {
+				t.Fatalf("ReadFrom failed: %v", err)
+			}
+			if decoded.GetNodesCount() != uint64(len(tt.keys)) {
+				t.Fatalf("expected %d entries, got %d", len(tt.keys), decoded.GetNodesCount())
+			}
+			for _, key := range tt.keys {
+				if res, v, err := decoded.SearchExact(ctx, key); err != nil || res != Match || v != "value of "+key {
+					t.Fatalf("SearchExact %s: %v %s %v", key, res, v, err)
+				}
+			}
+
+			// Trees of another kind do not decode the encoding
+			other := trees[(i+2)%len(trees)].newTree()
+			if err := other.UnmarshalBinary(data); err != ErrInvalidEncoding {
+				t.Fatalf("expected %v, got %v", ErrInvalidEncoding, err)
+			}
+		})
+	}
+
+	// Prefixes longer than an IPv4 address are rejected
+	tr := NewTree[string]()
+	tr.Insert(ctx, []byte{10, 0, 0, 0, 0}, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, "too long")
+	data, _ := tr.MarshalBinary()
+	data[5] = byte(kindV4)
+
+	if err := NewV4Tree[string]().UnmarshalBinary(rechecksum(data)); err != ErrInvalidEncoding {
+		t.Fatalf("expected %v, got %v", ErrInvalidEncoding, err)
+	}
+}
+
+// BenchmarkV4TreeLoad compares loading a tree from its binary encoding with
+// inserting the prefixes from text
+func BenchmarkV4TreeLoad(b *testing.B) {
+	ctx := context.Background()
+	prefixes := generateIPv4Addresses(100000)
+
+	source := NewV4Tree[int]()
+	for i, prefix := range prefixes {
+		source.Insert(ctx, prefix, i)
+	}
+
+	data, err := source.MarshalBinary()
+	if err != nil {
+		b.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	b.Run("Insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := NewV4Tree[int]()
+			for j, prefix := range prefixes {
+				tree.Insert(ctx, prefix, j)
+			}
+		}
+	})
+
+	b.Run("UnmarshalBinary", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			tree := NewV4Tree[int]()
+			if err := tree.UnmarshalBinary(data); err != nil {
+				b.Fatalf("UnmarshalBinary failed: %v", err)
+			}
+		}
+	})
+
+	b.Run("MarshalBinary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			source.MarshalBinary()
+		}
+	})
+}
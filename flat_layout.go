@@ -0,0 +1,521 @@
+package prefix_tree
+
+// Flat layout of a compiled tree, see Tree.Compile(). A path compressed binary trie
+// whose nodes are stored in a single array in breadth-first order, and whose values
+// are stored in a second array. The children of a node are next to each other, so a
+// node only keeps the index of its first child. Nodes hold no pointers, so the
+// garbage collector never scans them, and lookups allocate nothing.
+//
+// The layout is immutable. The read-only tree that holds it rejects every write.
+
+import (
+	"unsafe"
+)
+
+const (
+	flatLeft  = 1 << 0 // the node has a left (bit 0) child
+	flatRight = 1 << 1 // the node has a right (bit 1) child
+)
+
+type flatNode struct {
+	skip     uint64 // bits skipped on the way to the node, right aligned
+	child    uint32 // index of the first child. The right child follows the left one.
+	value    uint32 // index of the value plus one. 0 if the node holds no entry.
+	skipLen  uint8  // number of skipped bits
+	children uint8  // flatLeft and flatRight
+}
+
+// Returns the index of the child for the given bit. The root is at index 0 and is
+// nobody's child, so 0 means there is no such child.
+func (n *flatNode) getChild(bit byte) uint32 {
+	if 0 == bit {
+		if 0 == n.children&flatLeft {
+			return 0
+		}
+		return n.child
+	}
+
+	if 0 == n.children&flatRight {
+		return 0
+	}
+	return n.child + uint32(n.children&flatLeft)
+}
+
+// Returns the skipped bit at the given index. Index 0 is the first skipped bit.
+func (n *flatNode) getSkipBit(idx int) byte {
+	return byte(n.skip>>(int(n.skipLen)-1-idx)) & 1
+}
+
+// Writes the bits of the path from a parent to a node into the key, i.e. the
+// branch bit followed by the bits skipped on the way to the node
+func (n *flatNode) setPath(key []byte, depth int, bit byte) []byte {
+	key = setBit(key, depth, bit)
+	return setBits(key, depth+1, int(n.skipLen), n.skip)
+}
+
+// Position of a walk in a flat layout
+type flatFrame struct {
+	idx   uint32 // index of the node
+	depth int    // prefix length of the node in bits
+	bit   byte   // bit that leads from the parent to the node
+}
+
+type flatLayout[T any] struct {
+	nodes  []flatNode // in breadth-first order. The root is first.
+	values []T
+
+	// Whether the binary layouts made from the layout are persistent, like the tree
+	// it was compiled from
+	persistent bool
+}
+
+// Returns a flat layout with the entries of the current version of a layout. The
+// nodes are those of the path compressed binary layout with the same entries.
+// Arguments:
+//
+//	layout     - layout to compile
+//	persistent - whether the tree of the layout is persistent
+//
+// Returns:
+//
+//	*flatLayout - pointer to the new layout
+func compileFlatLayout[T any](layout treeLayout[T], persistent bool) *flatLayout[T] {
+	if flat, ok := layout.(*flatLayout[T]); ok {
+		return flat
+	}
+
+	source, ok := layout.(*binaryLayout[T])
+	if !ok || !source.compressed {
+		source = newBinaryLayout[T](true, false)
+		layout.walk(nil, 0, func(key []byte, plen int, value T) error {
+			_, err := source.insert(key, plen, value)
+			return err
+		})
+	}
+
+	l := &flatLayout[T]{persistent: persistent}
+
+	// Nodes are numbered in the order they are queued. The children of a node are
+	// queued together, so they get consecutive indexes.
+	queue := []*Node[T]{source.root.Node}
+	for i := 0; i < len(queue); i++ {
+		node := queue[i]
+
+		flat := flatNode{
+			skip:    asCompressed(node).skip,
+			skipLen: asCompressed(node).skipLen,
+			child:   uint32(len(queue)),
+		}
+
+		if node.IsTerminal() && !source.isRoot(node) {
+			l.values = append(l.values, node.value)
+			flat.value = uint32(len(l.values))
+		}
+
+		if nil != node.left {
+			queue = append(queue, node.left)
+			flat.children |= flatLeft
+		}
+
+		if nil != node.right {
+			queue = append(queue, node.right)
+			flat.children |= flatRight
+		}
+
+		l.nodes = append(l.nodes, flat)
+	}
+
+	return l
+}
+
+// Returns a path compressed binary layout with the entries of the layout. Every value
+// is passed through cloneFn, if set.
+func (l *flatLayout[T]) thaw(cloneFn CloneFn[T]) *binaryLayout[T] {
+	thawed := newBinaryLayout[T](true, l.persistent)
+	l.walk(nil, 0, func(key []byte, plen int, value T) error {
+		if nil != cloneFn {
+			value = cloneFn(value)
+		}
+
+		_, err := thawed.insert(key, plen, value)
+		return err
+	})
+
+	return thawed
+}
+
+func (l *flatLayout[T]) insert(key []byte, plen int, value T) (OpResult, error) {
+	return Error, ErrReadOnly
+}
+
+func (l *flatLayout[T]) update(key []byte, plen int, value T) bool {
+	return false
+}
+
+func (l *flatLayout[T]) remove(key []byte, plen int) (T, bool) {
+	var zero T
+	return zero, false
+}
+
+func (l *flatLayout[T]) prune(key []byte, plen int, visitFn func([]byte, int, T)) int {
+	return 0
+}
+
+// The layout never changes, so there is nothing to freeze
+func (l *flatLayout[T]) freeze() {
+}
+
+func (l *flatLayout[T]) snapshot() treeLayout[T] {
+	return l
+}
+
+// Returns a new empty path compressed binary layout, which can be written to
+func (l *flatLayout[T]) empty() treeLayout[T] {
+	return newBinaryLayout[T](true, l.persistent)
+}
+
+// Returns a path compressed binary layout, so the copy can be written to
+func (l *flatLayout[T]) clone(cloneFn CloneFn[T]) treeLayout[T] {
+	return l.thaw(cloneFn)
+}
+
+// Merges the path compressed binary layout with the same entries. The result can
+// be written to.
+func (l *flatLayout[T]) merge(other treeLayout[T], op setOp, resolveFn ResolveFn[T]) (treeLayout[T], int, bool) {
+	return l.thaw(nil).merge(other, op, resolveFn)
+}
+
+// Looks up the node for a key.
+// Arguments:
+//
+//	key   - key to find expressed as byte slice.
+//	plen  - prefix length of the key in bits.
+//	mType - type of match to perform (Exact/Partial/Longest)
+//
+// Returns:
+//
+//	*flatNode - the terminal node found, nil if there is none
+//	int       - depth of the node found
+func (l *flatLayout[T]) lookup(key []byte, plen int, mType MatchType) (*flatNode, int) {
+	node := &l.nodes[0]
+	depth := 0
+
+	// Deepest terminal node seen so far. Only tracked for Longest match.
+	var longest *flatNode
+	longestDepth := 0
+
+	for depth < plen {
+		if 0 != node.value {
+			// A partial match finds the earliest matching prefix in the tree
+			if Partial == mType {
+				return node, depth
+			}
+
+			// A longest match keeps going and remembers the most specific
+			// prefix seen so far, in case the full key is not in the tree
+			if Longest == mType {
+				longest, longestDepth = node, depth
+			}
+		}
+
+		idx := node.getChild(getBit(key, depth))
+		if 0 == idx {
+			node = nil
+			break
+		}
+
+		// The key must also match all the bits skipped on the way to the child
+		node = &l.nodes[idx]
+		if matchSkip(node.skip, int(node.skipLen), key, depth+1, plen) < int(node.skipLen) {
+			node = nil
+			break
+		}
+
+		depth += 1 + int(node.skipLen)
+	}
+
+	if nil != node && 0 != node.value {
+		return node, depth
+	}
+
+	// Fall back to the most specific prefix seen during the traversal
+	return longest, longestDepth
+}
+
+func (l *flatLayout[T]) find(key []byte, plen int, mType MatchType) (T, int, bool) {
+	node, depth := l.lookup(key, plen, mType)
+	if nil == node {
+		var zero T
+		return zero, 0, false
+	}
+
+	return l.values[node.value-1], depth, true
+}
+
+func (l *flatLayout[T]) trace(key []byte, plen int, visitFn func(int, T)) {
+	node := &l.nodes[0]
+	depth := 0
+
+	for {
+		if 0 != node.value {
+			visitFn(depth, l.values[node.value-1])
+		}
+
+		if depth >= plen {
+			break
+		}
+
+		idx := node.getChild(getBit(key, depth))
+		if 0 == idx {
+			break
+		}
+
+		next := &l.nodes[idx]
+		if matchSkip(next.skip, int(next.skipLen), key, depth+1, plen) < int(next.skipLen) {
+			break
+		}
+
+		node = next
+		depth += 1 + int(node.skipLen)
+	}
+}
+
+func (l *flatLayout[T]) walk(key []byte, plen int, visitFn func([]byte, int, T) error) error {
+	start, keyBuf, ok := l.subtree(key, plen)
+	if !ok {
+		return nil
+	}
+
+	stack := []flatFrame{start}
+
+	for len(stack) > 0 {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node := &l.nodes[frame.idx]
+
+		// Record the bits that led to this node. Root has no bits.
+		if frame.depth > 0 {
+			keyBuf = node.setPath(keyBuf, frame.depth-int(node.skipLen)-1, frame.bit)
+		}
+
+		if 0 != node.value {
+			if err := visitFn(keyBuf, frame.depth, l.values[node.value-1]); nil != err {
+				return err
+			}
+		}
+
+		// Push the right child first so that the left child is visited first
+		if idx := node.getChild(1); 0 != idx {
+			stack = append(stack, flatFrame{idx: idx, depth: frame.depth + 1 + int(l.nodes[idx].skipLen), bit: 1})
+		}
+
+		if idx := node.getChild(0); 0 != idx {
+			stack = append(stack, flatFrame{idx: idx, depth: frame.depth + 1 + int(l.nodes[idx].skipLen), bit: 0})
+		}
+	}
+
+	return nil
+}
+
+// Returns the root of the subtree that holds every entry equal to or more specific
+// than a key, i.e. the first node whose path extends the key.
+// Arguments:
+//
+//	key  - key expressed as byte slice.
+//	plen - prefix length of the key in bits.
+//
+// Returns:
+//
+//	flatFrame - root of the subtree
+//	[]byte    - key bits of the path to the parent of the root
+//	bool      - whether there is such a subtree
+func (l *flatLayout[T]) subtree(key []byte, plen int) (flatFrame, []byte, bool) {
+	// Key bits of the path. Copied since the bits are modified by the walk.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	frame := flatFrame{}
+
+	for frame.depth < plen {
+		bit := getBit(keyBuf, frame.depth)
+
+		idx := l.nodes[frame.idx].getChild(bit)
+		if 0 == idx {
+			return flatFrame{}, nil, false
+		}
+
+		// The key must be a prefix of the bits skipped on the way to the child
+		child := &l.nodes[idx]
+		matchLen := matchSkip(child.skip, int(child.skipLen), keyBuf, frame.depth+1, plen)
+		if matchLen < int(child.skipLen) && frame.depth+1+matchLen < plen {
+			return flatFrame{}, nil, false
+		}
+
+		frame = flatFrame{idx: idx, depth: frame.depth + 1 + int(child.skipLen), bit: bit}
+	}
+
+	return frame, keyBuf, true
+}
+
+func (l *flatLayout[T]) seek(key []byte, plen int, inclusive bool) ([]byte, int, T, bool) {
+	node, keyBuf, depth := l.seekNode(key, plen, inclusive)
+	if nil == node {
+		var zero T
+		return nil, 0, zero, false
+	}
+
+	return keyBuf, depth, l.values[node.value-1], true
+}
+
+// Returns the first terminal node at or after the given key in walk order.
+// Arguments:
+//
+//	key       - key to start from expressed as byte slice.
+//	plen      - prefix length of the key in bits.
+//	inclusive - whether the key itself can be returned.
+//
+// Returns:
+//
+//	*flatNode - the terminal node found, nil if there are no more entries
+//	[]byte    - key bits of the node
+//	int       - prefix length of the node in bits
+func (l *flatLayout[T]) seekNode(key []byte, plen int, inclusive bool) (*flatNode, []byte, int) {
+	// Key bits of the path. Copied since the bits are modified below.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	node := &l.nodes[0]
+	depth := 0
+
+	// Closest subtree to the right of the path and the depth of its parent.
+	// Everything in this subtree comes after the key in walk order.
+	var next uint32
+	nextDepth := 0
+
+	// Traverse the path of the key as far as possible
+	for depth < plen {
+		bit := getBit(keyBuf, depth)
+		if right := node.getChild(1); 0 == bit && 0 != right {
+			next = right
+			nextDepth = depth
+		}
+
+		idx := node.getChild(bit)
+		if 0 == idx {
+			node = nil
+			break
+		}
+
+		// The key ends within the bits skipped on the way to the child or diverges
+		// from them. The child's subtree comes right after the key if the key is a
+		// prefix of the child's path or the key has a 0 bit where the path has a 1.
+		child := &l.nodes[idx]
+		matchLen := matchSkip(child.skip, int(child.skipLen), keyBuf, depth+1, plen)
+		if matchLen < int(child.skipLen) {
+			if depth+1+matchLen == plen || 1 == child.getSkipBit(matchLen) {
+				return l.first(idx, keyBuf, depth, bit)
+			}
+
+			node = nil
+			break
+		}
+
+		node = child
+		depth += 1 + matchLen
+	}
+
+	if nil != node {
+		// The key itself is in the tree
+		if inclusive && 0 != node.value {
+			return node, keyBuf, depth
+		}
+
+		// Longer prefixes of the key come next
+		if idx := node.getChild(0); 0 != idx {
+			return l.first(idx, keyBuf, depth, 0)
+		}
+
+		if idx := node.getChild(1); 0 != idx {
+			return l.first(idx, keyBuf, depth, 1)
+		}
+	}
+
+	if 0 == next {
+		return nil, nil, 0
+	}
+
+	return l.first(next, keyBuf, nextDepth, 1)
+}
+
+// Returns the first terminal node of a subtree in walk order.
+// Arguments:
+//
+//	idx   - index of the root of the subtree
+//	key   - key bits of the path to the parent of the root
+//	depth - depth of the parent of the root
+//	bit   - bit that leads from the parent to the root
+//
+// Returns:
+//
+//	*flatNode - the terminal node found, nil if the subtree has no entries
+//	[]byte    - key bits of the node
+//	int       - prefix length of the node in bits
+func (l *flatLayout[T]) first(idx uint32, key []byte, depth int, bit byte) (*flatNode, []byte, int) {
+	for {
+		node := &l.nodes[idx]
+
+		key = node.setPath(key, depth, bit)
+		depth += 1 + int(node.skipLen)
+
+		if 0 != node.value {
+			return node, key, depth
+		}
+
+		if idx = node.getChild(0); 0 != idx {
+			bit = 0
+		} else if idx = node.getChild(1); 0 != idx {
+			bit = 1
+		} else {
+			return nil, nil, 0
+		}
+	}
+}
+
+func (l *flatLayout[T]) stats(stats *treeStats) {
+	type statsFrame struct {
+		depth   int  // depth of the node
+		plen    int  // prefix length of the node in bits
+		inChain bool // whether the parent is part of a single child chain
+	}
+
+	// The parent of a node always comes before it in breadth-first order, so the
+	// frame of a node is set by the time the node is reached
+	frames := make([]statsFrame, len(l.nodes))
+
+	for idx := range l.nodes {
+		node, frame := &l.nodes[idx], frames[idx]
+		stats.addNode(frame.depth, 0)
+
+		if 0 != node.value {
+			stats.addEntry(frame.depth, frame.plen)
+		}
+
+		// A chain starts at the first node without an entry and with a single child.
+		// Only runs of more than maxSkipLen bits are left after path compression.
+		inChain := 0 != idx && 0 == node.value && (flatLeft == node.children || flatRight == node.children)
+		if inChain && !frame.inChain {
+			stats.SingleChildChains++
+		}
+
+		for bit := byte(0); bit <= 1; bit++ {
+			if child := node.getChild(bit); 0 != child {
+				frames[child] = statsFrame{depth: frame.depth + 1, plen: frame.plen + 1 + int(l.nodes[child].skipLen), inChain: inChain}
+			}
+		}
+	}
+
+	// Both arrays are allocated whole
+	var value T
+	stats.Bytes += uint64(cap(l.nodes))*uint64(unsafe.Sizeof(flatNode{})) + uint64(cap(l.values))*uint64(unsafe.Sizeof(value))
+}
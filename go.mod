@@ -1,3 +1,3 @@
 module github.com/camelinx/prefix_tree
 
-go 1.18
+go 1.23
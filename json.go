@@ -0,0 +1,169 @@
+package prefix_tree
+
+// JSON encoding of the contents of a PrefixTree. The entries are encoded in walk order
+// as an array of objects, with the key in the same format accepted by Insert() and the
+// value in its own JSON encoding:
+//
+//	[{"prefix": "10.0.0.0/8", "value": 1}, {"prefix": "10.1.0.0/16", "value": 2}]
+//
+// Meant for tables that are diffed and edited by hand. See encoding.go for a compact
+// binary encoding.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+)
+
+// Entry of the JSON encoding
+type jsonEntry[T any] struct {
+	Prefix string `json:"prefix"`
+	Value  T      `json:"value"`
+}
+
+// Returns the JSON encoding of the entries visited by a walk
+// Arguments:
+//
+//	walkFn - walks the entries of the tree with their keys
+//
+// Returns:
+//
+//	[]byte - JSON encoding
+//	error  - error if any
+func marshalJSONEntries[T any](walkFn func(context.Context, KeyWalkerFn[T]) error) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+
+	err := walkFn(context.Background(), func(ctx context.Context, key string, value T) error {
+		data, err := json.Marshal(jsonEntry[T]{Prefix: key, Value: value})
+		if nil != err {
+			return err
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(data)
+
+		return nil
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// Replaces the contents of a tree with the entries of a JSON encoding. See replaceEntries().
+// Arguments:
+//
+//	tree    - tree to replace the contents of
+//	data    - JSON encoding
+//	parseFn - converts a key to its key/mask
+//
+// Returns:
+//
+//	error - error if any
+func unmarshalJSONEntries[T any](tree *Tree[T], data []byte, parseFn func(string) ([]byte, []byte, error)) error {
+	jsonEntries := []jsonEntry[T]{}
+	if err := json.Unmarshal(data, &jsonEntries); nil != err {
+		return err
+	}
+
+	entries := make([]Entry[T], len(jsonEntries))
+	for i := range jsonEntries {
+		entries[i] = Entry[T]{Key: jsonEntries[i].Prefix, Value: jsonEntries[i].Value}
+	}
+
+	return replaceEntries(context.Background(), tree, entries, parseFn)
+}
+
+// Returns the JSON encoding of the IPv4 prefix tree. Implements json.Marshaler.
+// Returns:
+//
+//	[]byte - JSON encoding
+//	error  - error if any
+func (v4t *V4Tree[T]) MarshalJSON() ([]byte, error) {
+	return marshalJSONEntries(v4t.WalkKeys)
+}
+
+// Replaces the contents of the IPv4 prefix tree with the entries of a JSON encoding.
+// Implements json.Unmarshaler. The tree is left alone on error.
+// Arguments:
+//
+//	data - JSON encoding
+//
+// Returns:
+//
+//	error - error if any. ErrDuplicateKey if a prefix is given twice.
+func (v4t *V4Tree[T]) UnmarshalJSON(data []byte) error {
+	return unmarshalJSONEntries(v4t.tree, data, v4t.keyParser())
+}
+
+// Returns the JSON encoding of the IPv6 prefix tree. Implements json.Marshaler.
+// Returns:
+//
+//	[]byte - JSON encoding
+//	error  - error if any
+func (v6t *V6Tree[T]) MarshalJSON() ([]byte, error) {
+	return marshalJSONEntries(v6t.WalkKeys)
+}
+
+// Replaces the contents of the IPv6 prefix tree with the entries of a JSON encoding.
+// Implements json.Unmarshaler. The tree is left alone on error.
+// Arguments:
+//
+//	data - JSON encoding
+//
+// Returns:
+//
+//	error - error if any. ErrDuplicateKey if a prefix is given twice.
+func (v6t *V6Tree[T]) UnmarshalJSON(data []byte) error {
+	return unmarshalJSONEntries(v6t.tree, data, v6t.keyParser())
+}
+
+// Returns the JSON encoding of the strings tree. Implements json.Marshaler.
+// Returns:
+//
+//	[]byte - JSON encoding
+//	error  - error if any
+func (st *StringsTree[T]) MarshalJSON() ([]byte, error) {
+	return marshalJSONEntries(st.WalkKeys)
+}
+
+// Replaces the contents of the strings tree with the entries of a JSON encoding.
+// Implements json.Unmarshaler. The tree is left alone on error.
+// Arguments:
+//
+//	data - JSON encoding
+//
+// Returns:
+//
+//	error - error if any. ErrDuplicateKey if a string is given twice.
+func (st *StringsTree[T]) UnmarshalJSON(data []byte) error {
+	return unmarshalJSONEntries(st.tree, data, st.keyParser())
+}
+
+// Returns the JSON encoding of the reversed strings tree. Implements json.Marshaler.
+// The strings are encoded as inserted, i.e. not reversed.
+// Returns:
+//
+//	[]byte - JSON encoding
+//	error  - error if any
+func (rst *ReversedStringsTree[T]) MarshalJSON() ([]byte, error) {
+	return marshalJSONEntries(rst.WalkKeys)
+}
+
+// Replaces the contents of the reversed strings tree with the entries of a JSON
+// encoding. Implements json.Unmarshaler. The tree is left alone on error.
+// Arguments:
+//
+//	data - JSON encoding
+//
+// Returns:
+//
+//	error - error if any. ErrDuplicateKey if a string is given twice.
+func (rst *ReversedStringsTree[T]) UnmarshalJSON(data []byte) error {
+	return unmarshalJSONEntries(rst.tree, data, rst.keyParser())
+}
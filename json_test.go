@@ -0,0 +1,119 @@
+package prefix_tree
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type testRoute struct {
+	ASN  int    `json:"asn"`
+	Name string `json:"name"`
+}
+
+// Returns the keys and values visited by WalkKeys
+func walkOutput[T any](tree PrefixTree[T]) []string {
+	output := []string{}
+	tree.WalkKeys(context.Background(), func(ctx context.Context, key string, value T) error {
+		output = append(output, fmt.Sprintf("%s=%v", key, value))
+		return nil
+	})
+
+	return output
+}
+
+// Trees of every kind with a few entries
+func testPrefixTrees() []struct {
+	name    string
+	newTree func() PrefixTree[testRoute]
+	keys    []string
+} {
+	return []struct {
+		name    string
+		newTree func() PrefixTree[testRoute]
+		keys    []string
+	}{
+		{"V4", func() PrefixTree[testRoute] { return NewV4Tree[testRoute]() }, []string{"10.0.0.0/8", "10.1.0.0/16", "192.168.1.1/32"}},
+		{"V6", func() PrefixTree[testRoute] { return NewV6Tree[testRoute]() }, []string{"2001:db8::/32", "2001:db8:1::/48", "fe80::1/128"}},
+		{"Strings", func() PrefixTree[testRoute] { return NewStringsTree[testRoute]() }, []string{"example.com", "example.org", "test, \"quoted\""}},
+		{"ReversedStrings", func() PrefixTree[testRoute] { return NewReversedStringsTree[testRoute]() }, []string{"example.com", "mail.example.com"}},
+	}
+}
+
+func TestPrefixTree_JSON(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range testPrefixTrees() {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := tt.newTree()
+			for i, key := range tt.keys {
+				tree.Insert(ctx, key, testRoute{ASN: 64512 + i, Name: "route " + key})
+			}
+
+			data, err := json.Marshal(tree)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+
+			decoded := tt.newTree()
+			decoded.Insert(ctx, tt.keys[0], testRoute{})
+			if err := json.Unmarshal(data, decoded); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+
+			if expected, actual := walkOutput(tree), walkOutput(decoded); fmt.Sprint(expected) != fmt.Sprint(actual) {
+				t.Fatalf("unexpected walk output after import:\n%v\n%v", expected, actual)
+			}
+			if decoded.GetNodesCount() != uint64(len(tt.keys)) {
+				t.Fatalf("expected %d entries, got %d", len(tt.keys), decoded.GetNodesCount())
+			}
+		})
+	}
+}
+
+func TestV4Tree_JSON(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int]()
+	v4t.Insert(ctx, "10.1.0.0/16", 2)
+	v4t.Insert(ctx, "10.0.0.0/8", 1)
+
+	data, err := json.Marshal(v4t)
+	if expected := `[{"prefix":"10.0.0.0/8","value":1},{"prefix":"10.1.0.0/16","value":2}]`; err != nil || string(data) != expected {
+		t.Fatalf("expected %s, got %s %v", expected, data, err)
+	}
+
+	data, err = json.Marshal(NewV4Tree[int]())
+	if err != nil || string(data) != "[]" {
+		t.Fatalf("expected [], got %s %v", data, err)
+	}
+
+	// The tree is left alone on error
+	tests := []struct {
+		data string
+		err  error
+	}{
+		{`[{"prefix":"10.2.0.0/16","value":1},{"prefix":"10.2.0.0/16","value":2}]`, ErrDuplicateKey},
+		{`[{"prefix":"10.2.0.0/33","value":1}]`, nil},
+		{`[{"prefix":"10.2.0.0/16","value":"one"}]`, nil},
+		{`{"prefix":"10.2.0.0/16","value":1}`, nil},
+	}
+
+	for _, tt := range tests {
+		err := json.Unmarshal([]byte(tt.data), v4t)
+		if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Fatalf("%s: expected an error, got %v", tt.data, err)
+		}
+
+		if output := walkOutput(v4t); fmt.Sprint(output) != "[10.0.0.0/8=1 10.1.0.0/16=2]" {
+			t.Fatalf("%s: tree changed by a failed import: %v", tt.data, output)
+		}
+	}
+
+	// Snapshots cannot be replaced
+	snapshot, _ := v4t.Snapshot(ctx)
+	if err := json.Unmarshal([]byte(`[]`), snapshot); err != ErrReadOnly {
+		t.Fatalf("expected %v, got %v", ErrReadOnly, err)
+	}
+}
@@ -0,0 +1,800 @@
+package prefix_tree
+
+// Trees keyed by arbitrary types. A KeyCodec converts keys of type K to the key bytes
+// and prefix length stored in a Tree and back, and a KeyedTree applies it around every
+// operation of the Tree. The IP and strings trees are keyed trees with a codec for
+// their string keys, see V4KeyCodec, V6KeyCodec, StringKeyCodec and
+// ReversedStringKeyCodec. Typed keys such as netip.Prefix, (tenant, prefix) tuples or
+// fixed width IDs only need a codec of their own, see PrefixKeyCodec.
+
+import (
+	"context"
+	"iter"
+	"net"
+	"net/netip"
+)
+
+// Encodes the keys of a tree to the key bytes and prefix length stored in the tree and
+// decodes them back. Keys sharing leading bits share the path to them, so the layout
+// of the key bytes decides which keys a lookup finds. For e.g. a (tenant, prefix) key
+// that starts with the tenant keeps the lookups of a tenant to its own prefixes.
+type KeyCodec[K any] interface {
+	// Appends the key bytes of the key to the buffer, which is empty. Returns the
+	// extended buffer and the prefix length of the key in bits, which cannot be more
+	// than the number of key bits. Bits after the prefix length should be 0.
+	AppendKey(buf []byte, key K) ([]byte, int, error)
+
+	// Decodes a key given its key bytes and prefix length in bits. The key bytes
+	// cover the prefix length, i.e. they can be shorter than the bytes returned by
+	// AppendKey(). The data is only valid for the duration of the call.
+	DecodeKey(data []byte, plen int) (K, error)
+}
+
+// Key and value of an entry stored in a KeyedTree
+type KeyedEntry[K, T any] struct {
+	Key   K
+	Value T
+}
+
+// Prefix tree keyed by keys of type K, see KeyCodec. Lookups allocate nothing as
+// long as the codec does not.
+type KeyedTree[K, T any] struct {
+	tree  *Tree[T]
+	codec KeyCodec[K]
+}
+
+// Returns a new keyed tree
+// Arguments:
+//
+//	codec - converts the keys to key bytes and back
+//	opts  - options, see options.go. For e.g. WithRWMutex().
+//
+// Returns:
+//
+//	*KeyedTree - keyed tree
+func NewKeyedTree[K, T any](codec KeyCodec[K], opts ...Option) *KeyedTree[K, T] {
+	return &KeyedTree[K, T]{
+		tree:  NewTree[T](opts...),
+		codec: codec,
+	}
+}
+
+// Returns the underlying tree, for e.g. for the set operations or the binary encoding
+// Returns:
+//
+//	*Tree - underlying tree
+func (kt *KeyedTree[K, T]) Tree() *Tree[T] {
+	return kt.tree
+}
+
+// Encodes the key into a key buffer. See KeyCodec.AppendKey().
+// Arguments:
+//
+//	kb  - key buffer
+//	key - key to encode
+//
+// Returns:
+//
+//	[]byte - key bytes
+//	int    - prefix length in bits
+//	error  - error if any
+func (kt *KeyedTree[K, T]) encodeKey(kb *keyBuffer, key K) ([]byte, int, error) {
+	data, plen, err := kt.codec.AppendKey(kb.key[:0], key)
+	if nil != err {
+		return nil, 0, err
+	}
+
+	kb.key = data
+	if plen < 0 || plen > len(data)*8 {
+		return nil, 0, ErrInvalidKeyMask
+	}
+
+	return data, plen, nil
+}
+
+// Encodes the key into a key buffer along with its mask
+// Arguments:
+//
+//	kb  - key buffer
+//	key - key to encode
+//
+// Returns:
+//
+//	[]byte - key bytes
+//	[]byte - mask bytes
+//	error  - error if any
+func (kt *KeyedTree[K, T]) encode(kb *keyBuffer, key K) ([]byte, []byte, error) {
+	data, plen, err := kt.encodeKey(kb, key)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	return data, kb.maskOf(plen), nil
+}
+
+// Decodes the key/mask of an entry. See KeyCodec.DecodeKey().
+// Arguments:
+//
+//	key  - key bytes
+//	mask - mask bytes
+//
+// Returns:
+//
+//	K     - key
+//	error - error if any
+func (kt *KeyedTree[K, T]) decode(key []byte, mask []byte) (K, error) {
+	return kt.codec.DecodeKey(key, getPrefixLen(mask))
+}
+
+// Returns the key of an entry, for codecs that cannot fail to decode the keys they
+// encoded, like those of the IP and strings trees
+// Arguments:
+//
+//	key  - key bytes
+//	mask - mask bytes
+//
+// Returns:
+//
+//	K - key
+func (kt *KeyedTree[K, T]) keyOf(key []byte, mask []byte) K {
+	k, _ := kt.decode(key, mask)
+	return k
+}
+
+// Returns a function that encodes keys into a key and a mask. The key and mask
+// buffers are reused by every call.
+func (kt *KeyedTree[K, T]) keyParser() func(K) ([]byte, []byte, error) {
+	kb := &keyBuffer{}
+
+	return func(key K) ([]byte, []byte, error) {
+		return kt.encode(kb, key)
+	}
+}
+
+// Decodes the keys of tree entries
+// Arguments:
+//
+//	treeEntries - entries with their key/mask
+//
+// Returns:
+//
+//	[]KeyedEntry - entries with their key
+//	error        - error from the codec, if any
+func (kt *KeyedTree[K, T]) toEntries(treeEntries []TreeEntry[T]) ([]KeyedEntry[K, T], error) {
+	entries := make([]KeyedEntry[K, T], len(treeEntries))
+	for i, te := range treeEntries {
+		key, err := kt.decode(te.Key, te.Mask)
+		if nil != err {
+			return nil, err
+		}
+
+		entries[i] = KeyedEntry[K, T]{Key: key, Value: te.Value}
+	}
+
+	return entries, nil
+}
+
+// Inserts the key into the tree. A key already in the tree keeps its value.
+// Arguments:
+//
+//	ctx   - context for the operation
+//	key   - key to insert
+//	value - value to be associated with the key
+//
+// Returns:
+//
+//	OpResult - Ok if the key was inserted, Dup if it is already in the tree
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) Insert(ctx context.Context, key K, value T) (OpResult, error) {
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, err
+	}
+
+	return kt.tree.Insert(ctx, data, mask, value)
+}
+
+// Stores the value for the key, replacing the value already stored for it, if any
+// Arguments:
+//
+//	ctx   - context for the operation
+//	key   - key to store
+//	value - value to be associated with the key
+//
+// Returns:
+//
+//	OpResult - Ok if the key was inserted, Match if its value was replaced
+//	T        - value previously associated with the key, if any
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) Replace(ctx context.Context, key K, value T) (OpResult, T, error) {
+	var zero T
+
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, zero, err
+	}
+
+	return kt.tree.Replace(ctx, data, mask, value)
+}
+
+// Stores the value returned by upsertFn for the key. upsertFn is called with the value
+// already associated with the key and whether there is one.
+// Arguments:
+//
+//	ctx      - context for the operation
+//	key      - key to store
+//	upsertFn - returns the value to be associated with the key
+//
+// Returns:
+//
+//	OpResult - Ok if the key was inserted, Match if its value was replaced
+//	T        - value associated with the key
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) Upsert(ctx context.Context, key K, upsertFn UpsertFn[T]) (OpResult, T, error) {
+	var zero T
+
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, zero, err
+	}
+
+	return kt.tree.Upsert(ctx, data, mask, upsertFn)
+}
+
+// Replaces the value associated with the key with newValue, only if the value
+// associated with it is equal to oldValue
+// Arguments:
+//
+//	ctx      - context for the operation
+//	key      - key to update
+//	oldValue - value expected to be associated with the key
+//	newValue - value to be associated with the key
+//	equalFn  - compares the value associated with the key with oldValue
+//
+// Returns:
+//
+//	OpResult - Match if the value was swapped, NoMatch if the value is not equal to oldValue
+//	error    - ErrKeyNotFound if the key is not in the tree, other error if any
+func (kt *KeyedTree[K, T]) CompareAndSwap(ctx context.Context, key K, oldValue T, newValue T, equalFn EqualFn[T]) (OpResult, error) {
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, err
+	}
+
+	return kt.tree.CompareAndSwap(ctx, data, mask, oldValue, newValue, equalFn)
+}
+
+// Inserts a batch of keys into the tree under a single write lock. Like Insert, a key
+// already in the tree keeps its value and is reported as Dup.
+// Arguments:
+//
+//	ctx     - context for the operation
+//	entries - keys and the values to be associated with them
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in the same order as entries
+//	error      - first error seen, if any. The other entries are still inserted.
+func (kt *KeyedTree[K, T]) InsertBatch(ctx context.Context, entries []KeyedEntry[K, T]) ([]OpResult, error) {
+	return insertEntries(ctx, kt.tree, entries, kt.keyParser())
+}
+
+// Inserts the keys returned by an iterator into the tree under a single write lock.
+// The iterator is drained before the lock is taken. See InsertBatch().
+// Arguments:
+//
+//	ctx     - context for the operation
+//	entries - iterator over the keys and the values to be associated with them
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in iteration order
+//	error      - first error seen, if any. The other entries are still inserted.
+func (kt *KeyedTree[K, T]) BulkLoad(ctx context.Context, entries iter.Seq2[K, T]) ([]OpResult, error) {
+	return kt.InsertBatch(ctx, collectEntries(entries))
+}
+
+// Deletes the key from the tree
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - key to delete
+//
+// Returns:
+//
+//	OpResult - result of the delete operation
+//	T        - value associated with the deleted key, if any
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) Delete(ctx context.Context, key K) (OpResult, T, error) {
+	var zero T
+
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, zero, err
+	}
+
+	return kt.tree.Delete(ctx, data, mask)
+}
+
+// Deletes the key and every key within it from the tree. See Tree.DeletePrefix().
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - prefix to delete
+//
+// Returns:
+//
+//	OpResult - Match if the key itself was in the tree, PartialMatch otherwise
+//	uint64   - number of keys deleted
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) DeletePrefix(ctx context.Context, key K) (OpResult, uint64, error) {
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, 0, err
+	}
+
+	return kt.tree.DeletePrefix(ctx, data, mask)
+}
+
+// Same as DeletePrefix(), but returns the deleted keys and their values
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - prefix to delete
+//
+// Returns:
+//
+//	OpResult     - Match if the key itself was in the tree, PartialMatch otherwise
+//	[]KeyedEntry - deleted keys and their values, in walk order
+//	error        - error, if any
+func (kt *KeyedTree[K, T]) DeletePrefixEntries(ctx context.Context, key K) (OpResult, []KeyedEntry[K, T], error) {
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, nil, err
+	}
+
+	res, treeEntries, err := kt.tree.DeletePrefixEntries(ctx, data, mask)
+	if nil != err {
+		return res, nil, err
+	}
+
+	entries, err := kt.toEntries(treeEntries)
+	if nil != err {
+		return Error, nil, err
+	}
+
+	return res, entries, nil
+}
+
+// Searches for the key in the tree without allocating. See Tree.Search().
+// Arguments:
+//
+//	ctx   - context for the operation
+//	key   - key to find
+//	mType - type of match to perform (Exact/Partial/Longest)
+//
+// Returns:
+//
+//	OpResult - result of the search operation
+//	T        - value associated with the found key, if any
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) search(ctx context.Context, key K, mType MatchType) (OpResult, T, error) {
+	var zero T
+
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, plen, err := kt.encodeKey(kb, key)
+	if nil != err {
+		return Error, zero, err
+	}
+
+	return kt.tree.searchPrefix(ctx, data, plen, mType)
+}
+
+// Performs a partial search. If there is a prefix of the key in the tree, it will be
+// returned. For exact match searches, use SearchExact().
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - key to find
+//
+// Returns:
+//
+//	OpResult - result of the search operation
+//	T        - value associated with the found key, if any
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) Search(ctx context.Context, key K) (OpResult, T, error) {
+	return kt.search(ctx, key, Partial)
+}
+
+// Similar to Search(), but performs an exact match search.
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - key to find
+//
+// Returns:
+//
+//	OpResult - result of the search operation
+//	T        - value associated with the found key, if any
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) SearchExact(ctx context.Context, key K) (OpResult, T, error) {
+	return kt.search(ctx, key, Exact)
+}
+
+// Same as Search(). Returns the shortest (least specific) prefix of the key in the tree.
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - key to find
+//
+// Returns:
+//
+//	OpResult - result of the search operation
+//	T        - value associated with the found key, if any
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) SearchShortest(ctx context.Context, key K) (OpResult, T, error) {
+	return kt.search(ctx, key, Shortest)
+}
+
+// Searches for the longest (most specific) prefix of the key in the tree
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - key to find
+//
+// Returns:
+//
+//	OpResult - Match if the key itself is in the tree, PartialMatch for a covering prefix
+//	T        - value associated with the found key, if any
+//	error    - error, if any
+func (kt *KeyedTree[K, T]) SearchLongest(ctx context.Context, key K) (OpResult, T, error) {
+	return kt.search(ctx, key, Longest)
+}
+
+// Returns every prefix of the key in the tree. The entries are ordered from the least
+// specific to the most specific prefix.
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - key to find
+//
+// Returns:
+//
+//	OpResult     - Match if the key itself is in the tree, PartialMatch otherwise
+//	[]KeyedEntry - matching prefixes and their values
+//	error        - error, if any
+func (kt *KeyedTree[K, T]) SearchAll(ctx context.Context, key K) (OpResult, []KeyedEntry[K, T], error) {
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, nil, err
+	}
+
+	res, treeEntries, err := kt.tree.SearchAll(ctx, data, mask)
+	if nil != err {
+		return res, nil, err
+	}
+
+	entries, err := kt.toEntries(treeEntries)
+	if nil != err {
+		return Error, nil, err
+	}
+
+	return res, entries, nil
+}
+
+// Returns every key in the tree that is equal to or more specific than the given key.
+// The entries are in walk order.
+// Arguments:
+//
+//	ctx - context for the operation
+//	key - prefix to find
+//
+// Returns:
+//
+//	OpResult     - Match if the key itself is in the tree, PartialMatch otherwise
+//	[]KeyedEntry - covered keys and their values
+//	error        - error, if any
+func (kt *KeyedTree[K, T]) SearchCovered(ctx context.Context, key K) (OpResult, []KeyedEntry[K, T], error) {
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return Error, nil, err
+	}
+
+	res, treeEntries, err := kt.tree.SearchCovered(ctx, data, mask)
+	if nil != err {
+		return res, nil, err
+	}
+
+	entries, err := kt.toEntries(treeEntries)
+	if nil != err {
+		return Error, nil, err
+	}
+
+	return res, entries, nil
+}
+
+// Returns a read-only view of the current contents of the tree. See Tree.Snapshot().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	*KeyedTree - read-only snapshot of the tree
+//	error      - error from the lock functions, if any
+func (kt *KeyedTree[K, T]) Snapshot(ctx context.Context) (*KeyedTree[K, T], error) {
+	snapshot, err := kt.tree.Snapshot(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	return &KeyedTree[K, T]{
+		tree:  snapshot,
+		codec: kt.codec,
+	}, nil
+}
+
+// Returns a deep copy of the tree. See Tree.Clone().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	*KeyedTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (kt *KeyedTree[K, T]) Clone(ctx context.Context) (*KeyedTree[K, T], error) {
+	return kt.CloneWith(ctx, nil)
+}
+
+// Returns a deep copy of the tree with a copy of every value. See Tree.CloneWith().
+// Arguments:
+//
+//	ctx     - context for the operation
+//	cloneFn - returns the copy of a value. The values are shared with the copy if nil.
+//
+// Returns:
+//
+//	*KeyedTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (kt *KeyedTree[K, T]) CloneWith(ctx context.Context, cloneFn CloneFn[T]) (*KeyedTree[K, T], error) {
+	clone, err := kt.tree.CloneWith(ctx, cloneFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return &KeyedTree[K, T]{
+		tree:  clone,
+		codec: kt.codec,
+	}, nil
+}
+
+// Returns the number of entries in the tree. Despite the name, nodes without an
+// entry are not counted, see Stats().
+// Returns:
+//
+//	uint64 - number of entries in the tree
+func (kt *KeyedTree[K, T]) GetNodesCount() uint64 {
+	return kt.tree.reader().numNodes
+}
+
+// Walk the tree and call passed function for all nodes
+// Arguments:
+//
+//	ctx - context for the operaton
+//	callback - function to be called for every value in the tree
+//
+// Returns:
+//
+//	err - nil if successful else an error
+func (kt *KeyedTree[K, T]) Walk(ctx context.Context, callback WalkerFn[T]) error {
+	if nil == callback {
+		return ErrNoWalkerFunction
+	}
+
+	return kt.tree.Walk(ctx, func(ctx context.Context, value T) error {
+		return callback(ctx, value)
+	})
+}
+
+// Walk the tree and call passed function for all nodes with the key of each node
+// Arguments:
+//
+//	ctx - context for the operaton
+//	callback - function to be called for every key/value in the tree. The key is
+//	           decoded by the codec of the tree.
+//
+// Returns:
+//
+//	err - nil if successful else an error. The error of the codec if a key cannot
+//	      be decoded.
+func (kt *KeyedTree[K, T]) WalkKeys(ctx context.Context, callback KeyedWalkerFn[K, T]) error {
+	if nil == callback {
+		return ErrNoWalkerFunction
+	}
+
+	return kt.tree.WalkKeys(ctx, func(ctx context.Context, key []byte, mask []byte, value T) error {
+		k, err := kt.decode(key, mask)
+		if nil != err {
+			return err
+		}
+
+		return callback(ctx, k, value)
+	})
+}
+
+// Walk the keys in the tree that are equal to or more specific than the given key
+// and call passed function with each
+// Arguments:
+//
+//	ctx      - context for the operaton
+//	key      - prefix to walk
+//	callback - function to be called for every covered key/value in the tree
+//
+// Returns:
+//
+//	err - nil if successful else an error
+func (kt *KeyedTree[K, T]) WalkPrefix(ctx context.Context, key K, callback KeyedWalkerFn[K, T]) error {
+	if nil == callback {
+		return ErrNoWalkerFunction
+	}
+
+	kb := getKeyBuffer()
+	defer putKeyBuffer(kb)
+
+	data, mask, err := kt.encode(kb, key)
+	if nil != err {
+		return err
+	}
+
+	return kt.tree.WalkPrefix(ctx, data, mask, func(ctx context.Context, key []byte, mask []byte, value T) error {
+		k, err := kt.decode(key, mask)
+		if nil != err {
+			return err
+		}
+
+		return callback(ctx, k, value)
+	})
+}
+
+// Returns an iterator over the keys and values in the tree, in walk order. The
+// iteration stops at a key that cannot be decoded.
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	iter.Seq2 - iterator over key/value pairs
+func (kt *KeyedTree[K, T]) All(ctx context.Context) iter.Seq2[K, T] {
+	return func(yield func(K, T) bool) {
+		c := kt.tree.NewCursor(ctx)
+		for c.Next() {
+			key, err := kt.decode(c.Key())
+			if nil != err || !yield(key, c.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// Returns an iterator over the keys in the tree along with their prefix length in bits,
+// in walk order. The iteration stops at a key that cannot be decoded.
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	iter.Seq2 - iterator over key/prefix length pairs
+func (kt *KeyedTree[K, T]) Prefixes(ctx context.Context) iter.Seq2[K, int] {
+	return func(yield func(K, int) bool) {
+		c := kt.tree.NewCursor(ctx)
+		for c.Next() {
+			key, err := kt.decode(c.Key())
+			if nil != err || !yield(key, c.plen) {
+				return
+			}
+		}
+	}
+}
+
+// Converts entries with string keys to those of a tree keyed by strings
+func toKeyedEntries[T any](entries []Entry[T]) []KeyedEntry[string, T] {
+	keyed := make([]KeyedEntry[string, T], len(entries))
+	for i := range entries {
+		keyed[i] = KeyedEntry[string, T](entries[i])
+	}
+
+	return keyed
+}
+
+// Converts the entries of a tree keyed by strings to entries with string keys
+func fromKeyedEntries[T any](keyed []KeyedEntry[string, T]) []Entry[T] {
+	if nil == keyed {
+		return nil
+	}
+
+	entries := make([]Entry[T], len(keyed))
+	for i := range keyed {
+		entries[i] = Entry[T](keyed[i])
+	}
+
+	return entries
+}
+
+// Codec for keys that are IP prefixes of either family. IPv4 and IPv6 prefixes are
+// kept apart by a leading byte with the family, so a lookup for an IPv4 address never
+// finds an IPv6 prefix. Unlike V4Tree and V6Tree, this makes 0.0.0.0/0 and ::/0 valid
+// keys. IPv4-mapped IPv6 addresses are IPv6 addresses. Host bits are dropped.
+type PrefixKeyCodec struct{}
+
+// Family bytes of PrefixKeyCodec
+const (
+	prefixFamilyV4 byte = 4
+	prefixFamilyV6 byte = 6
+)
+
+func (PrefixKeyCodec) AppendKey(buf []byte, prefix netip.Prefix) ([]byte, int, error) {
+	if !prefix.IsValid() {
+		return nil, 0, ErrInvalidKeyMask
+	}
+
+	prefix = prefix.Masked()
+	if prefix.Addr().Is4() {
+		addr := prefix.Addr().As4()
+		return append(append(buf, prefixFamilyV4), addr[:]...), 8 + prefix.Bits(), nil
+	}
+
+	addr := prefix.Addr().As16()
+	return append(append(buf, prefixFamilyV6), addr[:]...), 8 + prefix.Bits(), nil
+}
+
+func (PrefixKeyCodec) DecodeKey(data []byte, plen int) (netip.Prefix, error) {
+	if 0 == len(data) || plen < 8 {
+		return netip.Prefix{}, ErrInvalidEncoding
+	}
+
+	switch data[0] {
+	case prefixFamilyV4:
+		var addr [net.IPv4len]byte
+		copy(addr[:], data[1:])
+		return netip.AddrFrom4(addr).Prefix(plen - 8)
+
+	case prefixFamilyV6:
+		var addr [net.IPv6len]byte
+		copy(addr[:], data[1:])
+		return netip.AddrFrom16(addr).Prefix(plen - 8)
+	}
+
+	return netip.Prefix{}, ErrInvalidEncoding
+}
@@ -0,0 +1,289 @@
+package prefix_tree
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestKeyedTree_PrefixKeyCodec(t *testing.T) {
+	ctx := context.Background()
+
+	kt := NewKeyedTree[netip.Prefix, string](PrefixKeyCodec{})
+	for _, s := range []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "::/0", "2001:db8::/32", "::ffff:10.0.0.0/104"} {
+		if res, err := kt.Insert(ctx, netip.MustParsePrefix(s), s); res != Ok || err != nil {
+			t.Fatalf("Insert %s failed: %v %v", s, res, err)
+		}
+	}
+
+	// Host bits are dropped
+	if res, err := kt.Insert(ctx, netip.MustParsePrefix("10.1.2.3/16"), "dup"); res != Dup || err != nil {
+		t.Fatalf("expected Dup, got %v %v", res, err)
+	}
+
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"10.1.2.3", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"192.0.2.1", "0.0.0.0/0"},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"fe80::1", "::/0"},
+		{"::ffff:10.1.2.3", "::ffff:10.0.0.0/104"},
+	}
+
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		if res, v, err := kt.SearchLongest(ctx, netip.PrefixFrom(addr, addr.BitLen())); res != PartialMatch || v != tt.expected || err != nil {
+			t.Fatalf("SearchLongest %s failed: %v %v %v", tt.addr, res, v, err)
+		}
+	}
+
+	// Keys are walked as prefixes
+	var keys []netip.Prefix
+	err := kt.WalkKeys(ctx, func(ctx context.Context, key netip.Prefix, value string) error {
+		if key.String() != value {
+			return fmt.Errorf("key %s has value %s", key, value)
+		}
+
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || fmt.Sprint(keys) != "[0.0.0.0/0 10.0.0.0/8 10.1.0.0/16 ::/0 ::ffff:10.0.0.0/104 2001:db8::/32]" {
+		t.Fatalf("WalkKeys failed: %v %v", keys, err)
+	}
+
+	var all []netip.Prefix
+	for key := range kt.All(ctx) {
+		all = append(all, key)
+	}
+
+	if fmt.Sprint(all) != fmt.Sprint(keys) {
+		t.Fatalf("All mismatch: %v != %v", all, keys)
+	}
+
+	for key, plen := range kt.Prefixes(ctx) {
+		if plen != 8+key.Bits() {
+			t.Fatalf("unexpected prefix length %d for %s", plen, key)
+		}
+	}
+
+	res, entries, err := kt.SearchAll(ctx, netip.MustParsePrefix("10.1.2.0/24"))
+	if res != PartialMatch || err != nil || fmt.Sprint(entries) != "[{0.0.0.0/0 0.0.0.0/0} {10.0.0.0/8 10.0.0.0/8} {10.1.0.0/16 10.1.0.0/16}]" {
+		t.Fatalf("SearchAll failed: %v %v %v", res, entries, err)
+	}
+
+	res, entries, err = kt.DeletePrefixEntries(ctx, netip.MustParsePrefix("10.0.0.0/8"))
+	if res != Match || err != nil || 2 != len(entries) || entries[1].Key != netip.MustParsePrefix("10.1.0.0/16") {
+		t.Fatalf("DeletePrefixEntries failed: %v %v %v", res, entries, err)
+	}
+
+	if res, v, _ := kt.SearchLongest(ctx, netip.MustParsePrefix("10.1.2.3/32")); res != PartialMatch || v != "0.0.0.0/0" {
+		t.Fatalf("expected the default route, got %v %v", res, v)
+	}
+}
+
+// Key of a route of a tenant. Tenants never see the routes of other tenants.
+type tenantPrefix struct {
+	Tenant uint16
+	Prefix netip.Prefix
+}
+
+// Codec for tenantPrefix. The tenant leads the key, so a tenant is itself a prefix
+// of the keys of its routes.
+type tenantPrefixCodec struct{}
+
+func (tenantPrefixCodec) AppendKey(buf []byte, key tenantPrefix) ([]byte, int, error) {
+	buf = binary.BigEndian.AppendUint16(buf, key.Tenant)
+
+	buf, plen, err := PrefixKeyCodec{}.AppendKey(buf, key.Prefix)
+	return buf, 16 + plen, err
+}
+
+func (tenantPrefixCodec) DecodeKey(data []byte, plen int) (tenantPrefix, error) {
+	if len(data) < 2 || plen < 16 {
+		return tenantPrefix{}, ErrInvalidEncoding
+	}
+
+	prefix, err := PrefixKeyCodec{}.DecodeKey(data[2:], plen-16)
+	return tenantPrefix{Tenant: binary.BigEndian.Uint16(data), Prefix: prefix}, err
+}
+
+func TestKeyedTree_TupleCodec(t *testing.T) {
+	ctx := context.Background()
+
+	kt := NewKeyedTree[tenantPrefix, int](tenantPrefixCodec{}, WithRWMutex())
+	kt.Insert(ctx, tenantPrefix{1, netip.MustParsePrefix("10.0.0.0/8")}, 1)
+	kt.Insert(ctx, tenantPrefix{2, netip.MustParsePrefix("10.1.0.0/16")}, 2)
+	kt.Insert(ctx, tenantPrefix{2, netip.MustParsePrefix("2001:db8::/32")}, 3)
+
+	tests := []struct {
+		key      tenantPrefix
+		res      OpResult
+		expected int
+	}{
+		{tenantPrefix{1, netip.MustParsePrefix("10.1.2.3/32")}, PartialMatch, 1},
+		{tenantPrefix{2, netip.MustParsePrefix("10.1.2.3/32")}, PartialMatch, 2},
+		{tenantPrefix{2, netip.MustParsePrefix("10.2.0.1/32")}, Error, 0},
+		{tenantPrefix{3, netip.MustParsePrefix("10.1.2.3/32")}, Error, 0},
+		{tenantPrefix{2, netip.MustParsePrefix("2001:db8::/32")}, Match, 3},
+	}
+
+	for _, tt := range tests {
+		if res, v, _ := kt.SearchLongest(ctx, tt.key); res != tt.res || v != tt.expected {
+			t.Fatalf("SearchLongest %v failed: %v %v", tt.key, res, v)
+		}
+	}
+
+	// Routes of a tenant, using the tenant itself as the prefix
+	var routes []string
+	kt.tree.WalkPrefix(ctx, []byte{0, 2}, []byte{0xFF, 0xFF}, func(ctx context.Context, key []byte, mask []byte, value int) error {
+		tp, err := kt.decode(key, mask)
+		routes = append(routes, fmt.Sprint(tp, err))
+		return nil
+	})
+
+	if fmt.Sprint(routes) != "[{2 10.1.0.0/16} <nil> {2 2001:db8::/32} <nil>]" {
+		t.Fatalf("unexpected routes of tenant 2: %v", routes)
+	}
+
+	clone, err := kt.Clone(ctx)
+	if err != nil || clone.GetNodesCount() != 3 {
+		t.Fatalf("Clone failed: %v", err)
+	}
+
+	compiled, err := kt.Compile(ctx)
+	if err != nil || !compiled.Tree().IsReadOnly() {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	if res, v, _ := compiled.SearchLongest(ctx, tests[1].key); res != PartialMatch || v != 2 {
+		t.Fatalf("SearchLongest in the compiled tree failed: %v %v", res, v)
+	}
+
+	stats, err := compiled.Stats(ctx)
+	if err != nil || 3 != stats.Entries {
+		t.Fatalf("unexpected stats %+v %v", stats, err)
+	}
+}
+
+// Codec returning prefix lengths longer than its keys
+type longPrefixCodec struct{}
+
+func (longPrefixCodec) AppendKey(buf []byte, key byte) ([]byte, int, error) {
+	return append(buf, key), 9, nil
+}
+
+func (longPrefixCodec) DecodeKey(data []byte, plen int) (byte, error) {
+	return data[0], nil
+}
+
+func TestKeyedTree_CodecErrors(t *testing.T) {
+	ctx := context.Background()
+
+	kt := NewKeyedTree[netip.Prefix, int](PrefixKeyCodec{})
+	for _, prefix := range []netip.Prefix{{}, netip.PrefixFrom(netip.MustParseAddr("10.0.0.0"), 33)} {
+		if res, err := kt.Insert(ctx, prefix, 1); res != Error || err != ErrInvalidKeyMask {
+			t.Fatalf("expected ErrInvalidKeyMask for %v, got %v %v", prefix, res, err)
+		}
+
+		if res, _, err := kt.SearchLongest(ctx, prefix); res != Error || err != ErrInvalidKeyMask {
+			t.Fatalf("expected ErrInvalidKeyMask for %v, got %v %v", prefix, res, err)
+		}
+	}
+
+	lt := NewKeyedTree[byte, int](longPrefixCodec{})
+	if res, err := lt.Insert(ctx, 1, 1); res != Error || err != ErrInvalidKeyMask {
+		t.Fatalf("expected ErrInvalidKeyMask, got %v %v", res, err)
+	}
+
+	// Keys that cannot be decoded stop the walks
+	kt.Insert(ctx, netip.MustParsePrefix("10.0.0.0/8"), 1)
+	kt.tree.Insert(ctx, []byte{9, 0}, []byte{0xFF, 0xFF}, 2)
+
+	err := kt.WalkKeys(ctx, func(ctx context.Context, key netip.Prefix, value int) error {
+		return nil
+	})
+	if err != ErrInvalidEncoding {
+		t.Fatalf("expected ErrInvalidEncoding, got %v", err)
+	}
+
+	count := 0
+	for range kt.All(ctx) {
+		count++
+	}
+
+	if 1 != count {
+		t.Fatalf("expected All to stop at the invalid key, got %d entries", count)
+	}
+
+	if err := kt.WalkKeys(ctx, nil); err != ErrNoWalkerFunction {
+		t.Fatalf("expected ErrNoWalkerFunction, got %v", err)
+	}
+}
+
+func TestKeyedTree_Wrappers(t *testing.T) {
+	ctx := context.Background()
+
+	// The wrappers are keyed trees, so their keys can be walked as such
+	rst := NewReversedStringsTree[int]().(*ReversedStringsTree[int])
+	rst.Insert(ctx, "example.com", 1)
+	rst.Insert(ctx, "www.example.com", 2)
+
+	var keys []string
+	rst.KeyedTree.WalkPrefix(ctx, "example.com", func(ctx context.Context, key string, value int) error {
+		keys = append(keys, key)
+		return nil
+	})
+
+	if fmt.Sprint(keys) != "[example.com www.example.com]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	tests := []struct {
+		codec    KeyCodec[string]
+		key      string
+		plen     int
+		expected string
+	}{
+		{V4KeyCodec{}, "10.1.2.3/16", 16, "10.1.0.0/16"},
+		{V4KeyCodec{}, "10.1.2.3", 32, "10.1.2.3/32"},
+		{V6KeyCodec{}, "2001:db8::1/32", 32, "2001:db8::/32"},
+		{StringKeyCodec{}, "example.com", 88, "example.com"},
+		{ReversedStringKeyCodec{}, "bücher.de", 80, "bücher.de"},
+	}
+
+	for _, tt := range tests {
+		data, plen, err := tt.codec.AppendKey(nil, tt.key)
+		if err != nil || plen != tt.plen {
+			t.Fatalf("AppendKey %s failed: %v %v", tt.key, plen, err)
+		}
+
+		if key, err := tt.codec.DecodeKey(data, plen); err != nil || key != tt.expected {
+			t.Fatalf("DecodeKey %s failed: %v %v", tt.key, key, err)
+		}
+	}
+
+	if _, _, err := (V4KeyCodec{}).AppendKey(nil, "2001:db8::1"); err == nil {
+		t.Fatalf("expected an error for an IPv6 address")
+	}
+}
+
+func TestKeyedTree_SearchAllocs(t *testing.T) {
+	ctx := context.Background()
+
+	kt := NewKeyedTree[netip.Prefix, int](PrefixKeyCodec{})
+	kt.Insert(ctx, netip.MustParsePrefix("10.0.0.0/8"), 1)
+	kt.Insert(ctx, netip.MustParsePrefix("2001:db8::/32"), 2)
+
+	for _, s := range []string{"10.1.2.3/32", "2001:db8::1/128", "192.0.2.1/32"} {
+		prefix := netip.MustParsePrefix(s)
+		assertNoAllocs(t, "Search "+s, func() {
+			kt.SearchExact(ctx, prefix)
+			kt.SearchLongest(ctx, prefix)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package prefix_tree
+
+// Node layouts of a Tree. A Tree validates keys and masks, takes the locks and keeps
+// the entry count. Storing and finding the entries is left to its layout.
+//
+// Keys are passed to a layout as a byte slice and a prefix length in bits. The prefix
+// length is never 0, unless noted otherwise, and the key is always at least that many
+// bits long. Callers must hold the appropriate locks.
+
+type treeLayout[T any] interface {
+	// Stores the value for the key. Returns Dup if the key is already stored.
+	insert(key []byte, plen int, value T) (OpResult, error)
+
+	// Replaces the value stored for the key. Returns whether the key was found.
+	update(key []byte, plen int, value T) bool
+
+	// Removes the key. Returns the value stored for it and whether it was found.
+	remove(key []byte, plen int) (T, bool)
+
+	// Removes every entry equal to or more specific than the key. Calls visitFn,
+	// if set, for every entry removed. Returns the number of entries removed.
+	prune(key []byte, plen int, visitFn func([]byte, int, T)) int
+
+	// Finds the entry for the key according to the match type. Returns the value
+	// stored for the entry, its prefix length in bits and whether it was found.
+	find(key []byte, plen int, mType MatchType) (T, int, bool)
+
+	// Calls visitFn for every entry on the path of the key, from the least to the
+	// most specific, with the prefix length of the entry in bits and its value.
+	trace(key []byte, plen int, visitFn func(int, T))
+
+	// Calls visitFn for every entry equal to or more specific than the key in walk
+	// order, with the key bytes, the prefix length in bits and the value. A prefix
+	// length of 0 visits every entry. The key bytes are only valid for the duration
+	// of the call. Stops at the first error returned by visitFn.
+	walk(key []byte, plen int, visitFn func([]byte, int, T) error) error
+
+	// Freezes the current version of the layout. Later changes copy the nodes they
+	// modify instead of modifying them in place (path copying). Only called for
+	// persistent trees.
+	freeze()
+
+	// Returns a read-only layout that shares the nodes of the current version. The
+	// current version must be frozen, so later changes never affect the snapshot.
+	// Only called for persistent trees.
+	snapshot() treeLayout[T]
+
+	// Returns a new empty layout with the same configuration, e.g. the same stride
+	empty() treeLayout[T]
+
+	// Returns a deep copy of the current version that shares no nodes with it. Every
+	// value is passed through cloneFn, if set.
+	clone(cloneFn CloneFn[T]) treeLayout[T]
+
+	// Returns a new layout with the result of a set operation between the current
+	// versions of the layout and another, see setops.go, and the number of entries
+	// in it. Returns false if the other layout has a different configuration.
+	merge(other treeLayout[T], op setOp, resolveFn ResolveFn[T]) (treeLayout[T], int, bool)
+
+	// Adds the node counts, depths and sizes of the current version to the stats,
+	// see stats.go
+	stats(stats *treeStats)
+
+	// Returns the first entry at or after the key in walk order. The key itself
+	// is only returned if inclusive is set. Returns the key bytes of the entry,
+	// its prefix length in bits, its value and whether an entry was found.
+	seek(key []byte, plen int, inclusive bool) ([]byte, int, T, bool)
+}
@@ -0,0 +1,82 @@
+package prefix_tree
+
+// Allocation free lookups for the wrappers. A key handed to a layout escapes to the
+// heap, so a lookup borrows its key buffer from a pool instead of allocating one.
+// Masks are never built: the mask of a string is implied to be all ones and that of
+// an address is parsed into a prefix length, see Tree.searchPrefix().
+
+import (
+	"slices"
+	"sync"
+	"unicode/utf8"
+)
+
+// Buffers larger than this are not returned to the pool, so that a single long key
+// does not pin its buffer for the lifetime of the process
+const maxPooledKeyLen = 4096
+
+// Buffer for the key of a lookup, see getKeyBuffer()
+type keyBuffer struct {
+	key  []byte
+	mask []byte
+}
+
+var keyBuffers = sync.Pool{
+	New: func() any {
+		return new(keyBuffer)
+	},
+}
+
+// Borrows a key buffer from the pool. Must be returned with putKeyBuffer().
+// Returns:
+//
+//	*keyBuffer - key buffer
+func getKeyBuffer() *keyBuffer {
+	return keyBuffers.Get().(*keyBuffer)
+}
+
+// Returns a key buffer to the pool. The buffer must not be used afterwards.
+// Arguments:
+//
+//	kb - key buffer
+func putKeyBuffer(kb *keyBuffer) {
+	if cap(kb.key) > maxPooledKeyLen || cap(kb.mask) > maxPooledKeyLen {
+		return
+	}
+
+	keyBuffers.Put(kb)
+}
+
+// Returns a mask for the key of the buffer with the first plen bits set
+// Arguments:
+//
+//	plen - prefix length in bits
+//
+// Returns:
+//
+//	[]byte - mask of the same length as the key
+func (kb *keyBuffer) maskOf(plen int) []byte {
+	kb.mask = slices.Grow(kb.mask[:0], len(kb.key))[:len(kb.key)]
+	setMask(kb.mask, plen)
+	return kb.mask
+}
+
+// Appends the string to the byte slice with its characters in reverse order. Invalid
+// UTF-8 bytes are appended as utf8.RuneError, like a conversion to []rune does.
+// Arguments:
+//
+//	dst - byte slice to append to
+//	s   - string to be reversed
+//
+// Returns:
+//
+//	[]byte - extended byte slice
+func appendReversed(dst []byte, s string) []byte {
+	for i := len(s); i > 0; {
+		r, size := utf8.DecodeLastRuneInString(s[:i])
+		dst = utf8.AppendRune(dst, r)
+		i -= size
+	}
+
+	return dst
+}
@@ -0,0 +1,128 @@
+package prefix_tree
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Fails if fn allocates. Skipped with the race detector, which defeats the key pool.
+func assertNoAllocs(tb testing.TB, name string, fn func()) {
+	tb.Helper()
+	if raceEnabled {
+		return
+	}
+
+	if allocs := testing.AllocsPerRun(100, fn); 0 != allocs {
+		tb.Fatalf("%s: expected no allocations, got %v", name, allocs)
+	}
+}
+
+func TestAppendReversed(t *testing.T) {
+	// Reverses the string the way reverseString() used to
+	reverseRunes := func(s string) string {
+		sr := []rune(s)
+		for i, j := 0, len(sr)-1; i < j; i, j = i+1, j-1 {
+			sr[i], sr[j] = sr[j], sr[i]
+		}
+
+		return string(sr)
+	}
+
+	tests := []string{"", "a", "google.com", "bücher.de", "例子.测试", "\xff", "a\xe2\x82", "\xf0\x9f\x98", "\xc3\xa9\xa9", "\xed\xa0\x80"}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, random.Intn(12))
+		for j := range b {
+			b[j] = []byte{'a', 0x80, 0xa9, 0xc3, 0xe2, 0xed, 0xf0, 0xff}[random.Intn(8)]
+		}
+		tests = append(tests, string(b))
+	}
+
+	for _, s := range tests {
+		if expected, actual := reverseRunes(s), string(appendReversed(nil, s)); expected != actual {
+			t.Fatalf("appendReversed(%q) = %q, expected %q", s, actual, expected)
+		}
+	}
+
+	if reverseString("moc.elgoog") != "google.com" {
+		t.Fatalf("unexpected reverseString %q", reverseString("moc.elgoog"))
+	}
+}
+
+func TestPrefixTree_SearchAllocs(t *testing.T) {
+	ctx := context.Background()
+
+	misses := map[string]string{
+		"V4":              "192.0.2.1",
+		"V6":              "2001:db9::1",
+		"Strings":         "example.net",
+		"ReversedStrings": "example.net",
+	}
+
+	for _, tt := range testPrefixTrees() {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := tt.newTree()
+			for i, key := range tt.keys {
+				tree.Insert(ctx, key, testRoute{ASN: 64512 + i, Name: "route " + key})
+			}
+
+			compiled, _ := tree.Compile(ctx)
+
+			for _, tree := range []PrefixTree[testRoute]{tree, compiled} {
+				for _, key := range tt.keys {
+					assertNoAllocs(t, "Search "+key, func() {
+						tree.Search(ctx, key)
+						tree.SearchExact(ctx, key)
+						tree.SearchShortest(ctx, key)
+						tree.SearchLongest(ctx, key)
+					})
+				}
+
+				// Misses do not allocate either
+				assertNoAllocs(t, "Search miss", func() {
+					tree.SearchExact(ctx, misses[tt.name])
+					tree.SearchLongest(ctx, misses[tt.name])
+				})
+			}
+		})
+	}
+}
+
+func TestPrefixTree_SearchPrefixLen(t *testing.T) {
+	ctx := context.Background()
+
+	v4t := NewV4Tree[int]()
+	v4t.Insert(ctx, "10.0.0.0/8", 8)
+	v4t.Insert(ctx, "10.1.2.0/24", 24)
+
+	v6t := NewV6Tree[int]()
+	v6t.Insert(ctx, "2001:db8::/32", 32)
+
+	tests := []struct {
+		tree     PrefixTree[int]
+		saddr    string
+		expected string
+	}{
+		{v4t, "10.1.2.3", "4 24 <nil>"},
+		{v4t, "10.1.2.0/24", "3 24 <nil>"},
+		{v4t, "10.1.0.0/16", "4 8 <nil>"},
+		{v4t, "10.1.2.3/8", "3 8 <nil>"},
+		{v4t, "::ffff:10.1.2.3", "4 24 <nil>"},
+		{v4t, "0.0.0.0/0", "0 0 " + ErrInvalidKeyMask.Error()},
+		{v4t, "::ffff:10.1.2.3/120", "0 0 " + ErrInvalidKeyMask.Error()},
+		{v4t, "2001:db8::1", "0 0 invalid v4 address 2001:db8::1"},
+		{v6t, "2001:db8::1", "4 32 <nil>"},
+		{v6t, "2001:db8::/32", "3 32 <nil>"},
+		{v6t, "10.1.2.3", "0 0 invalid v6 address 10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		res, value, err := tt.tree.SearchLongest(ctx, tt.saddr)
+		if actual := fmt.Sprint(res, value, err); actual != tt.expected {
+			t.Fatalf("SearchLongest %s: expected %s, got %s", tt.saddr, tt.expected, actual)
+		}
+	}
+}
@@ -1,5 +1,13 @@
 package prefix_tree
 
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// Maximum number of bits a node can skip in a path compressed tree
+const maxSkipLen = 64
+
 // Node represents a node in the prefix tree.
 type Node[T any] struct {
 	right *Node[T]
@@ -9,6 +17,39 @@ type Node[T any] struct {
 	value    T // Can be nil
 }
 
+// Node of a path compressed tree. The nodes of a tree are linked by the Node they
+// start with, so a *Node of a path compressed tree points to a compressedNode. Trees
+// that are not path compressed do without the fields. See binaryLayout.newNode().
+type compressedNode[T any] struct {
+	Node[T]
+
+	// Bits that follow the branch bit leading to this node
+	skip    uint64 // skipped bits, right aligned
+	skipLen uint8  // number of skipped bits
+}
+
+// Node of a persistent tree
+type persistentNode[T any] struct {
+	Node[T]
+
+	// Version of the tree that created the node. Nodes of an older version are
+	// shared with snapshots and copied before they are modified.
+	gen uint64
+}
+
+// Node of a persistent path compressed tree
+type persistentCompressedNode[T any] struct {
+	compressedNode[T]
+
+	// See persistentNode
+	gen uint64
+}
+
+// Returns the compressedNode that a node of a path compressed tree starts
+func asCompressed[T any](node *Node[T]) *compressedNode[T] {
+	return (*compressedNode[T])(unsafe.Pointer(node))
+}
+
 // Root node. Same as Node.
 type RootNode[T any] struct {
 	*Node[T]
@@ -28,6 +69,62 @@ func (n *Node[T]) IsLeaf() bool {
 	return nil == n.right && nil == n.left
 }
 
+// Returns the child for the given bit. Bit 1 is the right child, bit 0 is the left child.
+func (n *Node[T]) getChild(bit byte) *Node[T] {
+	if 1 == bit {
+		return n.right
+	}
+
+	return n.left
+}
+
+// Sets the child for the given bit. Bit 1 is the right child, bit 0 is the left child.
+func (n *Node[T]) setChild(bit byte, child *Node[T]) {
+	if 1 == bit {
+		n.right = child
+	} else {
+		n.left = child
+	}
+}
+
+// Returns the number of leading skipped bits of the node that match the key bits
+// [bitIdx, plen). Also stops at the end of the key.
+func (n *compressedNode[T]) matchSkip(key []byte, bitIdx int, plen int) int {
+	return matchSkip(n.skip, int(n.skipLen), key, bitIdx, plen)
+}
+
+// Returns the number of leading skipped bits that match the key bits [bitIdx, plen).
+// Also stops at the end of the key.
+// Arguments:
+//
+//	skip    - skipped bits, right aligned
+//	skipLen - number of skipped bits
+//	key     - key expressed as byte slice
+//	bitIdx  - index of the key bit to match the first skipped bit with
+//	plen    - prefix length of the key in bits
+//
+// Returns:
+//
+//	int - number of matching bits
+func matchSkip(skip uint64, skipLen int, key []byte, bitIdx int, plen int) int {
+	count := min(skipLen, plen-bitIdx)
+	if count <= 0 {
+		return 0
+	}
+
+	diff := getBits(key, bitIdx, count) ^ (skip >> (skipLen - count))
+	if 0 == diff {
+		return count
+	}
+
+	return bits.LeadingZeros64(diff << (64 - count))
+}
+
+// Returns the skipped bit at the given index. Index 0 is the first skipped bit.
+func (n *compressedNode[T]) getSkipBit(idx int) byte {
+	return byte(n.skip>>(int(n.skipLen)-1-idx)) & 1
+}
+
 func (n *Node[T]) IsTerminal() bool {
 	return n.terminal
 }
@@ -45,6 +142,14 @@ func (n *Node[T]) SaveAndMarkTerminal(value T) {
 	n.MarkTerminal()
 }
 
+// Node along with its position in the tree. Used by traversals that need
+// to rebuild the key of a node.
+type nodeFrame[T any] struct {
+	node  *Node[T]
+	depth int  // depth of the node, which is also its prefix length in bits
+	bit   byte // bit that leads from the parent to the node
+}
+
 // treeNodeStack is a simple stack implementation for treeNode pointers.
 // Used to assist in tree traversals.
 type NodeStack[T any] struct {
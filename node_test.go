@@ -2,6 +2,7 @@ package prefix_tree
 
 import (
 	"testing"
+	"unsafe"
 )
 
 func TestTreeNode(t *testing.T) {
@@ -35,6 +36,28 @@ func TestTreeNode(t *testing.T) {
 	}
 }
 
+func TestTreeNodeSize(t *testing.T) {
+	// Two children, the terminal flag and the value. Path compression and versions
+	// only take memory in the trees that use them.
+	if size := unsafe.Sizeof(Node[int]{}); size != 32 {
+		t.Fatalf("expected 32 bytes per node, got %d", size)
+	}
+
+	for name, tt := range map[string]struct {
+		tree *Tree[int]
+		size uintptr
+	}{
+		"Binary":               {NewTree[int](), unsafe.Sizeof(Node[int]{})},
+		"Compressed":           {NewCompressedTree[int](), unsafe.Sizeof(compressedNode[int]{})},
+		"Persistent":           {NewPersistentTree[int](), unsafe.Sizeof(persistentNode[int]{})},
+		"PersistentCompressed": {NewPersistentTree[int](WithPathCompression()), unsafe.Sizeof(persistentCompressedNode[int]{})},
+	} {
+		if size := tt.tree.layout.(*binaryLayout[int]).nodeSize(); size != tt.size {
+			t.Fatalf("%s: expected %d bytes per node, got %d", name, tt.size, size)
+		}
+	}
+}
+
 func TestTreeNodeStack(t *testing.T) {
 	stack := NewNodeStack[string]()
 	if stack == nil {
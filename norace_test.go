@@ -0,0 +1,5 @@
+//go:build !race
+
+package prefix_tree
+
+const raceEnabled = false
@@ -0,0 +1,323 @@
+package prefix_tree
+
+// Functional options for the tree constructors. Options configure the locking of a
+// tree and its mode. For e.g.
+//
+//	tree := NewV4Tree[string](WithRWMutex())
+//
+// A tree without lock options takes no locks and is not safe for concurrent use.
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Configures a tree when passed to a constructor
+type Option func(*treeOptions)
+
+type treeOptions struct {
+	// Lock functions. Unset functions are not called.
+	rlockFn   func(context.Context) error
+	runlockFn func(context.Context)
+	wlockFn   func(context.Context) error
+	unlockFn  func(context.Context)
+
+	compressed bool
+	arena      bool
+	stride     int // bits consumed per node of a multibit stride tree. 0 for a binary tree.
+	persistent bool
+	rcu        bool
+
+	// Error of an invalid option, set by WithStride(). Fails every operation of the tree.
+	err error
+
+	codec any // ValueCodec of the value type of the tree
+
+	// Options applied, in order. A clone applies them again to get the same
+	// configuration, with locks of its own.
+	opts []Option
+}
+
+// Applies options in order. A later option overrides an earlier one.
+// Arguments:
+//
+//	opts - options to apply
+//
+// Returns:
+//
+//	*treeOptions - resulting configuration
+func newTreeOptions(opts []Option) *treeOptions {
+	options := &treeOptions{opts: slices.Clone(opts)}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return options
+}
+
+// Locks the tree with the given lock handlers. Handlers that are nil are not called.
+// Arguments:
+//
+//	rlockFn   - read lock function
+//	runlockFn - read unlock function
+//	wlockFn   - write lock function
+//	unlockFn  - unlock function
+//
+// Returns:
+//
+//	Option - tree option
+func WithLockHandlers(rlockFn ReadLockFn, runlockFn ReadUnlockFn, wlockFn WriteLockFn, unlockFn UnlockFn) Option {
+	return func(o *treeOptions) {
+		o.rlockFn, o.wlockFn = nil, nil
+		if nil != rlockFn {
+			o.rlockFn = func(ctx context.Context) error {
+				rlockFn(ctx)
+				return nil
+			}
+		}
+
+		if nil != wlockFn {
+			o.wlockFn = func(ctx context.Context) error {
+				wlockFn(ctx)
+				return nil
+			}
+		}
+
+		o.runlockFn = runlockFn
+		o.unlockFn = unlockFn
+	}
+}
+
+// Locks the tree with a sync.RWMutex of its own. Readers share the lock, writers
+// hold it exclusively.
+// Returns:
+//
+//	Option - tree option
+func WithRWMutex() Option {
+	return func(o *treeOptions) {
+		mu := &sync.RWMutex{}
+
+		o.rlockFn = func(context.Context) error {
+			mu.RLock()
+			return nil
+		}
+		o.runlockFn = func(context.Context) {
+			mu.RUnlock()
+		}
+		o.wlockFn = func(context.Context) error {
+			mu.Lock()
+			return nil
+		}
+		o.unlockFn = func(context.Context) {
+			mu.Unlock()
+		}
+	}
+}
+
+// Locks the tree with a read/write lock of its own that honours the context of each
+// operation. An operation that cannot take the lock before its context is done fails
+// with the error of the context, e.g. context.DeadlineExceeded, instead of blocking.
+// Returns:
+//
+//	Option - tree option
+func WithContextLock() Option {
+	return func(o *treeOptions) {
+		mu := &ctxRWMutex{}
+
+		o.rlockFn = mu.RLock
+		o.runlockFn = func(context.Context) {
+			mu.RUnlock()
+		}
+		o.wlockFn = mu.Lock
+		o.unlockFn = func(context.Context) {
+			mu.Unlock()
+		}
+	}
+}
+
+// Folds runs of bits without a branch or an entry into a single node. See
+// NewCompressedTree(). Ignored by stride trees.
+// Returns:
+//
+//	Option - tree option
+func WithPathCompression() Option {
+	return func(o *treeOptions) {
+		o.compressed = true
+	}
+}
+
+// Allocates the nodes from slabs instead of one by one. See NewArenaTree().
+// Ignored by stride trees. Arena trees are not path compressed.
+//
+// Ignored with WithPersistence() or WithRCU(). The versions of those trees share
+// nodes, and an arena cannot tell when a shared node is no longer in use, so it
+// could never reuse them. Such trees use the default layout. For the same reason,
+// Snapshot() copies an arena tree in O(n).
+// Returns:
+//
+//	Option - tree option
+func WithArena() Option {
+	return func(o *treeOptions) {
+		o.arena = true
+	}
+}
+
+// Uses a multibit stride layout. Every node consumes stride bits of a key, so a lookup
+// visits at most one node per stride bits. Prefixes that end between two stride
+// boundaries are expanded to the boundary (controlled prefix expansion), so a longest
+// match needs no backtracking. Larger strides trade memory for fewer node visits.
+// Results are the same as those of a binary tree.
+//
+// WithPathCompression() and WithArena() are ignored. A stride out of range fails every
+// operation of the tree with ErrInvalidStride.
+// Arguments:
+//
+//	stride - number of bits consumed per node, from 1 to 8. 4 and 8 are typical.
+//
+// Returns:
+//
+//	Option - tree option
+func WithStride(stride int) Option {
+	return func(o *treeOptions) {
+		if stride < 1 || stride > maxStride {
+			o.stride, o.err = 0, ErrInvalidStride
+			return
+		}
+
+		o.stride, o.err = stride, nil
+	}
+}
+
+// Copies the nodes modified by every write instead of modifying them in place.
+// See NewPersistentTree().
+// Returns:
+//
+//	Option - tree option
+func WithPersistence() Option {
+	return func(o *treeOptions) {
+		o.persistent = true
+	}
+}
+
+// Lets readers go without locks. See NewRCUTree(). Read lock handlers are never
+// called. Writers use the write lock handlers, if set, or a mutex of their own.
+// Returns:
+//
+//	Option - tree option
+func WithRCU() Option {
+	return func(o *treeOptions) {
+		o.rcu = true
+	}
+}
+
+// Encodes and decodes the values of the tree with the given codec. See ValueCodec.
+// The codec must be for the value type of the tree, otherwise encoding and decoding
+// fail with ErrInvalidValueCodec.
+// Arguments:
+//
+//	codec - value codec
+//
+// Returns:
+//
+//	Option - tree option
+func WithValueCodec[T any](codec ValueCodec[T]) Option {
+	return func(o *treeOptions) {
+		o.codec = codec
+	}
+}
+
+// Read/write lock that gives up when the context of the caller is done. Writers
+// are preferred, so a steady stream of readers cannot starve them.
+type ctxRWMutex struct {
+	mu sync.Mutex
+
+	readers int  // number of readers holding the lock
+	writer  bool // whether a writer holds the lock
+	waiting int  // number of writers waiting for the lock
+
+	// Closed when the lock is released. Only allocated when someone waits.
+	released chan struct{}
+}
+
+// Returns the channel that is closed when the lock is next released. Called with mu held.
+func (m *ctxRWMutex) waitCh() chan struct{} {
+	if nil == m.released {
+		m.released = make(chan struct{})
+	}
+
+	return m.released
+}
+
+// Wakes up every waiter. Called with mu held.
+func (m *ctxRWMutex) wake() {
+	if nil != m.released {
+		close(m.released)
+		m.released = nil
+	}
+}
+
+func (m *ctxRWMutex) RLock(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		if !m.writer && 0 == m.waiting {
+			m.readers++
+			m.mu.Unlock()
+			return nil
+		}
+
+		released := m.waitCh()
+		m.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *ctxRWMutex) RUnlock() {
+	m.mu.Lock()
+	m.readers--
+	if 0 == m.readers {
+		m.wake()
+	}
+	m.mu.Unlock()
+}
+
+func (m *ctxRWMutex) Lock(ctx context.Context) error {
+	m.mu.Lock()
+	m.waiting++
+
+	for m.writer || m.readers > 0 {
+		released := m.waitCh()
+		m.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.waiting--
+
+			// Readers held back by this writer may go on
+			m.wake()
+			m.mu.Unlock()
+			return ctx.Err()
+		}
+
+		m.mu.Lock()
+	}
+
+	m.waiting--
+	m.writer = true
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *ctxRWMutex) Unlock() {
+	m.mu.Lock()
+	m.writer = false
+	m.wake()
+	m.mu.Unlock()
+}
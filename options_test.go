@@ -0,0 +1,223 @@
+package prefix_tree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithRWMutex(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int](WithRWMutex())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 256; i++ {
+				v4t.Insert(ctx, fmt.Sprintf("10.%d.%d.0/24", w, i), i)
+				v4t.SearchLongest(ctx, fmt.Sprintf("10.%d.%d.1", w, i))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := v4t.GetNodesCount(); count != 4*256 {
+		t.Fatalf("expected %d entries, got %d", 4*256, count)
+	}
+}
+
+func TestWithLockHandlers(t *testing.T) {
+	ctx := context.Background()
+
+	var rlocks, runlocks, wlocks, unlocks int
+	tr := NewTree[int](WithLockHandlers(
+		func(context.Context) { rlocks++ },
+		func(context.Context) { runlocks++ },
+		func(context.Context) { wlocks++ },
+		func(context.Context) { unlocks++ },
+	))
+
+	key := []byte{10, 0, 0, 0}
+	mask := []byte{0xFF, 0, 0, 0}
+	tr.Insert(ctx, key, mask, 1)
+	tr.Search(ctx, key, mask, Exact)
+	tr.Delete(ctx, key, mask)
+
+	if rlocks != 1 || runlocks != 1 || wlocks != 2 || unlocks != 2 {
+		t.Fatalf("unexpected lock calls %d %d %d %d", rlocks, runlocks, wlocks, unlocks)
+	}
+
+	// Handlers left unset are not called
+	tr = NewTree[int](WithLockHandlers(nil, nil, func(context.Context) { wlocks++ }, nil))
+	if res, err := tr.Insert(ctx, key, mask, 1); err != nil || res != Ok {
+		t.Fatalf("Insert failed: %v %v", res, err)
+	}
+	if res, _, err := tr.Search(ctx, key, mask, Exact); err != nil || res != Match {
+		t.Fatalf("Search failed: %v %v", res, err)
+	}
+}
+
+func TestWithContextLock(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int](WithContextLock())
+	tr := v4t.(*V4Tree[int]).tree
+
+	v4t.Insert(ctx, "10.0.0.0/8", 1)
+
+	// A writer holds the lock, so every operation gives up when its context is done
+	if err := tr.wlock(ctx); err != nil {
+		t.Fatalf("wlock failed: %v", err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	if res, err := v4t.Insert(timeoutCtx, "10.1.0.0/16", 2); !errors.Is(err, context.DeadlineExceeded) || res != Error {
+		t.Fatalf("Insert: expected deadline exceeded, got %v %v", res, err)
+	}
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if res, _, err := v4t.SearchExact(cancelledCtx, "10.0.0.0/8"); !errors.Is(err, context.Canceled) || res != Error {
+		t.Fatalf("Search: expected canceled, got %v %v", res, err)
+	}
+
+	if res, _, err := v4t.Delete(cancelledCtx, "10.0.0.0/8"); !errors.Is(err, context.Canceled) || res != Error {
+		t.Fatalf("Delete: expected canceled, got %v %v", res, err)
+	}
+
+	if err := v4t.WalkKeys(cancelledCtx, func(context.Context, string, int) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WalkKeys: expected canceled, got %v", err)
+	}
+
+	cursor := v4t.Cursor(cancelledCtx)
+	if cursor.Next() || !errors.Is(cursor.Err(), context.Canceled) {
+		t.Fatalf("Cursor: expected canceled, got %v", cursor.Err())
+	}
+
+	if _, err := v4t.Snapshot(cancelledCtx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Snapshot: expected canceled, got %v", err)
+	}
+
+	tr.unlock(ctx)
+
+	// Nothing was changed and the lock is free again
+	if res, v, err := v4t.SearchExact(ctx, "10.0.0.0/8"); err != nil || res != Match || v != 1 {
+		t.Fatalf("Search failed: %v %v %v", res, v, err)
+	}
+	if res, err := v4t.Insert(ctx, "10.1.0.0/16", 2); err != nil || res != Ok {
+		t.Fatalf("Insert failed: %v %v", res, err)
+	}
+}
+
+func TestWithContextLock_Readers(t *testing.T) {
+	ctx := context.Background()
+	tr := NewTree[int](WithContextLock())
+
+	key := []byte{10, 0, 0, 0}
+	mask := []byte{0xFF, 0, 0, 0}
+
+	// Readers share the lock and keep writers out
+	if err := tr.rlock(ctx); err != nil {
+		t.Fatalf("rlock failed: %v", err)
+	}
+	if res, _, err := tr.Search(ctx, key, mask, Exact); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Search while read locked: %v %v", res, err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	if res, err := tr.Insert(timeoutCtx, key, mask, 1); !errors.Is(err, context.DeadlineExceeded) || res != Error {
+		t.Fatalf("Insert: expected deadline exceeded, got %v %v", res, err)
+	}
+
+	// The writer gave up, which lets new readers in again
+	if res, _, err := tr.Search(ctx, key, mask, Exact); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Search after the writer gave up: %v %v", res, err)
+	}
+
+	// A waiting writer takes the lock once the readers are gone
+	done := make(chan error)
+	go func() {
+		_, err := tr.Insert(ctx, key, mask, 1)
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	tr.runlock(ctx)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if res, v, err := tr.Search(ctx, key, mask, Exact); err != nil || res != Match || v != 1 {
+		t.Fatalf("Search failed: %v %v %v", res, v, err)
+	}
+}
+
+func TestWithContextLock_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	tr := NewTree[int](WithContextLock())
+
+	mask := []byte{0xFF, 0xFF, 0xFF, 0}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 256; i++ {
+				if _, err := tr.Insert(ctx, []byte{10, byte(w), byte(i), 0}, mask, i); err != nil {
+					t.Errorf("Insert failed: %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 256; i++ {
+				// Some readers give up, which must not leave the lock behind
+				readCtx, cancel := context.WithTimeout(ctx, time.Duration(i%4)*time.Microsecond)
+				tr.Search(readCtx, []byte{10, byte(w), byte(i), 0}, mask, Exact)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if tr.numNodes != 4*256 {
+		t.Fatalf("expected %d entries, got %d", 4*256, tr.numNodes)
+	}
+}
+
+func TestWithRCU_ContextLock(t *testing.T) {
+	ctx := context.Background()
+	tr := NewRCUTree[int](WithContextLock())
+
+	key := []byte{10, 0, 0, 0}
+	mask := []byte{0xFF, 0, 0, 0}
+	tr.Insert(ctx, key, mask, 1)
+
+	if err := tr.wlock(ctx); err != nil {
+		t.Fatalf("wlock failed: %v", err)
+	}
+
+	// Readers of a RCU tree never wait for the writer
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if res, v, err := tr.Search(cancelledCtx, key, mask, Exact); err != nil || res != Match || v != 1 {
+		t.Fatalf("Search failed: %v %v %v", res, v, err)
+	}
+	if res, err := tr.Insert(cancelledCtx, []byte{11, 0, 0, 0}, mask, 2); !errors.Is(err, context.Canceled) || res != Error {
+		t.Fatalf("Insert: expected canceled, got %v %v", res, err)
+	}
+
+	tr.unlock(ctx)
+}
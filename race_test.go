@@ -0,0 +1,6 @@
+//go:build race
+
+package prefix_tree
+
+// The race detector randomly drops pooled objects, so pooled lookups allocate
+const raceEnabled = true
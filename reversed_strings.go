@@ -6,20 +6,24 @@ package prefix_tree
 
 import (
 	"context"
+	"io"
 )
 
+// Prefix tree keyed by strings stored in reverse order, see ReversedStringKeyCodec
 type ReversedStringsTree[T any] struct {
-	stree PrefixTree[T]
+	KeyedTree[string, T]
 }
 
 // Returns a new IPv4 prefix tree
+// Arguments:
+//
+//	opts - options, see options.go. For e.g. WithRWMutex().
+//
 // Returns:
 //
 //	AddrTree - IPv4 prefix tree
-func NewReversedStringsTree[T any]() PrefixTree[T] {
-	return &ReversedStringsTree[T]{
-		stree: NewStringsTree[T](),
-	}
+func NewReversedStringsTree[T any](opts ...Option) PrefixTree[T] {
+	return wrapReversedStringsTree(NewTree[T](opts...))
 }
 
 // Returns a new IPv4 prefix tree with custom lock handlers
@@ -34,9 +38,7 @@ func NewReversedStringsTree[T any]() PrefixTree[T] {
 //
 //	AddrTree - IPv4 prefix tree
 func NewReversedStringsTreeWithLockHandlers[T any](rlockFn ReadLockFn, runlockFn ReadUnlockFn, wlockFn WriteLockFn, unlockFn UnlockFn) PrefixTree[T] {
-	return &ReversedStringsTree[T]{
-		stree: NewStringsTreeWithLockHandlers[T](rlockFn, runlockFn, wlockFn, unlockFn),
-	}
+	return wrapReversedStringsTree(NewTree[T](WithLockHandlers(rlockFn, runlockFn, wlockFn, unlockFn)))
 }
 
 // Reverses a string
@@ -48,32 +50,79 @@ func NewReversedStringsTreeWithLockHandlers[T any](rlockFn ReadLockFn, runlockFn
 //
 //	string - reversed string
 func reverseString(s string) string {
-	// A rune slice is needed to properly handle multi-byte characters
+	// Characters are reversed as a whole to properly handle multi-byte characters
 	// Reversing a byte slice does not guarantee correct results for multi-byte characters
-	sr := []rune(s)
-	for i, j := 0, len(sr)-1; i < j; i, j = i+1, j-1 {
-		sr[i], sr[j] = sr[j], sr[i]
+	return string(appendReversed(make([]byte, 0, len(s)), s))
+}
+
+// Codec for string keys stored with their characters in reverse order, the keys of a
+// ReversedStringsTree. Strings sharing a suffix share the path to them.
+type ReversedStringKeyCodec struct{}
+
+// Appends the bytes of the reversed string. See KeyCodec.AppendKey().
+func (ReversedStringKeyCodec) AppendKey(buf []byte, s string) ([]byte, int, error) {
+	n := len(buf)
+	buf = appendReversed(buf, s)
+
+	return buf, (len(buf) - n) * 8, nil
+}
+
+// Returns the string of the reversed key bytes. See KeyCodec.DecodeKey().
+func (ReversedStringKeyCodec) DecodeKey(data []byte, _ int) (string, error) {
+	return reverseString(string(data)), nil
+}
+
+// Wraps a tree storing reversed strings into a ReversedStringsTree
+// Arguments:
+//
+//	tree - underlying tree
+//
+// Returns:
+//
+//	*ReversedStringsTree - reversed strings tree
+func wrapReversedStringsTree[T any](tree *Tree[T]) *ReversedStringsTree[T] {
+	return &ReversedStringsTree[T]{
+		KeyedTree: KeyedTree[string, T]{
+			tree:  tree,
+			codec: ReversedStringKeyCodec{},
+		},
 	}
+}
 
-	return string(sr)
+// Inserts a batch of reversed strings into the tree under a single write lock. The reversed strings
+// are parsed before the lock is taken. Like Insert, a key already in the tree keeps
+// its value and is reported as Dup.
+// Arguments:
+//
+//	ctx     - context for the operation
+//	entries - reversed strings and the values to be associated with them
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in the same order as entries
+//	error      - first error seen, if any. The other entries are still inserted.
+func (rst *ReversedStringsTree[T]) InsertBatch(ctx context.Context, entries []Entry[T]) ([]OpResult, error) {
+	return rst.KeyedTree.InsertBatch(ctx, toKeyedEntries(entries))
 }
 
-// Insert the reversed string into the tree
+// Same as DeletePrefix(), but returns the deleted strings and their values
 // Arguments:
 //
-//	ctx   - context for the operation
-//	s     - key as a string
-//	value - Optional value to be associated with the given string. Can be nil.
+//	ctx - context for the operation
+//	s   - suffix as a string
 //
 // Returns:
 //
-//	OpResult - result of the insert operation
+//	OpResult - Match if the string itself was in the tree, PartialMatch otherwise
+//	[]Entry  - deleted strings and their values, in the order of the reversed strings
 //	error    - error, if any
-func (rst *ReversedStringsTree[T]) Insert(ctx context.Context, s string, value T) (OpResult, error) {
-	return rst.stree.Insert(ctx, reverseString(s), value)
+func (rst *ReversedStringsTree[T]) DeletePrefixEntries(ctx context.Context, s string) (OpResult, []Entry[T], error) {
+	res, entries, err := rst.KeyedTree.DeletePrefixEntries(ctx, s)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Deletes the reversed string from the tree
+// Returns every stored suffix of the given string. The entries are ordered
+// from the shortest to the longest suffix.
 // Arguments:
 //
 //	ctx - context for the operation
@@ -81,67 +130,172 @@ func (rst *ReversedStringsTree[T]) Insert(ctx context.Context, s string, value T
 //
 // Returns:
 //
-//	OpResult - result of the delete operation
-//	T        - value associated with the deleted address/mask, if any
+//	OpResult - Match if the string itself is in the tree, PartialMatch otherwise
+//	[]Entry  - matching suffixes and their values
 //	error    - error, if any
-func (rst *ReversedStringsTree[T]) Delete(ctx context.Context, s string) (OpResult, T, error) {
-	return rst.stree.Delete(ctx, reverseString(s))
+func (rst *ReversedStringsTree[T]) SearchAll(ctx context.Context, s string) (OpResult, []Entry[T], error) {
+	res, entries, err := rst.KeyedTree.SearchAll(ctx, s)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Searches for the reversed string in the tree.
-// Performs a partial search. If there is a prefix in the tree
-// that matches the reversed string, it will be returned.
-// For exact match searches, use SearchExactReversed().
+// Returns every stored string that ends with the given string, including the
+// string itself. For e.g. a search for "google.com" returns "mail.google.com".
 // Arguments:
 //
 //	ctx - context for the operation
-//	s   - key as a string
+//	s   - suffix as a string
 //
 // Returns:
 //
-//	OpResult - result of the search operation
-//	T        - value associated with the found address/mask, if any
+//	OpResult - Match if the string itself is in the tree, PartialMatch otherwise
+//	[]Entry  - strings ending with the suffix and their values, in walk order
 //	error    - error, if any
-func (rst *ReversedStringsTree[T]) Search(ctx context.Context, s string) (OpResult, T, error) {
-	return rst.stree.Search(ctx, reverseString(s))
+func (rst *ReversedStringsTree[T]) SearchCovered(ctx context.Context, s string) (OpResult, []Entry[T], error) {
+	res, entries, err := rst.KeyedTree.SearchCovered(ctx, s)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Similar to SearchReversed(), but performs an exact match search.
+// Returns a read-only view of the current contents of the reversed strings tree.
+// Later writes to the tree never affect the snapshot. Writes to the snapshot
+// fail with ErrReadOnly.
 // Arguments:
 //
 //	ctx - context for the operation
-//	s   - key as a string
 //
 // Returns:
 //
-//	OpResult - result of the search operation
-//	T        - value associated with the found address/mask, if any
-//	error    - error, if any
-func (rst *ReversedStringsTree[T]) SearchExact(ctx context.Context, s string) (OpResult, T, error) {
-	return rst.stree.SearchExact(ctx, reverseString(s))
+//	PrefixTree - read-only snapshot of the tree
+//	error      - error from the lock functions, if any
+func (rst *ReversedStringsTree[T]) Snapshot(ctx context.Context) (PrefixTree[T], error) {
+	snapshot, err := rst.tree.Snapshot(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapReversedStringsTree(snapshot), nil
 }
 
-// Returns the number of nodes in the IPv4 prefix tree
+// Returns a deep copy of the reversed strings tree. See Tree.Clone().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	PrefixTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (rst *ReversedStringsTree[T]) Clone(ctx context.Context) (PrefixTree[T], error) {
+	return rst.CloneWith(ctx, nil)
+}
+
+// Returns a deep copy of the reversed strings tree with a copy of every value. See Tree.CloneWith().
+// Arguments:
+//
+//	ctx     - context for the operation
+//	cloneFn - returns the copy of a value. The values are shared with the copy if nil.
+//
 // Returns:
 //
-//	uint64 - number of nodes in the tree
-func (rst *ReversedStringsTree[T]) GetNodesCount() uint64 {
-	return rst.stree.GetNodesCount()
+//	PrefixTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (rst *ReversedStringsTree[T]) CloneWith(ctx context.Context, cloneFn CloneFn[T]) (PrefixTree[T], error) {
+	clone, err := rst.tree.CloneWith(ctx, cloneFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapReversedStringsTree(clone), nil
 }
 
-// Walk the tree and call passed function for all nodes
+// Walk the tree and call passed function for all nodes with the key of each node
 // Arguments:
 //
 //	ctx - context for the operaton
-//	callback - function to be called for every value in the tree
+//	callback - function to be called for every key/value in the tree. The key is
+//	           the string as passed to Insert(), i.e. not reversed.
+//
+// Returns:
+//
+//	err - nil if successful else an error
+func (rst *ReversedStringsTree[T]) WalkKeys(ctx context.Context, callback KeyWalkerFn[T]) error {
+	return rst.KeyedTree.WalkKeys(ctx, KeyedWalkerFn[string, T](callback))
+}
+
+// Walk the strings in the tree that end with the given string and call passed
+// function with each
+// Arguments:
+//
+//	ctx      - context for the operaton
+//	s        - suffix as a string
+//	callback - function to be called for every matching key/value in the tree.
+//	           The key is the string as passed to Insert(), i.e. not reversed.
 //
 // Returns:
 //
 //	err - nil if successful else an error
-func (rst *ReversedStringsTree[T]) Walk(ctx context.Context, callback WalkerFn[T]) error {
-	rst.stree.Walk(ctx, func(ctx context.Context, value T) error {
-		return callback(ctx, value)
-	})
+func (rst *ReversedStringsTree[T]) WalkPrefix(ctx context.Context, s string, callback KeyWalkerFn[T]) error {
+	return rst.KeyedTree.WalkPrefix(ctx, s, KeyedWalkerFn[string, T](callback))
+}
 
-	return nil
+// Returns a new cursor positioned before the first entry of the tree
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	*Cursor - cursor over the strings. Entries are in the order of the reversed strings
+func (rst *ReversedStringsTree[T]) Cursor(ctx context.Context) *Cursor[T] {
+	return newCursor(ctx, &rst.KeyedTree)
+}
+
+// Returns the binary encoding of the reversed strings tree. Implements encoding.BinaryMarshaler.
+// Values are encoded by the value codec of the tree, see WithValueCodec().
+// Returns:
+//
+//	[]byte - encoding of the tree
+//	error  - error if any
+func (rst *ReversedStringsTree[T]) MarshalBinary() ([]byte, error) {
+	return rst.tree.marshal(kindReversedStrings)
+}
+
+// Replaces the contents of the reversed strings tree with the entries of an encoding returned by
+// MarshalBinary(). Implements encoding.BinaryUnmarshaler. The tree is left alone if
+// the encoding is invalid.
+// Arguments:
+//
+//	data - binary encoding
+//
+// Returns:
+//
+//	error - error if any
+func (rst *ReversedStringsTree[T]) UnmarshalBinary(data []byte) error {
+	return rst.tree.unmarshal(data, kindReversedStrings, maxEncodedKeyLen*8)
+}
+
+// Writes the binary encoding of the reversed strings tree. Implements io.WriterTo.
+// Arguments:
+//
+//	w - writer to write to
+//
+// Returns:
+//
+//	int64 - number of bytes written
+//	error - error if any
+func (rst *ReversedStringsTree[T]) WriteTo(w io.Writer) (int64, error) {
+	return rst.tree.writeTo(context.Background(), w, kindReversedStrings)
+}
+
+// Replaces the contents of the reversed strings tree with the binary encoding read from a reader.
+// Reads until EOF. Implements io.ReaderFrom.
+// Arguments:
+//
+//	r - reader to read from
+//
+// Returns:
+//
+//	int64 - number of bytes read
+//	error - error if any
+func (rst *ReversedStringsTree[T]) ReadFrom(r io.Reader) (int64, error) {
+	return rst.tree.readFrom(r, kindReversedStrings, maxEncodedKeyLen*8)
 }
@@ -2,6 +2,7 @@ package prefix_tree
 
 import (
 	"context"
+	"fmt"
 	"testing"
 )
 
@@ -165,6 +166,82 @@ func TestReversedStringsPrefixSearch(t *testing.T) {
 	}
 }
 
+func TestLongestSuffixReversedStrings(t *testing.T) {
+	ctx := context.Background()
+	rstree := NewReversedStringsTree[string]()
+
+	for _, domain := range []string{"google.com", "mail.google.com"} {
+		res, err := rstree.Insert(ctx, domain, domain)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", domain)
+		}
+	}
+
+	res, v, err := rstree.SearchLongest(ctx, "inbox.mail.google.com")
+	if err != nil || res != PartialMatch || v != "mail.google.com" {
+		t.Fatalf("SearchLongest failed: %v %s %v", res, v, err)
+	}
+
+	res, v, err = rstree.SearchShortest(ctx, "inbox.mail.google.com")
+	if err != nil || res != PartialMatch || v != "google.com" {
+		t.Fatalf("SearchShortest failed: %v %s %v", res, v, err)
+	}
+
+	res, v, err = rstree.SearchLongest(ctx, "drive.google.com")
+	if err != nil || res != PartialMatch || v != "google.com" {
+		t.Fatalf("SearchLongest failed: %v %s %v", res, v, err)
+	}
+}
+
+func TestSearchAllReversedStrings(t *testing.T) {
+	ctx := context.Background()
+	rstree := NewReversedStringsTree[int]()
+
+	domains := []string{"com", "google.com", "mail.google.com"}
+	for i, domain := range domains {
+		res, err := rstree.Insert(ctx, domain, i)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", domain)
+		}
+	}
+
+	res, entries, err := rstree.SearchAll(ctx, "mail.google.com")
+	if err != nil || res != Match || len(entries) != len(domains) {
+		t.Fatalf("SearchAll failed: %v %v %v", res, entries, err)
+	}
+	for i, entry := range entries {
+		if entry.Key != domains[i] || entry.Value != i {
+			t.Fatalf("Unexpected entry %v, expected %s/%d", entry, domains[i], i)
+		}
+	}
+}
+
+func TestWalkKeysReversedStrings(t *testing.T) {
+	ctx := context.Background()
+	rstree := NewReversedStringsTree[int]()
+
+	domains := []string{"google.com", "mail.google.com", "example.org", "bücher.de"}
+	for i, domain := range domains {
+		res, err := rstree.Insert(ctx, domain, i)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", domain)
+		}
+	}
+
+	walkedCount := 0
+	err := rstree.WalkKeys(ctx, func(ctx context.Context, key string, value int) error {
+		if domains[value] != key {
+			t.Fatalf("Unexpected key %s for value %d, expected %s", key, value, domains[value])
+		}
+
+		walkedCount++
+		return nil
+	})
+	if err != nil || walkedCount != len(domains) {
+		t.Fatalf("WalkKeys failed: walked %d, %v", walkedCount, err)
+	}
+}
+
 func generateReversedStringKeys(n int) []string {
 	keys := make([]string, n)
 	for i := 0; i < n; i++ {
@@ -198,8 +275,104 @@ func BenchmarkReversedStringsTreeSearch(b *testing.B) {
 		rstree.Insert(ctx, stringKeys[i], ival)
 	}
 
+	// Lookups must not allocate
+	assertNoAllocs(b, "Search", func() {
+		rstree.Search(ctx, stringKeys[0])
+	})
+
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		rstree.Search(ctx, stringKeys[i])
 	}
 }
+
+func TestSearchCoveredReversedStrings(t *testing.T) {
+	ctx := context.Background()
+	rstree := NewReversedStringsTree[int]()
+
+	domains := []string{"google.com", "mail.google.com", "maps.google.com", "example.com"}
+	for i, domain := range domains {
+		rstree.Insert(ctx, domain, i)
+	}
+
+	res, entries, err := rstree.SearchCovered(ctx, "google.com")
+	if err != nil || res != Match || len(entries) != 3 {
+		t.Fatalf("SearchCovered failed: %v %v %v", res, entries, err)
+	}
+	for i, expected := range domains[:3] {
+		if entries[i].Key != expected || entries[i].Value != i {
+			t.Fatalf("unexpected entry %v, expected %s", entries[i], expected)
+		}
+	}
+
+	visited := []string{}
+	err = rstree.WalkPrefix(ctx, ".google.com", func(ctx context.Context, key string, value int) error {
+		visited = append(visited, key)
+		return nil
+	})
+	if err != nil || len(visited) != 2 || visited[0] != "mail.google.com" || visited[1] != "maps.google.com" {
+		t.Fatalf("unexpected WalkPrefix result %v %v", visited, err)
+	}
+}
+
+func TestDeletePrefixReversedStrings(t *testing.T) {
+	ctx := context.Background()
+	rstree := NewReversedStringsTree[int]()
+
+	domains := []string{"google.com", "mail.google.com", "maps.google.com", "example.com"}
+	for i, domain := range domains {
+		rstree.Insert(ctx, domain, i)
+	}
+
+	res, entries, err := rstree.DeletePrefixEntries(ctx, ".google.com")
+	if err != nil || res != PartialMatch || len(entries) != 2 || entries[0].Key != "mail.google.com" || entries[1].Key != "maps.google.com" {
+		t.Fatalf("DeletePrefixEntries failed: %v %v %v", res, entries, err)
+	}
+
+	if res, _, err := rstree.SearchExact(ctx, "google.com"); err != nil || res != Match {
+		t.Fatalf("google.com not found after DeletePrefix")
+	}
+}
+
+func TestReversedStringsWalkError(t *testing.T) {
+	ctx := context.Background()
+	tree := NewReversedStringsTree[int]()
+
+	for i, key := range []string{"example.com", "mail.example.com"} {
+		tree.Insert(ctx, key, i)
+	}
+
+	// The first error returned by the walker stops the walk and is returned
+	errStop := fmt.Errorf("stop")
+	visited := 0
+	err := tree.Walk(ctx, func(ctx context.Context, value int) error {
+		visited++
+		return errStop
+	})
+	if err != errStop || visited != 1 {
+		t.Fatalf("expected the walk to stop with %v after 1 entry, got %d %v", errStop, visited, err)
+	}
+}
+
+func TestReversedStringsTree_Clone(t *testing.T) {
+	ctx := context.Background()
+	rstree := NewReversedStringsTree[int]()
+	rstree.Insert(ctx, "google.com", 1)
+	rstree.Insert(ctx, "mail.google.com", 2)
+
+	clone, err := rstree.Clone(ctx)
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+
+	clone.Replace(ctx, "google.com", 3)
+	clone.Insert(ctx, "drive.google.com", 4)
+
+	if expected, actual := "[google.com=1 mail.google.com=2]", fmt.Sprint(walkOutput[int](rstree)); expected != actual {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+	if expected, actual := "[google.com=3 drive.google.com=4 mail.google.com=2]", fmt.Sprint(walkOutput(clone)); expected != actual {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+}
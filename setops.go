@@ -0,0 +1,439 @@
+package prefix_tree
+
+// Set operations between two trees. The entries of the trees are the elements of the
+// sets, so a key is in a result only if the key itself, not just a covering prefix,
+// is in the trees. For e.g. the union of two allowlists:
+//
+//	allowed, err := Union(ctx, office, vpn, func(a, b Policy) Policy { return a.Merge(b) })
+//
+// The tries are merged node by node, so the cost is linear in the number of nodes and
+// keys are never parsed again. The result is a new tree. The trees are not changed.
+
+import (
+	"context"
+)
+
+// Set operation between two trees
+type setOp int
+
+const (
+	opUnion      setOp = iota // keys in either tree
+	opIntersect               // keys in both trees
+	opDifference              // keys in the first tree but not in the second
+)
+
+// Returns a new tree with the keys in either tree. The value of a key in both trees
+// is the value returned by resolveFn for the values in a and b.
+//
+// The new tree has the layout and the options of a. The trees are read locked for
+// the duration of the operation, a first.
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	a, b      - trees to combine
+//	resolveFn - returns the value for a key in both trees
+//
+// Returns:
+//
+//	*Tree - new tree with the result
+//	error - error from the lock functions, if any
+func Union[T any](ctx context.Context, a *Tree[T], b *Tree[T], resolveFn ResolveFn[T]) (*Tree[T], error) {
+	if nil == resolveFn {
+		return nil, ErrNoResolveFunction
+	}
+
+	return setOperation(ctx, a, b, opUnion, resolveFn)
+}
+
+// Returns a new tree with the keys in both trees. The value of a key is the value
+// returned by resolveFn for the values in a and b. See Union().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	a, b      - trees to combine
+//	resolveFn - returns the value for a key
+//
+// Returns:
+//
+//	*Tree - new tree with the result
+//	error - error from the lock functions, if any
+func Intersect[T any](ctx context.Context, a *Tree[T], b *Tree[T], resolveFn ResolveFn[T]) (*Tree[T], error) {
+	if nil == resolveFn {
+		return nil, ErrNoResolveFunction
+	}
+
+	return setOperation(ctx, a, b, opIntersect, resolveFn)
+}
+
+// Returns a new tree with the keys in a that are not in b, with their values in a.
+// See Union().
+// Arguments:
+//
+//	ctx  - context for the lock functions
+//	a, b - trees to combine
+//
+// Returns:
+//
+//	*Tree - new tree with the result
+//	error - error from the lock functions, if any
+func Difference[T any](ctx context.Context, a *Tree[T], b *Tree[T]) (*Tree[T], error) {
+	return setOperation(ctx, a, b, opDifference, nil)
+}
+
+// Returns a new tree with the result of a set operation between two trees. Trees with
+// layouts of different configurations, e.g. a binary and a stride tree, cannot be
+// merged directly. The entries of b are then copied to a layout like that of a first.
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	a, b      - trees to combine
+//	op        - set operation
+//	resolveFn - returns the value for a key in both trees
+//
+// Returns:
+//
+//	*Tree - new tree with the result
+//	error - error from the lock functions or from copying the entries of b, if any
+func setOperation[T any](ctx context.Context, a *Tree[T], b *Tree[T], op setOp, resolveFn ResolveFn[T]) (*Tree[T], error) {
+	if nil == a || nil == b {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	unlock, err := rlockTrees(ctx, a, b)
+	if nil != err {
+		return nil, err
+	}
+	defer func() {
+		unlock()
+	}()
+
+	aLayout, bLayout := a.reader().layout, b.reader().layout
+
+	layout, count, ok := aLayout.merge(bLayout, op, resolveFn)
+	if !ok {
+		converted := aLayout.empty()
+		err := bLayout.walk(nil, 0, func(key []byte, plen int, value T) error {
+			_, err := converted.insert(key, plen, value)
+			return err
+		})
+		if nil != err {
+			return nil, err
+		}
+
+		layout, count, _ = aLayout.merge(converted, op, resolveFn)
+	}
+
+	return a.derive(layout, uint64(count)), nil
+}
+
+// Returns a new IPv4 prefix tree with the prefixes in either tree. See Union().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	other     - IPv4 prefix tree to combine with
+//	resolveFn - returns the value for a prefix in both trees
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a IPv4 prefix tree,
+//	             error from the lock functions, if any
+func (v4t *V4Tree[T]) Union(ctx context.Context, other PrefixTree[T], resolveFn ResolveFn[T]) (PrefixTree[T], error) {
+	o, ok := other.(*V4Tree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Union(ctx, v4t.tree, o.tree, resolveFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapV4Tree(tree), nil
+}
+
+// Returns a new IPv4 prefix tree with the prefixes in both trees. See Intersect().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	other     - IPv4 prefix tree to combine with
+//	resolveFn - returns the value for a prefix
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a IPv4 prefix tree,
+//	             error from the lock functions, if any
+func (v4t *V4Tree[T]) Intersect(ctx context.Context, other PrefixTree[T], resolveFn ResolveFn[T]) (PrefixTree[T], error) {
+	o, ok := other.(*V4Tree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Intersect(ctx, v4t.tree, o.tree, resolveFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapV4Tree(tree), nil
+}
+
+// Returns a new IPv4 prefix tree with the prefixes that are not in the other tree.
+// See Difference().
+// Arguments:
+//
+//	ctx   - context for the lock functions
+//	other - IPv4 prefix tree with the prefixes to leave out
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a IPv4 prefix tree,
+//	             error from the lock functions, if any
+func (v4t *V4Tree[T]) Difference(ctx context.Context, other PrefixTree[T]) (PrefixTree[T], error) {
+	o, ok := other.(*V4Tree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Difference(ctx, v4t.tree, o.tree)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapV4Tree(tree), nil
+}
+
+// Returns a new IPv6 prefix tree with the prefixes in either tree. See Union().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	other     - IPv6 prefix tree to combine with
+//	resolveFn - returns the value for a prefix in both trees
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a IPv6 prefix tree,
+//	             error from the lock functions, if any
+func (v6t *V6Tree[T]) Union(ctx context.Context, other PrefixTree[T], resolveFn ResolveFn[T]) (PrefixTree[T], error) {
+	o, ok := other.(*V6Tree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Union(ctx, v6t.tree, o.tree, resolveFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapV6Tree(tree), nil
+}
+
+// Returns a new IPv6 prefix tree with the prefixes in both trees. See Intersect().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	other     - IPv6 prefix tree to combine with
+//	resolveFn - returns the value for a prefix
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a IPv6 prefix tree,
+//	             error from the lock functions, if any
+func (v6t *V6Tree[T]) Intersect(ctx context.Context, other PrefixTree[T], resolveFn ResolveFn[T]) (PrefixTree[T], error) {
+	o, ok := other.(*V6Tree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Intersect(ctx, v6t.tree, o.tree, resolveFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapV6Tree(tree), nil
+}
+
+// Returns a new IPv6 prefix tree with the prefixes that are not in the other tree.
+// See Difference().
+// Arguments:
+//
+//	ctx   - context for the lock functions
+//	other - IPv6 prefix tree with the prefixes to leave out
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a IPv6 prefix tree,
+//	             error from the lock functions, if any
+func (v6t *V6Tree[T]) Difference(ctx context.Context, other PrefixTree[T]) (PrefixTree[T], error) {
+	o, ok := other.(*V6Tree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Difference(ctx, v6t.tree, o.tree)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapV6Tree(tree), nil
+}
+
+// Returns a new strings tree with the strings in either tree. See Union().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	other     - strings tree to combine with
+//	resolveFn - returns the value for a string in both trees
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a strings tree,
+//	             error from the lock functions, if any
+func (st *StringsTree[T]) Union(ctx context.Context, other PrefixTree[T], resolveFn ResolveFn[T]) (PrefixTree[T], error) {
+	o, ok := other.(*StringsTree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Union(ctx, st.tree, o.tree, resolveFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapStringsTree(tree), nil
+}
+
+// Returns a new strings tree with the strings in both trees. See Intersect().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	other     - strings tree to combine with
+//	resolveFn - returns the value for a string
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a strings tree,
+//	             error from the lock functions, if any
+func (st *StringsTree[T]) Intersect(ctx context.Context, other PrefixTree[T], resolveFn ResolveFn[T]) (PrefixTree[T], error) {
+	o, ok := other.(*StringsTree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Intersect(ctx, st.tree, o.tree, resolveFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapStringsTree(tree), nil
+}
+
+// Returns a new strings tree with the strings that are not in the other tree.
+// See Difference().
+// Arguments:
+//
+//	ctx   - context for the lock functions
+//	other - strings tree with the strings to leave out
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a strings tree,
+//	             error from the lock functions, if any
+func (st *StringsTree[T]) Difference(ctx context.Context, other PrefixTree[T]) (PrefixTree[T], error) {
+	o, ok := other.(*StringsTree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Difference(ctx, st.tree, o.tree)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapStringsTree(tree), nil
+}
+
+// Returns a new reversed strings tree with the strings in either tree. See Union().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	other     - reversed strings tree to combine with
+//	resolveFn - returns the value for a string in both trees
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a reversed strings tree,
+//	             error from the lock functions, if any
+func (rst *ReversedStringsTree[T]) Union(ctx context.Context, other PrefixTree[T], resolveFn ResolveFn[T]) (PrefixTree[T], error) {
+	o, ok := other.(*ReversedStringsTree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Union(ctx, rst.tree, o.tree, resolveFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapReversedStringsTree(tree), nil
+}
+
+// Returns a new reversed strings tree with the strings in both trees. See Intersect().
+// Arguments:
+//
+//	ctx       - context for the lock functions
+//	other     - reversed strings tree to combine with
+//	resolveFn - returns the value for a string
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a reversed strings tree,
+//	             error from the lock functions, if any
+func (rst *ReversedStringsTree[T]) Intersect(ctx context.Context, other PrefixTree[T], resolveFn ResolveFn[T]) (PrefixTree[T], error) {
+	o, ok := other.(*ReversedStringsTree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Intersect(ctx, rst.tree, o.tree, resolveFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapReversedStringsTree(tree), nil
+}
+
+// Returns a new reversed strings tree with the strings that are not in the other tree.
+// See Difference().
+// Arguments:
+//
+//	ctx   - context for the lock functions
+//	other - reversed strings tree with the strings to leave out
+//
+// Returns:
+//
+//	PrefixTree - new tree with the result
+//	error      - ErrInvalidPrefixTree if the other tree is not a reversed strings tree,
+//	             error from the lock functions, if any
+func (rst *ReversedStringsTree[T]) Difference(ctx context.Context, other PrefixTree[T]) (PrefixTree[T], error) {
+	o, ok := other.(*ReversedStringsTree[T])
+	if !ok {
+		return nil, ErrInvalidPrefixTree
+	}
+
+	tree, err := Difference(ctx, rst.tree, o.tree)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapReversedStringsTree(tree), nil
+}
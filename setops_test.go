@@ -0,0 +1,329 @@
+package prefix_tree
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetOperations(t *testing.T) {
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	newStrideTree := func(stride int) func() *Tree[int] {
+		return func() *Tree[int] {
+			return NewTree[int](WithStride(stride))
+		}
+	}
+
+	newTrees := map[string]func() *Tree[int]{
+		"Binary":     func() *Tree[int] { return NewTree[int]() },
+		"Compressed": func() *Tree[int] { return NewCompressedTree[int]() },
+		"RCU":        func() *Tree[int] { return NewRCUTree[int](WithPathCompression()) },
+		"Stride3":    newStrideTree(3),
+		"Stride4":    newStrideTree(4),
+		"Arena":      func() *Tree[int] { return NewArenaTree[int]() },
+	}
+
+	// Short keys with few distinct bits to get plenty of shared prefixes, plus long
+	// keys to get skipped runs of more than 64 bits
+	randomEntries := func(tr *Tree[int], count int) {
+		for i := 0; i < count; i++ {
+			keyLen := 2
+			if random.Intn(4) == 0 {
+				keyLen = 12
+			}
+
+			key := make([]byte, keyLen)
+			for i := range key {
+				key[i] = byte(random.Intn(4)) << 6
+			}
+
+			mask := newTreeEntry(make([]byte, keyLen), 1+random.Intn(keyLen*8), 0).Mask
+			tr.Insert(ctx, key, mask, random.Intn(1000))
+		}
+	}
+
+	resolveFn := func(a, b int) int {
+		return a*1000 + b
+	}
+
+	for aName, newA := range newTrees {
+		for bName, newB := range newTrees {
+			t.Run(aName+"/"+bName, func(t *testing.T) {
+				a, b := newA(), newB()
+				randomEntries(a, 300)
+				randomEntries(b, 300)
+
+				aEntries, bEntries := treeEntries(a), treeEntries(b)
+
+				inB := map[string]int{}
+				for _, entry := range bEntries {
+					inB[fmt.Sprint(entry.Key, entry.Mask)] = entry.Value
+				}
+
+				// The results, built entry by entry in a tree like a
+				union, intersection, difference := newA(), newA(), newA()
+				for _, entry := range aEntries {
+					if value, ok := inB[fmt.Sprint(entry.Key, entry.Mask)]; ok {
+						union.Insert(ctx, entry.Key, entry.Mask, resolveFn(entry.Value, value))
+						intersection.Insert(ctx, entry.Key, entry.Mask, resolveFn(entry.Value, value))
+					} else {
+						union.Insert(ctx, entry.Key, entry.Mask, entry.Value)
+						difference.Insert(ctx, entry.Key, entry.Mask, entry.Value)
+					}
+				}
+				for _, entry := range bEntries {
+					union.Insert(ctx, entry.Key, entry.Mask, entry.Value)
+				}
+
+				results := []struct {
+					name     string
+					op       func() (*Tree[int], error)
+					expected *Tree[int]
+				}{
+					{"Union", func() (*Tree[int], error) { return Union(ctx, a, b, resolveFn) }, union},
+					{"Intersect", func() (*Tree[int], error) { return Intersect(ctx, a, b, resolveFn) }, intersection},
+					{"Difference", func() (*Tree[int], error) { return Difference(ctx, a, b) }, difference},
+				}
+
+				for _, result := range results {
+					tr, err := result.op()
+					if err != nil {
+						t.Fatalf("%s failed: %v", result.name, err)
+					}
+
+					expected, actual := treeEntries(result.expected), treeEntries(tr)
+					if fmt.Sprint(expected) != fmt.Sprint(actual) || tr.numNodes != result.expected.numNodes {
+						t.Fatalf("%s: unexpected result (%d entries, expected %d):\n%v\n%v", result.name, tr.numNodes, result.expected.numNodes, expected, actual)
+					}
+
+					// The result has the same nodes as a tree built entry by entry. Path
+					// compressed layouts keep copied subtrees as they are, which may
+					// split runs of bits into more nodes.
+					if layout, ok := tr.layout.(*binaryLayout[int]); !ok || !layout.compressed {
+						if countLayoutNodes(tr) != countLayoutNodes(result.expected) {
+							t.Fatalf("%s: expected %d nodes, got %d", result.name, countLayoutNodes(result.expected), countLayoutNodes(tr))
+						}
+					}
+
+					// The result is a tree of its own, which empties out
+					for _, entry := range expected {
+						if res, _, err := tr.Delete(ctx, entry.Key, entry.Mask); err != nil || res != Match {
+							t.Fatalf("%s: Delete from the result failed: %v %v", result.name, res, err)
+						}
+					}
+					if !tr.IsEmpty() || countLayoutNodes(tr) != 1 {
+						t.Fatalf("%s: expected an empty result, got %d nodes", result.name, countLayoutNodes(tr))
+					}
+				}
+
+				if fmt.Sprint(aEntries) != fmt.Sprint(treeEntries(a)) || fmt.Sprint(bEntries) != fmt.Sprint(treeEntries(b)) {
+					t.Fatalf("trees changed by set operations")
+				}
+			})
+		}
+	}
+}
+
+func TestSetOperations_Trees(t *testing.T) {
+	ctx := context.Background()
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+
+	tr := NewPersistentTree[int](WithRWMutex())
+	tr.Insert(ctx, []byte{10, 1, 0, 0}, mask, 1)
+
+	if _, err := Union(ctx, tr, tr, nil); err != ErrNoResolveFunction {
+		t.Fatalf("expected %v, got %v", ErrNoResolveFunction, err)
+	}
+	if _, err := Intersect(ctx, tr, nil, func(a, b int) int { return a }); err != ErrInvalidPrefixTree {
+		t.Fatalf("expected %v, got %v", ErrInvalidPrefixTree, err)
+	}
+
+	// A tree with itself, read locked once
+	union, err := Union(ctx, tr, tr, func(a, b int) int { return a + b })
+	if err != nil || union.numNodes != 1 {
+		t.Fatalf("Union failed: %v", err)
+	}
+	if _, v, _ := union.SearchExact(ctx, []byte{10, 1, 0, 0}, mask); v != 2 {
+		t.Fatalf("expected 2, got %d", v)
+	}
+
+	difference, err := Difference(ctx, tr, tr)
+	if err != nil || !difference.IsEmpty() {
+		t.Fatalf("expected an empty difference: %v", err)
+	}
+
+	// The result has the options of the first tree and is writable, even for a snapshot
+	snapshot, _ := tr.Snapshot(ctx)
+	union, err = Union(ctx, snapshot, NewTree[int](), func(a, b int) int { return a })
+	if err != nil || union.IsReadOnly() || !union.persistent || nil == union.wlockFn {
+		t.Fatalf("unexpected result of a snapshot: %v", err)
+	}
+	if res, err := union.Insert(ctx, []byte{10, 2, 0, 0}, mask, 2); err != nil || res != Ok {
+		t.Fatalf("Insert into the result failed: %v %v", res, err)
+	}
+	if snapshot.numNodes != 1 || tr.numNodes != 1 {
+		t.Fatalf("trees changed by a write to the result")
+	}
+}
+
+// Layout that cannot be merged with other layouts and fails every insert
+type failingLayout[T any] struct {
+	treeLayout[T]
+}
+
+func (l *failingLayout[T]) insert(key []byte, plen int, value T) (OpResult, error) {
+	return Error, ErrInsertFailed
+}
+
+func (l *failingLayout[T]) empty() treeLayout[T] {
+	return &failingLayout[T]{l.treeLayout.empty()}
+}
+
+func (l *failingLayout[T]) merge(other treeLayout[T], op setOp, resolveFn ResolveFn[T]) (treeLayout[T], int, bool) {
+	return nil, 0, false
+}
+
+func TestSetOperations_ConvertError(t *testing.T) {
+	ctx := context.Background()
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+
+	a := NewTree[int]()
+	a.Insert(ctx, []byte{10, 1, 0, 0}, mask, 1)
+	a.layout = &failingLayout[int]{a.layout}
+
+	b := NewTree[int](WithStride(4))
+	b.Insert(ctx, []byte{10, 2, 0, 0}, mask, 2)
+
+	// The entries of b cannot be copied to a layout like that of a
+	if result, err := Union(ctx, a, b, func(a, b int) int { return a }); err != ErrInsertFailed || nil != result {
+		t.Fatalf("expected %v, got %v", ErrInsertFailed, err)
+	}
+	if _, err := Difference(ctx, a, b); err != ErrInsertFailed {
+		t.Fatalf("expected %v, got %v", ErrInsertFailed, err)
+	}
+}
+
+func TestSetOperations_LockOrder(t *testing.T) {
+	ctx := context.Background()
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+
+	// Yields after taking a read lock, so the other goroutines get in between
+	newTree := func() *Tree[int] {
+		mu := &sync.RWMutex{}
+		return NewTree[int](WithLockHandlers(
+			func(context.Context) { mu.RLock(); runtime.Gosched() },
+			func(context.Context) { mu.RUnlock() },
+			func(context.Context) { mu.Lock() },
+			func(context.Context) { mu.Unlock() },
+		))
+	}
+
+	a, b := newTree(), newTree()
+	a.Insert(ctx, []byte{10, 1, 0, 0}, mask, 1)
+	b.Insert(ctx, []byte{10, 2, 0, 0}, mask, 2)
+
+	resolveFn := func(a, b int) int { return a }
+
+	// Opposite argument orders while writers wait on both trees
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	run(func(int) { Union(ctx, a, b, resolveFn) })
+	run(func(int) { Union(ctx, b, a, resolveFn) })
+	run(func(int) { Diff(ctx, b, a, func(a, b int) bool { return a == b }) })
+	run(func(i int) { a.Replace(ctx, []byte{10, 1, 0, 0}, mask, i) })
+	run(func(i int) { b.Replace(ctx, []byte{10, 2, 0, 0}, mask, i) })
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("set operations deadlocked")
+	}
+}
+
+func TestV4Tree_SetOperations(t *testing.T) {
+	ctx := context.Background()
+
+	office := NewV4Tree[string]()
+	office.Insert(ctx, "10.0.0.0/8", "office")
+	office.Insert(ctx, "192.168.1.0/24", "office")
+
+	vpn := NewV4Tree[string]()
+	vpn.Insert(ctx, "10.0.0.0/8", "vpn")
+	vpn.Insert(ctx, "172.16.0.0/12", "vpn")
+
+	resolveFn := func(a, b string) string {
+		return a + "+" + b
+	}
+
+	tests := []struct {
+		name     string
+		op       func() (PrefixTree[string], error)
+		expected string
+	}{
+		{"Union", func() (PrefixTree[string], error) { return office.Union(ctx, vpn, resolveFn) }, "[10.0.0.0/8=office+vpn 172.16.0.0/12=vpn 192.168.1.0/24=office]"},
+		{"Intersect", func() (PrefixTree[string], error) { return office.Intersect(ctx, vpn, resolveFn) }, "[10.0.0.0/8=office+vpn]"},
+		{"Difference", func() (PrefixTree[string], error) { return office.Difference(ctx, vpn) }, "[192.168.1.0/24=office]"},
+	}
+
+	for _, tt := range tests {
+		result, err := tt.op()
+		if err != nil {
+			t.Fatalf("%s failed: %v", tt.name, err)
+		}
+
+		if actual := fmt.Sprint(walkOutput[string](result)); actual != tt.expected {
+			t.Fatalf("%s: expected %s, got %s", tt.name, tt.expected, actual)
+		}
+	}
+}
+
+func TestReversedStringsTree_SetOperations(t *testing.T) {
+	ctx := context.Background()
+
+	a := NewReversedStringsTree[int]()
+	a.Insert(ctx, "google.com", 1)
+	a.Insert(ctx, "mail.google.com", 2)
+
+	b := NewReversedStringsTree[int]()
+	b.Insert(ctx, "mail.google.com", 3)
+	b.Insert(ctx, "example.com", 4)
+
+	union, err := a.Union(ctx, b, func(a, b int) int { return a + b })
+	if err != nil {
+		t.Fatalf("Union failed: %v", err)
+	}
+
+	if expected, actual := "[google.com=1 mail.google.com=5 example.com=4]", fmt.Sprint(walkOutput[int](union)); expected != actual {
+		t.Fatalf("expected %s, got %s", expected, actual)
+	}
+
+	difference, err := a.Difference(ctx, b)
+	if err != nil {
+		t.Fatalf("Difference failed: %v", err)
+	}
+
+	if res, _, _ := difference.Search(ctx, "mail.google.com"); res != PartialMatch {
+		t.Fatalf("expected a partial match for a subdomain, got %v", res)
+	}
+}
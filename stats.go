@@ -0,0 +1,103 @@
+package prefix_tree
+
+// Statistics on the nodes of a tree, for capacity planning. GetNodesCount() only
+// counts the entries. A tree also allocates nodes without an entry on the way to
+// them, how many depends on the keys and the layout of the tree.
+
+import (
+	"context"
+)
+
+// Statistics of a tree, see Stats()
+type TreeStats struct {
+	Entries uint64 // number of entries, same as GetNodesCount()
+	Nodes   uint64 // number of nodes allocated, including the root
+
+	MaxDepth int     // depth of the deepest node. The root is at depth 0.
+	AvgDepth float64 // average depth of the nodes holding the entries, i.e. the cost of a search
+
+	PrefixLengths []uint64 // number of entries per prefix length in bits, indexed by the length
+
+	// Number of runs of nodes without an entry and with a single child. Path
+	// compression folds each run into a single node.
+	SingleChildChains uint64
+
+	// Estimated memory used by the nodes and the entries, in bytes. Memory that the
+	// values point to is not included.
+	Bytes uint64
+}
+
+// Collects the statistics of a layout
+type treeStats struct {
+	TreeStats
+	depthSum uint64 // sum of the depths of the nodes holding the entries
+}
+
+// Records a node
+// Arguments:
+//
+//	depth - depth of the node
+//	size  - estimated size of the node in bytes
+func (s *treeStats) addNode(depth int, size uintptr) {
+	s.Nodes++
+	s.MaxDepth = max(s.MaxDepth, depth)
+	s.Bytes += uint64(size)
+}
+
+// Records an entry
+// Arguments:
+//
+//	depth - depth of the node holding the entry
+//	plen  - prefix length of the entry in bits
+func (s *treeStats) addEntry(depth int, plen int) {
+	if plen >= len(s.PrefixLengths) {
+		s.PrefixLengths = append(s.PrefixLengths, make([]uint64, plen+1-len(s.PrefixLengths))...)
+	}
+
+	s.PrefixLengths[plen]++
+	s.depthSum += uint64(depth)
+}
+
+// Returns the statistics of a tree. Walks every node, so it takes O(n).
+// Arguments:
+//
+//	ctx - context for the lock functions
+//
+// Returns:
+//
+//	*TreeStats - statistics of the tree
+//	error      - error from the lock functions, if any
+func (t *Tree[T]) Stats(ctx context.Context) (*TreeStats, error) {
+	if err := t.rlock(ctx); nil != err {
+		return nil, err
+	}
+	defer func() {
+		t.runlock(ctx)
+	}()
+
+	r := t.reader()
+
+	stats := &treeStats{}
+	r.layout.stats(stats)
+
+	stats.Entries = r.numNodes
+	if stats.Entries > 0 {
+		stats.AvgDepth = float64(stats.depthSum) / float64(stats.Entries)
+	}
+
+	return &stats.TreeStats, nil
+}
+
+// Returns the statistics of the keyed tree. Prefix lengths are in bits, as returned
+// by the codec of the tree. See Tree.Stats().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	*TreeStats - statistics of the tree
+//	error      - error from the lock functions, if any
+func (kt *KeyedTree[K, T]) Stats(ctx context.Context) (*TreeStats, error) {
+	return kt.tree.Stats(ctx)
+}
@@ -0,0 +1,124 @@
+package prefix_tree
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+func TestTree_Stats(t *testing.T) {
+	ctx := context.Background()
+
+	stats, err := NewTree[int]().Stats(ctx)
+	if err != nil || stats.Entries != 0 || stats.Nodes != 1 || stats.MaxDepth != 0 || stats.AvgDepth != 0 || nil != stats.PrefixLengths {
+		t.Fatalf("unexpected stats of an empty tree: %+v %v", stats, err)
+	}
+
+	newStrideTree := func() *Tree[int] {
+		return NewTree[int](WithStride(4))
+	}
+
+	// 10.0.0.0/8 and 10.1.0.0/16
+	tests := []struct {
+		name     string
+		newTree  func() *Tree[int]
+		nodes    uint64
+		maxDepth int
+		avgDepth float64
+		chains   uint64
+	}{
+		// One node per bit. Bits 1 to 7 and 9 to 15 are single child chains.
+		{"Binary", func() *Tree[int] { return NewTree[int]() }, 17, 16, 12, 2},
+		// One node per entry
+		{"Compressed", func() *Tree[int] { return NewCompressedTree[int]() }, 3, 2, 1.5, 0},
+		// One node per 4 bits. The nodes for bits 4 to 7 and 12 to 15 have no entry.
+		{"Stride4", newStrideTree, 5, 4, 3, 2},
+		// One node per bit, like Binary
+		{"Arena", func() *Tree[int] { return NewArenaTree[int]() }, 17, 16, 12, 2},
+	}
+
+	for _, tt := range tests {
+		tr := tt.newTree()
+		tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}, 1)
+		tr.Insert(ctx, []byte{10, 1, 0, 0}, []byte{0xFF, 0xFF, 0, 0}, 2)
+
+		stats, err := tr.Stats(ctx)
+		if err != nil {
+			t.Fatalf("%s: Stats failed: %v", tt.name, err)
+		}
+
+		if stats.Entries != 2 || stats.Nodes != tt.nodes || stats.MaxDepth != tt.maxDepth || stats.AvgDepth != tt.avgDepth || stats.SingleChildChains != tt.chains {
+			t.Fatalf("%s: unexpected stats %+v", tt.name, stats)
+		}
+
+		if len(stats.PrefixLengths) != 17 || stats.PrefixLengths[8] != 1 || stats.PrefixLengths[16] != 1 {
+			t.Fatalf("%s: unexpected prefix lengths %v", tt.name, stats.PrefixLengths)
+		}
+	}
+
+	tr := NewTree[int]()
+	tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}, 1)
+	if stats, _ := tr.Stats(ctx); stats.Bytes != 9*uint64(unsafe.Sizeof(Node[int]{})) {
+		t.Fatalf("expected %d bytes, got %d", 9*unsafe.Sizeof(Node[int]{}), stats.Bytes)
+	}
+}
+
+func TestTree_StatsRandom(t *testing.T) {
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	newTrees := map[string]func() *Tree[int]{
+		"Binary":     func() *Tree[int] { return NewTree[int]() },
+		"Compressed": func() *Tree[int] { return NewCompressedTree[int]() },
+		"RCU":        func() *Tree[int] { return NewRCUTree[int]() },
+		"Stride3":    func() *Tree[int] { return NewTree[int](WithStride(3)) },
+		"Arena":      func() *Tree[int] { return NewArenaTree[int]() },
+	}
+
+	for name, newTree := range newTrees {
+		tr := newTree()
+		for i := 0; i < 1000; i++ {
+			key := []byte{byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256)), 0}
+			mask := newTreeEntry(make([]byte, 4), 1+random.Intn(24), 0).Mask
+			tr.Insert(ctx, key[:len(mask)], mask, i)
+		}
+
+		stats, err := tr.Stats(ctx)
+		if err != nil {
+			t.Fatalf("%s: Stats failed: %v", name, err)
+		}
+
+		entries := uint64(0)
+		for _, count := range stats.PrefixLengths {
+			entries += count
+		}
+
+		if entries != tr.numNodes || stats.Entries != tr.numNodes || tr.numNodes < 500 {
+			t.Fatalf("%s: expected %d entries, got %d %d", name, tr.numNodes, stats.Entries, entries)
+		}
+		if stats.Nodes != uint64(countLayoutNodes(tr.reader())) {
+			t.Fatalf("%s: expected %d nodes, got %d", name, countLayoutNodes(tr.reader()), stats.Nodes)
+		}
+		if stats.AvgDepth <= 0 || stats.AvgDepth > float64(stats.MaxDepth) || 0 == stats.Bytes {
+			t.Fatalf("%s: unexpected stats %+v", name, stats)
+		}
+	}
+}
+
+func TestPrefixTree_Stats(t *testing.T) {
+	ctx := context.Background()
+
+	rst := NewReversedStringsTree[int]()
+	rst.Insert(ctx, "example.com", 1)
+	rst.Insert(ctx, "www.example.com", 2)
+
+	stats, err := rst.Stats(ctx)
+	if err != nil || stats.Entries != rst.GetNodesCount() || stats.Nodes <= stats.Entries {
+		t.Fatalf("unexpected stats %+v %v", stats, err)
+	}
+
+	if len(stats.PrefixLengths) != 8*15+1 || stats.PrefixLengths[8*11] != 1 || stats.PrefixLengths[8*15] != 1 {
+		t.Fatalf("unexpected prefix lengths %v", stats.PrefixLengths)
+	}
+}
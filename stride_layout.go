@@ -0,0 +1,936 @@
+package prefix_tree
+
+// Multibit stride layout. Every node consumes stride bits of a key and has up to
+// 2^stride children, one per value of those bits.
+//
+// Prefixes that end inside a node are kept in the node's prefix table. The table is a
+// complete binary tree in heap order: the prefix with l < stride bits past the node and
+// bit value b is at index 1<<l | b. Every prefix is also expanded to the child slots it
+// covers (controlled prefix expansion), so each slot knows the most specific prefix of
+// the node covering it. A longest match therefore reads one slot per node and never
+// backtracks. The prefix table keeps the original prefixes for exact match, delete and
+// walk, so results are the same as those of a binary trie.
+
+import (
+	"errors"
+	"math/bits"
+	"slices"
+	"unsafe"
+)
+
+// Largest supported stride in bits
+const maxStride = 8
+
+// Returned by a visit function to stop a walk early
+var errStopWalk = errors.New("stop walk")
+
+type strideEntry[T any] struct {
+	value T
+	plen  uint8 // prefix length in bits past the node
+}
+
+type strideNode[T any] struct {
+	children []*strideNode[T]  // indexed by the next stride bits of a key
+	prefixes []*strideEntry[T] // prefix table in heap order
+	expanded []*strideEntry[T] // most specific prefix covering each child slot
+
+	numChildren int
+	numPrefixes int
+
+	// Version of the tree that created the node. Nodes of an older version are
+	// shared with snapshots and copied before they are modified.
+	gen uint64
+}
+
+// Position in the prefix table of a node. Positions at and past 1<<stride are
+// the child slots of the node.
+type strideFrame[T any] struct {
+	node  *strideNode[T]
+	idx   int // index in the prefix table
+	depth int // prefix length of the position in bits
+	slot  int // child slot of the parent that leads to the node. Only used when idx is 1.
+}
+
+type strideLayout[T any] struct {
+	root   *strideNode[T]
+	stride int
+
+	// Current version. Nodes of older versions are never modified.
+	gen uint64
+}
+
+// Returns a new multibit stride layout
+// Arguments:
+//
+//	stride - number of bits consumed per node
+//
+// Returns:
+//
+//	*strideLayout - pointer to the new layout
+func newStrideLayout[T any](stride int) *strideLayout[T] {
+	return &strideLayout[T]{
+		root:   &strideNode[T]{},
+		stride: stride,
+	}
+}
+
+// Returns the node itself if it belongs to the current version. Otherwise returns
+// a copy of the node, which replaces the node in its parent. The entries are shared
+// with the copy, so they are replaced rather than modified.
+// Arguments:
+//
+//	parent - owned parent of the node. nil if the node is the root.
+//	slot   - child slot of the parent that leads to the node
+//	node   - node to own
+//
+// Returns:
+//
+//	*strideNode - node of the current version
+func (l *strideLayout[T]) own(parent *strideNode[T], slot int, node *strideNode[T]) *strideNode[T] {
+	if l.gen == node.gen {
+		return node
+	}
+
+	owned := &strideNode[T]{
+		children:    slices.Clone(node.children),
+		prefixes:    slices.Clone(node.prefixes),
+		expanded:    slices.Clone(node.expanded),
+		numChildren: node.numChildren,
+		numPrefixes: node.numPrefixes,
+		gen:         l.gen,
+	}
+
+	if nil == parent {
+		l.root = owned
+	} else {
+		parent.children[slot] = owned
+	}
+
+	return owned
+}
+
+// Owns every node on the path of a key, starting from the root. The owned nodes
+// replace the nodes in the path.
+// Arguments:
+//
+//	path - nodes on the path. The node at index i is at depth i*stride.
+//	key  - key expressed as byte slice
+func (l *strideLayout[T]) ownPath(path []*strideNode[T], key []byte) {
+	var parent *strideNode[T]
+	for i, node := range path {
+		slot := 0
+		if i > 0 {
+			slot = l.getSlot(key, (i-1)*l.stride)
+		}
+
+		parent = l.own(parent, slot, node)
+		path[i] = parent
+	}
+}
+
+func (l *strideLayout[T]) freeze() {
+	l.gen++
+}
+
+func (l *strideLayout[T]) snapshot() treeLayout[T] {
+	return &strideLayout[T]{
+		root:   l.root,
+		stride: l.stride,
+		gen:    l.gen,
+	}
+}
+
+func (l *strideLayout[T]) empty() treeLayout[T] {
+	return newStrideLayout[T](l.stride)
+}
+
+func (l *strideLayout[T]) clone(cloneFn CloneFn[T]) treeLayout[T] {
+	cloned := newStrideLayout[T](l.stride)
+	cloned.root, _ = l.cloneNodes(l.root, cloneFn)
+	return cloned
+}
+
+// Returns a copy of a node and of every node under it, all of the first version.
+// Values are passed through cloneFn, if set.
+// Arguments:
+//
+//	node    - root of the nodes to copy
+//	cloneFn - returns the copy of a value. Optional argument.
+//
+// Returns:
+//
+//	*strideNode - copy of the node
+//	int         - number of entries copied
+func (l *strideLayout[T]) cloneNodes(node *strideNode[T], cloneFn CloneFn[T]) (*strideNode[T], int) {
+	cloned := l.cloneNode(node, cloneFn)
+	count := 0
+
+	// Copies start out pointing to the children of the original and replace them
+	stack := []*strideNode[T]{cloned}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		count += node.numPrefixes
+
+		for slot, child := range node.children {
+			if nil != child {
+				node.children[slot] = l.cloneNode(child, cloneFn)
+				stack = append(stack, node.children[slot])
+			}
+		}
+	}
+
+	return cloned, count
+}
+
+// Returns a copy of a node of the first version, with copies of its entries. Values
+// are passed through cloneFn, if set. The child slots are expanded again, since the
+// original slots point to the original entries.
+func (l *strideLayout[T]) cloneNode(node *strideNode[T], cloneFn CloneFn[T]) *strideNode[T] {
+	cloned := &strideNode[T]{
+		children:    slices.Clone(node.children),
+		numChildren: node.numChildren,
+		numPrefixes: node.numPrefixes,
+	}
+
+	if nil == node.prefixes {
+		return cloned
+	}
+
+	cloned.prefixes = make([]*strideEntry[T], len(node.prefixes))
+	for idx, entry := range node.prefixes {
+		if nil == entry {
+			continue
+		}
+
+		value := entry.value
+		if nil != cloneFn {
+			value = cloneFn(value)
+		}
+
+		cloned.prefixes[idx] = &strideEntry[T]{value: value, plen: entry.plen}
+	}
+
+	cloned.expanded = make([]*strideEntry[T], len(node.expanded))
+	for slot := range cloned.expanded {
+		cloned.expanded[slot] = cloned.coveringPrefix(slot, l.stride-1, l.stride)
+	}
+
+	return cloned
+}
+
+func (n *strideNode[T]) getChild(slot int) *strideNode[T] {
+	if nil == n.children {
+		return nil
+	}
+
+	return n.children[slot]
+}
+
+func (n *strideNode[T]) setChild(slot int, child *strideNode[T], stride int) {
+	if nil == n.children {
+		n.children = make([]*strideNode[T], 1<<stride)
+	}
+
+	n.children[slot] = child
+	n.numChildren++
+}
+
+func (n *strideNode[T]) removeChild(slot int) {
+	n.children[slot] = nil
+	n.numChildren--
+
+	if 0 == n.numChildren {
+		n.children = nil
+	}
+}
+
+func (n *strideNode[T]) getPrefix(idx int) *strideEntry[T] {
+	if nil == n.prefixes {
+		return nil
+	}
+
+	return n.prefixes[idx]
+}
+
+func (n *strideNode[T]) isEmpty() bool {
+	return 0 == n.numChildren && 0 == n.numPrefixes
+}
+
+// Stores a prefix in the prefix table and expands it to the child slots it covers.
+// Arguments:
+//
+//	idx    - index of the prefix in the prefix table
+//	plen   - prefix length in bits past the node
+//	stride - stride of the layout
+//	value  - value of the prefix
+func (n *strideNode[T]) addPrefix(idx int, plen int, stride int, value T) {
+	if nil == n.prefixes {
+		n.prefixes = make([]*strideEntry[T], 1<<stride)
+		n.expanded = make([]*strideEntry[T], 1<<stride)
+	}
+
+	entry := &strideEntry[T]{value: value, plen: uint8(plen)}
+	n.prefixes[idx] = entry
+	n.numPrefixes++
+
+	// A more specific prefix already expanded to a slot keeps it
+	first, last := slotRange(idx, plen, stride)
+	for slot := first; slot < last; slot++ {
+		if nil == n.expanded[slot] || n.expanded[slot].plen < entry.plen {
+			n.expanded[slot] = entry
+		}
+	}
+}
+
+// Removes a prefix from the prefix table. The child slots it was expanded to fall
+// back to the next most specific prefix of the node covering them.
+// Arguments:
+//
+//	idx    - index of the prefix in the prefix table
+//	plen   - prefix length in bits past the node
+//	stride - stride of the layout
+//
+// Returns:
+//
+//	T - value of the prefix
+func (n *strideNode[T]) removePrefix(idx int, plen int, stride int) T {
+	entry := n.prefixes[idx]
+	n.prefixes[idx] = nil
+	n.numPrefixes--
+
+	if 0 == n.numPrefixes {
+		n.prefixes = nil
+		n.expanded = nil
+		return entry.value
+	}
+
+	first, last := slotRange(idx, plen, stride)
+	for slot := first; slot < last; slot++ {
+		if entry == n.expanded[slot] {
+			n.expanded[slot] = n.coveringPrefix(slot, plen-1, stride)
+		}
+	}
+
+	return entry.value
+}
+
+// Returns the most specific prefix of the node that covers a child slot and is
+// at most maxLen bits long.
+func (n *strideNode[T]) coveringPrefix(slot int, maxLen int, stride int) *strideEntry[T] {
+	for plen := maxLen; plen >= 0; plen-- {
+		if entry := n.prefixes[1<<plen|slot>>(stride-plen)]; nil != entry {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// Returns the range [first, last) of child slots covered by a prefix in the prefix table
+func slotRange(idx int, plen int, stride int) (int, int) {
+	bits := idx ^ 1<<plen
+	return bits << (stride - plen), (bits + 1) << (stride - plen)
+}
+
+// Returns the child slot for the stride bits of the key at depth
+func (l *strideLayout[T]) getSlot(key []byte, depth int) int {
+	return int(getBits(key, depth, l.stride))
+}
+
+// Returns the index in the prefix table for the key bits [depth, depth+plen)
+func getPrefixIdx(key []byte, depth int, plen int) int {
+	return 1<<plen | int(getBits(key, depth, plen))
+}
+
+func (l *strideLayout[T]) insert(key []byte, plen int, value T) (OpResult, error) {
+	// Start from root. Every node on the path is owned, since it is modified
+	// or leads to a node that is.
+	node := l.own(nil, 0, l.root)
+	depth := 0
+
+	// Go down one node per stride, creating nodes as needed. The prefix is
+	// stored in the node where it ends.
+	for depth+l.stride <= plen {
+		slot := l.getSlot(key, depth)
+
+		child := node.getChild(slot)
+		if nil == child {
+			child = &strideNode[T]{gen: l.gen}
+			node.setChild(slot, child, l.stride)
+		} else {
+			child = l.own(node, slot, child)
+		}
+
+		node = child
+		depth += l.stride
+	}
+
+	rel := plen - depth
+	idx := getPrefixIdx(key, depth, rel)
+
+	// If the prefix is already stored, it's a duplicate insert
+	if nil != node.getPrefix(idx) {
+		return Dup, nil
+	}
+
+	node.addPrefix(idx, rel, l.stride, value)
+	return Ok, nil
+}
+
+func (l *strideLayout[T]) update(key []byte, plen int, value T) bool {
+	// Nodes on the path of the key
+	path := make([]*strideNode[T], 1, plen/l.stride+1)
+	path[0] = l.root
+
+	node := l.root
+	depth := 0
+
+	for depth+l.stride <= plen {
+		node = node.getChild(l.getSlot(key, depth))
+		if nil == node {
+			return false
+		}
+
+		path = append(path, node)
+		depth += l.stride
+	}
+
+	rel := plen - depth
+	idx := getPrefixIdx(key, depth, rel)
+
+	entry := node.getPrefix(idx)
+	if nil == entry {
+		return false
+	}
+
+	l.ownPath(path, key)
+	node = path[len(path)-1]
+
+	// The entry may be shared with a snapshot, so it is replaced. The expanded
+	// slots that refer to it are pointed to the new entry.
+	updated := &strideEntry[T]{value: value, plen: entry.plen}
+	node.prefixes[idx] = updated
+
+	first, last := slotRange(idx, rel, l.stride)
+	for slot := first; slot < last; slot++ {
+		if entry == node.expanded[slot] {
+			node.expanded[slot] = updated
+		}
+	}
+
+	return true
+}
+
+func (l *strideLayout[T]) remove(key []byte, plen int) (T, bool) {
+	var zero T
+
+	// Nodes traversed on the way to the prefix
+	ancestors := make([]*strideNode[T], 0, plen/l.stride)
+
+	node := l.root
+	depth := 0
+
+	for depth+l.stride <= plen {
+		ancestors = append(ancestors, node)
+
+		node = node.getChild(l.getSlot(key, depth))
+		if nil == node {
+			return zero, false
+		}
+
+		depth += l.stride
+	}
+
+	rel := plen - depth
+	idx := getPrefixIdx(key, depth, rel)
+	if nil == node.getPrefix(idx) {
+		return zero, false
+	}
+
+	path := append(ancestors, node)
+	l.ownPath(path, key)
+	node, ancestors = path[len(path)-1], path[:len(path)-1]
+
+	value := node.removePrefix(idx, rel, l.stride)
+
+	// Remove empty nodes up the tree. The root always stays.
+	for i := len(ancestors) - 1; i >= 0 && node.isEmpty(); i-- {
+		node = ancestors[i]
+		node.removeChild(l.getSlot(key, i*l.stride))
+	}
+
+	return value, true
+}
+
+// Removes every entry equal to or more specific than a key. A subtree that starts
+// at a node is detached from the parent. A subtree that starts inside the prefix
+// table of a node is cleared from the node.
+// Arguments:
+//
+//	key     - key of the subtree expressed as byte slice.
+//	plen    - prefix length of the key in bits.
+//	visitFn - function to call for each removed entry. Optional argument.
+//
+// Returns:
+//
+//	int - number of entries removed
+func (l *strideLayout[T]) prune(key []byte, plen int, visitFn func([]byte, int, T)) int {
+	// Key bits of the path. Copied since the bits are modified by the walk.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	// Nodes traversed on the way to the position of the key
+	ancestors := make([]*strideNode[T], 0, plen/l.stride)
+
+	// Start from root
+	frame := strideFrame[T]{node: l.root, idx: 1}
+
+	for frame.depth < plen {
+		frame.idx = 2*frame.idx + int(getBit(keyBuf, frame.depth))
+		frame.depth++
+
+		// Move on to the child node
+		if frame.idx >= 1<<l.stride {
+			ancestors = append(ancestors, frame.node)
+
+			frame.slot = frame.idx - 1<<l.stride
+			frame.node = frame.node.getChild(frame.slot)
+			frame.idx = 1
+
+			if nil == frame.node {
+				return 0
+			}
+		}
+	}
+
+	count := 0
+	l.visit([]strideFrame[T]{frame}, keyBuf, func(key []byte, plen int, value T) error {
+		if nil != visitFn {
+			visitFn(key, plen, value)
+		}
+
+		count++
+		return nil
+	})
+
+	if 0 == count {
+		return 0
+	}
+
+	node := frame.node
+	if 1 == frame.idx {
+		// The entire node goes. It is never the root. Being only detached,
+		// the node is not owned.
+		l.ownPath(ancestors, keyBuf)
+
+		node = ancestors[len(ancestors)-1]
+		ancestors = ancestors[:len(ancestors)-1]
+
+		node.removeChild(frame.slot)
+	} else {
+		path := append(ancestors, node)
+		l.ownPath(path, keyBuf)
+		node, ancestors = path[len(path)-1], path[:len(path)-1]
+
+		// Prefixes at and below the position
+		level := bits.Len(uint(frame.idx)) - 1
+		for entryLen := level; entryLen < l.stride; entryLen++ {
+			first := frame.idx << (entryLen - level)
+			for idx := first; idx < first+1<<(entryLen-level); idx++ {
+				if nil != node.getPrefix(idx) {
+					node.removePrefix(idx, entryLen, l.stride)
+				}
+			}
+		}
+
+		// Children in the slots covered by the position
+		first, last := slotRange(frame.idx, level, l.stride)
+		for slot := first; slot < last; slot++ {
+			if nil != node.getChild(slot) {
+				node.removeChild(slot)
+			}
+		}
+	}
+
+	// Remove empty nodes up the tree. The root always stays.
+	for i := len(ancestors) - 1; i >= 0 && node.isEmpty(); i-- {
+		node = ancestors[i]
+		node.removeChild(l.getSlot(keyBuf, i*l.stride))
+	}
+
+	return count
+}
+
+func (l *strideLayout[T]) find(key []byte, plen int, mType MatchType) (T, int, bool) {
+	// Most specific prefix seen so far. Only tracked for Longest match.
+	var longest *strideEntry[T]
+	longestLen := 0
+
+	node := l.root
+	depth := 0
+
+	for nil != node {
+		// Key bits left past this node
+		rel := plen - depth
+
+		if nil != node.prefixes {
+			switch mType {
+			case Exact:
+				if rel < l.stride {
+					if entry := node.prefixes[getPrefixIdx(key, depth, rel)]; nil != entry {
+						return entry.value, plen, true
+					}
+				}
+
+			case Partial:
+				// The earliest matching prefix in the tree
+				for i := 0; i <= min(rel, l.stride-1); i++ {
+					if entry := node.prefixes[getPrefixIdx(key, depth, i)]; nil != entry {
+						return entry.value, depth + i, true
+					}
+				}
+
+			case Longest:
+				if rel >= l.stride {
+					// The expanded slot holds the most specific prefix of this node
+					if entry := node.expanded[l.getSlot(key, depth)]; nil != entry {
+						longest, longestLen = entry, depth+int(entry.plen)
+					}
+				} else {
+					for i := rel; i >= 0; i-- {
+						if entry := node.prefixes[getPrefixIdx(key, depth, i)]; nil != entry {
+							longest, longestLen = entry, depth+i
+							break
+						}
+					}
+				}
+			}
+		}
+
+		// The key ends in this node
+		if rel < l.stride {
+			break
+		}
+
+		node = node.getChild(l.getSlot(key, depth))
+		depth += l.stride
+	}
+
+	if nil == longest {
+		var zero T
+		return zero, 0, false
+	}
+
+	return longest.value, longestLen, true
+}
+
+func (l *strideLayout[T]) trace(key []byte, plen int, visitFn func(int, T)) {
+	node := l.root
+	depth := 0
+
+	for nil != node {
+		rel := plen - depth
+
+		if nil != node.prefixes {
+			for i := 0; i <= min(rel, l.stride-1); i++ {
+				if entry := node.prefixes[getPrefixIdx(key, depth, i)]; nil != entry {
+					visitFn(depth+i, entry.value)
+				}
+			}
+		}
+
+		if rel < l.stride {
+			break
+		}
+
+		node = node.getChild(l.getSlot(key, depth))
+		depth += l.stride
+	}
+}
+
+func (l *strideLayout[T]) walk(key []byte, plen int, visitFn func([]byte, int, T) error) error {
+	// Key bits of the path. Copied since the bits are modified by the walk.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	// Start from root
+	frame := strideFrame[T]{node: l.root, idx: 1}
+
+	// Follow the path of the key through the prefix tables to the position of the key
+	for frame.depth < plen {
+		frame.idx = 2*frame.idx + int(getBit(keyBuf, frame.depth))
+		frame.depth++
+
+		// Move on to the child node
+		if frame.idx >= 1<<l.stride {
+			frame.slot = frame.idx - 1<<l.stride
+			frame.node = frame.node.getChild(frame.slot)
+			frame.idx = 1
+
+			if nil == frame.node {
+				return nil
+			}
+		}
+	}
+
+	return l.visit([]strideFrame[T]{frame}, keyBuf, visitFn)
+}
+
+func (l *strideLayout[T]) seek(key []byte, plen int, inclusive bool) ([]byte, int, T, bool) {
+	// Key bits of the path. Copied since the bits are modified below.
+	keyBuf := make([]byte, (plen+7)/8)
+	copy(keyBuf, key)
+
+	// Positions to the right of the path. Everything below them comes after the
+	// key in walk order. The closest position is pushed last, so it is visited first.
+	stack := []strideFrame[T]{}
+
+	// Start from root
+	node := l.root
+	idx := 1
+	depth := 0
+	slot := 0
+
+	// Follow the path of the key through the prefix tables as far as possible
+	for depth < plen && nil != node {
+		bit := int(getBit(keyBuf, depth))
+		if 0 == bit {
+			stack = append(stack, strideFrame[T]{node: node, idx: 2*idx + 1, depth: depth + 1})
+		}
+
+		idx = 2*idx + bit
+		depth++
+
+		// Move on to the child node
+		if idx >= 1<<l.stride {
+			slot = idx - 1<<l.stride
+			node = node.getChild(slot)
+			idx = 1
+		}
+	}
+
+	if nil != node {
+		if inclusive {
+			// The key itself and the longer prefixes of the key come next
+			stack = append(stack, strideFrame[T]{node: node, idx: idx, depth: depth, slot: slot})
+		} else {
+			// Longer prefixes of the key come next
+			stack = append(stack,
+				strideFrame[T]{node: node, idx: 2*idx + 1, depth: depth + 1},
+				strideFrame[T]{node: node, idx: 2 * idx, depth: depth + 1})
+		}
+	}
+
+	var found []byte
+	var foundLen int
+	var value T
+
+	err := l.visit(stack, keyBuf, func(key []byte, plen int, v T) error {
+		found, foundLen, value = key, plen, v
+		return errStopWalk
+	})
+	if nil == err {
+		return nil, 0, value, false
+	}
+
+	return found, foundLen, value, true
+}
+
+// Performs a pre-order depth-first traversal of the positions on the stack, top
+// of the stack first. Within a node, the prefix table is traversed as the binary
+// trie it represents, left (bit 0) before right (bit 1), so the entries are visited
+// in the same order as in a binary trie.
+// Arguments:
+//
+//	stack   - positions to visit
+//	key     - key bits of the path to the positions
+//	visitFn - function to call for each entry. Receives the key bytes, the prefix
+//	          length in bits and the value.
+//
+// Returns:
+//
+//	error - error returned by visitFn, if any
+func (l *strideLayout[T]) visit(stack []strideFrame[T], key []byte, visitFn func([]byte, int, T) error) error {
+	numSlots := 1 << l.stride
+
+	for len(stack) > 0 {
+		// Pop the top frame from the stack
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node, idx, depth := frame.node, frame.idx, frame.depth
+
+		if 1 == idx {
+			// Record the bits of the child slot that led to this node. Root has no bits.
+			if depth > 0 {
+				key = setBits(key, depth-l.stride, l.stride, uint64(frame.slot))
+			}
+
+			// Without prefixes only the children are left to visit.
+			// Push the last child first so that the first child is visited first.
+			if nil == node.prefixes {
+				for slot := len(node.children) - 1; slot >= 0; slot-- {
+					if child := node.children[slot]; nil != child {
+						stack = append(stack, strideFrame[T]{node: child, idx: 1, depth: depth + l.stride, slot: slot})
+					}
+				}
+
+				continue
+			}
+		} else {
+			// Record the bit that led to this position
+			key = setBit(key, depth-1, byte(idx&1))
+		}
+
+		// A child slot leads to the child node
+		if idx >= numSlots {
+			if child := node.getChild(idx - numSlots); nil != child {
+				stack = append(stack, strideFrame[T]{node: child, idx: 1, depth: depth, slot: idx - numSlots})
+			}
+
+			continue
+		}
+
+		if entry := node.getPrefix(idx); nil != entry {
+			err := visitFn(key, depth, entry.value)
+			if nil != err {
+				return err
+			}
+		}
+
+		// Push the right position first so that the left position is visited first
+		stack = append(stack,
+			strideFrame[T]{node: node, idx: 2*idx + 1, depth: depth + 1},
+			strideFrame[T]{node: node, idx: 2 * idx, depth: depth + 1})
+	}
+
+	return nil
+}
+
+func (l *strideLayout[T]) merge(other treeLayout[T], op setOp, resolveFn ResolveFn[T]) (treeLayout[T], int, bool) {
+	o, ok := other.(*strideLayout[T])
+	if !ok || o.stride != l.stride {
+		return nil, 0, false
+	}
+
+	count := 0
+
+	merged := newStrideLayout[T](l.stride)
+	if root := l.mergeNodes(l.root, o.root, op, resolveFn, &count); nil != root {
+		merged.root = root
+	}
+
+	return merged, count, true
+}
+
+// Returns the result of a set operation for two nodes at the same position, one
+// in each layout. Returns nil if the result is empty.
+// Arguments:
+//
+//	a, b      - nodes to merge. Either can be nil.
+//	op        - set operation
+//	resolveFn - returns the value for a prefix in both nodes
+//	count     - incremented for every entry of the result
+//
+// Returns:
+//
+//	*strideNode - new node with the result
+func (l *strideLayout[T]) mergeNodes(a *strideNode[T], b *strideNode[T], op setOp, resolveFn ResolveFn[T], count *int) *strideNode[T] {
+	switch {
+	case nil == a && nil == b:
+		return nil
+	case nil == b:
+		if opIntersect == op {
+			return nil
+		}
+
+		node, copied := l.cloneNodes(a, nil)
+		*count += copied
+		return node
+	case nil == a:
+		if opUnion != op {
+			return nil
+		}
+
+		node, copied := l.cloneNodes(b, nil)
+		*count += copied
+		return node
+	}
+
+	node := &strideNode[T]{}
+
+	for idx := 1; idx < 1<<l.stride; idx++ {
+		aEntry, bEntry := a.getPrefix(idx), b.getPrefix(idx)
+
+		switch {
+		case nil != aEntry && nil != bEntry:
+			if opDifference != op {
+				node.addPrefix(idx, int(aEntry.plen), l.stride, resolveFn(aEntry.value, bEntry.value))
+			}
+		case nil != aEntry:
+			if opIntersect != op {
+				node.addPrefix(idx, int(aEntry.plen), l.stride, aEntry.value)
+			}
+		case nil != bEntry:
+			if opUnion == op {
+				node.addPrefix(idx, int(bEntry.plen), l.stride, bEntry.value)
+			}
+		}
+	}
+	*count += node.numPrefixes
+
+	for slot := 0; slot < 1<<l.stride; slot++ {
+		if child := l.mergeNodes(a.getChild(slot), b.getChild(slot), op, resolveFn, count); nil != child {
+			node.setChild(slot, child, l.stride)
+		}
+	}
+
+	if node.isEmpty() {
+		return nil
+	}
+
+	return node
+}
+
+func (l *strideLayout[T]) stats(stats *treeStats) {
+	type statsFrame struct {
+		node    *strideNode[T]
+		depth   int  // depth of the node
+		inChain bool // whether the parent is part of a single child chain
+	}
+
+	nodeSize := unsafe.Sizeof(strideNode[T]{})
+	entrySize := unsafe.Sizeof(strideEntry[T]{})
+	pointerSize := unsafe.Sizeof(l.root)
+
+	stack := []statsFrame{{node: l.root}}
+	for len(stack) > 0 {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node := frame.node
+
+		// The prefix table and the expanded slots share the entries
+		slots := cap(node.children) + cap(node.prefixes) + cap(node.expanded)
+		stats.addNode(frame.depth, nodeSize+uintptr(slots)*pointerSize+uintptr(node.numPrefixes)*entrySize)
+
+		for _, entry := range node.prefixes {
+			if nil != entry {
+				stats.addEntry(frame.depth, frame.depth*l.stride+int(entry.plen))
+			}
+		}
+
+		// A chain starts at the first node without an entry and with a single child
+		inChain := frame.depth > 0 && 0 == node.numPrefixes && 1 == node.numChildren
+		if inChain && !frame.inChain {
+			stats.SingleChildChains++
+		}
+
+		for _, child := range node.children {
+			if nil != child {
+				stack = append(stack, statsFrame{node: child, depth: frame.depth + 1, inChain: inChain})
+			}
+		}
+	}
+}
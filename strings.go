@@ -6,20 +6,24 @@ package prefix_tree
 
 import (
 	"context"
+	"io"
 )
 
+// Prefix tree keyed by strings, see StringKeyCodec
 type StringsTree[T any] struct {
-	tree *Tree[T]
+	KeyedTree[string, T]
 }
 
 // Returns a new IPv4 prefix tree
+// Arguments:
+//
+//	opts - options, see options.go. For e.g. WithRWMutex().
+//
 // Returns:
 //
 //	AddrTree - IPv4 prefix tree
-func NewStringsTree[T any]() PrefixTree[T] {
-	return &StringsTree[T]{
-		tree: NewTree[T](),
-	}
+func NewStringsTree[T any](opts ...Option) PrefixTree[T] {
+	return wrapStringsTree(NewTree[T](opts...))
 }
 
 // Returns a new IPv4 prefix tree with custom lock handlers
@@ -34,47 +38,74 @@ func NewStringsTree[T any]() PrefixTree[T] {
 //
 //	AddrTree - IPv4 prefix tree
 func NewStringsTreeWithLockHandlers[T any](rlockFn ReadLockFn, runlockFn ReadUnlockFn, wlockFn WriteLockFn, unlockFn UnlockFn) PrefixTree[T] {
-	return &StringsTree[T]{
-		tree: NewTreeWithLockHandlers[T](rlockFn, runlockFn, wlockFn, unlockFn),
-	}
+	return wrapStringsTree(NewTree[T](WithLockHandlers(rlockFn, runlockFn, wlockFn, unlockFn)))
+}
+
+// Codec for string keys, the keys of a StringsTree. Every bit of a string is part of
+// its key, i.e. its prefix length is its length in bits.
+type StringKeyCodec struct{}
+
+// Appends the bytes of the string. See KeyCodec.AppendKey().
+func (StringKeyCodec) AppendKey(buf []byte, s string) ([]byte, int, error) {
+	return append(buf, s...), len(s) * 8, nil
 }
 
-// Converts a string byte slice to a mask byte slice
+// Returns the string of the key bytes. See KeyCodec.DecodeKey().
+func (StringKeyCodec) DecodeKey(data []byte, _ int) (string, error) {
+	return string(data), nil
+}
+
+// Wraps a tree storing strings into a StringsTree
 // Arguments:
 //
-//	sb - string byte slice
+//	tree - underlying tree
 //
 // Returns:
 //
-//	[]byte - mask byte slice with all bits set
-func getMaskFromString(sb []byte) []byte {
-	mask := make([]byte, len(sb))
-	for i := range mask {
-		mask[i] = 0xFF
+//	*StringsTree - strings tree
+func wrapStringsTree[T any](tree *Tree[T]) *StringsTree[T] {
+	return &StringsTree[T]{
+		KeyedTree: KeyedTree[string, T]{
+			tree:  tree,
+			codec: StringKeyCodec{},
+		},
 	}
+}
 
-	return mask
+// Inserts a batch of strings into the tree under a single write lock. The strings
+// are parsed before the lock is taken. Like Insert, a key already in the tree keeps
+// its value and is reported as Dup.
+// Arguments:
+//
+//	ctx     - context for the operation
+//	entries - strings and the values to be associated with them
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in the same order as entries
+//	error      - first error seen, if any. The other entries are still inserted.
+func (st *StringsTree[T]) InsertBatch(ctx context.Context, entries []Entry[T]) ([]OpResult, error) {
+	return st.KeyedTree.InsertBatch(ctx, toKeyedEntries(entries))
 }
 
-// Inserts the given string into the tree
+// Same as DeletePrefix(), but returns the deleted strings and their values
 // Arguments:
 //
-//	ctx   - context for the operation
-//	s     - key as a string
-//	value - Optional value to be associated with the given string. Can be nil.
+//	ctx - context for the operation
+//	s   - prefix as a string
 //
 // Returns:
 //
-//	OpResult - result of the insert operation
+//	OpResult - Match if the string itself was in the tree, PartialMatch otherwise
+//	[]Entry  - deleted strings and their values, in walk order
 //	error    - error, if any
-func (st *StringsTree[T]) Insert(ctx context.Context, s string, value T) (OpResult, error) {
-	sb := []byte(s)
-
-	// Insert parsed address and mask into the tree
-	return st.tree.Insert(ctx, sb, getMaskFromString(sb), value)
+func (st *StringsTree[T]) DeletePrefixEntries(ctx context.Context, s string) (OpResult, []Entry[T], error) {
+	res, entries, err := st.KeyedTree.DeletePrefixEntries(ctx, s)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Deletes the given string from the tree
+// Returns every stored prefix of the given string. The entries are ordered
+// from the shortest to the longest prefix.
 // Arguments:
 //
 //	ctx - context for the operation
@@ -82,76 +113,171 @@ func (st *StringsTree[T]) Insert(ctx context.Context, s string, value T) (OpResu
 //
 // Returns:
 //
-//	OpResult - result of the delete operation
-//	T        - value associated with the deleted address/mask, if any
+//	OpResult - Match if the string itself is in the tree, PartialMatch otherwise
+//	[]Entry  - matching prefixes and their values
 //	error    - error, if any
-func (st *StringsTree[T]) Delete(ctx context.Context, s string) (OpResult, T, error) {
-	sb := []byte(s)
-
-	// Delete parsed address and mask from the tree
-	return st.tree.Delete(ctx, sb, getMaskFromString(sb))
+func (st *StringsTree[T]) SearchAll(ctx context.Context, s string) (OpResult, []Entry[T], error) {
+	res, entries, err := st.KeyedTree.SearchAll(ctx, s)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Searches for the given string in the tree.
-// Performs a partial search. If there is a prefix in the tree
-// that matches the given string, it will be returned.
-// For exact match searches, use SearchExact().
+// Returns every stored string that starts with the given string, including the
+// string itself. For e.g. a search for "api/" returns "api/v1" and "api/v2".
 // Arguments:
 //
 //	ctx - context for the operation
-//	s   - key as a string
+//	s   - prefix as a string
 //
 // Returns:
 //
-//	OpResult - result of the search operation
-//	T        - value associated with the found address/mask, if any
+//	OpResult - Match if the string itself is in the tree, PartialMatch otherwise
+//	[]Entry  - strings starting with the prefix and their values, in walk order
 //	error    - error, if any
-func (st *StringsTree[T]) Search(ctx context.Context, s string) (OpResult, T, error) {
-	sb := []byte(s)
-
-	// Perform partial search for parsed address and mask in the tree
-	return st.tree.SearchPartial(ctx, sb, getMaskFromString(sb))
+func (st *StringsTree[T]) SearchCovered(ctx context.Context, s string) (OpResult, []Entry[T], error) {
+	res, entries, err := st.KeyedTree.SearchCovered(ctx, s)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Similar to Search(), but performs an exact match search.
+// Returns a read-only view of the current contents of the strings tree.
+// Later writes to the tree never affect the snapshot. Writes to the snapshot
+// fail with ErrReadOnly.
 // Arguments:
 //
 //	ctx - context for the operation
-//	s   - key as a string
 //
 // Returns:
 //
-//	OpResult - result of the search operation
-//	T        - value associated with the found address/mask, if any
-//	error    - error, if any
-func (st *StringsTree[T]) SearchExact(ctx context.Context, s string) (OpResult, T, error) {
-	sb := []byte(s)
+//	PrefixTree - read-only snapshot of the tree
+//	error      - error from the lock functions, if any
+func (st *StringsTree[T]) Snapshot(ctx context.Context) (PrefixTree[T], error) {
+	snapshot, err := st.tree.Snapshot(ctx)
+	if nil != err {
+		return nil, err
+	}
 
-	// Perform exact search for parsed address and mask in the tree
-	return st.tree.SearchExact(ctx, sb, getMaskFromString(sb))
+	return wrapStringsTree(snapshot), nil
+}
+
+// Returns a deep copy of the strings tree. See Tree.Clone().
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	PrefixTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (st *StringsTree[T]) Clone(ctx context.Context) (PrefixTree[T], error) {
+	return st.CloneWith(ctx, nil)
 }
 
-// Returns the number of nodes in the IPv4 prefix tree
+// Returns a deep copy of the strings tree with a copy of every value. See Tree.CloneWith().
+// Arguments:
+//
+//	ctx     - context for the operation
+//	cloneFn - returns the copy of a value. The values are shared with the copy if nil.
+//
 // Returns:
 //
-//	uint64 - number of nodes in the tree
-func (st *StringsTree[T]) GetNodesCount() uint64 {
-	return st.tree.numNodes
+//	PrefixTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (st *StringsTree[T]) CloneWith(ctx context.Context, cloneFn CloneFn[T]) (PrefixTree[T], error) {
+	clone, err := st.tree.CloneWith(ctx, cloneFn)
+	if nil != err {
+		return nil, err
+	}
+
+	return wrapStringsTree(clone), nil
 }
 
-// Walk the tree and call passed function for all nodes
+// Walk the tree and call passed function for all nodes with the key of each node
 // Arguments:
 //
 //	ctx - context for the operaton
-//	callback - function to be called for every value in the tree
+//	callback - function to be called for every key/value in the tree. The key is
+//	           the string as passed to Insert().
 //
 // Returns:
 //
 //	err - nil if successful else an error
-func (st *StringsTree[T]) Walk(ctx context.Context, callback WalkerFn[T]) error {
-	st.tree.Walk(ctx, func(ctx context.Context, value T) error {
-		return callback(ctx, value)
-	})
+func (st *StringsTree[T]) WalkKeys(ctx context.Context, callback KeyWalkerFn[T]) error {
+	return st.KeyedTree.WalkKeys(ctx, KeyedWalkerFn[string, T](callback))
+}
+
+// Walk the strings in the tree that start with the given string and call passed
+// function with each
+// Arguments:
+//
+//	ctx      - context for the operaton
+//	s        - prefix as a string
+//	callback - function to be called for every matching key/value in the tree
+//
+// Returns:
+//
+//	err - nil if successful else an error
+func (st *StringsTree[T]) WalkPrefix(ctx context.Context, s string, callback KeyWalkerFn[T]) error {
+	return st.KeyedTree.WalkPrefix(ctx, s, KeyedWalkerFn[string, T](callback))
+}
+
+// Returns a new cursor positioned before the first entry of the tree
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	*Cursor - cursor over the strings
+func (st *StringsTree[T]) Cursor(ctx context.Context) *Cursor[T] {
+	return newCursor(ctx, &st.KeyedTree)
+}
+
+// Returns the binary encoding of the strings tree. Implements encoding.BinaryMarshaler.
+// Values are encoded by the value codec of the tree, see WithValueCodec().
+// Returns:
+//
+//	[]byte - encoding of the tree
+//	error  - error if any
+func (st *StringsTree[T]) MarshalBinary() ([]byte, error) {
+	return st.tree.marshal(kindStrings)
+}
+
+// Replaces the contents of the strings tree with the entries of an encoding returned by
+// MarshalBinary(). Implements encoding.BinaryUnmarshaler. The tree is left alone if
+// the encoding is invalid.
+// Arguments:
+//
+//	data - binary encoding
+//
+// Returns:
+//
+//	error - error if any
+func (st *StringsTree[T]) UnmarshalBinary(data []byte) error {
+	return st.tree.unmarshal(data, kindStrings, maxEncodedKeyLen*8)
+}
+
+// Writes the binary encoding of the strings tree. Implements io.WriterTo.
+// Arguments:
+//
+//	w - writer to write to
+//
+// Returns:
+//
+//	int64 - number of bytes written
+//	error - error if any
+func (st *StringsTree[T]) WriteTo(w io.Writer) (int64, error) {
+	return st.tree.writeTo(context.Background(), w, kindStrings)
+}
 
-	return nil
+// Replaces the contents of the strings tree with the binary encoding read from a reader.
+// Reads until EOF. Implements io.ReaderFrom.
+// Arguments:
+//
+//	r - reader to read from
+//
+// Returns:
+//
+//	int64 - number of bytes read
+//	error - error if any
+func (st *StringsTree[T]) ReadFrom(r io.Reader) (int64, error) {
+	return st.tree.readFrom(r, kindStrings, maxEncodedKeyLen*8)
 }
@@ -2,6 +2,7 @@ package prefix_tree
 
 import (
 	"context"
+	"fmt"
 	"testing"
 )
 
@@ -170,6 +171,91 @@ func TestPrefixStrings(t *testing.T) {
 	}
 }
 
+func TestLongestPrefixStrings(t *testing.T) {
+	ctx := context.Background()
+	st := NewStringsTree[string]()
+
+	for _, prefix := range []string{"/api", "/api/v1", "/api/v1/resource"} {
+		res, err := st.Insert(ctx, prefix, prefix)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", prefix)
+		}
+	}
+
+	searchUrls := map[string]string{
+		"/api/v1/resource/123": "/api/v1/resource",
+		"/api/v1/other":        "/api/v1",
+		"/api/v2":              "/api",
+		"/api/v1":              "/api/v1",
+	}
+
+	for searchUrl, expected := range searchUrls {
+		res, v, err := st.SearchLongest(ctx, searchUrl)
+		if err != nil || res == Error || v != expected {
+			t.Fatalf("SearchLongest %s: expected %s, got %s (%v, %v)", searchUrl, expected, v, res, err)
+		}
+
+		res, v, err = st.SearchShortest(ctx, searchUrl)
+		if err != nil || res == Error || v != "/api" {
+			t.Fatalf("SearchShortest %s: expected /api, got %s (%v, %v)", searchUrl, v, res, err)
+		}
+	}
+}
+
+func TestSearchAllStrings(t *testing.T) {
+	ctx := context.Background()
+	st := NewStringsTree[int]()
+
+	prefixes := []string{"/api", "/api/v1", "/api/v1/resource"}
+	for i, prefix := range prefixes {
+		res, err := st.Insert(ctx, prefix, i)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", prefix)
+		}
+	}
+
+	res, entries, err := st.SearchAll(ctx, "/api/v1/resource/123")
+	if err != nil || res != PartialMatch || len(entries) != len(prefixes) {
+		t.Fatalf("SearchAll failed: %v %v %v", res, entries, err)
+	}
+	for i, entry := range entries {
+		if entry.Key != prefixes[i] || entry.Value != i {
+			t.Fatalf("Unexpected entry %v, expected %s/%d", entry, prefixes[i], i)
+		}
+	}
+}
+
+func TestWalkKeysStrings(t *testing.T) {
+	ctx := context.Background()
+	st := NewStringsTree[int]()
+
+	urls := []string{"/about", "/api", "/api/v1", "/api/v2", "/home"}
+	for i := len(urls) - 1; i >= 0; i-- {
+		res, err := st.Insert(ctx, urls[i], i)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", urls[i])
+		}
+	}
+
+	walked := []string{}
+	err := st.WalkKeys(ctx, func(ctx context.Context, key string, value int) error {
+		if urls[value] != key {
+			t.Fatalf("Unexpected key %s for value %d", key, value)
+		}
+
+		walked = append(walked, key)
+		return nil
+	})
+	if err != nil || len(walked) != len(urls) {
+		t.Fatalf("WalkKeys failed: %v %v", walked, err)
+	}
+	for i := range urls {
+		if walked[i] != urls[i] {
+			t.Fatalf("Unexpected walk order %v", walked)
+		}
+	}
+}
+
 func generateStringKeys(n int) []string {
 	keys := make([]string, n)
 	for i := 0; i < n; i++ {
@@ -203,8 +289,140 @@ func BenchmarkStringsTreeSearch(b *testing.B) {
 		stree.Insert(ctx, stringKeys[i], ival)
 	}
 
+	// Lookups must not allocate
+	assertNoAllocs(b, "Search", func() {
+		stree.Search(ctx, stringKeys[0])
+	})
+
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		stree.Search(ctx, stringKeys[i])
 	}
 }
+
+func TestSearchCoveredStrings(t *testing.T) {
+	ctx := context.Background()
+	stree := NewStringsTree[int]()
+
+	keys := []string{"api", "api/v1", "api/v1/users", "api/v2", "apis", "web"}
+	for i, key := range keys {
+		stree.Insert(ctx, key, i)
+	}
+
+	res, entries, err := stree.SearchCovered(ctx, "api/")
+	if err != nil || res != PartialMatch || len(entries) != 3 {
+		t.Fatalf("SearchCovered failed: %v %v %v", res, entries, err)
+	}
+	for i, expected := range keys[1:4] {
+		if entries[i].Key != expected || entries[i].Value != i+1 {
+			t.Fatalf("unexpected entry %v, expected %s", entries[i], expected)
+		}
+	}
+
+	res, entries, err = stree.SearchCovered(ctx, "api")
+	if err != nil || res != Match || len(entries) != 5 {
+		t.Fatalf("SearchCovered for api failed: %v %v %v", res, entries, err)
+	}
+
+	if res, _, err := stree.SearchCovered(ctx, "api/v3"); err == nil || res != Error {
+		t.Fatalf("SearchCovered found entries for api/v3")
+	}
+
+	visited := []string{}
+	err = stree.WalkPrefix(ctx, "api/v1", func(ctx context.Context, key string, value int) error {
+		visited = append(visited, key)
+		return nil
+	})
+	if err != nil || len(visited) != 2 || visited[0] != "api/v1" || visited[1] != "api/v1/users" {
+		t.Fatalf("unexpected WalkPrefix result %v %v", visited, err)
+	}
+}
+
+func TestDeletePrefixStrings(t *testing.T) {
+	ctx := context.Background()
+	stree := NewStringsTree[int]()
+
+	keys := []string{"api", "api/v1", "api/v1/users", "api/v2", "apis", "web"}
+	for i, key := range keys {
+		stree.Insert(ctx, key, i)
+	}
+
+	res, count, err := stree.DeletePrefix(ctx, "api/")
+	if err != nil || res != PartialMatch || count != 3 {
+		t.Fatalf("DeletePrefix failed: %v %d %v", res, count, err)
+	}
+
+	res, entries, err := stree.DeletePrefixEntries(ctx, "api")
+	if err != nil || res != Match || len(entries) != 2 || entries[0].Key != "api" || entries[1].Key != "apis" {
+		t.Fatalf("DeletePrefixEntries failed: %v %v %v", res, entries, err)
+	}
+
+	if res, _, err := stree.SearchExact(ctx, "web"); err != nil || res != Match {
+		t.Fatalf("web not found after DeletePrefix")
+	}
+}
+
+func TestUpsertStrings(t *testing.T) {
+	ctx := context.Background()
+	stree := NewStringsTree[int]()
+
+	count := func(old int, exists bool) int { return old + 1 }
+	for _, key := range []string{"api", "api/v1", "api", "api"} {
+		stree.Upsert(ctx, key, count)
+	}
+
+	if _, v, _ := stree.SearchExact(ctx, "api"); v != 3 {
+		t.Fatalf("expected 3 for api, got %d", v)
+	}
+
+	res, err := stree.CompareAndSwap(ctx, "api/v1", 2, 5, func(a, b int) bool { return a == b })
+	if err != nil || res != NoMatch {
+		t.Fatalf("CompareAndSwap swapped a stale value: %v %v", res, err)
+	}
+
+	res, old, err := stree.Replace(ctx, "api/v1", 5)
+	if err != nil || res != Match || old != 1 {
+		t.Fatalf("Replace of api/v1 failed: %v %d %v", res, old, err)
+	}
+}
+
+func TestInsertBatchStrings(t *testing.T) {
+	ctx := context.Background()
+	stree := NewStringsTree[int]()
+
+	results, err := stree.InsertBatch(ctx, []Entry[int]{{Key: "api", Value: 1}, {Key: "", Value: 2}, {Key: "api", Value: 3}, {Key: "web", Value: 4}})
+	if err == nil || fmt.Sprint(results) != fmt.Sprint([]OpResult{Ok, Error, Dup, Ok}) {
+		t.Fatalf("InsertBatch failed: %v %v", results, err)
+	}
+
+	rstree := NewReversedStringsTree[int]()
+	results, err = rstree.BulkLoad(ctx, stree.All(ctx))
+	if err != nil || len(results) != 2 {
+		t.Fatalf("BulkLoad failed: %v %v", results, err)
+	}
+
+	if _, v, _ := rstree.SearchExact(ctx, "web"); v != 4 {
+		t.Fatalf("expected 4 for web, got %d", v)
+	}
+}
+
+func TestStringsWalkError(t *testing.T) {
+	ctx := context.Background()
+	tree := NewStringsTree[int]()
+
+	for i, key := range []string{"example.com", "example.org"} {
+		tree.Insert(ctx, key, i)
+	}
+
+	// The first error returned by the walker stops the walk and is returned
+	errStop := fmt.Errorf("stop")
+	visited := 0
+	err := tree.Walk(ctx, func(ctx context.Context, value int) error {
+		visited++
+		return errStop
+	})
+	if err != errStop || visited != 1 {
+		t.Fatalf("expected the walk to stop with %v after 1 entry, got %d %v", errStop, visited, err)
+	}
+}
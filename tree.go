@@ -5,41 +5,175 @@ package prefix_tree
 // corresponding masks. Masks are useful when storing IP addresses in CIDR notation. The tree supports lock handlers
 // for concurrent access.
 //
-// TODO:
-//   1. Tree compression to optimize memory usage and performance.
-//   2. Iterator to traverse the tree.
+// A RCU tree lets readers go without locks. Every write copies the nodes it modifies and publishes the new
+// version of the tree through an atomic pointer, which readers load.
+//
+// By default the tree allocates one node per bit of a key. A path compressed tree folds runs of bits without
+// a branch or a terminal node into a single node, which stores the skipped bits. A multibit stride tree consumes
+// several bits per node and expands prefixes to the stride boundaries. An arena tree allocates its nodes from
+// slabs instead of one by one. All layouts behave the same.
 
 import (
 	"context"
 	"fmt"
+	"iter"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
 type Tree[T any] struct {
-	root *RootNode[T]
+	// Stores the entries. Binary trie by default.
+	layout treeLayout[T]
 
 	numNodes uint64
 
-	rlockFn   ReadLockFn
-	runlockFn ReadUnlockFn
-	wlockFn   WriteLockFn
-	unlockFn  UnlockFn
+	// Whether every write copies the nodes it modifies, so a version of the tree is
+	// never modified once the write that created it is done
+	persistent bool
+
+	// Whether the tree is a snapshot. Snapshots never change, so they take no locks.
+	readOnly bool
+
+	// Read-copy-update mode. Readers take no locks and read the version published
+	// by the last write, a snapshot of the tree. Writers serialize on the write lock
+	// handlers, if set, or on writeMu.
+	rcu       bool
+	published atomic.Pointer[Tree[T]]
+	writeMu   sync.Mutex
+
+	// Lock functions, see options.go. Unset functions are not called. An error from
+	// a lock function fails the operation.
+	rlockFn   func(context.Context) error
+	runlockFn func(context.Context)
+	wlockFn   func(context.Context) error
+	unlockFn  func(context.Context)
+
+	// Value codec set with WithValueCodec(), a ValueCodec[T]. nil for the default codec.
+	codec any
+
+	// Options the tree was created with, see Clone()
+	opts []Option
+
+	// Error of an invalid option the tree was created with, e.g. WithStride(0). Every
+	// operation fails with it.
+	err error
 }
 
 // Walker function
 type TreeWalkerFn[T any] func(context.Context, T) error
 
+// Walker function that also receives the key and mask of each entry
+type TreeKeyWalkerFn[T any] func(context.Context, []byte, []byte, T) error
+
 // Returns a new prefix tree
+// Arguments:
+//
+//	opts - options, see options.go. For e.g. WithRWMutex().
+//
 // Returns:
 //
 //	*Tree - pointer to the new prefix tree
-func NewTree[T any]() *Tree[T] {
-	return &Tree[T]{
-		root:     NewRootNode[T](),
-		numNodes: 0,
+func NewTree[T any](opts ...Option) *Tree[T] {
+	options := newTreeOptions(opts)
+
+	if 0 != options.stride {
+		return newTree(newStrideLayout[T](options.stride), options)
 	}
+
+	// Persistent and RCU trees share nodes between versions, which an arena never
+	// does, see WithArena()
+	if options.arena && !options.persistent && !options.rcu {
+		return newTree(newArenaLayout[T](), options)
+	}
+
+	return newTree(newBinaryLayout[T](options.compressed, options.persistent || options.rcu), options)
 }
 
-// Returns a new prefix tree with lock handlers set
+// Returns a new prefix tree that stores its entries in the given layout
+// Arguments:
+//
+//	layout  - layout of the tree
+//	options - options of the tree
+//
+// Returns:
+//
+//	*Tree - pointer to the new prefix tree
+func newTree[T any](layout treeLayout[T], options *treeOptions) *Tree[T] {
+	t := &Tree[T]{
+		layout:     layout,
+		numNodes:   0,
+		persistent: options.persistent || options.rcu,
+		rcu:        options.rcu,
+		rlockFn:    options.rlockFn,
+		runlockFn:  options.runlockFn,
+		wlockFn:    options.wlockFn,
+		unlockFn:   options.unlockFn,
+		codec:      options.codec,
+		opts:       options.opts,
+		err:        options.err,
+	}
+
+	// The layout may come with entries, see Clone(). Later writes copy them.
+	if t.persistent {
+		t.layout.freeze()
+	}
+
+	if t.rcu {
+		t.publish()
+	}
+
+	return t
+}
+
+// Returns a new path compressed prefix tree. Nodes are only allocated where keys
+// branch or end, so long keys like IPv6 addresses use a fraction of the memory.
+// Same as NewTree() with WithPathCompression().
+// Arguments:
+//
+//	opts - options, see options.go
+//
+// Returns:
+//
+//	*Tree - pointer to the new prefix tree
+func NewCompressedTree[T any](opts ...Option) *Tree[T] {
+	return NewTree[T](append([]Option{WithPathCompression()}, opts...)...)
+}
+
+// Returns a new path compressed prefix tree with lock handlers set
+// Arguments:
+//
+//	rlockFn   - read lock function
+//	runlockFn - read unlock function
+//	wlockFn   - write lock function
+//	unlockFn  - unlock function
+//
+// Returns:
+//
+//	*Tree - pointer to the new prefix tree
+func NewCompressedTreeWithLockHandlers[T any](rlockFn ReadLockFn, runlockFn ReadUnlockFn, wlockFn WriteLockFn, unlockFn UnlockFn) *Tree[T] {
+	return NewCompressedTree[T](WithLockHandlers(rlockFn, runlockFn, wlockFn, unlockFn))
+}
+
+// Returns a new arena prefix tree. Nodes live in slabs of a fixed number of nodes and
+// refer to their children by 32 bit index rather than by pointer, so loading a large
+// table makes a few allocations instead of one per node and, for values without
+// pointers, leaves the garbage collector nothing to scan. Nodes freed by a delete are
+// reused by later inserts. Same as NewTree() with WithArena().
+// Arguments:
+//
+//	opts - options, see options.go. WithPathCompression() is ignored. With
+//	       WithPersistence() or WithRCU() the tree uses the default layout instead.
+//
+// Returns:
+//
+//	*Tree - pointer to the new prefix tree
+func NewArenaTree[T any](opts ...Option) *Tree[T] {
+	return NewTree[T](append([]Option{WithArena()}, opts...)...)
+}
+
+// Returns a new prefix tree with lock handlers set. Same as NewTree() with
+// WithLockHandlers().
 // Arguments:
 //
 //	rlockFn   - read lock function
@@ -51,43 +185,273 @@ func NewTree[T any]() *Tree[T] {
 //
 //	*Tree - pointer to the new prefix tree
 func NewTreeWithLockHandlers[T any](rlockFn ReadLockFn, runlockFn ReadUnlockFn, wlockFn WriteLockFn, unlockFn UnlockFn) *Tree[T] {
-	t := NewTree[T]()
-	t.rlockFn = rlockFn
-	t.runlockFn = runlockFn
-	t.wlockFn = wlockFn
-	t.unlockFn = unlockFn
+	return NewTree[T](WithLockHandlers(rlockFn, runlockFn, wlockFn, unlockFn))
+}
+
+// Returns a new persistent prefix tree. Writes never modify the nodes of the tree in
+// place. Every write copies the nodes on the path it modifies (path copying) and
+// installs a new root, so Snapshot() can share the nodes of the current version
+// with no copying at all. Same as NewTree() with WithPersistence().
+// Arguments:
+//
+//	opts - options, see options.go
+//
+// Returns:
+//
+//	*Tree - pointer to the new prefix tree
+func NewPersistentTree[T any](opts ...Option) *Tree[T] {
+	return NewTree[T](append([]Option{WithPersistence()}, opts...)...)
+}
+
+// Returns a new persistent prefix tree with lock handlers set
+// Arguments:
+//
+//	rlockFn   - read lock function
+//	runlockFn - read unlock function
+//	wlockFn   - write lock function
+//	unlockFn  - unlock function
+//
+// Returns:
+//
+//	*Tree - pointer to the new prefix tree
+func NewPersistentTreeWithLockHandlers[T any](rlockFn ReadLockFn, runlockFn ReadUnlockFn, wlockFn WriteLockFn, unlockFn UnlockFn) *Tree[T] {
+	return NewPersistentTree[T](WithLockHandlers(rlockFn, runlockFn, wlockFn, unlockFn))
+}
+
+// Returns a read-only view of the current contents of the tree. Later writes to the
+// tree never affect the snapshot. The snapshot takes no locks and is safe to read
+// from any number of goroutines. Writes to the snapshot fail with ErrReadOnly.
+//
+// A persistent tree already copies the nodes modified by every write, so the
+// snapshot shares the nodes of the tree and takes O(1). Other trees keep no track
+// of which nodes may be shared, so the snapshot is a copy that takes O(n). Either
+// way only the read lock is taken.
+// Arguments:
+//
+//	ctx - context for the lock functions.
+//
+// Returns:
+//
+//	*Tree - read-only snapshot of the tree
+//	error - error from the lock functions, if any
+func (t *Tree[T]) Snapshot(ctx context.Context) (*Tree[T], error) {
+	// A snapshot never changes
+	if t.readOnly {
+		return t, nil
+	}
+
+	if nil != t.err {
+		return nil, t.err
+	}
+
+	// The published version already is a snapshot
+	if t.rcu {
+		return t.published.Load(), nil
+	}
+
+	if err := t.rlock(ctx); nil != err {
+		return nil, err
+	}
+	defer func() {
+		t.runlock(ctx)
+	}()
+
+	var layout treeLayout[T]
+	if t.persistent {
+		layout = t.layout.snapshot()
+	} else {
+		layout = t.layout.clone(nil)
+	}
+
+	return &Tree[T]{
+		layout:   layout,
+		numNodes: t.numNodes,
+		readOnly: true,
+		codec:    t.codec,
+		opts:     t.opts,
+	}, nil
+}
+
+// Returns a deep copy of the tree. The copy has the entries of the tree, in the same
+// node structure, and the options the tree was created with. It shares no nodes with
+// the tree, so either can be changed without affecting the other. Unlike a snapshot,
+// the copy is writable and takes O(n) to make.
+//
+// Locks created by an option, e.g. WithRWMutex(), are created again for the copy.
+// Lock handlers set with WithLockHandlers() are shared with it. The copy of a
+// snapshot gets the options of the tree the snapshot was taken of.
+// Arguments:
+//
+//	ctx - context for the lock functions
+//
+// Returns:
+//
+//	*Tree - copy of the tree
+//	error - error from the lock functions, if any
+func (t *Tree[T]) Clone(ctx context.Context) (*Tree[T], error) {
+	return t.CloneWith(ctx, nil)
+}
+
+// Returns a deep copy of the tree with a copy of every value. See Clone().
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	cloneFn - returns the copy of a value, e.g. of the struct a pointer points to.
+//	          Called with the read lock held, so it must not access the tree.
+//	          The values are shared with the copy if nil.
+//
+// Returns:
+//
+//	*Tree - copy of the tree
+//	error - error from the lock functions, if any
+func (t *Tree[T]) CloneWith(ctx context.Context, cloneFn CloneFn[T]) (*Tree[T], error) {
+	if err := t.rlock(ctx); nil != err {
+		return nil, err
+	}
+	defer func() {
+		t.runlock(ctx)
+	}()
+
+	reader := t.reader()
+	return t.derive(reader.layout.clone(cloneFn), reader.numNodes), nil
+}
+
+// Returns a new tree with the options the tree was created with, that stores its
+// entries in the given layout
+// Arguments:
+//
+//	layout - layout of the new tree. Not shared with any other tree.
+//	count  - number of entries in the layout
+//
+// Returns:
+//
+//	*Tree - pointer to the new prefix tree
+func (t *Tree[T]) derive(layout treeLayout[T], count uint64) *Tree[T] {
+	derived := newTree(layout, newTreeOptions(t.opts))
+	derived.numNodes = count
+
+	if derived.rcu {
+		derived.publish()
+	}
+
+	return derived
+}
+
+// Returns a new RCU (read-copy-update) prefix tree. Readers never lock. They read the
+// version of the tree published by the last write and never block writers or each
+// other. Writers serialize among themselves, copy the nodes they modify (see
+// NewPersistentTree()) and publish the new version atomically when done.
+//
+// Readers see a write only once it is complete. A walk sees the version published
+// when it started, so its callback may write to the tree. Same as NewTree() with
+// WithRCU().
+// Arguments:
+//
+//	opts - options, see options.go
+//
+// Returns:
+//
+//	*Tree - pointer to the new prefix tree
+func NewRCUTree[T any](opts ...Option) *Tree[T] {
+	return NewTree[T](append([]Option{WithRCU()}, opts...)...)
+}
+
+// Publishes the current version of a RCU tree to the readers. The version must be
+// frozen. Called with the write lock held.
+func (t *Tree[T]) publish() {
+	t.published.Store(&Tree[T]{
+		layout:   t.layout.snapshot(),
+		numNodes: t.numNodes,
+		readOnly: true,
+		codec:    t.codec,
+		opts:     t.opts,
+	})
+}
+
+// Returns the tree to read from. For a RCU tree, that is the version published by
+// the last write. Called with the read lock held.
+func (t *Tree[T]) reader() *Tree[T] {
+	if t.rcu {
+		return t.published.Load()
+	}
+
 	return t
 }
 
+// Whether the tree is a read-only snapshot
+func (t *Tree[T]) IsReadOnly() bool {
+	return t.readOnly
+}
+
+// Whether the node is the root of the tree. Only binary trees are made of Node values.
 func (t *Tree[T]) IsRoot(node *Node[T]) bool {
-	return t.root.Node == node
+	layout, ok := t.layout.(*binaryLayout[T])
+	return ok && layout.isRoot(node)
 }
 
+// Whether the tree has no entries. For a RCU tree, as of the version published by the
+// last write, so it is safe to call concurrently with writers.
 func (t *Tree[T]) IsEmpty() bool {
-	return t.numNodes == 0
+	return t.reader().numNodes == 0
 }
 
-func (t *Tree[T]) rlock(ctx context.Context) {
+func (t *Tree[T]) rlock(ctx context.Context) error {
+	if nil != t.err {
+		return t.err
+	}
+
+	// Readers of a RCU tree do not lock
+	if t.rcu {
+		return nil
+	}
+
 	if t.rlockFn != nil {
-		t.rlockFn(ctx)
+		return t.rlockFn(ctx)
 	}
+
+	return nil
 }
 
 func (t *Tree[T]) runlock(ctx context.Context) {
+	if t.rcu {
+		return
+	}
+
 	if t.runlockFn != nil {
 		t.runlockFn(ctx)
 	}
 }
 
-func (t *Tree[T]) wlock(ctx context.Context) {
+func (t *Tree[T]) wlock(ctx context.Context) error {
+	if nil != t.err {
+		return t.err
+	}
+
 	if t.wlockFn != nil {
-		t.wlockFn(ctx)
+		return t.wlockFn(ctx)
+	}
+
+	if t.rcu {
+		t.writeMu.Lock()
 	}
+
+	return nil
 }
 
 func (t *Tree[T]) unlock(ctx context.Context) {
+	// The version created by the write is done. Later writes copy its nodes.
+	if t.persistent {
+		t.layout.freeze()
+	}
+
+	if t.rcu {
+		t.publish()
+	}
+
 	if t.unlockFn != nil {
 		t.unlockFn(ctx)
+	} else if t.rcu {
+		t.writeMu.Unlock()
 	}
 }
 
@@ -101,10 +465,244 @@ func (t *Tree[T]) decrNumNodes() {
 	}
 }
 
+func (t *Tree[T]) subNumNodes(n uint64) {
+	t.numNodes -= min(n, t.numNodes)
+}
+
 var (
 	msbByteVal byte = byte(0x80) // 1000 0000
 )
 
+// Returns a tree entry for the prefix of length plen bits of the given key.
+// The key and mask are copied and trimmed to the bytes covered by the prefix.
+// Arguments:
+//
+//	key   - key expressed as byte slice. Must be at least plen bits long.
+//	plen  - prefix length in bits
+//	value - value stored for the prefix
+//
+// Returns:
+//
+//	TreeEntry - entry with the key/mask of the prefix and its value
+func newTreeEntry[T any](key []byte, plen int, value T) TreeEntry[T] {
+	keyLen := (plen + 7) / 8
+
+	entry := TreeEntry[T]{
+		Key:   make([]byte, keyLen),
+		Mask:  make([]byte, keyLen),
+		Value: value,
+	}
+
+	for i := 0; i < keyLen; i++ {
+		bits := plen - i*8
+		if bits >= 8 {
+			entry.Mask[i] = 0xFF
+		} else {
+			entry.Mask[i] = byte(0xFF << (8 - bits))
+		}
+
+		entry.Key[i] = key[i] & entry.Mask[i]
+	}
+
+	return entry
+}
+
+// Converts tree entries to PrefixTree entries
+// Arguments:
+//
+//	treeEntries - entries returned by the tree
+//	keyFn       - converts the key/mask of an entry to its string form
+//
+// Returns:
+//
+//	[]Entry - entries with string keys
+func toEntries[T any](treeEntries []TreeEntry[T], keyFn func([]byte, []byte) string) []Entry[T] {
+	entries := make([]Entry[T], len(treeEntries))
+	for i, te := range treeEntries {
+		entries[i] = Entry[T]{
+			Key:   keyFn(te.Key, te.Mask),
+			Value: te.Value,
+		}
+	}
+
+	return entries
+}
+
+// Parses the keys of a batch and inserts them into the tree under a single
+// write lock. Keys that cannot be parsed are reported as Error.
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	tree    - tree to insert into
+//	entries - keys and values to insert
+//	parseFn - converts a key to its key/mask. The key/mask returned is only
+//	          used until the next call, so it may be a reused buffer.
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in the same order as entries
+//	error      - first error seen, if any. The other entries are still inserted. If
+//	             ctx is done, the error of ctx. The remaining entries are left as Error.
+func insertEntries[K, T any](ctx context.Context, tree *Tree[T], entries []KeyedEntry[K, T], parseFn func(K) ([]byte, []byte, error)) ([]OpResult, error) {
+	var firstErr error
+
+	results := make([]OpResult, len(entries))
+	if tree.readOnly {
+		return results, ErrReadOnly
+	}
+
+	if err := tree.wlock(ctx); nil != err {
+		return results, err
+	}
+	defer func() {
+		tree.unlock(ctx)
+	}()
+
+	checker := ctxChecker{ctx: ctx}
+
+	for i := range entries {
+		if err := checker.check(); nil != err {
+			return results, err
+		}
+
+		key, mask, err := parseFn(entries[i].Key)
+		if nil == err && len(key) != len(mask) {
+			err = ErrInvalidKeyMask
+		}
+
+		plen := 0
+		if nil == err {
+			plen, err = getKeyPrefixLen(key, mask)
+		}
+
+		if nil == err {
+			results[i], err = tree.layout.insert(key, plen, entries[i].Value)
+			if Ok == results[i] {
+				tree.incrNumNodes()
+			}
+		}
+
+		if nil != err && nil == firstErr {
+			firstErr = err
+		}
+	}
+
+	return results, firstErr
+}
+
+// Replaces the contents of the tree with a set of entries. The entries are parsed and
+// inserted into a new layout first, then swapped in under the write lock, so readers
+// see either the old or the new contents and the tree is left alone on error.
+// Arguments:
+//
+//	ctx     - context for the lock functions
+//	tree    - tree to replace the contents of
+//	entries - string keys and values
+//	parseFn - converts a string key to its key/mask. The key/mask returned is only
+//	          used until the next call, so it may be a reused buffer.
+//
+// Returns:
+//
+//	error - first error seen, if any. ErrDuplicateKey if a key is given twice.
+func replaceEntries[T any](ctx context.Context, tree *Tree[T], entries []Entry[T], parseFn func(string) ([]byte, []byte, error)) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	layout, err := tree.emptyLayout(ctx)
+	if nil != err {
+		return err
+	}
+
+	checker := ctxChecker{ctx: ctx}
+
+	for i := range entries {
+		if err := checker.check(); nil != err {
+			return err
+		}
+
+		key, mask, err := parseFn(entries[i].Key)
+		if nil != err {
+			return err
+		}
+
+		if len(key) != len(mask) {
+			return ErrInvalidKeyMask
+		}
+
+		plen, err := getKeyPrefixLen(key, mask)
+		if nil != err {
+			return err
+		}
+
+		result, err := layout.insert(key, plen, entries[i].Value)
+		if nil != err {
+			return err
+		}
+
+		if Dup == result {
+			return fmt.Errorf("%w %s", ErrDuplicateKey, entries[i].Key)
+		}
+	}
+
+	return tree.swapLayout(ctx, layout, uint64(len(entries)))
+}
+
+// Returns a new empty layout with the same configuration as the layout of the tree,
+// e.g. the same stride. Lets new contents be built without holding the write lock.
+// Arguments:
+//
+//	ctx - context for the lock functions
+//
+// Returns:
+//
+//	treeLayout - new layout
+//	error      - error from the lock functions, if any
+func (t *Tree[T]) emptyLayout(ctx context.Context) (treeLayout[T], error) {
+	if err := t.rlock(ctx); nil != err {
+		return nil, err
+	}
+	defer func() {
+		t.runlock(ctx)
+	}()
+
+	return t.reader().layout.empty(), nil
+}
+
+// Replaces the layout of the tree, and with it every entry, under the write lock
+// Arguments:
+//
+//	ctx    - context for the lock functions
+//	layout - new layout. Not shared with any other tree.
+//	count  - number of entries in the new layout
+//
+// Returns:
+//
+//	error - error from the lock functions, if any
+func (t *Tree[T]) swapLayout(ctx context.Context, layout treeLayout[T], count uint64) error {
+	if err := t.wlock(ctx); nil != err {
+		return err
+	}
+	defer func() {
+		t.unlock(ctx)
+	}()
+
+	t.layout = layout
+	t.numNodes = count
+
+	return nil
+}
+
+// Collects the keys and values returned by an iterator
+func collectEntries[K, T any](entries iter.Seq2[K, T]) []KeyedEntry[K, T] {
+	collected := []KeyedEntry[K, T]{}
+	for key, value := range entries {
+		collected = append(collected, KeyedEntry[K, T]{Key: key, Value: value})
+	}
+
+	return collected
+}
+
 // Insert a key into the prefix tree. Will write lock the tree when inserting.
 // Arguments:
 //
@@ -121,227 +719,353 @@ var (
 //	OpResult - result of the operation
 //	error    - error if any
 func (t *Tree[T]) Insert(ctx context.Context, key []byte, mask []byte, value T) (OpResult, error) {
+	if t.readOnly {
+		return Error, ErrReadOnly
+	}
+
 	// key and mask lengths must be the same
 	if len(key) != len(mask) {
 		return Error, ErrInvalidKeyMask
 	}
 
-	keyLen := len(key)
-	if keyLen <= 0 {
-		return Error, fmt.Errorf("invalid key length %d", keyLen)
+	plen, err := getKeyPrefixLen(key, mask)
+	if nil != err {
+		return Error, err
 	}
 
-	maskIdx := 0
-	match := msbByteVal
+	if err := t.wlock(ctx); nil != err {
+		return Error, err
+	}
+	defer func() {
+		t.unlock(ctx)
+	}()
 
-	// The very first bit of mask cannot be 0
-	// The only way to store this node is to mark
-	// the root as terminal. This is not supported.
-	if match != match&mask[maskIdx] {
-		return Error, ErrInvalidKeyMask
+	// If the key is already stored, it's a duplicate insert
+	// It is left to the caller to determine if this is an error.
+	// We will not return an error here.
+	result, err := t.layout.insert(key, plen, value)
+	if Ok == result {
+		// Increment node count
+		t.incrNumNodes()
 	}
 
-	t.wlock(ctx)
+	return result, err
+}
+
+// Stores the value for a key/mask in the prefix tree. Unlike Insert, the value
+// already stored for the key, if any, is replaced. Runs under a single write lock.
+// Arguments:
+//
+//	ctx   - context for the lock functions.
+//	key   - key expressed as byte slice.
+//	mask  - mask for the key expressed as byte slice.
+//	value - value to be stored for the key.
+//
+// Returns:
+//
+//	OpResult - Ok if the key was inserted, Match if its value was replaced
+//	T        - value previously stored for the key, if any
+//	error    - error if any
+func (t *Tree[T]) Replace(ctx context.Context, key []byte, mask []byte, value T) (OpResult, T, error) {
+	result, old, _, err := t.upsert(ctx, key, mask, func(T, bool) T {
+		return value
+	})
+
+	return result, old, err
+}
+
+// Stores the value returned by upsertFn for a key/mask in the prefix tree. upsertFn
+// is called with the value already stored for the key and whether there is one. The
+// lookup, the call and the store run under a single write lock, so upsertFn must not
+// call back into the tree.
+// Arguments:
+//
+//	ctx      - context for the lock functions.
+//	key      - key expressed as byte slice.
+//	mask     - mask for the key expressed as byte slice.
+//	upsertFn - returns the value to be stored for the key.
+//
+// Returns:
+//
+//	OpResult - Ok if the key was inserted, Match if its value was replaced
+//	T        - value stored for the key
+//	error    - error if any
+func (t *Tree[T]) Upsert(ctx context.Context, key []byte, mask []byte, upsertFn UpsertFn[T]) (OpResult, T, error) {
+	result, _, value, err := t.upsert(ctx, key, mask, upsertFn)
+	return result, value, err
+}
+
+// Returns the result, the old and the new value of an upsert
+func (t *Tree[T]) upsert(ctx context.Context, key []byte, mask []byte, upsertFn UpsertFn[T]) (OpResult, T, T, error) {
+	var zero T
+	if t.readOnly {
+		return Error, zero, zero, ErrReadOnly
+	}
+
+	if nil == upsertFn {
+		return Error, zero, zero, ErrNoUpsertFunction
+	}
+
+	if len(key) != len(mask) {
+		return Error, zero, zero, ErrInvalidKeyMask
+	}
+
+	plen, err := getKeyPrefixLen(key, mask)
+	if nil != err {
+		return Error, zero, zero, err
+	}
+
+	if err := t.wlock(ctx); nil != err {
+		return Error, zero, zero, err
+	}
 	defer func() {
 		t.unlock(ctx)
 	}()
 
-	// Start from root
-	node := t.root.Node
-	next := t.root.Node
+	old, _, exists := t.layout.find(key, plen, Exact)
+	value := upsertFn(old, exists)
 
-	// Traverse down the tree as far as possible.
-	// Note: the first occurence of 0 in the mask will terminate the traversal.
-	// It is assumed that all bits after the first 0 in the mask are also 0s.
-	// There is no explicit check for this condition here. A mask with non-contiguous
-	// 1s is considered unexpected and will lead to undefined behavior.
-	for match == match&mask[maskIdx] {
-		// We don't store the match value in the node.
-		// Bit 1 goes to right child, bit 0 goes to left child.
-		if match == match&key[maskIdx] {
-			next = node.right
-		} else {
-			next = node.left
-		}
+	if exists {
+		t.layout.update(key, plen, value)
+		return Match, old, value, nil
+	}
 
-		// If we can't go further, break
-		if nil == next {
-			break
-		}
+	result, err := t.layout.insert(key, plen, value)
+	if Ok != result {
+		return result, zero, zero, err
+	}
 
-		node = next
+	// Increment node count
+	t.incrNumNodes()
 
-		if match == 1 {
-			// Move to next byte in key/mask
-			// If we have exhausted the key/mask, break
-			maskIdx++
-			if keyLen == maskIdx {
-				break
-			}
+	return Ok, zero, value, nil
+}
 
-			// Reset match to MSB
-			match = msbByteVal
-		} else {
-			// Move to next bit in current byte
-			match >>= 1
-		}
+// Replaces the value stored for a key/mask with newValue, only if the value stored
+// is equal to oldValue. The comparison and the swap run under a single write lock.
+// Arguments:
+//
+//	ctx      - context for the lock functions.
+//	key      - key expressed as byte slice.
+//	mask     - mask for the key expressed as byte slice.
+//	oldValue - value expected to be stored for the key.
+//	newValue - value to be stored for the key.
+//	equalFn  - compares the value stored with oldValue.
+//
+// Returns:
+//
+//	OpResult - Match if the value was swapped, NoMatch if the value stored is not equal to oldValue
+//	error    - ErrKeyNotFound if the key is not in the tree, other error if any
+func (t *Tree[T]) CompareAndSwap(ctx context.Context, key []byte, mask []byte, oldValue T, newValue T, equalFn EqualFn[T]) (OpResult, error) {
+	if t.readOnly {
+		return Error, ErrReadOnly
 	}
 
-	// We found an existing node. This condition will evaluate to true
-	// if we have covered the entire key/mask in the traversal above.
-	if nil != next {
-		// Cannot be hit but check just in case.
-		// This cannot be the root node
-		if t.IsRoot(node) {
-			return Error, ErrInsertFailed
-		}
+	if nil == equalFn {
+		return Error, ErrNoEqualFunction
+	}
 
-		// If the node is already terminal, it's a duplicate insert
-		// It is left to the caller to determine if this is an error.
-		// We will not return an error here.
-		if node.IsTerminal() {
-			return Dup, nil
-		}
+	if len(key) != len(mask) {
+		return Error, ErrInvalidKeyMask
+	}
 
-		// Mark the node as terminal and set the value
-		node.SaveAndMarkTerminal(value)
+	plen, err := getKeyPrefixLen(key, mask)
+	if nil != err {
+		return Error, err
+	}
 
-		// Increment node count
-		t.incrNumNodes()
+	if err := t.wlock(ctx); nil != err {
+		return Error, err
+	}
+	defer func() {
+		t.unlock(ctx)
+	}()
 
-		// Successful insert
-		return Ok, nil
+	value, _, found := t.layout.find(key, plen, Exact)
+	if !found {
+		return Error, ErrKeyNotFound
 	}
 
-	// We are unlikely to hit this condition. Check for safety (future proofing).
-	// The for loop above might change and make this condition evaluate to true.
-	if keyLen == maskIdx {
-		return Error, ErrInsertFailed
+	if !equalFn(value, oldValue) {
+		return NoMatch, nil
 	}
 
-	// Create new nodes for the remaining bits in the key/mask.
-	for match == match&mask[maskIdx] {
-		// Create a new node
-		next = NewNode[T]()
+	t.layout.update(key, plen, newValue)
+	return Match, nil
+}
 
-		// Bit 1 goes to right child, bit 0 goes to left child.
-		if match == match&key[maskIdx] {
-			node.right = next
-		} else {
-			node.left = next
-		}
+// Inserts a batch of keys into the prefix tree under a single write lock. Keys are
+// validated before the lock is taken. Like Insert, a key already in the tree keeps
+// its value and is reported as Dup. The batch stops early if ctx is done. Entries
+// inserted until then stay in the tree.
+// Arguments:
+//
+//	ctx     - context for the lock functions.
+//	entries - keys, masks and values to insert.
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in the same order as entries
+//	error      - first error seen, if any. The other entries are still inserted. If
+//	             ctx is done, the error of ctx. The remaining entries are left as Error.
+func (t *Tree[T]) InsertBatch(ctx context.Context, entries []TreeEntry[T]) ([]OpResult, error) {
+	var firstErr error
+
+	results := make([]OpResult, len(entries))
+	if t.readOnly {
+		return results, ErrReadOnly
+	}
+
+	plens := make([]int, len(entries))
 
-		node = next
+	for i := range entries {
+		if len(entries[i].Key) != len(entries[i].Mask) {
+			plens[i] = -1
+			if nil == firstErr {
+				firstErr = ErrInvalidKeyMask
+			}
+			continue
+		}
 
-		if match == 1 {
-			// Move to next byte in key/mask
-			// If we have exhausted the key/mask, break
-			maskIdx++
-			if keyLen == maskIdx {
-				break
+		plen, err := getKeyPrefixLen(entries[i].Key, entries[i].Mask)
+		if nil != err {
+			plens[i] = -1
+			if nil == firstErr {
+				firstErr = err
 			}
+			continue
+		}
+
+		plens[i] = plen
+	}
+
+	if err := t.wlock(ctx); nil != err {
+		return results, err
+	}
+	defer func() {
+		t.unlock(ctx)
+	}()
+
+	checker := ctxChecker{ctx: ctx}
+
+	for i := range entries {
+		if err := checker.check(); nil != err {
+			return results, err
+		}
+
+		// Invalid entries are left as Error
+		if plens[i] < 0 {
+			continue
+		}
+
+		result, err := t.layout.insert(entries[i].Key, plens[i], entries[i].Value)
+		if Ok == result {
+			t.incrNumNodes()
+		}
 
-			// Reset match to MSB
-			match = msbByteVal
-		} else {
-			// Move to next bit in current byte
-			match >>= 1
+		if nil != err && nil == firstErr {
+			firstErr = err
 		}
-	}
 
-	// The last node created corresponds to the key/mask.
-	// Mark it as terminal and set the value.
-	node.SaveAndMarkTerminal(value)
+		results[i] = result
+	}
 
-	// Increment node count
-	t.incrNumNodes()
+	return results, firstErr
+}
 
-	// Successful insert
-	return Ok, nil
+// Inserts the keys returned by an iterator into the prefix tree under a single
+// write lock. The iterator is drained before the lock is taken, so it may read
+// from the tree. See InsertBatch.
+// Arguments:
+//
+//	ctx     - context for the lock functions.
+//	entries - iterator over the keys, masks and values to insert.
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in iteration order
+//	error      - first error seen, if any. The other entries are still inserted.
+func (t *Tree[T]) BulkLoad(ctx context.Context, entries iter.Seq[TreeEntry[T]]) ([]OpResult, error) {
+	return t.InsertBatch(ctx, slices.Collect(entries))
 }
 
-// find a key in the prefix tree. Caller must hold appropriate locks.
+// Validates a key/mask and returns the prefix length of the key in bits.
 // Arguments:
 //
-//	key   - key to find expressed as byte slice.
-//	mask  - mask for the key expressed as byte slice.
-//	mType - type of match to perform (Exact/Partial)
-//	nodeAncestors - stack of ancestor nodes. Optional argument.
+//	key  - key expressed as byte slice.
+//	mask - mask for the key expressed as byte slice.
 //
 // Returns:
 //
-//	*treeNode - pointer to the found node
-//	*treeNodeStack - stack of nodes traversed during the search
-//	OpResult  - result of the operation
-//	error     - error if any
-func (t *Tree[T]) find(key []byte, mask []byte, mType MatchType, nodeAncestors *NodeStack[T]) (*Node[T], OpResult, error) {
-	if t.IsEmpty() {
-		return nil, NoMatch, ErrKeyNotFound
-	}
+//	int   - prefix length in bits
+//	error - error if any
+func getKeyPrefixLen(key []byte, mask []byte) (int, error) {
+	// Note: the first occurence of 0 in the mask will terminate the traversal.
+	// It is assumed that all bits after the first 0 in the mask are also 0s.
+	// There is no explicit check for this condition here. A mask with non-contiguous
+	// 1s is considered unexpected and will lead to undefined behavior.
+	plen := getPrefixLen(mask)
+	return plen, checkKeyPrefixLen(key, plen)
+}
 
+// Validates a key and the prefix length of its implied mask.
+// Arguments:
+//
+//	key  - key expressed as byte slice.
+//	plen - prefix length of the key in bits
+//
+// Returns:
+//
+//	error - error if any
+func checkKeyPrefixLen(key []byte, plen int) error {
 	keyLen := len(key)
 	if keyLen <= 0 {
-		return nil, Error, fmt.Errorf("invalid key length %d", keyLen)
+		return fmt.Errorf("invalid key length %d", keyLen)
 	}
 
-	match := msbByteVal
-	maskIdx := 0
-
 	// The very first bit of mask cannot be 0
 	// The only way to store this node is to mark
 	// the root as terminal. This is not supported.
-	if match != match&mask[maskIdx] {
-		return nil, Error, ErrInvalidKeyMask
-	}
-
-	// Start from root
-	node := t.root.Node
-	ret := Match
-
-	// Traverse down the tree as far as possible.
-	for nil != node && match == match&mask[maskIdx] {
-		// Check for partial match condition. If we see a terminal node
-		// during traversal and the match type is Partial, we are done.
-		// A partial match will find the earliest matching prefix in the tree.
-		if Partial == mType && node.IsTerminal() {
-			ret = PartialMatch
-			break
-		}
+	if plen <= 0 {
+		return ErrInvalidKeyMask
+	}
 
-		// Save the traversed node if asked for
-		if nodeAncestors != nil {
-			nodeAncestors.Push(node)
-		}
+	return nil
+}
 
-		// Bit 1 goes to right child, bit 0 goes to left child.
-		if match == match&key[maskIdx] {
-			node = node.right
-		} else {
-			node = node.left
-		}
+// find a key in the prefix tree. Caller must hold appropriate locks.
+// Arguments:
+//
+//	key   - key to find expressed as byte slice.
+//	plen  - prefix length of the key in bits
+//	mType - type of match to perform (Exact/Partial/Longest)
+//
+// Returns:
+//
+//	T        - value associated with the found key
+//	OpResult - result of the operation
+//	error    - error if any
+func (t *Tree[T]) find(key []byte, plen int, mType MatchType) (T, OpResult, error) {
+	var zero T
+	if t.IsEmpty() {
+		return zero, NoMatch, ErrKeyNotFound
+	}
 
-		if match == 1 {
-			// Move to next byte in key/mask
-			// If we have exhausted the key/mask, break
-			maskIdx++
-			if keyLen == maskIdx {
-				break
-			}
+	if err := checkKeyPrefixLen(key, plen); nil != err {
+		return zero, Error, err
+	}
 
-			// Reset match to MSB
-			match = msbByteVal
-		} else {
-			// Move to next bit in current byte
-			match >>= 1
-		}
+	value, depth, ok := t.layout.find(key, plen, mType)
+	if !ok {
+		return zero, NoMatch, ErrKeyNotFound
 	}
 
-	// For Exact match, we must end up on a terminal node
-	if nil != node && node.IsTerminal() {
-		return node, ret, nil
+	// A prefix of the key was found
+	if depth < plen {
+		return value, PartialMatch, nil
 	}
 
-	return nil, NoMatch, ErrKeyNotFound
+	return value, Match, nil
 }
 
 // Delete a key from the prefix tree. Will write lock the tree when deleting.
@@ -358,68 +1082,141 @@ func (t *Tree[T]) find(key []byte, mask []byte, mType MatchType, nodeAncestors *
 //	error    - error if any
 func (t *Tree[T]) Delete(ctx context.Context, key []byte, mask []byte) (OpResult, T, error) {
 	var zero T
+	if t.readOnly {
+		return Error, zero, ErrReadOnly
+	}
+
 	if len(key) != len(mask) {
 		return Error, zero, ErrInvalidKeyMask
 	}
 
-	t.wlock(ctx)
+	if err := t.wlock(ctx); nil != err {
+		return Error, zero, err
+	}
 	defer func() {
 		t.unlock(ctx)
 	}()
 
-	// Stack of ancestors to the node we are searching for
-	nodeAncestors := NewNodeStack[T]()
+	if t.IsEmpty() {
+		return Error, zero, ErrKeyNotFound
+	}
 
-	// Find the node to delete. It must be an exact match for deletion.
-	node, result, err := t.find(key, mask, Exact, nodeAncestors)
-	if nil != err || Match != result {
+	plen, err := getKeyPrefixLen(key, mask)
+	if nil != err {
 		return Error, zero, err
 	}
 
-	// This condition should never be hit
-	if nil == node || !node.IsTerminal() || t.IsRoot(node) {
+	// It must be an exact match for deletion.
+	value, ok := t.layout.remove(key, plen)
+	if !ok {
 		return Error, zero, ErrKeyNotFound
 	}
 
-	// Is the match node not a leaf?
-	if !node.IsLeaf() {
-		// Unmark terminal to indicate deletion
-		node.UnmarkTerminal()
+	// Decrement node count
+	t.decrNumNodes()
+
+	// Deleted successfully
+	return Match, value, nil
+}
+
+// Deletes a key and every key more specific than it from the prefix tree, i.e. the
+// entire subtree for the key. For e.g. deleting 10.0.0.0/8 also deletes 10.1.0.0/16.
+// The subtree is detached under a single write lock.
+// Arguments:
+//
+//	ctx  - context for the lock functions.
+//	key  - key of the subtree expressed as byte slice.
+//	mask - mask for the key expressed as byte slice.
+//
+// Returns:
+//
+//	OpResult - Match if the key itself was in the tree, PartialMatch otherwise
+//	uint64   - number of keys deleted
+//	error    - error if any
+func (t *Tree[T]) DeletePrefix(ctx context.Context, key []byte, mask []byte) (OpResult, uint64, error) {
+	return t.deletePrefix(ctx, key, mask, nil)
+}
+
+// Same as DeletePrefix(), but returns the deleted keys and their values in walk order.
+// Arguments:
+//
+//	ctx  - context for the lock functions.
+//	key  - key of the subtree expressed as byte slice.
+//	mask - mask for the key expressed as byte slice.
+//
+// Returns:
+//
+//	OpResult    - Match if the key itself was in the tree, PartialMatch otherwise
+//	[]TreeEntry - deleted entries with their key/mask and value
+//	error       - error if any
+func (t *Tree[T]) DeletePrefixEntries(ctx context.Context, key []byte, mask []byte) (OpResult, []TreeEntry[T], error) {
+	entries := []TreeEntry[T]{}
+	res, _, err := t.deletePrefix(ctx, key, mask, func(key []byte, plen int, value T) {
+		entries = append(entries, newTreeEntry(key, plen, value))
+	})
+	if nil != err {
+		return res, nil, err
+	}
+
+	return res, entries, nil
+}
+
+// Deletes the subtree for a key. Will write lock the tree when deleting.
+// Arguments:
+//
+//	ctx     - context for the lock functions.
+//	key     - key of the subtree expressed as byte slice.
+//	mask    - mask for the key expressed as byte slice.
+//	visitFn - function to call for each deleted entry. Optional argument.
+//
+// Returns:
+//
+//	OpResult - result of the operation
+//	uint64   - number of keys deleted
+//	error    - error if any
+func (t *Tree[T]) deletePrefix(ctx context.Context, key []byte, mask []byte, visitFn func([]byte, int, T)) (OpResult, uint64, error) {
+	if t.readOnly {
+		return Error, 0, ErrReadOnly
+	}
 
-		// Decrement node count
-		t.decrNumNodes()
+	if len(key) != len(mask) {
+		return Error, 0, ErrInvalidKeyMask
+	}
 
-		// Deleted successfully
-		return Match, node.value, nil
+	if err := t.wlock(ctx); nil != err {
+		return Error, 0, err
 	}
+	defer func() {
+		t.unlock(ctx)
+	}()
 
-	value := node.value
+	if t.IsEmpty() {
+		return Error, 0, ErrKeyNotFound
+	}
 
-	// Remove nodes up the tree
-	for !nodeAncestors.IsEmpty() {
-		// Pop the parent node
-		parent := nodeAncestors.Pop()
+	plen, err := getKeyPrefixLen(key, mask)
+	if nil != err {
+		return Error, 0, err
+	}
 
-		// Remove the reference to the current node from the parent
-		if node == parent.right {
-			parent.right = nil
-		} else {
-			parent.left = nil
+	// The key itself comes first in the subtree, if it is in the tree
+	result := PartialMatch
+	count := t.layout.prune(key, plen, func(entryKey []byte, entryLen int, value T) {
+		if entryLen == plen {
+			result = Match
 		}
 
-		node = parent
-
-		// If the new node is not a leaf, is a terminal or root, break
-		if !node.IsLeaf() || node.IsTerminal() || t.IsRoot(node) {
-			break
+		if nil != visitFn {
+			visitFn(entryKey, entryLen, value)
 		}
+	})
+	if 0 == count {
+		return Error, 0, ErrKeyNotFound
 	}
 
-	// Decrement node count
-	t.decrNumNodes()
+	t.subNumNodes(uint64(count))
 
-	// Deleted successfully
-	return Match, value, nil
+	return result, uint64(count), nil
 }
 
 // Searches for a key in the prefix tree. Will read lock the tree when searching.
@@ -428,7 +1225,7 @@ func (t *Tree[T]) Delete(ctx context.Context, key []byte, mask []byte) (OpResult
 //	ctx   - context for the lock functions.
 //	key   - key to find expressed as byte slice.
 //	mask  - mask for the key expressed as byte slice.
-//	mType - type of match to perform (Exact/Partial)
+//	mType - type of match to perform (Exact/Partial/Longest)
 //
 // Returns:
 //
@@ -441,13 +1238,34 @@ func (t *Tree[T]) Search(ctx context.Context, key []byte, mask []byte, mType Mat
 		return Error, zero, ErrInvalidKeyMask
 	}
 
-	t.rlock(ctx)
+	return t.searchPrefix(ctx, key, getPrefixLen(mask), mType)
+}
+
+// Same as Search(), but the mask of the key is given as its prefix length. Lets the
+// wrappers search without building a mask, see lookup.go.
+// Arguments:
+//
+//	ctx   - context for the lock functions.
+//	key   - key to find expressed as byte slice. Not retained.
+//	plen  - prefix length of the key in bits
+//	mType - type of match to perform (Exact/Partial/Longest)
+//
+// Returns:
+//
+//	OpResult - result of the operation
+//	T        - value associated with the found key
+//	error    - error if any
+func (t *Tree[T]) searchPrefix(ctx context.Context, key []byte, plen int, mType MatchType) (OpResult, T, error) {
+	var zero T
+	if err := t.rlock(ctx); nil != err {
+		return Error, zero, err
+	}
 	defer func() {
 		t.runlock(ctx)
 	}()
 
 	// Find the node. Match type is determined by caller.
-	node, result, err := t.find(key, mask, mType, nil)
+	value, result, err := t.reader().find(key, plen, mType)
 	if nil != err {
 		return Error, zero, err
 	}
@@ -456,22 +1274,17 @@ func (t *Tree[T]) Search(ctx context.Context, key []byte, mask []byte, mType Mat
 	switch mType {
 	case Exact:
 		if result != Match {
-			return Error, zero, err
+			return Error, zero, ErrKeyNotFound
 		}
 
-	case Partial:
+	case Partial, Longest:
 		if result != Match && result != PartialMatch {
-			return Error, zero, err
+			return Error, zero, ErrKeyNotFound
 		}
 	}
 
-	// This condition should never be hit
-	if nil == node || !node.IsTerminal() || t.IsRoot(node) {
-		return Error, zero, ErrKeyNotFound
-	}
-
 	// Search successful
-	return result, node.value, nil
+	return result, value, nil
 }
 
 // Searches for an exact match of the key in the prefix tree.
@@ -506,10 +1319,125 @@ func (t *Tree[T]) SearchPartial(ctx context.Context, key []byte, mask []byte) (O
 	return t.Search(ctx, key, mask, Partial)
 }
 
+// Same as SearchPartial(). Returns the shortest (least specific) prefix in the
+// tree that matches the key.
+// Arguments:
+//
+//	ctx   - context for the lock functions.
+//	key   - key to find expressed as byte slice.
+//	mask  - mask for the key expressed as byte slice.
+//
+// Returns:
+//
+//	OpResult - result of the operation
+//	T        - value associated with the found key
+//	error    - error if any
+func (t *Tree[T]) SearchShortest(ctx context.Context, key []byte, mask []byte) (OpResult, T, error) {
+	return t.Search(ctx, key, mask, Shortest)
+}
+
+// Searches for the longest (most specific) prefix in the tree that matches the key.
+// For e.g. if the tree has both 10.0.0.0/8 and 10.1.2.0/24, a search for 10.1.2.3/32
+// returns the value stored for 10.1.2.0/24.
+// Arguments:
+//
+//	ctx   - context for the lock functions.
+//	key   - key to find expressed as byte slice.
+//	mask  - mask for the key expressed as byte slice.
+//
+// Returns:
+//
+//	OpResult - Match if the key itself is in the tree, PartialMatch for a covering prefix
+//	T        - value associated with the found key
+//	error    - error if any
+func (t *Tree[T]) SearchLongest(ctx context.Context, key []byte, mask []byte) (OpResult, T, error) {
+	return t.Search(ctx, key, mask, Longest)
+}
+
+// Returns every prefix in the tree that matches the key. The entries are
+// ordered from the least specific to the most specific prefix. For e.g. if the
+// tree has 10.0.0.0/8, 10.1.0.0/16 and 10.1.2.0/24, a search for 10.1.2.3/32
+// returns all three.
+// Arguments:
+//
+//	ctx   - context for the lock functions.
+//	key   - key to find expressed as byte slice.
+//	mask  - mask for the key expressed as byte slice.
+//
+// Returns:
+//
+//	OpResult    - Match if the key itself is in the tree, PartialMatch otherwise
+//	[]TreeEntry - matching entries with their key/mask and value
+//	error       - error if any
+func (t *Tree[T]) SearchAll(ctx context.Context, key []byte, mask []byte) (OpResult, []TreeEntry[T], error) {
+	if len(key) != len(mask) {
+		return Error, nil, ErrInvalidKeyMask
+	}
+
+	if err := t.rlock(ctx); nil != err {
+		return Error, nil, err
+	}
+	defer func() {
+		t.runlock(ctx)
+	}()
+
+	r := t.reader()
+	if r.IsEmpty() {
+		return Error, nil, ErrKeyNotFound
+	}
+
+	plen, err := getKeyPrefixLen(key, mask)
+	if nil != err {
+		return Error, nil, err
+	}
+
+	// Collect the entries on the entire path for the key
+	entries := []TreeEntry[T]{}
+	depth := 0
+	r.layout.trace(key, plen, func(entryLen int, value T) {
+		entries = append(entries, newTreeEntry(key, entryLen, value))
+		depth = entryLen
+	})
+
+	if len(entries) == 0 {
+		return Error, nil, ErrKeyNotFound
+	}
+
+	// The key itself is in the tree
+	if depth == plen {
+		return Match, entries, nil
+	}
+
+	return PartialMatch, entries, nil
+}
+
 // Walk the tree using the provided walker function. Performs a depth-first traversal.
 // The walker function is called for each node with a valid key and value.
-// The k/v pairs are returned in the order they are encountered during the traversal.
-// This might be different from the order in which they were inserted.
+// The k/v pairs are returned in key order. A prefix is visited before the longer
+// prefixes it covers. This might be different from the order in which they were inserted.
+// The walk stops with the error of ctx once ctx is done, so a long walk can be cancelled
+// or given a deadline. The same applies to the other walks and to batch inserts.
+// Arguments:
+//
+//	ctx        - context for the lock functions and the walk.
+//	walkerFn   - function to call for each node during the walk
+//
+// Returns:
+//
+//	error    - error returned by walkerFn, the error of ctx or other error if any
+func (t *Tree[T]) Walk(ctx context.Context, walkerFn TreeWalkerFn[T]) error {
+	if nil == walkerFn {
+		return ErrNoWalkerFunction
+	}
+
+	return t.walk(ctx, nil, 0, func(_ []byte, _ int, value T) error {
+		return walkerFn(ctx, value)
+	})
+}
+
+// Same as Walk(), but the walker function also receives the key and mask of
+// every entry. The key and mask are trimmed to the bytes covered by the prefix
+// and can be retained by the walker function.
 // Arguments:
 //
 //	ctx        - context for the lock functions.
@@ -518,84 +1446,149 @@ func (t *Tree[T]) SearchPartial(ctx context.Context, key []byte, mask []byte) (O
 // Returns:
 //
 //	error    - error if any
-func (t *Tree[T]) Walk(ctx context.Context, walkerFn TreeWalkerFn[T]) error {
+func (t *Tree[T]) WalkKeys(ctx context.Context, walkerFn TreeKeyWalkerFn[T]) error {
 	if nil == walkerFn {
 		return ErrNoWalkerFunction
 	}
 
-	if t.IsEmpty() {
-		return nil
+	return t.walk(ctx, nil, 0, func(key []byte, plen int, value T) error {
+		entry := newTreeEntry(key, plen, value)
+		return walkerFn(ctx, entry.Key, entry.Mask, entry.Value)
+	})
+}
+
+// Walks the entries that are equal to or more specific than the key, i.e. the
+// subtree for the key. For e.g. if the tree has 10.0.0.0/8, 10.1.0.0/16 and
+// 10.1.2.0/24, a walk for 10.1.0.0/16 visits the last two. The entries are visited
+// in walk order, with their key and mask.
+// Arguments:
+//
+//	ctx      - context for the lock functions.
+//	key      - key of the subtree expressed as byte slice.
+//	mask     - mask for the key expressed as byte slice.
+//	walkerFn - function to call for each entry in the subtree
+//
+// Returns:
+//
+//	error    - error if any
+func (t *Tree[T]) WalkPrefix(ctx context.Context, key []byte, mask []byte, walkerFn TreeKeyWalkerFn[T]) error {
+	if nil == walkerFn {
+		return ErrNoWalkerFunction
 	}
 
-	t.rlock(ctx)
-	defer func() {
-		t.runlock(ctx)
-	}()
+	if len(key) != len(mask) {
+		return ErrInvalidKeyMask
+	}
+
+	plen, err := getKeyPrefixLen(key, mask)
+	if nil != err {
+		return err
+	}
 
-	// Node stack
-	treeNodeStack := NewNodeStack[T]()
+	return t.walk(ctx, key, plen, func(key []byte, plen int, value T) error {
+		entry := newTreeEntry(key, plen, value)
+		return walkerFn(ctx, entry.Key, entry.Mask, entry.Value)
+	})
+}
 
-	// Start at root
-	treeNodeStack.Push(t.root.Node)
+// Returns every entry in the tree that is equal to or more specific than the key.
+// This is the reverse of SearchAll(). For e.g. if the tree has 10.0.0.0/8, 10.1.0.0/16
+// and 10.1.2.0/24, a search for 10.1.0.0/16 returns the last two. The entries are
+// in walk order.
+// Arguments:
+//
+//	ctx   - context for the lock functions.
+//	key   - key to find expressed as byte slice.
+//	mask  - mask for the key expressed as byte slice.
+//
+// Returns:
+//
+//	OpResult    - Match if the key itself is in the tree, PartialMatch otherwise
+//	[]TreeEntry - covered entries with their key/mask and value
+//	error       - error if any
+func (t *Tree[T]) SearchCovered(ctx context.Context, key []byte, mask []byte) (OpResult, []TreeEntry[T], error) {
+	entries := []TreeEntry[T]{}
+	err := t.WalkPrefix(ctx, key, mask, func(_ context.Context, key []byte, mask []byte, value T) error {
+		entries = append(entries, TreeEntry[T]{Key: key, Mask: mask, Value: value})
+		return nil
+	})
+	if nil != err {
+		return Error, nil, err
+	}
 
-	// Start looping
-	for !treeNodeStack.IsEmpty() {
-		// Peek at the top node in the stack
-		node := treeNodeStack.Peek()
+	if len(entries) == 0 {
+		return Error, nil, ErrKeyNotFound
+	}
 
-		// If there is a left child, push the left child onto the stack
-		// and continue
-		if nil != node.left {
-			treeNodeStack.Push(node.left)
-			continue
-		}
+	// The key itself comes first, if it is in the tree
+	if getPrefixLen(entries[0].Mask) == getPrefixLen(mask) {
+		return Match, entries, nil
+	}
 
-		// If there is a right child, add the right child to the stack
-		if nil != node.right {
-			treeNodeStack.Push(node.right)
-			continue
-		}
+	return PartialMatch, entries, nil
+}
 
-		// Pop the current node from the stack
-		node = treeNodeStack.Pop()
+// Visits the entries of the subtree for a key in walk order. Will read lock the
+// tree during the traversal. The traversal checks ctx every ctxCheckInterval
+// entries and stops once it is done.
+// Arguments:
+//
+//	ctx     - context for the lock functions.
+//	key     - key of the subtree expressed as byte slice.
+//	plen    - prefix length of the key in bits. 0 for the entire tree.
+//	visitFn - function to call for each entry. Receives the key bytes, the prefix
+//	          length in bits and the value. The key bytes are only valid for the
+//	          duration of the call.
+//
+// Returns:
+//
+//	error    - error returned by visitFn or the error of ctx, if any
+func (t *Tree[T]) walk(ctx context.Context, key []byte, plen int, visitFn func([]byte, int, T) error) error {
+	if err := t.rlock(ctx); nil != err {
+		return err
+	}
+	defer func() {
+		t.runlock(ctx)
+	}()
 
-		// Ignore root
-		if t.IsRoot(node) {
-			continue
-		}
+	r := t.reader()
+	if r.IsEmpty() {
+		return nil
+	}
 
-		// Left node must be a terminal node. Call the walker function
-		if node.IsTerminal() {
-			err := walkerFn(ctx, node.value)
-			if nil != err {
-				return err
-			}
+	checker := ctxChecker{ctx: ctx}
+	return r.layout.walk(key, plen, func(key []byte, plen int, value T) error {
+		if err := checker.check(); nil != err {
+			return err
 		}
 
-		// Unwind the stack to find the next unvisited right child
-		for !treeNodeStack.IsEmpty() {
-			parent := treeNodeStack.Peek()
-
-			// If the parent has a right child and the right child
-			// is not the current node. Push the right child onto
-			// the stack and break.
-			if nil != parent.right && parent.right != node {
-				treeNodeStack.Push(parent.right)
-				break
-			}
+		return visitFn(key, plen, value)
+	})
+}
 
-			// Pop the parent node
-			node = treeNodeStack.Pop()
+// Number of entries a long running operation goes through between two checks of
+// its context
+const ctxCheckInterval = 256
+
+// Checks the context of a long running operation, such as a walk, every
+// ctxCheckInterval entries. Checking on every entry would cost more than the
+// work done for most entries.
+type ctxChecker struct {
+	ctx   context.Context
+	count int // number of calls to check()
+	next  int // value of count at which the context is checked next
+}
 
-			// If the popped node is not root node and is a terminal node, call the walker function
-			if !t.IsRoot(node) && node.IsTerminal() {
-				err := walkerFn(ctx, node.value)
-				if nil != err {
-					return err
-				}
-			}
-		}
+// Called once per entry. The first call always checks the context.
+// Returns:
+//
+//	error - error of the context if it is done, nil otherwise
+func (c *ctxChecker) check() error {
+	c.count++
+	if c.count < c.next {
+		return nil
 	}
 
-	return nil
+	c.next = c.count + ctxCheckInterval
+	return c.ctx.Err()
 }
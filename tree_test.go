@@ -3,8 +3,11 @@ package prefix_tree
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestTree_Insert_Search_Delete(t *testing.T) {
@@ -146,6 +149,101 @@ func TestTree_Partial_Prefixs(t *testing.T) {
 	}
 }
 
+func TestTree_SearchLongest(t *testing.T) {
+	ctx := context.Background()
+	tr := NewTree[string]()
+
+	// 10.0.0.0/8 and 10.1.2.0/24
+	tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-8")
+	tr.Insert(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00}, "net-24")
+
+	addr := []byte{10, 1, 2, 3}
+	mask := []byte{0xFF, 0xFF, 0xFF, 0xFF}
+
+	// shortest prefix match returns the /8
+	res, v, err := tr.SearchShortest(ctx, addr, mask)
+	if err != nil || res != PartialMatch || v != "net-8" {
+		t.Fatalf("SearchShortest failed: res=%v v=%v err=%v", res, v, err)
+	}
+
+	// longest prefix match returns the /24
+	res, v, err = tr.SearchLongest(ctx, addr, mask)
+	if err != nil || res != PartialMatch || v != "net-24" {
+		t.Fatalf("SearchLongest failed: res=%v v=%v err=%v", res, v, err)
+	}
+
+	// longest prefix match for an address outside the /24 returns the /8
+	res, v, err = tr.SearchLongest(ctx, []byte{10, 1, 3, 3}, mask)
+	if err != nil || res != PartialMatch || v != "net-8" {
+		t.Fatalf("SearchLongest outside /24 failed: res=%v v=%v err=%v", res, v, err)
+	}
+
+	// longest prefix match for the stored key itself is a full match
+	res, v, err = tr.SearchLongest(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00})
+	if err != nil || res != Match || v != "net-24" {
+		t.Fatalf("SearchLongest for stored key failed: res=%v v=%v err=%v", res, v, err)
+	}
+
+	// no covering prefix
+	res, _, err = tr.SearchLongest(ctx, []byte{11, 1, 2, 3}, mask)
+	if err == nil || res != Error {
+		t.Fatalf("expected error for address without covering prefix, got res=%v err=%v", res, err)
+	}
+}
+
+func TestTree_SearchAll(t *testing.T) {
+	ctx := context.Background()
+	tr := NewTree[string]()
+
+	// 10.0.0.0/8, 10.1.0.0/16 and 10.1.2.0/24
+	tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-8")
+	tr.Insert(ctx, []byte{10, 1, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00}, "net-16")
+	tr.Insert(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00}, "net-24")
+
+	res, entries, err := tr.SearchAll(ctx, []byte{10, 1, 2, 3}, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	if err != nil || res != PartialMatch {
+		t.Fatalf("SearchAll failed: res=%v err=%v", res, err)
+	}
+
+	expected := []TreeEntry[string]{
+		{Key: []byte{10}, Mask: []byte{0xFF}, Value: "net-8"},
+		{Key: []byte{10, 1}, Mask: []byte{0xFF, 0xFF}, Value: "net-16"},
+		{Key: []byte{10, 1, 2}, Mask: []byte{0xFF, 0xFF, 0xFF}, Value: "net-24"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d: %v", len(expected), len(entries), entries)
+	}
+	for i := range expected {
+		if string(entries[i].Key) != string(expected[i].Key) ||
+			string(entries[i].Mask) != string(expected[i].Mask) ||
+			entries[i].Value != expected[i].Value {
+			t.Fatalf("unexpected entry %d: %v, expected %v", i, entries[i], expected[i])
+		}
+	}
+
+	// the most specific entry is the key itself
+	res, entries, err = tr.SearchAll(ctx, []byte{10, 1, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00})
+	if err != nil || res != Match || len(entries) != 2 || entries[1].Value != "net-16" {
+		t.Fatalf("SearchAll for stored key failed: res=%v entries=%v err=%v", res, entries, err)
+	}
+
+	// prefix lengths that are not byte aligned
+	tr.Insert(ctx, []byte{10, 1, 2, 128}, []byte{0xFF, 0xFF, 0xFF, 0xE0}, "net-27")
+	res, entries, err = tr.SearchAll(ctx, []byte{10, 1, 2, 129}, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	if err != nil || res != PartialMatch || len(entries) != 4 {
+		t.Fatalf("SearchAll failed: res=%v entries=%v err=%v", res, entries, err)
+	}
+	if string(entries[3].Key) != string([]byte{10, 1, 2, 128}) || string(entries[3].Mask) != string([]byte{0xFF, 0xFF, 0xFF, 0xE0}) {
+		t.Fatalf("unexpected /27 entry: %v", entries[3])
+	}
+
+	// no covering prefix
+	res, entries, err = tr.SearchAll(ctx, []byte{11, 1, 2, 3}, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	if err == nil || res != Error || entries != nil {
+		t.Fatalf("expected error for key without covering prefix, got res=%v err=%v", res, err)
+	}
+}
+
 func TestTree_LockingHandlers(t *testing.T) {
 	ctx := context.Background()
 	// Very small test to ensure lock handlers are called
@@ -385,237 +483,1669 @@ func TestWalk_StopOnError(t *testing.T) {
 	}
 }
 
-type testError struct {
-	msg string
-}
+func TestTree_SearchCovered(t *testing.T) {
+	ctx := context.Background()
+	strided := NewTree[string](WithStride(4))
+
+	for _, tr := range []*Tree[string]{NewTree[string](), NewCompressedTree[string](), strided} {
+		tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-8")
+		tr.Insert(ctx, []byte{10, 1, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00}, "net-16")
+		tr.Insert(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00}, "net-24")
+		tr.Insert(ctx, []byte{10, 2, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00}, "net-16-2")
+		tr.Insert(ctx, []byte{11, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-11")
+
+		tests := []struct {
+			key      []byte
+			mask     []byte
+			res      OpResult
+			expected []string
+		}{
+			{[]byte{10}, []byte{0xFF}, Match, []string{"net-8", "net-16", "net-24", "net-16-2"}},
+			{[]byte{10, 1}, []byte{0xFF, 0xFF}, Match, []string{"net-16", "net-24"}},
+			// 10.0.0.0/14 covers 10.1.0.0/16 and 10.2.0.0/16 but is not stored itself
+			{[]byte{10, 0}, []byte{0xFF, 0xFC}, PartialMatch, []string{"net-16", "net-24", "net-16-2"}},
+			// 10.0.0.0/7 covers both /8s
+			{[]byte{10}, []byte{0xFE}, PartialMatch, []string{"net-8", "net-16", "net-24", "net-16-2", "net-11"}},
+			{[]byte{10, 1, 2, 3}, []byte{0xFF, 0xFF, 0xFF, 0xFF}, Error, nil},
+			{[]byte{12}, []byte{0xFF}, Error, nil},
+		}
 
-func (e *testError) Error() string {
-	return e.msg
-}
+		for _, tt := range tests {
+			res, entries, err := tr.SearchCovered(ctx, tt.key, tt.mask)
+			if res != tt.res || (Error == res) != (nil != err) {
+				t.Fatalf("SearchCovered %v/%v: expected %v, got %v %v", tt.key, tt.mask, tt.res, res, err)
+			}
 
-// Benchmark Tests
+			values := []string{}
+			for _, entry := range entries {
+				values = append(values, entry.Value)
+			}
+			if fmt.Sprint(values) != fmt.Sprint(tt.expected) && len(tt.expected) > 0 {
+				t.Fatalf("SearchCovered %v/%v: expected %v, got %v", tt.key, tt.mask, tt.expected, values)
+			}
+		}
 
-// BenchmarkInsertExact benchmarks inserting exact IPv4/IPv6 addresses into the tree
-func BenchmarkInsertExact(b *testing.B) {
-	ctx := context.Background()
-	tree := NewTree[int]()
-	keys := generateTestKeys(b.N)
+		// keys are reported and the walk stops on error
+		stop := &testError{"stop"}
+		visited := []string{}
+		err := tr.WalkPrefix(ctx, []byte{10}, []byte{0xFF}, func(c context.Context, key []byte, mask []byte, v string) error {
+			visited = append(visited, fmt.Sprintf("%v/%d", key, getPrefixLen(mask)))
+			if len(visited) == 2 {
+				return stop
+			}
+			return nil
+		})
+		if err != stop || fmt.Sprint(visited) != "[[10]/8 [10 1]/16]" {
+			t.Fatalf("unexpected WalkPrefix result %v %v", visited, err)
+		}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		key := keys[i].key
-		mask := keys[i].mask
-		ival := i
-		tree.Insert(ctx, key, mask, ival)
+		if err := tr.WalkPrefix(ctx, []byte{10}, []byte{0xFF}, nil); err != ErrNoWalkerFunction {
+			t.Fatalf("expected ErrNoWalkerFunction, got %v", err)
+		}
 	}
 }
 
-// BenchmarkSearchExact benchmarks exact searches in a pre-populated tree
-func BenchmarkSearchExact(b *testing.B) {
+func TestTree_DeletePrefix(t *testing.T) {
 	ctx := context.Background()
-	tree := NewTree[int]()
-	keys := generateTestKeys(b.N)
+	strided := NewTree[string](WithStride(4))
+
+	for _, tr := range []*Tree[string]{NewTree[string](), NewCompressedTree[string](), strided} {
+		tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-8")
+		tr.Insert(ctx, []byte{10, 1, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00}, "net-16")
+		tr.Insert(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00}, "net-24")
+		tr.Insert(ctx, []byte{10, 2, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00}, "net-16-2")
+		tr.Insert(ctx, []byte{11, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-11")
+
+		// 10.0.0.0/14 is not in the tree, but 10.1.0.0/16 and 10.2.0.0/16 are within it
+		res, entries, err := tr.DeletePrefixEntries(ctx, []byte{10, 0}, []byte{0xFF, 0xFC})
+		if err != nil || res != PartialMatch || len(entries) != 3 {
+			t.Fatalf("DeletePrefixEntries failed: %v %v %v", res, entries, err)
+		}
+		if string(entries[1].Key) != string([]byte{10, 1, 2}) || entries[1].Value != "net-24" {
+			t.Fatalf("unexpected entry %v", entries[1])
+		}
+		if tr.numNodes != 2 {
+			t.Fatalf("expected 2 entries left, got %d", tr.numNodes)
+		}
 
-	// Pre-populate the tree
-	for i := 0; i < b.N; i++ {
-		key := keys[i].key
-		mask := keys[i].mask
-		ival := i
-		tree.Insert(ctx, key, mask, ival)
-	}
+		// The covering prefix is left alone
+		if _, v, err := tr.SearchLongest(ctx, []byte{10, 1, 2, 3}, []byte{0xFF, 0xFF, 0xFF, 0xFF}); err != nil || v != "net-8" {
+			t.Fatalf("expected net-8 after DeletePrefix, got %s %v", v, err)
+		}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		key := keys[i].key
-		mask := keys[i].mask
-		tree.SearchExact(ctx, key, mask)
+		res, _, err = tr.DeletePrefix(ctx, []byte{10, 0}, []byte{0xFF, 0xFC})
+		if err != ErrKeyNotFound || res != Error {
+			t.Fatalf("expected ErrKeyNotFound, got %v %v", res, err)
+		}
+
+		res, count, err := tr.DeletePrefix(ctx, []byte{10}, []byte{0xFE})
+		if err != nil || res != PartialMatch || count != 2 || !tr.IsEmpty() {
+			t.Fatalf("DeletePrefix failed: %v %d %v", res, count, err)
+		}
+
+		// All nodes but the root are released
+		if count := countLayoutNodes(tr); count != 1 {
+			t.Fatalf("expected only the root to be left, got %d nodes", count)
+		}
+
+		tr.Insert(ctx, []byte{10, 1, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00}, "net-16")
+		res, count, err = tr.DeletePrefix(ctx, []byte{10, 1}, []byte{0xFF, 0xFF})
+		if err != nil || res != Match || count != 1 || !tr.IsEmpty() {
+			t.Fatalf("DeletePrefix for a stored key failed: %v %d %v", res, count, err)
+		}
 	}
 }
 
-// BenchmarkSearchPartial benchmarks partial searches in a pre-populated tree
-func BenchmarkSearchPartial(b *testing.B) {
+func TestTree_ReplaceUpsertCompareAndSwap(t *testing.T) {
 	ctx := context.Background()
-	tree := NewTree[int]()
-	keys := generateTestKeys(b.N)
+	strided := NewTree[int](WithStride(4))
+	equal := func(a, b int) bool { return a == b }
 
-	// Pre-populate the tree
-	for i := 0; i < b.N; i++ {
-		key := keys[i].key
-		mask := keys[i].mask
-		ival := i
-		tree.Insert(ctx, key, mask, ival)
-	}
+	key := []byte{10, 1, 0, 0}
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		key := keys[i].key
-		mask := keys[i].mask
-		tree.SearchPartial(ctx, key, mask)
+	for _, tr := range []*Tree[int]{NewTree[int](), NewCompressedTree[int](), strided} {
+		res, old, err := tr.Replace(ctx, key, mask, 1)
+		if err != nil || res != Ok || old != 0 || tr.numNodes != 1 {
+			t.Fatalf("Replace of a new key failed: %v %d %v", res, old, err)
+		}
+
+		res, old, err = tr.Replace(ctx, key, mask, 2)
+		if err != nil || res != Match || old != 1 || tr.numNodes != 1 {
+			t.Fatalf("Replace of an existing key failed: %v %d %v", res, old, err)
+		}
+
+		if _, v, _ := tr.SearchExact(ctx, key, mask); v != 2 {
+			t.Fatalf("expected 2 after Replace, got %d", v)
+		}
+
+		// A longest match goes through the expanded slots of a stride tree
+		if _, v, _ := tr.SearchLongest(ctx, []byte{10, 1, 2, 3}, []byte{0xFF, 0xFF, 0xFF, 0xFF}); v != 2 {
+			t.Fatalf("expected 2 from SearchLongest after Replace, got %d", v)
+		}
+
+		increment := func(old int, exists bool) int {
+			if !exists {
+				return 100
+			}
+			return old + 1
+		}
+
+		res, v, err := tr.Upsert(ctx, key, mask, increment)
+		if err != nil || res != Match || v != 3 {
+			t.Fatalf("Upsert of an existing key failed: %v %d %v", res, v, err)
+		}
+
+		res, v, err = tr.Upsert(ctx, []byte{10, 2, 0, 0}, mask, increment)
+		if err != nil || res != Ok || v != 100 || tr.numNodes != 2 {
+			t.Fatalf("Upsert of a new key failed: %v %d %v", res, v, err)
+		}
+
+		if res, _, err := tr.Upsert(ctx, key, mask, nil); err != ErrNoUpsertFunction || res != Error {
+			t.Fatalf("expected ErrNoUpsertFunction, got %v %v", res, err)
+		}
+
+		if res, err := tr.CompareAndSwap(ctx, key, mask, 2, 10, equal); err != nil || res != NoMatch {
+			t.Fatalf("CompareAndSwap with a stale value: %v %v", res, err)
+		}
+
+		if res, err := tr.CompareAndSwap(ctx, key, mask, 3, 10, equal); err != nil || res != Match {
+			t.Fatalf("CompareAndSwap failed: %v %v", res, err)
+		}
+
+		if _, v, _ := tr.SearchExact(ctx, key, mask); v != 10 {
+			t.Fatalf("expected 10 after CompareAndSwap, got %d", v)
+		}
+
+		if res, err := tr.CompareAndSwap(ctx, []byte{10, 3, 0, 0}, mask, 0, 1, equal); err != ErrKeyNotFound || res != Error {
+			t.Fatalf("expected ErrKeyNotFound, got %v %v", res, err)
+		}
+
+		if res, err := tr.CompareAndSwap(ctx, key, mask, 10, 11, nil); err != ErrNoEqualFunction || res != Error {
+			t.Fatalf("expected ErrNoEqualFunction, got %v %v", res, err)
+		}
 	}
 }
 
-// BenchmarkDelete benchmarks deletion from the tree
-func BenchmarkDelete(b *testing.B) {
+func TestTree_UpsertConcurrent(t *testing.T) {
 	ctx := context.Background()
-	tree := NewTree[int]()
-	keys := generateTestKeys(b.N)
 
-	// Pre-populate the tree
-	for i := 0; i < b.N; i++ {
-		key := keys[i].key
-		mask := keys[i].mask
-		ival := i
-		tree.Insert(ctx, key, mask, ival)
+	var mu sync.RWMutex
+	tr := NewTreeWithLockHandlers[int](
+		func(context.Context) { mu.RLock() },
+		func(context.Context) { mu.RUnlock() },
+		func(context.Context) { mu.Lock() },
+		func(context.Context) { mu.Unlock() },
+	)
+
+	key := []byte{192, 168, 1, 0}
+	mask := []byte{0xFF, 0xFF, 0xFF, 0x00}
+
+	// Every increment must be seen by the next one
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				tr.Upsert(ctx, key, mask, func(old int, exists bool) int { return old + 1 })
+			}
+		}()
 	}
+	wg.Wait()
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		key := keys[i].key
-		mask := keys[i].mask
-		tree.Delete(ctx, key, mask)
+	if _, v, _ := tr.SearchExact(ctx, key, mask); v != 8000 || tr.numNodes != 1 {
+		t.Fatalf("expected 8000 after concurrent Upserts, got %d", v)
 	}
 }
 
-// BenchmarkGCPressure measures heap allocations and GC counts during insertions
-func BenchmarkGCPressure(b *testing.B) {
+func TestTree_InsertBatch(t *testing.T) {
 	ctx := context.Background()
-	tests := []struct {
-		name   string
-		count  int
-		keyLen int
-	}{
-		{"Small_IPv4", 1000, 4},
-		{"Large_IPv4", 10000, 4},
-		{"Small_IPv6", 1000, 16},
-		{"Large_IPv6", 10000, 16},
+	strided := NewTree[int](WithStride(4))
+
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+	entries := []TreeEntry[int]{
+		{Key: []byte{10, 1, 0, 0}, Mask: mask, Value: 1},
+		{Key: []byte{10, 2, 0, 0}, Mask: []byte{0xFF, 0xFF}, Value: 2},
+		{Key: []byte{10, 1, 0, 0}, Mask: mask, Value: 3},
+		{Key: []byte{0, 0, 0, 0}, Mask: []byte{0x00, 0x00, 0x00, 0x00}, Value: 4},
+		{Key: []byte{10, 3, 0, 0}, Mask: mask, Value: 5},
 	}
+	expected := []OpResult{Ok, Error, Dup, Error, Ok}
 
-	for _, tt := range tests {
-		b.Run(tt.name, func(b *testing.B) {
-			keys := generateTestKeys(tt.count)
-
-			var m runtime.MemStats
-
-			// Baseline: measure before insertions
-			runtime.GC()
-			runtime.ReadMemStats(&m)
-			baseHeap := m.HeapAlloc
-			baseGC := m.NumGC
+	for _, tr := range []*Tree[int]{NewTree[int](), NewCompressedTree[int](), strided} {
+		results, err := tr.InsertBatch(ctx, entries)
+		if err != ErrInvalidKeyMask || fmt.Sprint(results) != fmt.Sprint(expected) {
+			t.Fatalf("InsertBatch failed: %v %v", results, err)
+		}
 
-			b.ResetTimer()
+		if tr.numNodes != 2 {
+			t.Fatalf("expected 2 entries after InsertBatch, got %d", tr.numNodes)
+		}
 
-			tree := NewTree[int]()
-			for i := 0; i < tt.count; i++ {
-				key := keys[i].key
-				mask := keys[i].mask
+		// A duplicate keeps the value inserted first
+		if _, v, _ := tr.SearchExact(ctx, []byte{10, 1, 0, 0}, mask); v != 1 {
+			t.Fatalf("expected 1 for 10.1.0.0/16, got %d", v)
+		}
 
-				ival := i
-				tree.Insert(ctx, key, mask, ival)
+		// Load a copy of the tree from its iterator
+		clone := NewTree[int]()
+		results, err = clone.BulkLoad(ctx, func(yield func(TreeEntry[int]) bool) {
+			for c := tr.NewCursor(ctx); c.Next(); {
+				key, mask := c.Key()
+				if !yield(TreeEntry[int]{Key: key, Mask: mask, Value: c.Value()}) {
+					return
+				}
 			}
-
-			b.StopTimer()
-
-			// Measure after insertions
-			runtime.ReadMemStats(&m)
-			heapUsed := m.HeapAlloc - baseHeap
-			gcCount := m.NumGC - baseGC
-
-			// Report metrics
-			b.ReportMetric(float64(heapUsed), "bytes_alloc")
-			b.ReportMetric(float64(gcCount), "gc_runs")
-			b.ReportMetric(float64(heapUsed)/float64(tt.count), "bytes_per_insert")
-			b.Logf("%s: Heap used: %d bytes, GC runs: %d, Avg per insert: %.2f bytes",
-				tt.name, heapUsed, gcCount, float64(heapUsed)/float64(tt.count))
 		})
+		if err != nil || len(results) != 2 || results[0] != Ok || results[1] != Ok || clone.numNodes != 2 {
+			t.Fatalf("BulkLoad failed: %v %v", results, err)
+		}
 	}
 }
 
-// BenchmarkMixedOperations benchmarks a realistic mix of insert/search/delete
-func BenchmarkMixedOperations(b *testing.B) {
+func TestWalkKeys(t *testing.T) {
 	ctx := context.Background()
-	tree := NewTree[int]()
-	keys := generateTestKeys(b.N)
+	tr := NewTree[string]()
 
-	// Pre-populate 50% of keys
-	for i := 0; i < b.N/2; i++ {
-		key := keys[i].key
-		mask := keys[i].mask
-		ival := i
-		tree.Insert(ctx, key, mask, ival)
+	// Insert out of order. Walk must return them in key order.
+	tr.Insert(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFF, 0x00}, "net-24")
+	tr.Insert(ctx, []byte{192, 168, 0, 0}, []byte{0xFF, 0xFF, 0x00, 0x00}, "net-16")
+	tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-8")
+	tr.Insert(ctx, []byte{10, 1, 2, 128}, []byte{0xFF, 0xFF, 0xFF, 0xE0}, "net-27")
+
+	expected := []TreeEntry[string]{
+		{Key: []byte{10}, Mask: []byte{0xFF}, Value: "net-8"},
+		{Key: []byte{10, 1, 2}, Mask: []byte{0xFF, 0xFF, 0xFF}, Value: "net-24"},
+		{Key: []byte{10, 1, 2, 128}, Mask: []byte{0xFF, 0xFF, 0xFF, 0xE0}, Value: "net-27"},
+		{Key: []byte{192, 168}, Mask: []byte{0xFF, 0xFF}, Value: "net-16"},
 	}
 
-	b.ResetTimer()
+	visited := []TreeEntry[string]{}
+	err := tr.WalkKeys(ctx, func(c context.Context, key []byte, mask []byte, v string) error {
+		visited = append(visited, TreeEntry[string]{Key: key, Mask: mask, Value: v})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkKeys failed: %v", err)
+	}
 
-	// Mix of operations: 40% insert, 50% search, 10% delete
-	for i := 0; i < b.N; i++ {
-		op := i % 100
-		idx := i % len(keys)
-		key := keys[idx].key
-		mask := keys[idx].mask
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %d visited nodes, got %d: %v", len(expected), len(visited), visited)
+	}
+	for i := range expected {
+		if string(visited[i].Key) != string(expected[i].Key) ||
+			string(visited[i].Mask) != string(expected[i].Mask) ||
+			visited[i].Value != expected[i].Value {
+			t.Fatalf("unexpected entry %d: %v, expected %v", i, visited[i], expected[i])
+		}
+	}
 
-		if op < 40 {
-			ival := i
-			tree.Insert(ctx, key, mask, ival)
-		} else if op < 90 {
-			tree.SearchExact(ctx, key, mask)
-		} else {
-			tree.Delete(ctx, key, mask)
+	// Walk visits the values in the same order
+	values := []string{}
+	tr.Walk(ctx, func(c context.Context, v string) error {
+		values = append(values, v)
+		return nil
+	})
+	for i := range expected {
+		if values[i] != expected[i].Value {
+			t.Fatalf("Walk and WalkKeys order differ: %v", values)
 		}
 	}
+
+	if err := tr.WalkKeys(ctx, nil); err != ErrNoWalkerFunction {
+		t.Fatalf("expected ErrNoWalkerFunction, got %v", err)
+	}
 }
 
-// BenchmarkAllocations measures allocation counts during operations
-func BenchmarkAllocations(b *testing.B) {
+func TestCompressedTree(t *testing.T) {
 	ctx := context.Background()
-	tests := []struct {
-		name string
-		fn   func()
-	}{
-		{
-			"Insert_1000_Keys",
-			func() {
-				tree := NewTree[int]()
-				keys := generateTestKeys(1000)
-				for i := 0; i < 1000; i++ {
-					key := keys[i].key
-					mask := keys[i].mask
-					ival := i
-					tree.Insert(ctx, key, mask, ival)
-				}
-			},
-		},
-		{
-			"Search_1000_Keys",
-			func() {
-				tree := NewTree[int]()
-				keys := generateTestKeys(1000)
-				for i := 0; i < 1000; i++ {
-					key := keys[i].key
-					mask := keys[i].mask
-					ival := i
-					tree.Insert(ctx, key, mask, ival)
-				}
-				for i := 0; i < 1000; i++ {
-					key := keys[i].key
-					mask := keys[i].mask
-					tree.SearchExact(ctx, key, mask)
-				}
-			},
-		},
+	tr := NewCompressedTree[string]()
+
+	// A 128 bit key uses two nodes, each takes a branch bit and up to 64 skipped bits
+	key := make([]byte, 16)
+	mask := make([]byte, 16)
+	for i := range key {
+		key[i] = byte(i * 17)
+		mask[i] = 0xFF
 	}
 
-	for _, tt := range tests {
-		b.Run(tt.name, func(b *testing.B) {
-			var m runtime.MemStats
+	res, err := tr.Insert(ctx, key, mask, "v6-host")
+	if err != nil || res != Ok {
+		t.Fatalf("Insert failed: res=%v err=%v", res, err)
+	}
+	if count := countTreeNodes(treeRoot(tr)); count != 3 {
+		t.Fatalf("expected 3 nodes (root and key), got %d", count)
+	}
 
-			runtime.GC()
-			runtime.ReadMemStats(&m)
-			baseAllocs := m.Mallocs
+	// A prefix of the key splits the path
+	res, err = tr.Insert(ctx, key[:4], mask[:4], "v6-prefix")
+	if err != nil || res != Ok {
+		t.Fatalf("Insert prefix failed: res=%v err=%v", res, err)
+	}
+	if count := countTreeNodes(treeRoot(tr)); count != 4 {
+		t.Fatalf("expected 4 nodes after split, got %d", count)
+	}
 
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				tt.fn()
-			}
+	res, v, err := tr.SearchLongest(ctx, key, mask)
+	if err != nil || res != Match || v != "v6-host" {
+		t.Fatalf("SearchLongest failed: res=%v v=%v err=%v", res, v, err)
+	}
+
+	res, v, err = tr.SearchShortest(ctx, key, mask)
+	if err != nil || res != PartialMatch || v != "v6-prefix" {
+		t.Fatalf("SearchShortest failed: res=%v v=%v err=%v", res, v, err)
+	}
+
+	// Deleting the prefix merges the path again
+	res, v, err = tr.Delete(ctx, key[:4], mask[:4])
+	if err != nil || res != Match || v != "v6-prefix" {
+		t.Fatalf("Delete failed: res=%v v=%v err=%v", res, v, err)
+	}
+	if count := countTreeNodes(treeRoot(tr)); count != 3 {
+		t.Fatalf("expected 3 nodes after merge, got %d", count)
+	}
+
+	res, _, err = tr.Delete(ctx, key, mask)
+	if err != nil || res != Match || !tr.IsEmpty() || !treeRoot(tr).IsLeaf() {
+		t.Fatalf("Delete failed: res=%v err=%v", res, err)
+	}
+}
+
+// Compares a path compressed tree against the binary tree using random prefixes
+func TestCompressedTree_MatchesBinaryTree(t *testing.T) {
+	binary := NewTree[int]()
+	compressed := NewCompressedTree[int]()
+
+	testMatchesBinaryTree(t, binary, compressed)
+
+	if countTreeNodes(treeRoot(compressed)) >= countTreeNodes(treeRoot(binary)) {
+		t.Fatalf("compressed tree did not use fewer nodes")
+	}
+}
+
+func TestStrideTree_MatchesBinaryTree(t *testing.T) {
+	for stride := 1; stride <= maxStride; stride++ {
+		t.Run(fmt.Sprintf("Stride%d", stride), func(t *testing.T) {
+			testMatchesBinaryTree(t, NewTree[int](), NewTree[int](WithStride(stride)))
+		})
+	}
+}
+
+func TestArenaTree_MatchesBinaryTree(t *testing.T) {
+	arena := NewArenaTree[int]()
+	testMatchesBinaryTree(t, NewTree[int](), arena)
+
+	// Every node released by a delete is either reused or on the free list
+	layout := arena.layout.(*arenaLayout[int])
+	if count := countLayoutNodes(arena) + len(layout.free) + 1; count != int(layout.used) {
+		t.Fatalf("expected %d nodes in use, got %d", layout.used, count)
+	}
+}
+
+func TestArenaTree_FreeList(t *testing.T) {
+	ctx := context.Background()
+	tr := NewArenaTree[int]()
+	layout := tr.layout.(*arenaLayout[int])
+
+	keys := generateTestKeys(2000)
+	for i := range keys {
+		tr.Insert(ctx, keys[i].key, keys[i].mask, i)
+	}
+
+	used := layout.used
+	if used <= arenaChunkSize {
+		t.Fatalf("expected more than one chunk, got %d nodes", used)
+	}
+
+	for i := range keys {
+		tr.Delete(ctx, keys[i].key, keys[i].mask)
+	}
+
+	if !tr.IsEmpty() || countLayoutNodes(tr) != 1 || len(layout.free) != int(used)-2 {
+		t.Fatalf("expected every node but the root on the free list, got %d of %d", len(layout.free), used)
+	}
+
+	// Inserting the keys again takes every node from the free list
+	for i := range keys {
+		tr.Insert(ctx, keys[i].key, keys[i].mask, i)
+	}
+
+	if layout.used != used || 0 != len(layout.free) {
+		t.Fatalf("expected %d nodes with an empty free list, got %d and %d free", used, layout.used, len(layout.free))
+	}
+
+	// A snapshot is a copy, so nodes are still released
+	snapshot, _ := tr.Snapshot(ctx)
+	tr.DeletePrefix(ctx, []byte{0}, []byte{0x80})
+	tr.DeletePrefix(ctx, []byte{0x80}, []byte{0x80})
+
+	if !tr.IsEmpty() || len(layout.free) != int(used)-2 {
+		t.Fatalf("expected every node but the root on the free list, got %d of %d", len(layout.free), used)
+	}
+
+	for i := range keys {
+		if res, _, _ := snapshot.SearchExact(ctx, keys[i].key, keys[i].mask); res != Match {
+			t.Fatalf("snapshot lost key %v/%v", keys[i].key, keys[i].mask)
+		}
+	}
+}
+
+func TestArenaTree_SnapshotChurn(t *testing.T) {
+	ctx := context.Background()
+	tr := NewArenaTree[int]()
+	layout := tr.layout.(*arenaLayout[int])
+
+	keys := generateTestKeys(1000)
+	for i := range keys {
+		tr.Insert(ctx, keys[i].key, keys[i].mask, i)
+	}
+
+	used := layout.used
+
+	// Every round replaces the entries and takes a snapshot. Snapshots must not keep
+	// the nodes they saw from being reused.
+	var snapshot *Tree[int]
+	for round := 1; round <= 50; round++ {
+		for i := range keys {
+			tr.Delete(ctx, keys[i].key, keys[i].mask)
+		}
+
+		for i := range keys {
+			tr.Insert(ctx, keys[i].key, keys[i].mask, round)
+		}
+
+		snapshot, _ = tr.Snapshot(ctx)
+	}
+
+	if layout.used != used {
+		t.Fatalf("expected %d nodes in use, got %d", used, layout.used)
+	}
+
+	tr.DeletePrefix(ctx, []byte{0}, []byte{0x80})
+	tr.DeletePrefix(ctx, []byte{0x80}, []byte{0x80})
+
+	for i := range keys {
+		if res, value, _ := snapshot.SearchExact(ctx, keys[i].key, keys[i].mask); res != Match || value != 50 {
+			t.Fatalf("snapshot lost key %v/%v", keys[i].key, keys[i].mask)
+		}
+	}
+}
+
+func TestArenaTree_PersistenceIgnoresArena(t *testing.T) {
+	ctx := context.Background()
+
+	// Persistent and RCU trees would leave every copied node behind in an arena
+	for name, tr := range map[string]*Tree[int]{
+		"Persistent":    NewArenaTree[int](WithPersistence()),
+		"RCU":           NewArenaTree[int](WithRCU()),
+		"ArenaLast":     NewTree[int](WithPersistence(), WithArena()),
+		"CompressedRCU": NewArenaTree[int](WithRCU(), WithPathCompression()),
+	} {
+		if _, ok := tr.layout.(*binaryLayout[int]); !ok {
+			t.Fatalf("%s: expected the default layout, got %T", name, tr.layout)
+		}
+
+		if res, err := tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}, 1); res != Ok || err != nil {
+			t.Fatalf("%s: Insert failed: %v %v", name, res, err)
+		}
+	}
+
+	if _, ok := NewArenaTree[int]().layout.(*arenaLayout[int]); !ok {
+		t.Fatalf("expected an arena layout")
+	}
+}
+
+func TestPersistentTree_MatchesBinaryTree(t *testing.T) {
+	strided := NewTree[int](WithStride(4), WithPersistence())
+	compressed := NewCompressedTree[int](WithPersistence())
+
+	for name, persistent := range map[string]*Tree[int]{"Binary": NewPersistentTree[int](), "Compressed": compressed, "Stride4": strided} {
+		t.Run(name, func(t *testing.T) {
+			testMatchesBinaryTree(t, NewTree[int](), persistent)
+		})
+	}
+}
+
+// Returns the entries of a tree in walk order
+func treeEntries(tr *Tree[int]) []TreeEntry[int] {
+	entries := []TreeEntry[int]{}
+	tr.WalkKeys(context.Background(), func(c context.Context, key []byte, mask []byte, v int) error {
+		entries = append(entries, TreeEntry[int]{Key: key, Mask: mask, Value: v})
+		return nil
+	})
+
+	return entries
+}
+
+func TestTree_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	newTrees := map[string]func() *Tree[int]{
+		"Binary":           func() *Tree[int] { return NewTree[int]() },
+		"Compressed":       func() *Tree[int] { return NewCompressedTree[int]() },
+		"Persistent":       func() *Tree[int] { return NewPersistentTree[int]() },
+		"Stride4":          func() *Tree[int] { return NewTree[int](WithStride(4)) },
+		"PersistentStride": func() *Tree[int] { return NewTree[int](WithStride(3), WithPersistence()) },
+		"Arena":            func() *Tree[int] { return NewArenaTree[int]() },
+	}
+
+	for name, newTree := range newTrees {
+		t.Run(name, func(t *testing.T) {
+			tr := newTree()
+
+			snapshots := []*Tree[int]{}
+			expected := [][]TreeEntry[int]{}
+
+			for round := 0; round < 20; round++ {
+				for i := 0; i < 100; i++ {
+					key := []byte{byte(random.Intn(4)) << 6, byte(random.Intn(4)) << 6}
+					mask := newTreeEntry(make([]byte, 2), 1+random.Intn(16), 0).Mask
+
+					switch random.Intn(5) {
+					case 0:
+						tr.Delete(ctx, key, mask)
+					case 1:
+						tr.Replace(ctx, key, mask, random.Int())
+					case 2:
+						if 0 == random.Intn(10) {
+							tr.DeletePrefix(ctx, key, mask)
+						}
+					default:
+						tr.Insert(ctx, key, mask, random.Int())
+					}
+				}
+
+				snapshot, err := tr.Snapshot(ctx)
+				if err != nil || !snapshot.IsReadOnly() || snapshot.numNodes != tr.numNodes {
+					t.Fatalf("unexpected snapshot %v %d != %d", snapshot.IsReadOnly(), snapshot.numNodes, tr.numNodes)
+				}
+
+				snapshots = append(snapshots, snapshot)
+				expected = append(expected, treeEntries(tr))
+			}
+
+			// Later writes never show up in the snapshots
+			for i := range snapshots {
+				if actual := treeEntries(snapshots[i]); fmt.Sprint(expected[i]) != fmt.Sprint(actual) {
+					t.Fatalf("snapshot %d changed:\n%v\n%v", i, expected[i], actual)
+				}
+			}
+		})
+	}
+}
+
+func TestTree_SnapshotReadOnly(t *testing.T) {
+	ctx := context.Background()
+	tr := NewTree[int]()
+
+	key := []byte{10, 1, 0, 0}
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+	tr.Insert(ctx, key, mask, 1)
+
+	snapshot, err := tr.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if again, _ := snapshot.Snapshot(ctx); again != snapshot {
+		t.Fatalf("expected the snapshot of a snapshot to be itself")
+	}
+
+	if res, err := snapshot.Insert(ctx, []byte{10, 2, 0, 0}, mask, 2); err != ErrReadOnly || res != Error {
+		t.Fatalf("Insert into a snapshot: %v %v", res, err)
+	}
+
+	if res, _, err := snapshot.Replace(ctx, key, mask, 2); err != ErrReadOnly || res != Error {
+		t.Fatalf("Replace in a snapshot: %v %v", res, err)
+	}
+
+	if res, err := snapshot.CompareAndSwap(ctx, key, mask, 1, 2, func(a, b int) bool { return a == b }); err != ErrReadOnly || res != Error {
+		t.Fatalf("CompareAndSwap in a snapshot: %v %v", res, err)
+	}
+
+	if res, _, err := snapshot.Delete(ctx, key, mask); err != ErrReadOnly || res != Error {
+		t.Fatalf("Delete from a snapshot: %v %v", res, err)
+	}
+
+	if res, _, err := snapshot.DeletePrefix(ctx, key, mask); err != ErrReadOnly || res != Error {
+		t.Fatalf("DeletePrefix from a snapshot: %v %v", res, err)
+	}
+
+	if _, err := snapshot.InsertBatch(ctx, []TreeEntry[int]{{Key: key, Mask: mask, Value: 2}}); err != ErrReadOnly {
+		t.Fatalf("InsertBatch into a snapshot: %v", err)
+	}
+
+	// The tree itself is still writable
+	if res, _, err := tr.Replace(ctx, key, mask, 2); err != nil || res != Match {
+		t.Fatalf("Replace after a snapshot: %v %v", res, err)
+	}
+
+	if _, v, _ := snapshot.SearchExact(ctx, key, mask); v != 1 {
+		t.Fatalf("expected 1 in the snapshot, got %d", v)
+	}
+}
+
+func TestTree_SnapshotConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.RWMutex
+	tr := NewPersistentTreeWithLockHandlers[int](
+		func(context.Context) { mu.RLock() },
+		func(context.Context) { mu.RUnlock() },
+		func(context.Context) { mu.Lock() },
+		func(context.Context) { mu.Unlock() },
+	)
+
+	mask := []byte{0xFF, 0xFF, 0xFF, 0x00}
+	for i := 0; i < 256; i++ {
+		tr.Insert(ctx, []byte{10, 0, byte(i), 0}, mask, i)
+	}
+
+	// Readers of a snapshot take no locks while the writer keeps changing the tree
+	snapshot, _ := tr.Snapshot(ctx)
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				if _, v, err := snapshot.SearchExact(ctx, []byte{10, 0, byte(i), 0}, mask); err != nil || v != i%256 {
+					t.Errorf("unexpected snapshot value %d for %d: %v", v, i%256, err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := []byte{10, 0, byte(i), 0}
+		if 0 == i%2 {
+			tr.Delete(ctx, key, mask)
+		} else {
+			tr.Replace(ctx, key, mask, -i)
+		}
+	}
+	wg.Wait()
+
+	if snapshot.numNodes != 256 || len(treeEntries(snapshot)) != 256 {
+		t.Fatalf("snapshot changed by writes to the tree")
+	}
+}
+
+func TestTree_Clone(t *testing.T) {
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	newTrees := map[string]func() *Tree[int]{
+		"Binary":           func() *Tree[int] { return NewTree[int]() },
+		"Compressed":       func() *Tree[int] { return NewCompressedTree[int]() },
+		"Persistent":       func() *Tree[int] { return NewPersistentTree[int]() },
+		"RCU":              func() *Tree[int] { return NewRCUTree[int]() },
+		"Stride4":          func() *Tree[int] { return NewTree[int](WithStride(4)) },
+		"PersistentStride": func() *Tree[int] { return NewTree[int](WithStride(3), WithPersistence()) },
+		"Arena":            func() *Tree[int] { return NewArenaTree[int]() },
+	}
+
+	randomEntry := func() ([]byte, []byte) {
+		key := []byte{byte(random.Intn(4)) << 6, byte(random.Intn(4)) << 6}
+		return key, newTreeEntry(make([]byte, 2), 1+random.Intn(16), 0).Mask
+	}
+
+	for name, newTree := range newTrees {
+		t.Run(name, func(t *testing.T) {
+			tr := newTree()
+			for i := 0; i < 200; i++ {
+				key, mask := randomEntry()
+				tr.Insert(ctx, key, mask, random.Int())
+			}
+
+			clone, err := tr.Clone(ctx)
+			if err != nil || clone.IsReadOnly() || clone.rcu != tr.rcu || clone.persistent != tr.persistent {
+				t.Fatalf("unexpected clone: %v", err)
+			}
+
+			expected := treeEntries(tr)
+			if actual := treeEntries(clone); fmt.Sprint(expected) != fmt.Sprint(actual) || clone.numNodes != tr.numNodes {
+				t.Fatalf("clone differs:\n%v\n%v", expected, actual)
+			}
+			if countLayoutNodes(clone) != countLayoutNodes(tr) {
+				t.Fatalf("expected %d nodes in the clone, got %d", countLayoutNodes(tr), countLayoutNodes(clone))
+			}
+
+			// Writes to the clone never show up in the tree. Snapshots of the clone
+			// are not affected by later writes either.
+			snapshot, _ := clone.Snapshot(ctx)
+			for i := 0; i < 200; i++ {
+				key, mask := randomEntry()
+				if 0 == i%2 {
+					clone.Delete(ctx, key, mask)
+				} else {
+					clone.Replace(ctx, key, mask, -i)
+				}
+			}
+
+			if actual := treeEntries(tr); fmt.Sprint(expected) != fmt.Sprint(actual) {
+				t.Fatalf("tree changed by writes to the clone:\n%v\n%v", expected, actual)
+			}
+			if actual := treeEntries(snapshot); fmt.Sprint(expected) != fmt.Sprint(actual) {
+				t.Fatalf("snapshot changed by writes to the clone:\n%v\n%v", expected, actual)
+			}
+
+			// Nor do writes to the tree show up in the clone
+			expected = treeEntries(clone)
+			for i := 0; i < 200; i++ {
+				key, mask := randomEntry()
+				tr.Delete(ctx, key, mask)
+			}
+
+			if actual := treeEntries(clone); fmt.Sprint(expected) != fmt.Sprint(actual) {
+				t.Fatalf("clone changed by writes to the tree:\n%v\n%v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestTree_CloneWith(t *testing.T) {
+	ctx := context.Background()
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+
+	for _, stride := range []int{0, 4} {
+		tr := NewTree[*int]()
+		if stride > 0 {
+			tr = NewTree[*int](WithStride(stride))
+		}
+
+		for i := 0; i < 16; i++ {
+			value := i
+			tr.Insert(ctx, []byte{10, byte(i), 0, 0}, mask, &value)
+		}
+
+		copies := 0
+		clone, err := tr.CloneWith(ctx, func(value *int) *int {
+			copies++
+			copied := *value
+			return &copied
+		})
+		if err != nil || copies != 16 {
+			t.Fatalf("expected 16 copies, got %d %v", copies, err)
+		}
+
+		for i := 0; i < 16; i++ {
+			key := []byte{10, byte(i), 0, 0}
+			_, original, _ := tr.SearchExact(ctx, key, mask)
+			_, copied, _ := clone.SearchExact(ctx, key, mask)
+			if original == copied || *original != *copied {
+				t.Fatalf("stride %d: expected a copy of %d, got %p %p", stride, *original, original, copied)
+			}
+
+			// Longest matches read the expanded slots of stride nodes
+			_, copied, _ = clone.SearchLongest(ctx, []byte{10, byte(i), 1, 1}, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+			if original == copied || *original != *copied {
+				t.Fatalf("stride %d: expected a copy of %d for the longest match", stride, *original)
+			}
+		}
+	}
+}
+
+func TestTree_CloneLocks(t *testing.T) {
+	ctx := context.Background()
+	key := []byte{10, 1, 0, 0}
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+
+	// The clone gets a mutex of its own, so it can be written while the tree is
+	// read locked
+	tr := NewTree[int](WithRWMutex())
+	tr.Insert(ctx, key, mask, 1)
+
+	clone, err := tr.Clone(ctx)
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+
+	tr.Walk(ctx, func(ctx context.Context, value int) error {
+		if res, err := clone.Insert(ctx, []byte{10, 2, 0, 0}, mask, 2); err != nil || res != Ok {
+			t.Fatalf("Insert into the clone failed: %v %v", res, err)
+		}
+		return nil
+	})
+
+	// Lock handlers are shared
+	locks := 0
+	tr = NewTreeWithLockHandlers[int](
+		func(context.Context) { locks++ },
+		nil,
+		func(context.Context) { locks++ },
+		nil,
+	)
+
+	snapshot, _ := tr.Snapshot(ctx)
+	clone, _ = snapshot.Clone(ctx)
+	locks = 0
+
+	clone.Insert(ctx, key, mask, 1)
+	clone.SearchExact(ctx, key, mask)
+	if locks != 2 || clone.IsReadOnly() {
+		t.Fatalf("expected 2 locks taken by a writable clone, got %d", locks)
+	}
+
+	// Lock errors fail the clone
+	lockErr := &testError{msg: "lock failed"}
+	tr = NewTree[int](WithLockHandlers(nil, nil, nil, nil))
+	tr.rlockFn = func(context.Context) error { return lockErr }
+	if _, err := tr.Clone(ctx); err != lockErr {
+		t.Fatalf("expected %v, got %v", lockErr, err)
+	}
+}
+
+func TestRCUTree(t *testing.T) {
+	ctx := context.Background()
+	tr := NewRCUTree[int]()
+
+	mask := []byte{0xFF, 0xFF, 0x00, 0x00}
+	for i := 0; i < 4; i++ {
+		tr.Insert(ctx, []byte{10, byte(i), 0, 0}, mask, i)
+	}
+
+	snapshot, _ := tr.Snapshot(ctx)
+
+	// A walk reads a published version without locks, so it can write to the tree
+	err := tr.WalkKeys(ctx, func(ctx context.Context, key []byte, mask []byte, v int) error {
+		_, _, err := tr.Replace(ctx, key, mask, v*10)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WalkKeys failed: %v", err)
+	}
+
+	if _, v, _ := tr.SearchExact(ctx, []byte{10, 3, 0, 0}, mask); v != 30 {
+		t.Fatalf("expected 30 after Replace, got %d", v)
+	}
+
+	if _, v, _ := snapshot.SearchExact(ctx, []byte{10, 3, 0, 0}, mask); v != 3 {
+		t.Fatalf("expected 3 in the snapshot, got %d", v)
+	}
+
+	tr.DeletePrefix(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0xFE, 0x00, 0x00})
+	if tr.reader().numNodes != 2 || len(treeEntries(tr)) != 2 {
+		t.Fatalf("expected 2 entries after DeletePrefix, got %d", tr.reader().numNodes)
+	}
+}
+
+// Run with -race. Readers take no locks while writers insert, replace and delete.
+func TestRCUTree_Stress(t *testing.T) {
+	ctx := context.Background()
+	tr := NewRCUTree[int]()
+
+	mask16 := []byte{0xFF, 0xFF, 0x00, 0x00}
+	mask24 := []byte{0xFF, 0xFF, 0xFF, 0x00}
+
+	var writers sync.WaitGroup
+	var readers sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Each pair of prefixes is inserted and deleted as a whole, so readers
+	// must always see both or neither
+	for w := 0; w < 2; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			random := rand.New(rand.NewSource(int64(w)))
+
+			for i := 0; i < 2000; i++ {
+				b := byte(w*128 + random.Intn(64))
+				switch random.Intn(3) {
+				case 0:
+					tr.InsertBatch(ctx, []TreeEntry[int]{
+						{Key: []byte{10, b, 0, 0}, Mask: mask16, Value: int(b)},
+						{Key: []byte{10, b, 1, 0}, Mask: mask24, Value: int(b)},
+					})
+				case 1:
+					tr.Replace(ctx, []byte{172, b, 0, 0}, mask16, i)
+					tr.Delete(ctx, []byte{172, b, 0, 0}, mask16)
+				default:
+					tr.DeletePrefix(ctx, []byte{10, b, 0, 0}, mask16)
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				seen := map[string]int{}
+				err := tr.WalkKeys(ctx, func(ctx context.Context, key []byte, mask []byte, v int) error {
+					if 10 == key[0] {
+						seen[string(key[:2])]++
+					}
+					return nil
+				})
+				if err != nil {
+					t.Errorf("WalkKeys failed: %v", err)
+					return
+				}
+
+				for k, n := range seen {
+					if 2 != n {
+						t.Errorf("saw %d of the pair for %v", n, []byte(k))
+						return
+					}
+				}
+
+				for b := 0; b < 256; b += 17 {
+					res, v, err := tr.SearchLongest(ctx, []byte{10, byte(b), 1, 1}, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+					if nil == err && (PartialMatch != res || byte(v) != byte(b)) {
+						t.Errorf("unexpected longest match %v %d for %d", res, v, b)
+						return
+					}
+				}
+
+				for c := tr.NewCursor(ctx); c.Next(); {
+				}
+
+				// Reads the entry count concurrently with the writers
+				tr.IsEmpty()
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	if uint64(len(treeEntries(tr))) != tr.reader().numNodes {
+		t.Fatalf("entry count %d does not match the tree contents", tr.reader().numNodes)
+	}
+}
+
+func TestTree_WalkContext(t *testing.T) {
+	ctx := context.Background()
+	tr := NewTree[int]()
+
+	mask := []byte{0xFF, 0xFF, 0xFF, 0x00}
+	for i := 0; i < 4096; i++ {
+		tr.Insert(ctx, []byte{10, byte(i >> 8), byte(i), 0}, mask, i)
+	}
+
+	// A walk gives up soon after its context is cancelled
+	walkCtx, cancel := context.WithCancel(ctx)
+	visited := 0
+	err := tr.Walk(walkCtx, func(ctx context.Context, value int) error {
+		visited++
+		if 10 == visited {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled || visited > 10+ctxCheckInterval {
+		t.Fatalf("expected the walk to stop after %d entries, got %d %v", 10+ctxCheckInterval, visited, err)
+	}
+
+	// A walk with a context that is already done visits nothing
+	visited = 0
+	deadlineCtx, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+
+	err = tr.WalkPrefix(deadlineCtx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}, func(ctx context.Context, key []byte, mask []byte, value int) error {
+		visited++
+		return nil
+	})
+	if err != context.DeadlineExceeded || 0 != visited {
+		t.Fatalf("expected deadline exceeded, got %d %v", visited, err)
+	}
+
+	if _, _, err := tr.SearchCovered(deadlineCtx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}); err != context.DeadlineExceeded {
+		t.Fatalf("SearchCovered: expected deadline exceeded, got %v", err)
+	}
+
+	// A batch stops and leaves the rest of the entries alone
+	batch := []TreeEntry[int]{}
+	for i := 0; i < 16; i++ {
+		batch = append(batch, TreeEntry[int]{Key: []byte{11, byte(i), 0, 0}, Mask: mask, Value: i})
+	}
+
+	results, err := tr.InsertBatch(deadlineCtx, batch)
+	if err != context.DeadlineExceeded || len(results) != len(batch) || tr.numNodes != 4096 {
+		t.Fatalf("InsertBatch: expected deadline exceeded, got %v %v %d", results, err, tr.numNodes)
+	}
+	for i := range results {
+		if Error != results[i] {
+			t.Fatalf("InsertBatch: unexpected result %v for entry %d", results[i], i)
+		}
+	}
+}
+
+func TestStrideTree(t *testing.T) {
+	ctx := context.Background()
+
+	// An invalid stride fails every operation
+	for _, stride := range []int{0, -1, maxStride + 1} {
+		tr := NewTree[string](WithStride(stride))
+		if _, err := tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}, "net-8"); err != ErrInvalidStride {
+			t.Fatalf("stride %d: expected ErrInvalidStride, got %v", stride, err)
+		}
+
+		if _, _, err := tr.SearchLongest(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0, 0, 0}); err != ErrInvalidStride {
+			t.Fatalf("stride %d: expected ErrInvalidStride, got %v", stride, err)
+		}
+
+		if _, err := tr.Snapshot(ctx); err != ErrInvalidStride {
+			t.Fatalf("stride %d: expected ErrInvalidStride, got %v", stride, err)
+		}
+	}
+
+	// A later stride overrides an earlier one, and the stride wins over the arena
+	if _, ok := NewTree[string](WithStride(0), WithArena(), WithStride(4)).layout.(*strideLayout[string]); !ok {
+		t.Fatalf("expected a stride layout")
+	}
+
+	tr := NewTree[string](WithStride(4))
+
+	// 10.0.0.0/8 ends on a stride boundary, 10.0.0.0/6 and 10.1.2.0/23 inside a node
+	tr.Insert(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00}, "net-8")
+	tr.Insert(ctx, []byte{8, 0, 0, 0}, []byte{0xFC, 0x00, 0x00, 0x00}, "net-6")
+	tr.Insert(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFE, 0x00}, "net-23")
+
+	// 1 root, 2 nodes for the /8 and 3 more for the /23
+	if count := countLayoutNodes(tr); count != 6 {
+		t.Fatalf("expected 6 nodes, got %d", count)
+	}
+
+	mask := []byte{0xFF, 0xFF, 0xFF, 0xFF}
+	tests := []struct {
+		addr     []byte
+		mType    MatchType
+		expected string
+	}{
+		{[]byte{10, 1, 3, 3}, Longest, "net-23"},
+		{[]byte{10, 1, 4, 3}, Longest, "net-8"},
+		{[]byte{11, 1, 4, 3}, Longest, "net-6"},
+		{[]byte{10, 1, 3, 3}, Shortest, "net-6"},
+	}
+
+	for _, tt := range tests {
+		_, v, err := tr.Search(ctx, tt.addr, mask, tt.mType)
+		if err != nil || v != tt.expected {
+			t.Fatalf("Search %v (%v): expected %s, got %s %v", tt.addr, tt.mType, tt.expected, v, err)
+		}
+	}
+
+	// The expanded slots fall back to the shorter prefix after a delete
+	tr.Delete(ctx, []byte{10, 0, 0, 0}, []byte{0xFF, 0x00, 0x00, 0x00})
+	if _, v, _ := tr.SearchLongest(ctx, []byte{10, 1, 4, 3}, mask); v != "net-6" {
+		t.Fatalf("expected net-6 after delete, got %s", v)
+	}
+
+	tr.Delete(ctx, []byte{8, 0, 0, 0}, []byte{0xFC, 0x00, 0x00, 0x00})
+	tr.Delete(ctx, []byte{10, 1, 2, 0}, []byte{0xFF, 0xFF, 0xFE, 0x00})
+
+	// All nodes but the root are released
+	if count := countLayoutNodes(tr); count != 1 || !tr.IsEmpty() {
+		t.Fatalf("expected only the root to be left, got %d nodes", count)
+	}
+}
+
+// Applies the same random operations to a binary tree and a tree with another
+// layout, and fails if any result differs
+func testMatchesBinaryTree(t *testing.T, binary *Tree[int], other *Tree[int]) {
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+
+	// Short keys with few distinct bits to get plenty of shared prefixes,
+	// plus long keys to get skipped runs of more than 64 bits
+	randomKey := func() ([]byte, []byte) {
+		keyLen := 2
+		if random.Intn(4) == 0 {
+			keyLen = 12
+		}
+
+		key := make([]byte, keyLen)
+		for i := range key {
+			key[i] = byte(random.Intn(4)) << 6
+		}
+
+		plen := 1 + random.Intn(keyLen*8)
+		return key, newTreeEntry(make([]byte, keyLen), plen, 0).Mask
+	}
+
+	paddedMask := func(key []byte, mask []byte) []byte {
+		padded := make([]byte, len(key))
+		copy(padded, mask)
+		return padded
+	}
+
+	compareTrees := func() {
+		expected := []TreeEntry[int]{}
+		binary.WalkKeys(ctx, func(c context.Context, key []byte, mask []byte, v int) error {
+			expected = append(expected, TreeEntry[int]{Key: key, Mask: mask, Value: v})
+			return nil
+		})
+
+		actual := []TreeEntry[int]{}
+		other.WalkKeys(ctx, func(c context.Context, key []byte, mask []byte, v int) error {
+			actual = append(actual, TreeEntry[int]{Key: key, Mask: mask, Value: v})
+			return nil
+		})
+
+		if fmt.Sprint(expected) != fmt.Sprint(actual) {
+			t.Fatalf("walk mismatch:\nbinary     %v\nother      %v", expected, actual)
+		}
+
+		if binary.numNodes != other.numNodes {
+			t.Fatalf("node count mismatch: %d != %d", binary.numNodes, other.numNodes)
+		}
+	}
+
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 200; i++ {
+			key, mask := randomKey()
+			mask = paddedMask(key, mask)
+
+			res1, err1 := binary.Insert(ctx, key, mask, i)
+			res2, err2 := other.Insert(ctx, key, mask, i)
+			if res1 != res2 || err1 != err2 {
+				t.Fatalf("Insert %v/%v mismatch: %v/%v != %v/%v", key, mask, res1, err1, res2, err2)
+			}
+		}
+
+		compareTrees()
+
+		for i := 0; i < 500; i++ {
+			key, mask := randomKey()
+			mask = paddedMask(key, mask)
+
+			for _, mType := range []MatchType{Exact, Partial, Longest} {
+				res1, v1, err1 := binary.Search(ctx, key, mask, mType)
+				res2, v2, err2 := other.Search(ctx, key, mask, mType)
+				if res1 != res2 || v1 != v2 || err1 != err2 {
+					t.Fatalf("Search %v/%v (%v) mismatch: %v/%v/%v != %v/%v/%v", key, mask, mType, res1, v1, err1, res2, v2, err2)
+				}
+			}
+
+			res1, entries1, err1 := binary.SearchAll(ctx, key, mask)
+			res2, entries2, err2 := other.SearchAll(ctx, key, mask)
+			if res1 != res2 || err1 != err2 || fmt.Sprint(entries1) != fmt.Sprint(entries2) {
+				t.Fatalf("SearchAll %v/%v mismatch: %v/%v != %v/%v", key, mask, entries1, err1, entries2, err2)
+			}
+
+			// Subtree walks are slow, only check some of them
+			if i%10 == 0 {
+				res1, entries1, err1 = binary.SearchCovered(ctx, key, mask)
+				res2, entries2, err2 = other.SearchCovered(ctx, key, mask)
+				if res1 != res2 || err1 != err2 || fmt.Sprint(entries1) != fmt.Sprint(entries2) {
+					t.Fatalf("SearchCovered %v/%v mismatch: %v/%v != %v/%v", key, mask, entries1, err1, entries2, err2)
+				}
+			}
+
+			c1 := binary.NewCursor(ctx)
+			c2 := other.NewCursor(ctx)
+			c1.Seek(key, mask)
+			c2.Seek(key, mask)
+			for j := 0; j < 3; j++ {
+				ok1, ok2 := c1.Next(), c2.Next()
+				k1, m1 := c1.Key()
+				k2, m2 := c2.Key()
+				if ok1 != ok2 || fmt.Sprint(k1, m1, c1.Value()) != fmt.Sprint(k2, m2, c2.Value()) {
+					t.Fatalf("Seek %v/%v mismatch: %v/%v/%v != %v/%v/%v", key, mask, k1, m1, c1.Value(), k2, m2, c2.Value())
+				}
+			}
+		}
+
+		for i := 0; i < 5; i++ {
+			key, mask := randomKey()
+			mask = paddedMask(key, mask)
+
+			res1, entries1, err1 := binary.DeletePrefixEntries(ctx, key, mask)
+			res2, entries2, err2 := other.DeletePrefixEntries(ctx, key, mask)
+			if res1 != res2 || err1 != err2 || fmt.Sprint(entries1) != fmt.Sprint(entries2) {
+				t.Fatalf("DeletePrefix %v/%v mismatch: %v/%v != %v/%v", key, mask, entries1, err1, entries2, err2)
+			}
+		}
+
+		compareTrees()
+
+		for i := 0; i < 150; i++ {
+			key, mask := randomKey()
+			mask = paddedMask(key, mask)
+
+			res1, v1, err1 := binary.Delete(ctx, key, mask)
+			res2, v2, err2 := other.Delete(ctx, key, mask)
+			if res1 != res2 || v1 != v2 || err1 != err2 {
+				t.Fatalf("Delete %v/%v mismatch: %v/%v/%v != %v/%v/%v", key, mask, res1, v1, err1, res2, v2, err2)
+			}
+		}
+
+		compareTrees()
+	}
+}
+
+// Counts the nodes allocated under the given node, including the node
+func countTreeNodes[T any](node *Node[T]) int {
+	if nil == node {
+		return 0
+	}
+
+	return 1 + countTreeNodes(node.left) + countTreeNodes(node.right)
+}
+
+// Counts the nodes allocated by the layout of a tree
+func countLayoutNodes[T any](tr *Tree[T]) int {
+	switch layout := tr.layout.(type) {
+	case *binaryLayout[T]:
+		return countTreeNodes(layout.root.Node)
+	case *strideLayout[T]:
+		return countStrideNodes(layout.root)
+	case *arenaLayout[T]:
+		return countArenaNodes(layout, layout.root)
+	}
+
+	return 0
+}
+
+// Counts the nodes under the given arena node, including the node
+func countArenaNodes[T any](layout *arenaLayout[T], idx uint32) int {
+	count := 1
+	for _, child := range layout.node(idx).children {
+		if 0 != child {
+			count += countArenaNodes(layout, child)
+		}
+	}
+
+	return count
+}
+
+// Counts the nodes under the given stride node, including the node
+func countStrideNodes[T any](node *strideNode[T]) int {
+	count := 1
+	for _, child := range node.children {
+		if nil != child {
+			count += countStrideNodes(child)
+		}
+	}
+
+	return count
+}
+
+// Returns the root node of a binary tree
+func treeRoot[T any](tr *Tree[T]) *Node[T] {
+	return tr.layout.(*binaryLayout[T]).root.Node
+}
+
+type testError struct {
+	msg string
+}
+
+func (e *testError) Error() string {
+	return e.msg
+}
+
+// Benchmark Tests
+
+// BenchmarkInsertExact benchmarks inserting exact IPv4/IPv6 addresses into the tree
+func BenchmarkInsertExact(b *testing.B) {
+	ctx := context.Background()
+	tree := NewTree[int]()
+	keys := generateTestKeys(b.N)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i].key
+		mask := keys[i].mask
+		ival := i
+		tree.Insert(ctx, key, mask, ival)
+	}
+}
+
+// BenchmarkSearchExact benchmarks exact searches in a pre-populated tree
+func BenchmarkSearchExact(b *testing.B) {
+	ctx := context.Background()
+	tree := NewTree[int]()
+	keys := generateTestKeys(b.N)
+
+	// Pre-populate the tree
+	for i := 0; i < b.N; i++ {
+		key := keys[i].key
+		mask := keys[i].mask
+		ival := i
+		tree.Insert(ctx, key, mask, ival)
+	}
+
+	// Lookups must not allocate
+	assertNoAllocs(b, "SearchExact", func() {
+		tree.SearchExact(ctx, keys[0].key, keys[0].mask)
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i].key
+		mask := keys[i].mask
+		tree.SearchExact(ctx, key, mask)
+	}
+}
+
+// BenchmarkSearchPartial benchmarks partial searches in a pre-populated tree
+func BenchmarkSearchPartial(b *testing.B) {
+	ctx := context.Background()
+	tree := NewTree[int]()
+	keys := generateTestKeys(b.N)
+
+	// Pre-populate the tree
+	for i := 0; i < b.N; i++ {
+		key := keys[i].key
+		mask := keys[i].mask
+		ival := i
+		tree.Insert(ctx, key, mask, ival)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i].key
+		mask := keys[i].mask
+		tree.SearchPartial(ctx, key, mask)
+	}
+}
+
+// BenchmarkDelete benchmarks deletion from the tree
+func BenchmarkDelete(b *testing.B) {
+	ctx := context.Background()
+	tree := NewTree[int]()
+	keys := generateTestKeys(b.N)
+
+	// Pre-populate the tree
+	for i := 0; i < b.N; i++ {
+		key := keys[i].key
+		mask := keys[i].mask
+		ival := i
+		tree.Insert(ctx, key, mask, ival)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i].key
+		mask := keys[i].mask
+		tree.Delete(ctx, key, mask)
+	}
+}
+
+// BenchmarkGCPressure measures heap allocations and GC counts during insertions
+func BenchmarkGCPressure(b *testing.B) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		count  int
+		keyLen int
+		arena  bool
+	}{
+		{"Small_IPv4", 1000, 4, false},
+		{"Large_IPv4", 10000, 4, false},
+		{"Small_IPv6", 1000, 16, false},
+		{"Large_IPv6", 10000, 16, false},
+		{"Small_IPv4_Arena", 1000, 4, true},
+		{"Large_IPv4_Arena", 10000, 4, true},
+		{"Small_IPv6_Arena", 1000, 16, true},
+		{"Large_IPv6_Arena", 10000, 16, true},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			keys := generateTestKeys(tt.count)
+
+			var m runtime.MemStats
+
+			// Baseline: measure before insertions
+			runtime.GC()
+			runtime.ReadMemStats(&m)
+			baseHeap := m.HeapAlloc
+			baseGC := m.NumGC
+
+			b.ResetTimer()
+
+			tree := NewTree[int]()
+			if tt.arena {
+				tree = NewArenaTree[int]()
+			}
+
+			for i := 0; i < tt.count; i++ {
+				key := keys[i].key
+				mask := keys[i].mask
+
+				ival := i
+				tree.Insert(ctx, key, mask, ival)
+			}
+
+			b.StopTimer()
+
+			// Measure after insertions
+			runtime.ReadMemStats(&m)
+			heapUsed := m.HeapAlloc - baseHeap
+			gcCount := m.NumGC - baseGC
+
+			// Report metrics
+			b.ReportMetric(float64(heapUsed), "bytes_alloc")
+			b.ReportMetric(float64(gcCount), "gc_runs")
+			b.ReportMetric(float64(heapUsed)/float64(tt.count), "bytes_per_insert")
+			b.Logf("%s: Heap used: %d bytes, GC runs: %d, Avg per insert: %.2f bytes",
+				tt.name, heapUsed, gcCount, float64(heapUsed)/float64(tt.count))
+		})
+	}
+}
+
+// BenchmarkLayouts compares the binary, path compressed and multibit stride node layouts
+func BenchmarkLayouts(b *testing.B) {
+	ctx := context.Background()
+	newStrideTree := func(stride int) func() *Tree[int] {
+		return func() *Tree[int] {
+			return NewTree[int](WithStride(stride))
+		}
+	}
+
+	layouts := []struct {
+		name    string
+		newTree func() *Tree[int]
+	}{
+		{"Binary", func() *Tree[int] { return NewTree[int]() }},
+		{"Compressed", func() *Tree[int] { return NewCompressedTree[int]() }},
+		{"Stride4", newStrideTree(4)},
+		{"Stride8", newStrideTree(8)},
+		{"Arena", func() *Tree[int] { return NewArenaTree[int]() }},
+	}
+
+	populate := func(tree *Tree[int], keys []testKey) {
+		for i := range keys {
+			tree.Insert(ctx, keys[i].key, keys[i].mask, i)
+		}
+	}
+
+	// The key set is capped so that fast operations do not need
+	// billions of keys. Operations cycle through the keys instead.
+	const numKeys = 100000
+	keys := generateTestKeys(numKeys)
+
+	for _, layout := range layouts {
+		b.Run(layout.name+"/Insert", func(b *testing.B) {
+			tree := layout.newTree()
+
+			for i := 0; i < b.N; i++ {
+				if i%numKeys == 0 && i > 0 {
+					b.StopTimer()
+					tree = layout.newTree()
+					b.StartTimer()
+				}
+
+				tree.Insert(ctx, keys[i%numKeys].key, keys[i%numKeys].mask, i)
+			}
+		})
+
+		b.Run(layout.name+"/SearchExact", func(b *testing.B) {
+			tree := layout.newTree()
+			populate(tree, keys)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tree.SearchExact(ctx, keys[i%numKeys].key, keys[i%numKeys].mask)
+			}
+		})
+
+		b.Run(layout.name+"/SearchLongest", func(b *testing.B) {
+			tree := layout.newTree()
+			populate(tree, keys)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tree.SearchLongest(ctx, keys[i%numKeys].key, keys[i%numKeys].mask)
+			}
+		})
+
+		b.Run(layout.name+"/Delete", func(b *testing.B) {
+			tree := layout.newTree()
+			populate(tree, keys)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%numKeys == 0 && i > 0 {
+					b.StopTimer()
+					populate(tree, keys)
+					b.StartTimer()
+				}
+
+				tree.Delete(ctx, keys[i%numKeys].key, keys[i%numKeys].mask)
+			}
+		})
+
+		b.Run(layout.name+"/Memory", func(b *testing.B) {
+			const count = 10000
+			keys := generateTestKeys(count)
+
+			var m runtime.MemStats
+
+			runtime.GC()
+			runtime.ReadMemStats(&m)
+			baseHeap := m.HeapAlloc
+
+			b.ResetTimer()
+
+			tree := layout.newTree()
+			populate(tree, keys)
+
+			b.StopTimer()
+
+			runtime.GC()
+			runtime.ReadMemStats(&m)
+			heapUsed := m.HeapAlloc - baseHeap
+
+			b.ReportMetric(float64(heapUsed)/count, "bytes_per_key")
+			b.ReportMetric(float64(countLayoutNodes(tree))/count, "nodes_per_key")
+
+			// The keys and the tree must still be reachable when the heap is measured
+			runtime.KeepAlive(keys)
+			runtime.KeepAlive(tree)
+		})
+	}
+}
+
+// BenchmarkMixedOperations benchmarks a realistic mix of insert/search/delete
+func BenchmarkMixedOperations(b *testing.B) {
+	ctx := context.Background()
+	tree := NewTree[int]()
+	keys := generateTestKeys(b.N)
+
+	// Pre-populate 50% of keys
+	for i := 0; i < b.N/2; i++ {
+		key := keys[i].key
+		mask := keys[i].mask
+		ival := i
+		tree.Insert(ctx, key, mask, ival)
+	}
+
+	b.ResetTimer()
+
+	// Mix of operations: 40% insert, 50% search, 10% delete
+	for i := 0; i < b.N; i++ {
+		op := i % 100
+		idx := i % len(keys)
+		key := keys[idx].key
+		mask := keys[idx].mask
+
+		if op < 40 {
+			ival := i
+			tree.Insert(ctx, key, mask, ival)
+		} else if op < 90 {
+			tree.SearchExact(ctx, key, mask)
+		} else {
+			tree.Delete(ctx, key, mask)
+		}
+	}
+}
+
+// BenchmarkAllocations measures allocation counts during operations
+func BenchmarkAllocations(b *testing.B) {
+	ctx := context.Background()
+
+	insert := func(newTree func() *Tree[int]) func() {
+		return func() {
+			tree := newTree()
+			keys := generateTestKeys(1000)
+			for i := 0; i < 1000; i++ {
+				key := keys[i].key
+				mask := keys[i].mask
+				ival := i
+				tree.Insert(ctx, key, mask, ival)
+			}
+		}
+	}
+
+	search := func(newTree func() *Tree[int]) func() {
+		return func() {
+			tree := newTree()
+			keys := generateTestKeys(1000)
+			for i := 0; i < 1000; i++ {
+				key := keys[i].key
+				mask := keys[i].mask
+				ival := i
+				tree.Insert(ctx, key, mask, ival)
+			}
+			for i := 0; i < 1000; i++ {
+				key := keys[i].key
+				mask := keys[i].mask
+				tree.SearchExact(ctx, key, mask)
+			}
+		}
+	}
+
+	newArenaTree := func() *Tree[int] { return NewArenaTree[int]() }
+
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{"Insert_1000_Keys", insert(func() *Tree[int] { return NewTree[int]() })},
+		{"Search_1000_Keys", search(func() *Tree[int] { return NewTree[int]() })},
+		{"Insert_1000_Keys_Arena", insert(newArenaTree)},
+		{"Search_1000_Keys_Arena", search(newArenaTree)},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			var m runtime.MemStats
+
+			runtime.GC()
+			runtime.ReadMemStats(&m)
+			baseAllocs := m.Mallocs
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tt.fn()
+			}
 			b.StopTimer()
 
 			runtime.ReadMemStats(&m)
@@ -625,6 +2155,103 @@ func BenchmarkAllocations(b *testing.B) {
 	}
 }
 
+// BenchmarkInsertBatch compares loading keys with InsertBatch against looped Insert
+// on a tree with mutex lock handlers
+func BenchmarkInsertBatch(b *testing.B) {
+	ctx := context.Background()
+	keys := generateTestKeys(10000)
+
+	entries := make([]TreeEntry[int], len(keys))
+	for i := range keys {
+		entries[i] = TreeEntry[int]{Key: keys[i].key, Mask: keys[i].mask, Value: i}
+	}
+
+	newTree := func() *Tree[int] {
+		var mu sync.RWMutex
+		return NewTreeWithLockHandlers[int](
+			func(context.Context) { mu.RLock() },
+			func(context.Context) { mu.RUnlock() },
+			func(context.Context) { mu.Lock() },
+			func(context.Context) { mu.Unlock() },
+		)
+	}
+
+	b.Run("Insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := newTree()
+			for j := range entries {
+				tree.Insert(ctx, entries[j].Key, entries[j].Mask, entries[j].Value)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(entries)), "ns/key")
+	})
+
+	b.Run("InsertBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := newTree()
+			tree.InsertBatch(ctx, entries)
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(entries)), "ns/key")
+	})
+}
+
+// BenchmarkConcurrentSearch compares parallel lookups on a tree with RWMutex lock
+// handlers against a RCU tree, while a writer keeps updating the tree
+func BenchmarkConcurrentSearch(b *testing.B) {
+	ctx := context.Background()
+	keys := generateTestKeys(10000)
+
+	var mu sync.RWMutex
+	trees := map[string]*Tree[int]{
+		"RWMutex": NewTreeWithLockHandlers[int](
+			func(context.Context) { mu.RLock() },
+			func(context.Context) { mu.RUnlock() },
+			func(context.Context) { mu.Lock() },
+			func(context.Context) { mu.Unlock() },
+		),
+		"RCU": NewRCUTree[int](),
+	}
+
+	for _, name := range []string{"RWMutex", "RCU"} {
+		tree := trees[name]
+		for i := range keys {
+			tree.Insert(ctx, keys[i].key, keys[i].mask, i)
+		}
+
+		b.Run(name, func(b *testing.B) {
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					key := keys[i%len(keys)]
+					tree.Replace(ctx, key.key, key.mask, i)
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					tree.SearchExact(ctx, key.key, key.mask)
+					i++
+				}
+			})
+			b.StopTimer()
+
+			close(stop)
+			<-done
+		})
+	}
+}
+
 // Helper to generate test keys
 type testKey struct {
 	key  []byte
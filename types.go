@@ -3,6 +3,8 @@ package prefix_tree
 import (
 	"context"
 	"errors"
+	"io"
+	"iter"
 )
 
 type OpResult int
@@ -19,30 +21,108 @@ const (
 type MatchType int
 
 const (
-	Exact MatchType = iota
-	Partial
+	Exact   MatchType = iota
+	Partial           // Shortest stored prefix covering the key
+	Longest           // Longest (most specific) stored prefix covering the key
 )
 
+// Shortest is an alias for Partial. Partial has always returned the
+// earliest (least specific) matching prefix in the tree.
+const Shortest = Partial
+
 type ReadLockFn func(context.Context)
 type ReadUnlockFn func(context.Context)
 type WriteLockFn func(context.Context)
 type UnlockFn func(context.Context)
 
 type WalkerFn[T any] func(context.Context, T) error
+type KeyWalkerFn[T any] func(context.Context, string, T) error
+type KeyedWalkerFn[K, T any] func(context.Context, K, T) error
+
+// Returns the value to store for a key, given the value already stored for it and
+// whether there is one
+type UpsertFn[T any] func(old T, exists bool) T
+
+// Reports whether two values are equal
+type EqualFn[T any] func(a, b T) bool
+
+// Returns the copy of a value stored in a clone of a tree
+type CloneFn[T any] func(T) T
+
+// Returns the value to store for a key present in both trees of a set operation
+type ResolveFn[T any] func(a, b T) T
+
+// Key/mask and value of an entry stored in a Tree
+type TreeEntry[T any] struct {
+	Key   []byte
+	Mask  []byte
+	Value T
+}
+
+// Key and value of an entry stored in a PrefixTree. The key is in the same
+// format accepted by Insert, e.g. CIDR notation for the IP trees.
+type Entry[T any] struct {
+	Key   string
+	Value T
+}
 
 type PrefixTree[T any] interface {
 	Insert(context.Context, string, T) (OpResult, error)
+	InsertBatch(context.Context, []Entry[T]) ([]OpResult, error)
+	BulkLoad(context.Context, iter.Seq2[string, T]) ([]OpResult, error)
+	Replace(context.Context, string, T) (OpResult, T, error)
+	Upsert(context.Context, string, UpsertFn[T]) (OpResult, T, error)
+	CompareAndSwap(context.Context, string, T, T, EqualFn[T]) (OpResult, error)
 	Delete(context.Context, string) (OpResult, T, error)
+	DeletePrefix(context.Context, string) (OpResult, uint64, error)
+	DeletePrefixEntries(context.Context, string) (OpResult, []Entry[T], error)
 	Search(context.Context, string) (OpResult, T, error)
 	SearchExact(context.Context, string) (OpResult, T, error)
+	SearchShortest(context.Context, string) (OpResult, T, error)
+	SearchLongest(context.Context, string) (OpResult, T, error)
+	SearchAll(context.Context, string) (OpResult, []Entry[T], error)
+	SearchCovered(context.Context, string) (OpResult, []Entry[T], error)
 	Walk(context.Context, WalkerFn[T]) error
+	WalkKeys(context.Context, KeyWalkerFn[T]) error
+	WalkPrefix(context.Context, string, KeyWalkerFn[T]) error
+	Cursor(context.Context) *Cursor[T]
+	All(context.Context) iter.Seq2[string, T]
+	Prefixes(context.Context) iter.Seq2[string, int]
+	Snapshot(context.Context) (PrefixTree[T], error)
+	Compile(context.Context) (PrefixTree[T], error)
+	Clone(context.Context) (PrefixTree[T], error)
+	CloneWith(context.Context, CloneFn[T]) (PrefixTree[T], error)
+	Union(context.Context, PrefixTree[T], ResolveFn[T]) (PrefixTree[T], error)
+	Intersect(context.Context, PrefixTree[T], ResolveFn[T]) (PrefixTree[T], error)
+	Difference(context.Context, PrefixTree[T]) (PrefixTree[T], error)
+	Diff(context.Context, PrefixTree[T], EqualFn[T]) (*ChangeSet[T], error)
+	ApplyDiff(context.Context, *ChangeSet[T]) error
 	GetNodesCount() uint64
+	Stats(context.Context) (*TreeStats, error)
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary([]byte) error
+	WriteTo(io.Writer) (int64, error)
+	ReadFrom(io.Reader) (int64, error)
+	MarshalJSON() ([]byte, error)
+	UnmarshalJSON([]byte) error
 }
 
 var (
-	ErrInvalidPrefixTree = errors.New("invalid prefix tree")
-	ErrInvalidKeyMask    = errors.New("invalid key/mask")
-	ErrInsertFailed      = errors.New("insert failed")
-	ErrKeyNotFound       = errors.New("key not found")
-	ErrNoWalkerFunction  = errors.New("no walker function provided")
+	ErrInvalidPrefixTree  = errors.New("invalid prefix tree")
+	ErrInvalidKeyMask     = errors.New("invalid key/mask")
+	ErrInsertFailed       = errors.New("insert failed")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrNoWalkerFunction   = errors.New("no walker function provided")
+	ErrNoUpsertFunction   = errors.New("no upsert function provided")
+	ErrNoEqualFunction    = errors.New("no equal function provided")
+	ErrNoResolveFunction  = errors.New("no resolve function provided")
+	ErrInvalidStride      = errors.New("invalid stride")
+	ErrReadOnly           = errors.New("read-only prefix tree")
+	ErrInvalidEncoding    = errors.New("invalid prefix tree encoding")
+	ErrUnsupportedVersion = errors.New("unsupported prefix tree encoding version")
+	ErrChecksumMismatch   = errors.New("prefix tree encoding checksum mismatch")
+	ErrInvalidValueCodec  = errors.New("value codec does not match the value type")
+	ErrDuplicateKey       = errors.New("duplicate key")
+	ErrNoCSVFunction      = errors.New("no CSV format/parse function provided")
+	ErrInvalidCSVHeader   = errors.New("invalid CSV header")
 )
@@ -3,11 +3,15 @@ package prefix_tree
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"strings"
 )
 
+// IPv4 prefix tree, keyed by prefixes in CIDR notation, see V4KeyCodec
 type V4Tree[T any] struct {
-	tree *Tree[T]
+	KeyedTree[string, T]
 }
 
 // Returns the IPv4 address and mask for the given string representation
@@ -44,16 +48,154 @@ func getv4Addr(saddr string) (net.IP, net.IPMask, error) {
 	return nil, nil, fmt.Errorf("invalid v4 address %s", saddr)
 }
 
-// Returns a new IPv4 prefix tree
+// Parses the given IPv4 address into the key and mask buffers. Plain IPv4 addresses
+// and prefixes are parsed without allocating, anything else is left to getv4Addr().
+// Arguments:
+//
+//	saddr - string representation of the IPv4 address. Can be in
+//	         CIDR notation or just the IP address.
+//	key   - buffer of net.IPv4len bytes for the address
+//	mask  - buffer of net.IPv4len bytes for the mask
+//
 // Returns:
 //
-//	AddrTree - IPv4 prefix tree
-func NewV4Tree[T any]() PrefixTree[T] {
+//	[]byte - IPv4 address bytes
+//	[]byte - IPv4 mask bytes
+//	error  - error, if any
+func getv4Key(saddr string, key []byte, mask []byte) ([]byte, []byte, error) {
+	key, plen, err := getv4KeyPrefixLen(saddr, key)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	setMask(mask, plen)
+	return key, mask, nil
+}
+
+// Same as getv4Key(), but returns the mask as a prefix length.
+// Arguments:
+//
+//	saddr - string representation of the IPv4 address. Can be in
+//	         CIDR notation or just the IP address.
+//	key   - buffer of net.IPv4len bytes for the address
+//
+// Returns:
+//
+//	[]byte - IPv4 address bytes
+//	int    - prefix length in bits
+//	error  - error, if any
+func getv4KeyPrefixLen(saddr string, key []byte) ([]byte, int, error) {
+	var prefix netip.Prefix
+	var err error
+
+	if strings.IndexByte(saddr, '/') >= 0 {
+		prefix, err = netip.ParsePrefix(saddr)
+	} else {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(saddr)
+
+		// A zoned address is not a valid prefix, which leaves it to the fallback
+		if "" == addr.Zone() {
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+	}
+
+	if nil == err && prefix.Addr().Is4() {
+		addr := prefix.Masked().Addr().As4()
+		copy(key, addr[:])
+		return key, prefix.Bits(), nil
+	}
+
+	addr, mask, err := getv4Addr(saddr)
+	if nil != err {
+		return nil, 0, err
+	}
+
+	// The mask of an IPv4-mapped IPv6 prefix is an IPv6 mask
+	if net.IPv4len != len(mask) {
+		return nil, 0, ErrInvalidKeyMask
+	}
+
+	copy(key, addr.To4())
+	return key, getPrefixLen(mask), nil
+}
+
+// Returns the CIDR notation for the given IPv4 key and mask. The key and
+// mask can be shorter than an IPv4 address. Missing bytes are treated as 0.
+// Arguments:
+//
+//	key  - IPv4 address bytes
+//	mask - IPv4 mask bytes
+//
+// Returns:
+//
+//	string - CIDR notation of the prefix, e.g. 10.0.0.0/8
+func getv4Prefix(key []byte, mask []byte) string {
+	ipnet := net.IPNet{
+		IP:   make(net.IP, net.IPv4len),
+		Mask: make(net.IPMask, net.IPv4len),
+	}
+
+	copy(ipnet.IP, key)
+	copy(ipnet.Mask, mask)
+
+	return ipnet.String()
+}
+
+// Codec for IPv4 prefixes in CIDR notation or IPv4 addresses, the keys of a V4Tree.
+// Keys are decoded to CIDR notation.
+type V4KeyCodec struct{}
+
+// Appends the address bytes of the IPv4 prefix. See KeyCodec.AppendKey().
+func (V4KeyCodec) AppendKey(buf []byte, saddr string) ([]byte, int, error) {
+	buf = append(buf, make([]byte, net.IPv4len)...)
+
+	_, plen, err := getv4KeyPrefixLen(saddr, buf[len(buf)-net.IPv4len:])
+	if nil != err {
+		return nil, 0, err
+	}
+
+	return buf, plen, nil
+}
+
+// Returns the CIDR notation of the IPv4 prefix. See KeyCodec.DecodeKey().
+func (V4KeyCodec) DecodeKey(data []byte, plen int) (string, error) {
+	var mask [net.IPv4len]byte
+	setMask(mask[:], plen)
+
+	return getv4Prefix(data, mask[:]), nil
+}
+
+// Wraps a tree storing IPv4 prefixes into a V4Tree
+// Arguments:
+//
+//	tree - underlying tree
+//
+// Returns:
+//
+//	*V4Tree - IPv4 prefix tree
+func wrapV4Tree[T any](tree *Tree[T]) *V4Tree[T] {
 	return &V4Tree[T]{
-		tree: NewTree[T](),
+		KeyedTree: KeyedTree[string, T]{
+			tree:  tree,
+			codec: V4KeyCodec{},
+		},
 	}
 }
 
+// Returns a new IPv4 prefix tree
+// Arguments:
+//
+//	opts - options, see options.go. For e.g. WithRWMutex(), or WithStride(8) for
+//	       lookups that visit one node per 8 bits of the address.
+//
+// Returns:
+//
+//	AddrTree - IPv4 prefix tree
+func NewV4Tree[T any](opts ...Option) PrefixTree[T] {
+	return wrapV4Tree(NewTree[T](opts...))
+}
+
 // Returns a new IPv4 prefix tree with custom lock handlers
 // Arguments:
 //
@@ -66,34 +208,45 @@ func NewV4Tree[T any]() PrefixTree[T] {
 //
 //	AddrTree - IPv4 prefix tree
 func NewV4TreeWithLockHandlers[T any](rlockFn ReadLockFn, runlockFn ReadUnlockFn, wlockFn WriteLockFn, unlockFn UnlockFn) PrefixTree[T] {
-	return &V4Tree[T]{
-		tree: NewTreeWithLockHandlers[T](rlockFn, runlockFn, wlockFn, unlockFn),
-	}
+	return wrapV4Tree(NewTree[T](WithLockHandlers(rlockFn, runlockFn, wlockFn, unlockFn)))
+}
+
+// Inserts a batch of IPv4 addresses into the tree under a single write lock. The IPv4 addresses
+// are parsed before the lock is taken. Like Insert, a key already in the tree keeps
+// its value and is reported as Dup.
+// Arguments:
+//
+//	ctx     - context for the operation
+//	entries - IPv4 addresses and the values to be associated with them
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in the same order as entries
+//	error      - first error seen, if any. The other entries are still inserted.
+func (v4t *V4Tree[T]) InsertBatch(ctx context.Context, entries []Entry[T]) ([]OpResult, error) {
+	return v4t.KeyedTree.InsertBatch(ctx, toKeyedEntries(entries))
 }
 
-// Inserts the given IPv4 address and mask into the tree
+// Same as DeletePrefix(), but returns the deleted prefixes in CIDR notation and their values
 // Arguments:
 //
 //	ctx   - context for the operation
-//	saddr - string representation of the IPv4 address. Can be in
+//	saddr - string representation of the IPv4 prefix. Can be in
 //		    CIDR notation or just the IP address.
-//	value - Optional value to be associated with the given address/mask. Can be nil.
 //
 // Returns:
 //
-//	OpResult - result of the insert operation
+//	OpResult - Match if the prefix itself was in the tree, PartialMatch otherwise
+//	[]Entry  - deleted prefixes and their values, in walk order
 //	error    - error, if any
-func (v4t *V4Tree[T]) Insert(ctx context.Context, saddr string, value T) (OpResult, error) {
-	addr, mask, err := getv4Addr(saddr)
-	if nil != err {
-		return Error, err
-	}
-
-	// Insert parsed address and mask into the tree
-	return v4t.tree.Insert(ctx, addr.To4(), mask, value)
+func (v4t *V4Tree[T]) DeletePrefixEntries(ctx context.Context, saddr string) (OpResult, []Entry[T], error) {
+	res, entries, err := v4t.KeyedTree.DeletePrefixEntries(ctx, saddr)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Deletes the given IPv4 address and mask from the tree
+// Returns every prefix in the tree that matches the given IPv4 address.
+// The entries are ordered from the least specific to the most specific prefix
+// and the keys are in CIDR notation.
 // Arguments:
 //
 //	ctx   - context for the operation
@@ -102,91 +255,175 @@ func (v4t *V4Tree[T]) Insert(ctx context.Context, saddr string, value T) (OpResu
 //
 // Returns:
 //
-//	OpResult - result of the delete operation
-//	T        - value associated with the deleted address/mask, if any
+//	OpResult - Match if the address itself is in the tree, PartialMatch otherwise
+//	[]Entry  - matching prefixes and their values
 //	error    - error, if any
-func (v4t *V4Tree[T]) Delete(ctx context.Context, saddr string) (OpResult, T, error) {
-	var zero T
-	addr, mask, err := getv4Addr(saddr)
-	if nil != err {
-		return Error, zero, err
-	}
-
-	// Delete parsed address and mask from the tree
-	return v4t.tree.Delete(ctx, addr.To4(), mask)
+func (v4t *V4Tree[T]) SearchAll(ctx context.Context, saddr string) (OpResult, []Entry[T], error) {
+	res, entries, err := v4t.KeyedTree.SearchAll(ctx, saddr)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Searches for the given IPv4 address and mask in the tree.
-// Performs a partial search. If there is a prefix in the tree
-// that matches the given address/mask, it will be returned.
-// For e.g. if the tree has 192.168.128.0/24 and the search
-// is for 192.168.128.40/32, the search will be successful.
-// For exact match searches, use SearchExact().
+// Returns every prefix in the tree that is equal to or more specific than the given
+// IPv4 prefix. For e.g. a search for 10.0.0.0/8 returns every stored prefix within
+// 10.0.0.0/8. The entries are in walk order and the keys are in CIDR notation.
 // Arguments:
 //
 //	ctx   - context for the operation
-//	saddr - string representation of the IPv4 address. Can be in
+//	saddr - string representation of the IPv4 prefix. Can be in
 //		    CIDR notation or just the IP address.
 //
 // Returns:
 //
-//	OpResult - result of the search operation
-//	T        - value associated with the found address/mask, if any
+//	OpResult - Match if the prefix itself is in the tree, PartialMatch otherwise
+//	[]Entry  - covered prefixes and their values
 //	error    - error, if any
-func (v4t *V4Tree[T]) Search(ctx context.Context, saddr string) (OpResult, T, error) {
-	var zero T
-	addr, mask, err := getv4Addr(saddr)
+func (v4t *V4Tree[T]) SearchCovered(ctx context.Context, saddr string) (OpResult, []Entry[T], error) {
+	res, entries, err := v4t.KeyedTree.SearchCovered(ctx, saddr)
+	return res, fromKeyedEntries(entries), err
+}
+
+// Returns a read-only view of the current contents of the IPv4 prefix tree.
+// Later writes to the tree never affect the snapshot. Writes to the snapshot
+// fail with ErrReadOnly.
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	PrefixTree - read-only snapshot of the tree
+//	error      - error from the lock functions, if any
+func (v4t *V4Tree[T]) Snapshot(ctx context.Context) (PrefixTree[T], error) {
+	snapshot, err := v4t.tree.Snapshot(ctx)
 	if nil != err {
-		return Error, zero, err
+		return nil, err
 	}
 
-	// Perform partial search for parsed address and mask in the tree
-	return v4t.tree.SearchPartial(ctx, addr.To4(), mask)
+	return wrapV4Tree(snapshot), nil
 }
 
-// Similar to Search(), but performs an exact match search.
+// Returns a deep copy of the IPv4 prefix tree. See Tree.Clone().
 // Arguments:
 //
-//	ctx   - context for the operation
-//	saddr - string representation of the IPv4 address. Can be in
-//		    CIDR notation or just the IP address.
+//	ctx - context for the operation
 //
 // Returns:
 //
-//	OpResult - result of the search operation
-//	T        - value associated with the found address/mask, if any
-//	error    - error, if any
-func (v4t *V4Tree[T]) SearchExact(ctx context.Context, saddr string) (OpResult, T, error) {
-	var zero T
-	addr, mask, err := getv4Addr(saddr)
+//	PrefixTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (v4t *V4Tree[T]) Clone(ctx context.Context) (PrefixTree[T], error) {
+	return v4t.CloneWith(ctx, nil)
+}
+
+// Returns a deep copy of the IPv4 prefix tree with a copy of every value. See Tree.CloneWith().
+// Arguments:
+//
+//	ctx     - context for the operation
+//	cloneFn - returns the copy of a value. The values are shared with the copy if nil.
+//
+// Returns:
+//
+//	PrefixTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (v4t *V4Tree[T]) CloneWith(ctx context.Context, cloneFn CloneFn[T]) (PrefixTree[T], error) {
+	clone, err := v4t.tree.CloneWith(ctx, cloneFn)
 	if nil != err {
-		return Error, zero, err
+		return nil, err
 	}
 
-	return v4t.tree.SearchExact(ctx, addr.To4(), mask)
+	return wrapV4Tree(clone), nil
 }
 
-// Returns the number of nodes in the IPv4 prefix tree
+// Walk the tree and call passed function for all nodes with the key of each node
+// Arguments:
+//
+//	ctx - context for the operaton
+//	callback - function to be called for every key/value in the tree. The key is
+//	           the prefix in CIDR notation as passed to Insert().
+//
 // Returns:
 //
-//	uint64 - number of nodes in the tree
-func (v4t *V4Tree[T]) GetNodesCount() uint64 {
-	return v4t.tree.numNodes
+//	err - nil if successful else an error
+func (v4t *V4Tree[T]) WalkKeys(ctx context.Context, callback KeyWalkerFn[T]) error {
+	return v4t.KeyedTree.WalkKeys(ctx, KeyedWalkerFn[string, T](callback))
 }
 
-// Walk the tree and call passed function for all nodes
+// Walk the prefixes in the tree that are equal to or more specific than the given
+// IPv4 prefix and call passed function with the key of each
 // Arguments:
 //
-//	ctx - context for the operaton
-//	callback - function to be called for every value in the tree
+//	ctx      - context for the operaton
+//	saddr    - string representation of the IPv4 prefix. Can be in
+//		       CIDR notation or just the IP address.
+//	callback - function to be called for every covered key/value in the tree.
+//	           The key is the prefix in CIDR notation.
 //
 // Returns:
 //
 //	err - nil if successful else an error
-func (v4t *V4Tree[T]) Walk(ctx context.Context, callback WalkerFn[T]) error {
-	v4t.tree.Walk(ctx, func(ctx context.Context, value T) error {
-		return callback(ctx, value)
-	})
+func (v4t *V4Tree[T]) WalkPrefix(ctx context.Context, saddr string, callback KeyWalkerFn[T]) error {
+	return v4t.KeyedTree.WalkPrefix(ctx, saddr, KeyedWalkerFn[string, T](callback))
+}
+
+// Returns a new cursor positioned before the first entry of the tree
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	*Cursor - cursor over the IPv4 prefixes
+func (v4t *V4Tree[T]) Cursor(ctx context.Context) *Cursor[T] {
+	return newCursor(ctx, &v4t.KeyedTree)
+}
+
+// Returns the binary encoding of the IPv4 prefix tree. Implements encoding.BinaryMarshaler.
+// Values are encoded by the value codec of the tree, see WithValueCodec().
+// Returns:
+//
+//	[]byte - encoding of the tree
+//	error  - error if any
+func (v4t *V4Tree[T]) MarshalBinary() ([]byte, error) {
+	return v4t.tree.marshal(kindV4)
+}
+
+// Replaces the contents of the IPv4 prefix tree with the entries of an encoding returned by
+// MarshalBinary(). Implements encoding.BinaryUnmarshaler. The tree is left alone if
+// the encoding is invalid.
+// Arguments:
+//
+//	data - binary encoding
+//
+// Returns:
+//
+//	error - error if any
+func (v4t *V4Tree[T]) UnmarshalBinary(data []byte) error {
+	return v4t.tree.unmarshal(data, kindV4, net.IPv4len*8)
+}
+
+// Writes the binary encoding of the IPv4 prefix tree. Implements io.WriterTo.
+// Arguments:
+//
+//	w - writer to write to
+//
+// Returns:
+//
+//	int64 - number of bytes written
+//	error - error if any
+func (v4t *V4Tree[T]) WriteTo(w io.Writer) (int64, error) {
+	return v4t.tree.writeTo(context.Background(), w, kindV4)
+}
 
-	return nil
+// Replaces the contents of the IPv4 prefix tree with the binary encoding read from a reader.
+// Reads until EOF. Implements io.ReaderFrom.
+// Arguments:
+//
+//	r - reader to read from
+//
+// Returns:
+//
+//	int64 - number of bytes read
+//	error - error if any
+func (v4t *V4Tree[T]) ReadFrom(r io.Reader) (int64, error) {
+	return v4t.tree.readFrom(r, kindV4, net.IPv4len*8)
 }
@@ -2,9 +2,11 @@ package prefix_tree
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -204,6 +206,113 @@ func extendedV4Tests(t *testing.T) {
 	}
 }
 
+func TestV4SearchLongest(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[string]()
+
+	for _, cidr := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"} {
+		res, err := v4t.Insert(ctx, cidr, cidr)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", cidr)
+		}
+	}
+
+	tests := []struct {
+		addr     string
+		shortest string
+		longest  string
+	}{
+		{"10.1.2.3", "10.0.0.0/8", "10.1.2.0/24"},
+		{"10.1.3.3", "10.0.0.0/8", "10.1.0.0/16"},
+		{"10.2.3.4", "10.0.0.0/8", "10.0.0.0/8"},
+		{"10.1.2.0/24", "10.0.0.0/8", "10.1.2.0/24"},
+	}
+
+	for _, tt := range tests {
+		res, v, err := v4t.SearchShortest(ctx, tt.addr)
+		if err != nil || res == Error || v != tt.shortest {
+			t.Fatalf("SearchShortest %s: expected %s, got %s (%v, %v)", tt.addr, tt.shortest, v, res, err)
+		}
+
+		res, v, err = v4t.SearchLongest(ctx, tt.addr)
+		if err != nil || res == Error || v != tt.longest {
+			t.Fatalf("SearchLongest %s: expected %s, got %s (%v, %v)", tt.addr, tt.longest, v, res, err)
+		}
+	}
+
+	res, _, err := v4t.SearchLongest(ctx, "192.168.1.1")
+	if err == nil || res != Error {
+		t.Fatalf("Found longest prefix for address outside the tree")
+	}
+}
+
+func TestV4SearchAll(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int]()
+
+	cidrs := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "192.168.0.0/16"}
+	for i, cidr := range cidrs {
+		res, err := v4t.Insert(ctx, cidr, i)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", cidr)
+		}
+	}
+
+	res, entries, err := v4t.SearchAll(ctx, "10.1.2.3")
+	if err != nil || res != Match {
+		t.Fatalf("SearchAll failed: %v %v", res, err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %v", entries)
+	}
+	for i, entry := range entries {
+		if entry.Key != cidrs[i] || entry.Value != i {
+			t.Fatalf("Unexpected entry %v, expected %s/%d", entry, cidrs[i], i)
+		}
+	}
+
+	res, entries, err = v4t.SearchAll(ctx, "10.1.3.3")
+	if err != nil || res != PartialMatch || len(entries) != 2 {
+		t.Fatalf("SearchAll failed: %v %v %v", res, entries, err)
+	}
+
+	res, _, err = v4t.SearchAll(ctx, "172.16.0.1")
+	if err == nil || res != Error {
+		t.Fatalf("SearchAll found prefixes for address outside the tree")
+	}
+}
+
+func TestV4WalkKeys(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int]()
+
+	cidrs := []string{"10.0.0.0/8", "10.1.2.0/24", "10.1.2.3/32", "192.168.0.0/16"}
+	for i := len(cidrs) - 1; i >= 0; i-- {
+		res, err := v4t.Insert(ctx, cidrs[i], i)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", cidrs[i])
+		}
+	}
+
+	walked := []string{}
+	err := v4t.WalkKeys(ctx, func(ctx context.Context, key string, value int) error {
+		if cidrs[value] != key {
+			t.Fatalf("Unexpected key %s for value %d, expected %s", key, value, cidrs[value])
+		}
+
+		walked = append(walked, key)
+		return nil
+	})
+	if err != nil || len(walked) != len(cidrs) {
+		t.Fatalf("WalkKeys failed: %v %v", walked, err)
+	}
+	for i := range cidrs {
+		if walked[i] != cidrs[i] {
+			t.Fatalf("Unexpected walk order %v", walked)
+		}
+	}
+}
+
 func TestV4(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 
@@ -237,8 +346,353 @@ func BenchmarkV4TreeSearch(b *testing.B) {
 		v4tree.Insert(ctx, addresses[i], ival)
 	}
 
+	// Lookups must not allocate
+	assertNoAllocs(b, "Search", func() {
+		v4tree.Search(ctx, addresses[0])
+	})
+
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		v4tree.Search(ctx, addresses[i])
 	}
 }
+
+func TestV4StrideTree(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := NewV4Tree[string](WithStride(9)).Insert(ctx, "10.0.0.0/8", "10.0.0.0/8"); err != ErrInvalidStride {
+		t.Fatalf("expected ErrInvalidStride, got %v", err)
+	}
+
+	cidrs := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/23", "10.1.2.128/25", "172.16.0.0/12", "192.168.1.1/32"}
+	addrs := []string{"10.1.2.3", "10.1.3.200", "10.1.2.129", "10.2.3.4", "172.31.255.255", "172.32.0.0", "192.168.1.1", "10.1.0.0/16", "8.8.8.8"}
+
+	for _, stride := range []int{4, 8} {
+		v4t := NewV4Tree[string]()
+		sv4t := NewV4Tree[string](WithStride(stride))
+
+		for _, cidr := range cidrs {
+			v4t.Insert(ctx, cidr, cidr)
+			if res, err := sv4t.Insert(ctx, cidr, cidr); err != nil || res != Ok {
+				t.Fatalf("Failed to insert %s", cidr)
+			}
+		}
+
+		for _, addr := range addrs {
+			res1, v1, err1 := v4t.SearchShortest(ctx, addr)
+			res2, v2, err2 := sv4t.SearchShortest(ctx, addr)
+			if res1 != res2 || v1 != v2 || err1 != err2 {
+				t.Fatalf("stride %d: SearchShortest %s mismatch: %s != %s", stride, addr, v1, v2)
+			}
+
+			res1, v1, err1 = v4t.SearchLongest(ctx, addr)
+			res2, v2, err2 = sv4t.SearchLongest(ctx, addr)
+			if res1 != res2 || v1 != v2 || err1 != err2 {
+				t.Fatalf("stride %d: SearchLongest %s mismatch: %s != %s", stride, addr, v1, v2)
+			}
+
+			res1, v1, err1 = v4t.SearchExact(ctx, addr)
+			res2, v2, err2 = sv4t.SearchExact(ctx, addr)
+			if res1 != res2 || v1 != v2 || err1 != err2 {
+				t.Fatalf("stride %d: SearchExact %s mismatch: %s != %s", stride, addr, v1, v2)
+			}
+		}
+
+		keys := []string{}
+		for key := range sv4t.All(ctx) {
+			keys = append(keys, key)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(cidrs) {
+			t.Fatalf("stride %d: unexpected walk order %v", stride, keys)
+		}
+	}
+}
+
+func TestV4SearchCovered(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int]()
+
+	cidrs := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "192.168.1.1/32"}
+	for i, cidr := range cidrs {
+		v4t.Insert(ctx, cidr, i)
+	}
+
+	res, entries, err := v4t.SearchCovered(ctx, "10.0.0.0/8")
+	if err != nil || res != Match || len(entries) != 4 {
+		t.Fatalf("SearchCovered failed: %v %v %v", res, entries, err)
+	}
+	for i := range entries {
+		if entries[i].Key != cidrs[i] || entries[i].Value != i {
+			t.Fatalf("unexpected entry %v, expected %s/%d", entries[i], cidrs[i], i)
+		}
+	}
+
+	res, entries, err = v4t.SearchCovered(ctx, "10.0.0.0/14")
+	if err != nil || res != PartialMatch || len(entries) != 3 || entries[0].Key != "10.1.0.0/16" {
+		t.Fatalf("SearchCovered for 10.0.0.0/14 failed: %v %v %v", res, entries, err)
+	}
+
+	if res, _, err := v4t.SearchCovered(ctx, "172.16.0.0/12"); err == nil || res != Error {
+		t.Fatalf("SearchCovered found entries for 172.16.0.0/12")
+	}
+
+	keys := []string{}
+	err = v4t.WalkPrefix(ctx, "10.1.0.0/16", func(ctx context.Context, key string, value int) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || fmt.Sprint(keys) != "[10.1.0.0/16 10.1.2.0/24]" {
+		t.Fatalf("unexpected WalkPrefix result %v %v", keys, err)
+	}
+
+	if err := v4t.WalkPrefix(ctx, "10.1.0.0/33", func(context.Context, string, int) error { return nil }); err == nil {
+		t.Fatalf("WalkPrefix accepted an invalid prefix")
+	}
+}
+
+func TestV4DeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int]()
+
+	cidrs := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.2.0.0/16", "192.168.1.1/32"}
+	for i, cidr := range cidrs {
+		v4t.Insert(ctx, cidr, i)
+	}
+
+	res, entries, err := v4t.DeletePrefixEntries(ctx, "10.1.0.0/16")
+	if err != nil || res != Match || len(entries) != 2 || entries[0].Key != "10.1.0.0/16" || entries[1].Key != "10.1.2.0/24" {
+		t.Fatalf("DeletePrefixEntries failed: %v %v %v", res, entries, err)
+	}
+
+	if res, _, err := v4t.SearchExact(ctx, "10.1.2.0/24"); err == nil || res == Match {
+		t.Fatalf("10.1.2.0/24 found after DeletePrefix")
+	}
+
+	res, count, err := v4t.DeletePrefix(ctx, "0.0.0.0/1")
+	if err != nil || res != PartialMatch || count != 2 {
+		t.Fatalf("DeletePrefix for 0.0.0.0/1 failed: %v %d %v", res, count, err)
+	}
+
+	if res, _, err := v4t.DeletePrefix(ctx, "10.0.0.0/8"); err == nil || res != Error {
+		t.Fatalf("DeletePrefix removed entries for 10.0.0.0/8 twice")
+	}
+
+	if res, _, err := v4t.SearchExact(ctx, "192.168.1.1/32"); err != nil || res != Match {
+		t.Fatalf("192.168.1.1/32 not found after DeletePrefix")
+	}
+}
+
+func TestV4ReplaceUpsert(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[string]()
+
+	if res, _, err := v4t.Replace(ctx, "10.0.0.0/8", "a"); err != nil || res != Ok {
+		t.Fatalf("Replace of 10.0.0.0/8 failed: %v %v", res, err)
+	}
+
+	res, old, err := v4t.Replace(ctx, "10.1.2.3/8", "b")
+	if err != nil || res != Match || old != "a" {
+		t.Fatalf("Replace of 10.0.0.0/8 failed: %v %s %v", res, old, err)
+	}
+
+	res, v, err := v4t.Upsert(ctx, "10.0.0.0/8", func(old string, exists bool) string { return old + "c" })
+	if err != nil || res != Match || v != "bc" {
+		t.Fatalf("Upsert of 10.0.0.0/8 failed: %v %s %v", res, v, err)
+	}
+
+	equal := func(a, b string) bool { return a == b }
+	if res, err := v4t.CompareAndSwap(ctx, "10.0.0.0/8", "bc", "d", equal); err != nil || res != Match {
+		t.Fatalf("CompareAndSwap of 10.0.0.0/8 failed: %v %v", res, err)
+	}
+
+	if _, v, _ := v4t.SearchLongest(ctx, "10.9.9.9"); v != "d" {
+		t.Fatalf("expected d, got %s", v)
+	}
+
+	if res, _, err := v4t.Replace(ctx, "10.0.0.0/33", "e"); err == nil || res != Error {
+		t.Fatalf("Replace accepted an invalid prefix")
+	}
+}
+
+func TestV4InsertBatch(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[int]()
+
+	entries := []Entry[int]{
+		{Key: "10.0.0.0/8", Value: 1},
+		{Key: "10.1.0.0/33", Value: 2},
+		{Key: "10.1.2.3/8", Value: 3},
+		{Key: "192.168.1.1", Value: 4},
+	}
+
+	results, err := v4t.InsertBatch(ctx, entries)
+	if err == nil || fmt.Sprint(results) != fmt.Sprint([]OpResult{Ok, Error, Dup, Ok}) {
+		t.Fatalf("InsertBatch failed: %v %v", results, err)
+	}
+
+	if v4t.GetNodesCount() != 2 {
+		t.Fatalf("expected 2 prefixes after InsertBatch, got %d", v4t.GetNodesCount())
+	}
+
+	// Load a copy of the tree from its iterator
+	copied := NewV4Tree[int]()
+	results, err = copied.BulkLoad(ctx, v4t.All(ctx))
+	if err != nil || len(results) != 2 || results[0] != Ok || results[1] != Ok {
+		t.Fatalf("BulkLoad failed: %v %v", results, err)
+	}
+
+	if _, v, _ := copied.SearchExact(ctx, "192.168.1.1/32"); v != 4 {
+		t.Fatalf("expected 4 for 192.168.1.1/32, got %d", v)
+	}
+}
+
+// BenchmarkV4TreeBulkLoad compares loading prefixes with BulkLoad against looped
+// Insert on a tree with mutex lock handlers
+func BenchmarkV4TreeBulkLoad(b *testing.B) {
+	ctx := context.Background()
+	addresses := generateIPv4Addresses(10000)
+
+	entries := make([]Entry[int], len(addresses))
+	for i := range addresses {
+		entries[i] = Entry[int]{Key: addresses[i], Value: i}
+	}
+
+	newTree := func() PrefixTree[int] {
+		var mu sync.RWMutex
+		return NewV4TreeWithLockHandlers[int](
+			func(context.Context) { mu.RLock() },
+			func(context.Context) { mu.RUnlock() },
+			func(context.Context) { mu.Lock() },
+			func(context.Context) { mu.Unlock() },
+		)
+	}
+
+	b.Run("Insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			v4tree := newTree()
+			for j := range entries {
+				v4tree.Insert(ctx, entries[j].Key, entries[j].Value)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(entries)), "ns/key")
+	})
+
+	b.Run("InsertBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			v4tree := newTree()
+			v4tree.InsertBatch(ctx, entries)
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(entries)), "ns/key")
+	})
+}
+
+func TestGetv4Key(t *testing.T) {
+	key := make([]byte, net.IPv4len)
+	mask := make([]byte, net.IPv4len)
+
+	for _, saddr := range []string{"10.1.2.3/8", "10.1.2.3", "0.0.0.0/0", "192.168.1.0/23", "::ffff:10.1.2.3", "10.1.2.3/33", "2001:db8::/32", "10.1.2"} {
+		addr, nmask, err := getv4Addr(saddr)
+		k, m, kerr := getv4Key(saddr, key, mask)
+
+		if (nil == err) != (nil == kerr) {
+			t.Fatalf("getv4Key %s: error mismatch %v != %v", saddr, kerr, err)
+		}
+
+		if nil == err && (string(k) != string(addr.To4()) || string(m) != string(nmask)) {
+			t.Fatalf("getv4Key %s: %v/%v != %v/%v", saddr, k, m, addr.To4(), nmask)
+		}
+	}
+}
+
+func TestV4Snapshot(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[string]()
+
+	v4t.Insert(ctx, "10.0.0.0/8", "v1")
+	snapshot, err := v4t.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	v4t.Replace(ctx, "10.0.0.0/8", "v2")
+	v4t.Insert(ctx, "10.1.0.0/16", "v2")
+
+	if _, v, _ := snapshot.SearchLongest(ctx, "10.1.2.3"); v != "v1" {
+		t.Fatalf("expected v1 from the snapshot, got %s", v)
+	}
+
+	if _, v, _ := v4t.SearchLongest(ctx, "10.1.2.3"); v != "v2" {
+		t.Fatalf("expected v2 from the tree, got %s", v)
+	}
+
+	if res, err := snapshot.Insert(ctx, "192.168.0.0/16", "v3"); err != ErrReadOnly || res != Error {
+		t.Fatalf("Insert into a snapshot: %v %v", res, err)
+	}
+
+	if snapshot.GetNodesCount() != 1 || v4t.GetNodesCount() != 2 {
+		t.Fatalf("unexpected counts %d %d", snapshot.GetNodesCount(), v4t.GetNodesCount())
+	}
+}
+
+func TestV4WalkError(t *testing.T) {
+	ctx := context.Background()
+	tree := NewV4Tree[int]()
+
+	for i, key := range []string{"10.0.0.0/8", "10.1.0.0/16"} {
+		tree.Insert(ctx, key, i)
+	}
+
+	// The first error returned by the walker stops the walk and is returned
+	errStop := fmt.Errorf("stop")
+	visited := 0
+	err := tree.Walk(ctx, func(ctx context.Context, value int) error {
+		visited++
+		return errStop
+	})
+	if err != errStop || visited != 1 {
+		t.Fatalf("expected the walk to stop with %v after 1 entry, got %d %v", errStop, visited, err)
+	}
+}
+
+func TestV4Tree_Clone(t *testing.T) {
+	ctx := context.Background()
+	v4t := NewV4Tree[*testRoute](WithContextLock())
+	v4t.Insert(ctx, "10.0.0.0/8", &testRoute{ASN: 64512, Name: "private"})
+	v4t.Insert(ctx, "10.1.0.0/16", &testRoute{ASN: 64513, Name: "lab"})
+
+	clone, err := v4t.CloneWith(ctx, func(route *testRoute) *testRoute {
+		copied := *route
+		return &copied
+	})
+	if err != nil || clone.GetNodesCount() != 2 {
+		t.Fatalf("CloneWith failed: %v", err)
+	}
+
+	// Tentative changes to the clone
+	_, route, _ := clone.SearchExact(ctx, "10.1.0.0/16")
+	route.Name = "staging"
+	clone.Insert(ctx, "192.168.0.0/16", &testRoute{ASN: 64514})
+	clone.Delete(ctx, "10.0.0.0/8")
+
+	if _, route, _ := v4t.SearchExact(ctx, "10.1.0.0/16"); route.Name != "lab" {
+		t.Fatalf("value of the tree changed through the clone: %v", route.Name)
+	}
+	if v4t.GetNodesCount() != 2 || clone.GetNodesCount() != 2 {
+		t.Fatalf("unexpected counts %d %d", v4t.GetNodesCount(), clone.GetNodesCount())
+	}
+
+	if res, _, _ := clone.SearchLongest(ctx, "192.168.1.1"); res != PartialMatch {
+		t.Fatalf("expected a match in the clone, got %v", res)
+	}
+	if _, _, err := v4t.SearchLongest(ctx, "192.168.1.1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("unexpected match in the tree")
+	}
+
+	// Values are shared without a clone function
+	clone, _ = v4t.Clone(ctx)
+	_, original, _ := v4t.SearchExact(ctx, "10.0.0.0/8")
+	if _, route, _ := clone.SearchExact(ctx, "10.0.0.0/8"); route != original {
+		t.Fatalf("expected the value to be shared")
+	}
+}
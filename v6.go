@@ -3,11 +3,15 @@ package prefix_tree
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"strings"
 )
 
+// IPv6 prefix tree, keyed by prefixes in CIDR notation, see V6KeyCodec
 type V6Tree[T any] struct {
-	tree *Tree[T]
+	KeyedTree[string, T]
 }
 
 func testgetv6Addr(saddr string) (net.IP, net.IPMask, error) {
@@ -48,16 +52,149 @@ func getv6Addr(saddr string) (net.IP, net.IPMask, error) {
 	return nil, nil, fmt.Errorf("invalid v6 address %s", saddr)
 }
 
-// Returns a new IPv6 prefix tree
+// Parses the given IPv6 address into the key and mask buffers. Plain IPv6 addresses
+// and prefixes are parsed without allocating, anything else is left to getv6Addr().
+// Arguments:
+//
+//	saddr - string representation of the IPv6 address. Can be in
+//	         CIDR notation or just the IP address.
+//	key   - buffer of net.IPv6len bytes for the address
+//	mask  - buffer of net.IPv6len bytes for the mask
+//
 // Returns:
 //
-//	AddrTree - IPv6 prefix tree
-func NewV6Tree[T any]() PrefixTree[T] {
+//	[]byte - IPv6 address bytes
+//	[]byte - IPv6 mask bytes
+//	error  - error, if any
+func getv6Key(saddr string, key []byte, mask []byte) ([]byte, []byte, error) {
+	key, plen, err := getv6KeyPrefixLen(saddr, key)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	setMask(mask, plen)
+	return key, mask, nil
+}
+
+// Same as getv6Key(), but returns the mask as a prefix length.
+// Arguments:
+//
+//	saddr - string representation of the IPv6 address. Can be in
+//	         CIDR notation or just the IP address.
+//	key   - buffer of net.IPv6len bytes for the address
+//
+// Returns:
+//
+//	[]byte - IPv6 address bytes
+//	int    - prefix length in bits
+//	error  - error, if any
+func getv6KeyPrefixLen(saddr string, key []byte) ([]byte, int, error) {
+	var prefix netip.Prefix
+	var err error
+
+	if strings.IndexByte(saddr, '/') >= 0 {
+		prefix, err = netip.ParsePrefix(saddr)
+	} else {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(saddr)
+
+		// A zoned address is not a valid prefix, which leaves it to the fallback
+		if "" == addr.Zone() {
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+	}
+
+	if nil == err && prefix.Addr().Is6() && !prefix.Addr().Is4In6() {
+		addr := prefix.Masked().Addr().As16()
+		copy(key, addr[:])
+		return key, prefix.Bits(), nil
+	}
+
+	addr, mask, err := getv6Addr(saddr)
+	if nil != err {
+		return nil, 0, err
+	}
+
+	copy(key, addr)
+	return key, getPrefixLen(mask), nil
+}
+
+// Returns the CIDR notation for the given IPv6 key and mask. The key and
+// mask can be shorter than an IPv6 address. Missing bytes are treated as 0.
+// Arguments:
+//
+//	key  - IPv6 address bytes
+//	mask - IPv6 mask bytes
+//
+// Returns:
+//
+//	string - CIDR notation of the prefix, e.g. 2001:db8::/32
+func getv6Prefix(key []byte, mask []byte) string {
+	ipnet := net.IPNet{
+		IP:   make(net.IP, net.IPv6len),
+		Mask: make(net.IPMask, net.IPv6len),
+	}
+
+	copy(ipnet.IP, key)
+	copy(ipnet.Mask, mask)
+
+	return ipnet.String()
+}
+
+// Codec for IPv6 prefixes in CIDR notation or IPv6 addresses, the keys of a V6Tree.
+// Keys are decoded to CIDR notation.
+type V6KeyCodec struct{}
+
+// Appends the address bytes of the IPv6 prefix. See KeyCodec.AppendKey().
+func (V6KeyCodec) AppendKey(buf []byte, saddr string) ([]byte, int, error) {
+	buf = append(buf, make([]byte, net.IPv6len)...)
+
+	_, plen, err := getv6KeyPrefixLen(saddr, buf[len(buf)-net.IPv6len:])
+	if nil != err {
+		return nil, 0, err
+	}
+
+	return buf, plen, nil
+}
+
+// Returns the CIDR notation of the IPv6 prefix. See KeyCodec.DecodeKey().
+func (V6KeyCodec) DecodeKey(data []byte, plen int) (string, error) {
+	var mask [net.IPv6len]byte
+	setMask(mask[:], plen)
+
+	return getv6Prefix(data, mask[:]), nil
+}
+
+// Wraps a tree storing IPv6 prefixes into a V6Tree
+// Arguments:
+//
+//	tree - underlying tree
+//
+// Returns:
+//
+//	*V6Tree - IPv6 prefix tree
+func wrapV6Tree[T any](tree *Tree[T]) *V6Tree[T] {
 	return &V6Tree[T]{
-		tree: NewTree[T](),
+		KeyedTree: KeyedTree[string, T]{
+			tree:  tree,
+			codec: V6KeyCodec{},
+		},
 	}
 }
 
+// Returns a new IPv6 prefix tree
+// Arguments:
+//
+//	opts - options, see options.go. For e.g. WithRWMutex(), or WithStride(8) for
+//	       lookups that visit one node per 8 bits of the address.
+//
+// Returns:
+//
+//	AddrTree - IPv6 prefix tree
+func NewV6Tree[T any](opts ...Option) PrefixTree[T] {
+	return wrapV6Tree(NewTree[T](opts...))
+}
+
 // Returns a new IPv6 prefix tree with custom lock handlers
 // Arguments:
 //
@@ -70,34 +207,45 @@ func NewV6Tree[T any]() PrefixTree[T] {
 //
 //	AddrTree - IPv6 prefix tree
 func NewV6TreeWithLockHandlers[T any](rlockFn ReadLockFn, runlockFn ReadUnlockFn, wlockFn WriteLockFn, unlockFn UnlockFn) PrefixTree[T] {
-	return &V6Tree[T]{
-		tree: NewTreeWithLockHandlers[T](rlockFn, runlockFn, wlockFn, unlockFn),
-	}
+	return wrapV6Tree(NewTree[T](WithLockHandlers(rlockFn, runlockFn, wlockFn, unlockFn)))
+}
+
+// Inserts a batch of IPv6 addresses into the tree under a single write lock. The IPv6 addresses
+// are parsed before the lock is taken. Like Insert, a key already in the tree keeps
+// its value and is reported as Dup.
+// Arguments:
+//
+//	ctx     - context for the operation
+//	entries - IPv6 addresses and the values to be associated with them
+//
+// Returns:
+//
+//	[]OpResult - result of the insert for each entry, in the same order as entries
+//	error      - first error seen, if any. The other entries are still inserted.
+func (v6t *V6Tree[T]) InsertBatch(ctx context.Context, entries []Entry[T]) ([]OpResult, error) {
+	return v6t.KeyedTree.InsertBatch(ctx, toKeyedEntries(entries))
 }
 
-// Inserts a new IPv6 address into the prefix tree
+// Same as DeletePrefix(), but returns the deleted prefixes in CIDR notation and their values
 // Arguments:
 //
 //	ctx   - context for the operation
-//	saddr - string representation of the IPv6 address. Can be in
+//	saddr - string representation of the IPv6 prefix. Can be in
 //		    CIDR notation or just the IP address.
-//	value - value to be associated with the IPv6 address
 //
 // Returns:
 //
-//	OpResult - result of the insert operation
+//	OpResult - Match if the prefix itself was in the tree, PartialMatch otherwise
+//	[]Entry  - deleted prefixes and their values, in walk order
 //	error    - error, if any
-func (v6t *V6Tree[T]) Insert(ctx context.Context, saddr string, value T) (OpResult, error) {
-	addr, mask, err := getv6Addr(saddr)
-	if nil != err {
-		return Error, err
-	}
-
-	// Insert into the underlying tree
-	return v6t.tree.Insert(ctx, addr, mask, value)
+func (v6t *V6Tree[T]) DeletePrefixEntries(ctx context.Context, saddr string) (OpResult, []Entry[T], error) {
+	res, entries, err := v6t.KeyedTree.DeletePrefixEntries(ctx, saddr)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Deletes the given IPv6 address from the prefix tree
+// Returns every prefix in the tree that matches the given IPv6 address.
+// The entries are ordered from the least specific to the most specific prefix
+// and the keys are in CIDR notation.
 // Arguments:
 //
 //	ctx   - context for the operation
@@ -106,91 +254,175 @@ func (v6t *V6Tree[T]) Insert(ctx context.Context, saddr string, value T) (OpResu
 //
 // Returns:
 //
-//	OpResult - result of the delete operation
-//	T        - value associated with the deleted address, if any
+//	OpResult - Match if the address itself is in the tree, PartialMatch otherwise
+//	[]Entry  - matching prefixes and their values
 //	error    - error, if any
-func (v6t *V6Tree[T]) Delete(ctx context.Context, saddr string) (OpResult, T, error) {
-	var zero T
-	addr, mask, err := getv6Addr(saddr)
-	if nil != err {
-		return Error, zero, err
-	}
-
-	// Delete from the underlying tree
-	return v6t.tree.Delete(ctx, addr, mask)
+func (v6t *V6Tree[T]) SearchAll(ctx context.Context, saddr string) (OpResult, []Entry[T], error) {
+	res, entries, err := v6t.KeyedTree.SearchAll(ctx, saddr)
+	return res, fromKeyedEntries(entries), err
 }
 
-// Searches for the given IPv6 address in the prefix tree.
-// Performs a partial search. If there is a prefix in the tree
-// that matches the given address, it is returned. For e.g., if
-// the tree contains 2001:db8::/32 and the search is for
-// 2001:db8:abcd:0012::1/64, the search will be successful
-// For exact match searches, use SearchExact() instead.
+// Returns every prefix in the tree that is equal to or more specific than the given
+// IPv6 prefix. For e.g. a search for 10.0.0.0/8 returns every stored prefix within
+// 10.0.0.0/8. The entries are in walk order and the keys are in CIDR notation.
 // Arguments:
 //
 //	ctx   - context for the operation
-//	saddr - string representation of the IPv6 address. Can be in
+//	saddr - string representation of the IPv6 prefix. Can be in
 //		    CIDR notation or just the IP address.
 //
 // Returns:
 //
-//	OpResult - result of the search operation
-//	T        - value associated with the found address, if any
+//	OpResult - Match if the prefix itself is in the tree, PartialMatch otherwise
+//	[]Entry  - covered prefixes and their values
 //	error    - error, if any
-func (v6t *V6Tree[T]) Search(ctx context.Context, saddr string) (OpResult, T, error) {
-	var zero T
-	addr, mask, err := getv6Addr(saddr)
+func (v6t *V6Tree[T]) SearchCovered(ctx context.Context, saddr string) (OpResult, []Entry[T], error) {
+	res, entries, err := v6t.KeyedTree.SearchCovered(ctx, saddr)
+	return res, fromKeyedEntries(entries), err
+}
+
+// Returns a read-only view of the current contents of the IPv6 prefix tree.
+// Later writes to the tree never affect the snapshot. Writes to the snapshot
+// fail with ErrReadOnly.
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	PrefixTree - read-only snapshot of the tree
+//	error      - error from the lock functions, if any
+func (v6t *V6Tree[T]) Snapshot(ctx context.Context) (PrefixTree[T], error) {
+	snapshot, err := v6t.tree.Snapshot(ctx)
 	if nil != err {
-		return Error, zero, err
+		return nil, err
 	}
 
-	// Perform partial search in the underlying tree
-	return v6t.tree.SearchPartial(ctx, addr, mask)
+	return wrapV6Tree(snapshot), nil
 }
 
-// Similar to Search(), but performs an exact match search.
+// Returns a deep copy of the IPv6 prefix tree. See Tree.Clone().
 // Arguments:
 //
-//	ctx   - context for the operation
-//	saddr - string representation of the IPv6 address. Can be in
-//		    CIDR notation or just the IP address.
+//	ctx - context for the operation
 //
 // Returns:
 //
-//	OpResult - result of the search operation
-//	T        - value associated with the found address, if any
-//	error    - error, if any
-func (v6t *V6Tree[T]) SearchExact(ctx context.Context, saddr string) (OpResult, T, error) {
-	var zero T
-	addr, mask, err := getv6Addr(saddr)
+//	PrefixTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (v6t *V6Tree[T]) Clone(ctx context.Context) (PrefixTree[T], error) {
+	return v6t.CloneWith(ctx, nil)
+}
+
+// Returns a deep copy of the IPv6 prefix tree with a copy of every value. See Tree.CloneWith().
+// Arguments:
+//
+//	ctx     - context for the operation
+//	cloneFn - returns the copy of a value. The values are shared with the copy if nil.
+//
+// Returns:
+//
+//	PrefixTree - copy of the tree
+//	error      - error from the lock functions, if any
+func (v6t *V6Tree[T]) CloneWith(ctx context.Context, cloneFn CloneFn[T]) (PrefixTree[T], error) {
+	clone, err := v6t.tree.CloneWith(ctx, cloneFn)
 	if nil != err {
-		return Error, zero, err
+		return nil, err
 	}
 
-	return v6t.tree.SearchExact(ctx, addr, mask)
+	return wrapV6Tree(clone), nil
 }
 
-// Returns the number of nodes in the IPv6 prefix tree
+// Walk the tree and call passed function for all nodes with the key of each node
+// Arguments:
+//
+//	ctx - context for the operaton
+//	callback - function to be called for every key/value in the tree. The key is
+//	           the prefix in CIDR notation as passed to Insert().
+//
 // Returns:
 //
-//	uint64 - number of nodes in the tree
-func (v6t *V6Tree[T]) GetNodesCount() uint64 {
-	return v6t.tree.numNodes
+//	err - nil if successful else an error
+func (v6t *V6Tree[T]) WalkKeys(ctx context.Context, callback KeyWalkerFn[T]) error {
+	return v6t.KeyedTree.WalkKeys(ctx, KeyedWalkerFn[string, T](callback))
 }
 
-// Walk the tree and call passed function for all nodes
+// Walk the prefixes in the tree that are equal to or more specific than the given
+// IPv6 prefix and call passed function with the key of each
 // Arguments:
 //
-//	ctx - context for the operaton
-//	callback - function to be called for every value in the tree
+//	ctx      - context for the operaton
+//	saddr    - string representation of the IPv6 prefix. Can be in
+//		       CIDR notation or just the IP address.
+//	callback - function to be called for every covered key/value in the tree.
+//	           The key is the prefix in CIDR notation.
 //
 // Returns:
 //
 //	err - nil if successful else an error
-func (v6t *V6Tree[T]) Walk(ctx context.Context, callback WalkerFn[T]) error {
-	v6t.tree.Walk(ctx, func(ctx context.Context, value T) error {
-		return callback(ctx, value)
-	})
+func (v6t *V6Tree[T]) WalkPrefix(ctx context.Context, saddr string, callback KeyWalkerFn[T]) error {
+	return v6t.KeyedTree.WalkPrefix(ctx, saddr, KeyedWalkerFn[string, T](callback))
+}
+
+// Returns a new cursor positioned before the first entry of the tree
+// Arguments:
+//
+//	ctx - context for the operation
+//
+// Returns:
+//
+//	*Cursor - cursor over the IPv6 prefixes
+func (v6t *V6Tree[T]) Cursor(ctx context.Context) *Cursor[T] {
+	return newCursor(ctx, &v6t.KeyedTree)
+}
 
-	return nil
+// Returns the binary encoding of the IPv6 prefix tree. Implements encoding.BinaryMarshaler.
+// Values are encoded by the value codec of the tree, see WithValueCodec().
+// Returns:
+//
+//	[]byte - encoding of the tree
+//	error  - error if any
+func (v6t *V6Tree[T]) MarshalBinary() ([]byte, error) {
+	return v6t.tree.marshal(kindV6)
+}
+
+// Replaces the contents of the IPv6 prefix tree with the entries of an encoding returned by
+// MarshalBinary(). Implements encoding.BinaryUnmarshaler. The tree is left alone if
+// the encoding is invalid.
+// Arguments:
+//
+//	data - binary encoding
+//
+// Returns:
+//
+//	error - error if any
+func (v6t *V6Tree[T]) UnmarshalBinary(data []byte) error {
+	return v6t.tree.unmarshal(data, kindV6, net.IPv6len*8)
+}
+
+// Writes the binary encoding of the IPv6 prefix tree. Implements io.WriterTo.
+// Arguments:
+//
+//	w - writer to write to
+//
+// Returns:
+//
+//	int64 - number of bytes written
+//	error - error if any
+func (v6t *V6Tree[T]) WriteTo(w io.Writer) (int64, error) {
+	return v6t.tree.writeTo(context.Background(), w, kindV6)
+}
+
+// Replaces the contents of the IPv6 prefix tree with the binary encoding read from a reader.
+// Reads until EOF. Implements io.ReaderFrom.
+// Arguments:
+//
+//	r - reader to read from
+//
+// Returns:
+//
+//	int64 - number of bytes read
+//	error - error if any
+func (v6t *V6Tree[T]) ReadFrom(r io.Reader) (int64, error) {
+	return v6t.tree.readFrom(r, kindV6, net.IPv6len*8)
 }
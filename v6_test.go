@@ -2,6 +2,7 @@ package prefix_tree
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"testing"
 )
@@ -30,6 +31,78 @@ func TestV6(t *testing.T) {
 	validatev6Addr(t, "192.168.128.40/32", "", "", true)
 }
 
+func TestV6SearchLongest(t *testing.T) {
+	ctx := context.Background()
+	v6t := NewV6Tree[string]()
+
+	for _, cidr := range []string{"2001:db8::/32", "2001:db8:1::/48"} {
+		res, err := v6t.Insert(ctx, cidr, cidr)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", cidr)
+		}
+	}
+
+	res, v, err := v6t.SearchLongest(ctx, "2001:db8:1::1")
+	if err != nil || res != PartialMatch || v != "2001:db8:1::/48" {
+		t.Fatalf("SearchLongest failed: %v %s %v", res, v, err)
+	}
+
+	res, v, err = v6t.SearchShortest(ctx, "2001:db8:1::1")
+	if err != nil || res != PartialMatch || v != "2001:db8::/32" {
+		t.Fatalf("SearchShortest failed: %v %s %v", res, v, err)
+	}
+}
+
+func TestV6SearchAll(t *testing.T) {
+	ctx := context.Background()
+	v6t := NewV6Tree[int]()
+
+	cidrs := []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db8:1::1/128"}
+	for i, cidr := range cidrs {
+		res, err := v6t.Insert(ctx, cidr, i)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", cidr)
+		}
+	}
+
+	res, entries, err := v6t.SearchAll(ctx, "2001:db8:1::1")
+	if err != nil || res != Match || len(entries) != len(cidrs) {
+		t.Fatalf("SearchAll failed: %v %v %v", res, entries, err)
+	}
+	for i, entry := range entries {
+		if entry.Key != cidrs[i] || entry.Value != i {
+			t.Fatalf("Unexpected entry %v, expected %s/%d", entry, cidrs[i], i)
+		}
+	}
+}
+
+func TestV6WalkKeys(t *testing.T) {
+	ctx := context.Background()
+	v6t := NewV6Tree[int]()
+
+	cidrs := []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db8:1::1/128", "fe80::/10"}
+	for i, cidr := range cidrs {
+		res, err := v6t.Insert(ctx, cidr, i)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", cidr)
+		}
+	}
+
+	walked := []string{}
+	err := v6t.WalkKeys(ctx, func(ctx context.Context, key string, value int) error {
+		walked = append(walked, key)
+		return nil
+	})
+	if err != nil || len(walked) != len(cidrs) {
+		t.Fatalf("WalkKeys failed: %v %v", walked, err)
+	}
+	for i := range cidrs {
+		if walked[i] != cidrs[i] {
+			t.Fatalf("Unexpected walk order %v", walked)
+		}
+	}
+}
+
 // BenchmarkV6TreeInsert benchmarks V6Tree.Insert
 func BenchmarkV6TreeInsert(b *testing.B) {
 	ctx := context.Background()
@@ -55,8 +128,155 @@ func BenchmarkV6TreeSearch(b *testing.B) {
 		v6tree.Insert(ctx, addresses[i], ival)
 	}
 
+	// Lookups must not allocate
+	assertNoAllocs(b, "Search", func() {
+		v6tree.Search(ctx, addresses[0])
+	})
+
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		v6tree.Search(ctx, addresses[i])
 	}
 }
+
+func TestV6StrideTree(t *testing.T) {
+	ctx := context.Background()
+
+	v6t := NewV6Tree[string](WithStride(8))
+
+	cidrs := []string{"2001:db8::/32", "2001:db8::/47", "2001:db8:1::1/128"}
+	for _, cidr := range cidrs {
+		res, err := v6t.Insert(ctx, cidr, cidr)
+		if err != nil || res != Ok {
+			t.Fatalf("Failed to insert %s", cidr)
+		}
+	}
+
+	tests := []struct {
+		addr     string
+		shortest string
+		longest  string
+	}{
+		{"2001:db8:1::1", "2001:db8::/32", "2001:db8:1::1/128"},
+		{"2001:db8:1::2", "2001:db8::/32", "2001:db8::/47"},
+		{"2001:db8:0:1::", "2001:db8::/32", "2001:db8::/47"},
+		{"2001:db8:2::", "2001:db8::/32", "2001:db8::/32"},
+	}
+
+	for _, tt := range tests {
+		_, v, err := v6t.SearchShortest(ctx, tt.addr)
+		if err != nil || v != tt.shortest {
+			t.Fatalf("SearchShortest %s: expected %s, got %s (%v)", tt.addr, tt.shortest, v, err)
+		}
+
+		_, v, err = v6t.SearchLongest(ctx, tt.addr)
+		if err != nil || v != tt.longest {
+			t.Fatalf("SearchLongest %s: expected %s, got %s (%v)", tt.addr, tt.longest, v, err)
+		}
+	}
+
+	keys := []string{}
+	for key := range v6t.All(ctx) {
+		keys = append(keys, key)
+	}
+	if len(keys) != len(cidrs) {
+		t.Fatalf("expected %v, got %v", cidrs, keys)
+	}
+	for i := range cidrs {
+		if keys[i] != cidrs[i] {
+			t.Fatalf("expected %v, got %v", cidrs, keys)
+		}
+	}
+}
+
+func TestV6SearchCovered(t *testing.T) {
+	ctx := context.Background()
+	v6t := NewV6Tree[int]()
+
+	cidrs := []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db8:1::1/128", "2001:db9::/32"}
+	for i, cidr := range cidrs {
+		v6t.Insert(ctx, cidr, i)
+	}
+
+	res, entries, err := v6t.SearchCovered(ctx, "2001:db8::/32")
+	if err != nil || res != Match || len(entries) != 3 {
+		t.Fatalf("SearchCovered failed: %v %v %v", res, entries, err)
+	}
+	for i := range entries {
+		if entries[i].Key != cidrs[i] || entries[i].Value != i {
+			t.Fatalf("unexpected entry %v, expected %s/%d", entries[i], cidrs[i], i)
+		}
+	}
+
+	keys := []string{}
+	err = v6t.WalkPrefix(ctx, "2001:db8:1::/47", func(ctx context.Context, key string, value int) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || len(keys) != 2 || keys[0] != cidrs[1] || keys[1] != cidrs[2] {
+		t.Fatalf("unexpected WalkPrefix result %v %v", keys, err)
+	}
+}
+
+func TestV6DeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	v6t := NewV6Tree[int]()
+
+	cidrs := []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db8:1::1/128", "2001:db9::/32"}
+	for i, cidr := range cidrs {
+		v6t.Insert(ctx, cidr, i)
+	}
+
+	res, entries, err := v6t.DeletePrefixEntries(ctx, "2001:db8::/32")
+	if err != nil || res != Match || len(entries) != 3 {
+		t.Fatalf("DeletePrefixEntries failed: %v %v %v", res, entries, err)
+	}
+	for i := range entries {
+		if entries[i].Key != cidrs[i] || entries[i].Value != i {
+			t.Fatalf("unexpected entry %v, expected %s/%d", entries[i], cidrs[i], i)
+		}
+	}
+
+	if res, _, err := v6t.SearchExact(ctx, "2001:db9::/32"); err != nil || res != Match {
+		t.Fatalf("2001:db9::/32 not found after DeletePrefix")
+	}
+}
+
+func TestGetv6Key(t *testing.T) {
+	key := make([]byte, net.IPv6len)
+	mask := make([]byte, net.IPv6len)
+
+	for _, saddr := range []string{"2001:db8::1/32", "2001:db8::1", "::/0", "fe80::1%eth0", "::ffff:10.1.2.3", "10.1.2.3/8", "2001:db8::/129"} {
+		addr, nmask, err := getv6Addr(saddr)
+		k, m, kerr := getv6Key(saddr, key, mask)
+
+		if (nil == err) != (nil == kerr) {
+			t.Fatalf("getv6Key %s: error mismatch %v != %v", saddr, kerr, err)
+		}
+
+		if nil == err && (string(k) != string(addr) || string(m) != string(nmask)) {
+			t.Fatalf("getv6Key %s: %v/%v != %v/%v", saddr, k, m, addr, nmask)
+		}
+	}
+}
+
+func TestV6WalkError(t *testing.T) {
+	ctx := context.Background()
+	tree := NewV6Tree[int]()
+
+	for i, key := range []string{"2001:db8::/32", "2001:db8:1::/48"} {
+		tree.Insert(ctx, key, i)
+	}
+
+	// The first error returned by the walker stops the walk and is returned
+	errStop := fmt.Errorf("stop")
+	visited := 0
+	err := tree.Walk(ctx, func(ctx context.Context, value int) error {
+		visited++
+		return errStop
+	})
+	if err != errStop || visited != 1 {
+		t.Fatalf("expected the walk to stop with %v after 1 entry, got %d %v", errStop, visited, err)
+	}
+}